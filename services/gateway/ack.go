@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricWSSendResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "storm_ws_send_results_total",
+	Help: "Socket sends answered with an ack, or with a nack by code",
+}, []string{"result"})
+
+// Nack codes. Schema and moderation rejections keep their own codes.
+const (
+	nackMissingID     = "missing_id"
+	nackInvalidFrame  = "invalid_frame"
+	nackQueueFull     = "queue_full"
+	nackSaveFailed    = "save_failed"
+	nackPublishFailed = "publish_failed"
+)
+
+var (
+	errTaskQueueFull = errors.New("async task queue full")
+	errPublishFailed = errors.New("publish failed")
+)
+
+// ackFrame confirms a send. Persisted channel messages carry their id and
+// creation time; plain subject publishes carry the time they were accepted.
+func ackFrame(id string, msg Message) wsEnvelope {
+	metricWSSendResults.WithLabelValues("ack").Inc()
+	return wsEnvelope{
+		Type:      "ack",
+		ID:        id,
+		ChannelID: msg.ChannelID,
+		MessageID: msg.ID,
+		CreatedAt: msg.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// nackFrame tells the client its send was not accepted and why, so it can
+// retry or show the message as failed.
+func nackFrame(id string, channelID int64, code, message string, details any) wsEnvelope {
+	metricWSSendResults.WithLabelValues(code).Inc()
+	return wsEnvelope{Type: "nack", ID: id, ChannelID: channelID, Code: code, Message: message, Details: details}
+}
+
+// rejectionNack turns a schema or moderation rejection from wsCheck into a
+// nack, keeping the rejection itself as details.
+func rejectionNack(id string, channelID int64, rejection any) wsEnvelope {
+	code, message := "rejected", "payload rejected"
+	switch r := rejection.(type) {
+	case *schemaRejection:
+		code, message = r.Code, "payload does not match the subject schema"
+	case moderationRejection:
+		code, message = r.Code, r.Reason
+	}
+	return nackFrame(id, channelID, code, message, rejection)
+}
+
+// sendResult answers a send once its outcome is known.
+func sendResult(id string, channelID int64, msg Message, err error) wsEnvelope {
+	switch {
+	case err == nil:
+		return ackFrame(id, msg)
+	case errors.Is(err, errTaskQueueFull):
+		return nackFrame(id, channelID, nackQueueFull, "save queue is full, retry later", nil)
+	case errors.Is(err, errPublishFailed):
+		return nackFrame(id, channelID, nackPublishFailed, "publish failed", nil)
+	default:
+		return nackFrame(id, channelID, nackSaveFailed, "save message failed", nil)
+	}
+}
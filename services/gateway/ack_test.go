@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialAcked(t *testing.T, handler http.Handler, channelID int64) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	header := http.Header{}
+	header.Set("Cookie", "access_token="+testToken(t, "test"))
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?ack=1&channel_id=" + strconv.FormatInt(channelID, 10)
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestLegacyAckAfterPersistence(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	conn := dialAcked(t, NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}), channel.ID)
+
+	if err := conn.WriteJSON(wsEnvelope{Type: "send", ID: "c1", Payload: "hello"}); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, echo, err := conn.ReadMessage(); err != nil || string(echo) != "hello" {
+		t.Fatalf("expected live echo, got %q (%v)", echo, err)
+	}
+	if n, err := FlushTaskQueue(context.Background(), store, nil); err != nil || n != 1 {
+		t.Fatalf("expected the send queued for saving, got %d (%v)", n, err)
+	}
+	ack := readEnvelope(t, conn)
+	msgs, _ := store.ListMessages(context.Background(), channel.ID, 10)
+	if ack.Type != "ack" || ack.ID != "c1" || len(msgs) != 1 || ack.MessageID != msgs[0].ID || ack.CreatedAt == "" {
+		t.Fatalf("expected ack for the saved message, got %+v", ack)
+	}
+
+	if env := roundTrip(t, conn, wsEnvelope{Type: "send", Payload: "no id"}); env.Type != "nack" || env.Code != nackMissingID {
+		t.Fatalf("expected missing_id nack, got %+v", env)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("raw")); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	if env := readEnvelope(t, conn); env.Type != "nack" || env.Code != nackInvalidFrame {
+		t.Fatalf("expected invalid_frame nack, got %+v", env)
+	}
+}
+
+func TestLegacyNackWhenQueueFull(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	nc := newFakeNats()
+	conn := dialAcked(t, NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}), channel.ID)
+
+	for len(asyncTaskQueue) < cap(asyncTaskQueue) {
+		asyncTaskQueue <- asyncTask{}
+	}
+	t.Cleanup(func() {
+		for len(asyncTaskQueue) > 0 {
+			<-asyncTaskQueue
+		}
+	})
+
+	env := roundTrip(t, conn, wsEnvelope{Type: "send", ID: "c2", Payload: "hello"})
+	if env.Type != "nack" || env.ID != "c2" || env.Code != nackQueueFull {
+		t.Fatalf("expected queue_full nack, got %+v", env)
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if len(nc.published) != 0 {
+		t.Fatalf("a send that was not queued must not be published")
+	}
+}
+
+func TestMultiplexedNackWhenQueueFull(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	_ = store.EnsureMember(context.Background(), channel.ID, "user-1")
+	nc := newFakeNats()
+	conn := dialMultiplexed(t, NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+
+	drainTaskQueue(t)
+	for len(asyncTaskQueue) < cap(asyncTaskQueue) {
+		asyncTaskQueue <- asyncTask{}
+	}
+
+	env := roundTrip(t, conn, wsEnvelope{Type: "send", ID: "c3", ChannelID: channel.ID, Payload: "hello"})
+	if env.Type != "nack" || env.ID != "c3" || env.Code != nackQueueFull {
+		t.Fatalf("expected queue_full nack, got %+v", env)
+	}
+	if msgs, _ := store.ListMessages(context.Background(), channel.ID, 10); len(msgs) != 0 {
+		t.Fatalf("sends must go through the write queue, got %+v", msgs)
+	}
+}
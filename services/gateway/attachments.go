@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register decoders for thumbnailing
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultMaxAttachmentBytes = 10 << 20
+	maxAttachmentsPerUpload   = 10
+	thumbnailMaxSide          = 256
+	// Images larger than this are stored but not thumbnailed, which keeps
+	// decompression bombs from exhausting gateway memory: a decode can take
+	// 4 bytes per pixel, so at most 64 MB each.
+	maxThumbnailSourcePixels = 16_000_000
+	maxConcurrentThumbnails  = 2
+)
+
+// errAttachmentUnavailable rejects a message referencing an attachment that
+// is missing, was uploaded by someone else or to another channel, or already
+// belongs to a message.
+var errAttachmentUnavailable = errors.New("attachment unavailable")
+
+// thumbnailSlots bounds how many images are decoded at once, so concurrent
+// uploads cannot stack their decode buffers.
+var thumbnailSlots = make(chan struct{}, maxConcurrentThumbnails)
+
+func attachmentURL(id int64) string {
+	return "/attachments/" + strconv.FormatInt(id, 10)
+}
+
+func withAttachmentURLs(a Attachment) Attachment {
+	a.URL = attachmentURL(a.ID)
+	if a.ThumbnailKey != "" {
+		a.ThumbnailURL = a.URL + "/thumbnail"
+	}
+	return a
+}
+
+func newBlobKey(channelID int64) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "channels/" + strconv.FormatInt(channelID, 10) + "/" + hex.EncodeToString(buf), nil
+}
+
+// uploadAttachmentsHandler accepts one or more multipart "file" parts, stores
+// them in the blob store and records their metadata. The content type is
+// sniffed from the bytes; the client-supplied header is ignored.
+func uploadAttachmentsHandler(store Store, blobs BlobStore, maxBytes int64) http.HandlerFunc {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxAttachmentBytes
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if store == nil {
+			http.Error(w, "store not configured", http.StatusServiceUnavailable)
+			return
+		}
+		if blobs == nil {
+			http.Error(w, "blob store not configured", http.StatusServiceUnavailable)
+			return
+		}
+		channelID, err := parseID(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "invalid channel id", http.StatusBadRequest)
+			return
+		}
+		userID := userFromContext(req.Context())
+		if userID == "" {
+			http.Error(w, "missing user", http.StatusUnauthorized)
+			return
+		}
+		if err := store.EnsureUser(req.Context(), userID); err != nil {
+			http.Error(w, "ensure user failed", http.StatusInternalServerError)
+			return
+		}
+		// Uploading does not join the channel: downloads are gated on
+		// membership, so joining here would let anyone read attachments.
+		member, err := store.IsMember(req.Context(), channelID, userID)
+		if err != nil {
+			log.Printf("membership check failed: %v", err)
+			http.Error(w, "membership check failed", http.StatusInternalServerError)
+			return
+		}
+		if !member {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		req.Body = http.MaxBytesReader(w, req.Body, maxAttachmentsPerUpload*(maxBytes+4096))
+		reader, err := req.MultipartReader()
+		if err != nil {
+			http.Error(w, "multipart body required", http.StatusBadRequest)
+			return
+		}
+
+		var out []Attachment
+		for {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				http.Error(w, "invalid multipart body", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() != "file" {
+				_ = part.Close()
+				continue
+			}
+			if len(out) == maxAttachmentsPerUpload {
+				http.Error(w, "too many files", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			data, err := io.ReadAll(io.LimitReader(part, maxBytes+1))
+			_ = part.Close()
+			if err != nil {
+				http.Error(w, "cannot read file", http.StatusBadRequest)
+				return
+			}
+			if int64(len(data)) > maxBytes {
+				http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if len(data) == 0 {
+				http.Error(w, "empty file", http.StatusBadRequest)
+				return
+			}
+
+			attachment, err := storeAttachment(req, store, blobs, channelID, userID, part.FileName(), data)
+			if err != nil {
+				log.Printf("store attachment failed: %v", err)
+				http.Error(w, "store attachment failed", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, withAttachmentURLs(attachment))
+		}
+		if len(out) == 0 {
+			http.Error(w, "no file provided", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, out)
+	}
+}
+
+func storeAttachment(req *http.Request, store Store, blobs BlobStore, channelID int64, userID, filename string, data []byte) (Attachment, error) {
+	ctx := req.Context()
+	key, err := newBlobKey(channelID)
+	if err != nil {
+		return Attachment{}, err
+	}
+	contentType := http.DetectContentType(data)
+	if err := blobs.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		return Attachment{}, err
+	}
+
+	var thumbKey string
+	if thumb, ok := makeThumbnail(data); ok {
+		thumbKey = key + ".thumb.png"
+		if err := blobs.Put(ctx, thumbKey, bytes.NewReader(thumb), int64(len(thumb)), "image/png"); err != nil {
+			log.Printf("store thumbnail failed: %v", err)
+			thumbKey = ""
+		}
+	}
+
+	attachment, err := store.CreateAttachment(ctx, Attachment{
+		ChannelID:    channelID,
+		UserID:       userID,
+		Filename:     sanitizeFilename(filename),
+		ContentType:  contentType,
+		Size:         int64(len(data)),
+		StorageKey:   key,
+		ThumbnailKey: thumbKey,
+	})
+	if err != nil {
+		_ = blobs.Delete(ctx, key)
+		if thumbKey != "" {
+			_ = blobs.Delete(ctx, thumbKey)
+		}
+	}
+	return attachment, err
+}
+
+// checkAttachmentRefs verifies that a message the user is posting to the
+// channel may reference the given attachments.
+func checkAttachmentRefs(ctx context.Context, store Store, channelID int64, userID string, attachmentIDs []int64) error {
+	for _, id := range attachmentIDs {
+		a, err := store.GetAttachment(ctx, id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w: %d", errAttachmentUnavailable, id)
+		}
+		if err != nil {
+			return err
+		}
+		if a.ChannelID != channelID || a.UserID != userID || a.MessageID != nil {
+			return fmt.Errorf("%w: %d", errAttachmentUnavailable, id)
+		}
+	}
+	return nil
+}
+
+// downloadAttachmentHandler streams an attachment (or its thumbnail) to
+// members of the channel it was uploaded to.
+func downloadAttachmentHandler(store Store, blobs BlobStore, thumbnail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if store == nil {
+			http.Error(w, "store not configured", http.StatusServiceUnavailable)
+			return
+		}
+		if blobs == nil {
+			http.Error(w, "blob store not configured", http.StatusServiceUnavailable)
+			return
+		}
+		id, err := parseID(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "invalid attachment id", http.StatusBadRequest)
+			return
+		}
+		attachment, err := store.GetAttachment(req.Context(), id)
+		if err != nil {
+			http.Error(w, "attachment not found", http.StatusNotFound)
+			return
+		}
+		member, err := store.IsMember(req.Context(), attachment.ChannelID, userFromContext(req.Context()))
+		if err != nil {
+			http.Error(w, "membership check failed", http.StatusInternalServerError)
+			return
+		}
+		if !member {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		key, contentType, size := attachment.StorageKey, attachment.ContentType, attachment.Size
+		if thumbnail {
+			if attachment.ThumbnailKey == "" {
+				http.Error(w, "thumbnail not found", http.StatusNotFound)
+				return
+			}
+			key, contentType, size = attachment.ThumbnailKey, "image/png", -1
+		}
+		body, err := blobs.Get(req.Context(), key)
+		if err != nil {
+			if errors.Is(err, errBlobNotFound) {
+				http.Error(w, "attachment not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("get blob failed: %v", err)
+			http.Error(w, "get attachment failed", http.StatusBadGateway)
+			return
+		}
+		defer body.Close()
+
+		disposition := "attachment"
+		if strings.HasPrefix(contentType, "image/") {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		if size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, body); err != nil {
+			log.Printf("stream attachment failed: %v", err)
+		}
+	}
+}
+
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// makeThumbnail returns a PNG no larger than thumbnailMaxSide on either side,
+// or false when data is not a decodable image.
+func makeThumbnail(data []byte) ([]byte, bool) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, false
+	}
+	thumbnailSlots <- struct{}{}
+	defer func() { <-thumbnailSlots }()
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > thumbnailMaxSide || height > thumbnailMaxSide {
+		if width >= height {
+			height = max(1, height*thumbnailMaxSide/width)
+			width = thumbnailMaxSide
+		} else {
+			width = max(1, width*thumbnailMaxSide/height)
+			height = thumbnailMaxSide
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/width, sy))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
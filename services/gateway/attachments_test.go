@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func multipartBody(t *testing.T, files map[string][]byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, data := range files {
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatalf("create form file: %v", err)
+		}
+		_, _ = part.Write(data)
+	}
+	_ = mw.Close()
+	return &buf, mw.FormDataContentType()
+}
+
+func newAttachmentRouter(t *testing.T, maxBytes int64) (http.Handler, *memStore, Channel) {
+	t.Helper()
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	_ = store.EnsureMember(context.Background(), channel.ID, "user-1")
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("blob store: %v", err)
+	}
+	auth := AuthConfig{Secret: []byte("test"), Enabled: true}
+	return NewRouter(newFakeNats(), store, nil, auth, WithBlobStore(blobs, maxBytes)), store, channel
+}
+
+func TestAttachmentUploadAndDownload(t *testing.T) {
+	r, _, channel := newAttachmentRouter(t, 1<<20)
+	img := testPNG(t, 600, 300)
+
+	body, contentType := multipartBody(t, map[string][]byte{"../../photo.png": img})
+	req := httptest.NewRequest(http.MethodPost, "/channels/"+strconv.FormatInt(channel.ID, 10)+"/attachments", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var uploaded []Attachment
+	if err := json.NewDecoder(w.Body).Decode(&uploaded); err != nil || len(uploaded) != 1 {
+		t.Fatalf("decode attachments: %v", err)
+	}
+	got := uploaded[0]
+	if got.ContentType != "image/png" || got.Filename != "photo.png" || got.Size != int64(len(img)) {
+		t.Fatalf("unexpected attachment: %+v", got)
+	}
+	if got.URL == "" || got.ThumbnailURL == "" {
+		t.Fatalf("expected download and thumbnail urls: %+v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, got.URL, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), img) {
+		t.Fatalf("unexpected download: %d", w.Code)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("expected nosniff header")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, got.ThumbnailURL, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected thumbnail 200, got %d", w.Code)
+	}
+	thumb, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("decode thumbnail: %v", err)
+	}
+	if b := thumb.Bounds(); b.Dx() != thumbnailMaxSide || b.Dy() != 128 {
+		t.Fatalf("unexpected thumbnail size %v", b)
+	}
+}
+
+func TestAttachmentDownloadRequiresMembership(t *testing.T) {
+	r, store, channel := newAttachmentRouter(t, 1<<20)
+	_ = store.EnsureUser(context.Background(), "owner")
+	attachment, _ := store.CreateAttachment(context.Background(), Attachment{ChannelID: channel.ID, UserID: "owner", StorageKey: "k"})
+	store.mu.Lock()
+	delete(store.members, channel.ID)
+	store.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodGet, attachmentURL(attachment.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+}
+
+func TestAttachmentUploadTooLarge(t *testing.T) {
+	r, _, channel := newAttachmentRouter(t, 16)
+	body, contentType := multipartBody(t, map[string][]byte{"notes.txt": bytes.Repeat([]byte("a"), 17)})
+	req := httptest.NewRequest(http.MethodPost, "/channels/"+strconv.FormatInt(channel.ID, 10)+"/attachments", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", w.Code)
+	}
+}
+
+func TestAttachmentUploadRequiresMembership(t *testing.T) {
+	r, store, channel := newAttachmentRouter(t, 1<<20)
+	store.mu.Lock()
+	delete(store.members, channel.ID)
+	store.mu.Unlock()
+
+	body, contentType := multipartBody(t, map[string][]byte{"notes.txt": []byte("hello")})
+	req := httptest.NewRequest(http.MethodPost, "/channels/"+strconv.FormatInt(channel.ID, 10)+"/attachments", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	// Uploading must not have joined the channel either.
+	if ok, _ := store.IsMember(context.Background(), channel.ID, "user-1"); ok {
+		t.Fatalf("upload joined the channel")
+	}
+}
+
+func TestMessageReferencesAttachments(t *testing.T) {
+	r, store, channel := newAttachmentRouter(t, 1<<20)
+	ctx := context.Background()
+	other, _ := store.CreateChannel(ctx, "random", "user-1")
+	_ = store.EnsureUser(ctx, "owner")
+	own, _ := store.CreateAttachment(ctx, Attachment{ChannelID: channel.ID, UserID: "user-1", StorageKey: "a"})
+	elsewhere, _ := store.CreateAttachment(ctx, Attachment{ChannelID: other.ID, UserID: "user-1", StorageKey: "b"})
+	someoneElses, _ := store.CreateAttachment(ctx, Attachment{ChannelID: channel.ID, UserID: "owner", StorageKey: "c"})
+
+	post := func(ids ...int64) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"payload": "see attached", "attachment_ids": ids})
+		req := httptest.NewRequest(http.MethodPost, "/channels/"+strconv.FormatInt(channel.ID, 10)+"/messages", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, id := range []int64{elsewhere.ID, someoneElses.ID, 999} {
+		if w := post(own.ID, id); w.Code != http.StatusBadRequest {
+			t.Fatalf("attachment %d: expected 400, got %d", id, w.Code)
+		}
+	}
+	if a, _ := store.GetAttachment(ctx, own.ID); a.MessageID != nil {
+		t.Fatalf("a rejected message linked an attachment")
+	}
+
+	w := post(own.ID, own.ID)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var msg Message
+	if err := json.NewDecoder(w.Body).Decode(&msg); err != nil || len(msg.AttachmentIDs) != 1 || msg.AttachmentIDs[0] != own.ID {
+		t.Fatalf("unexpected message: %+v (%v)", msg, err)
+	}
+	if a, _ := store.GetAttachment(ctx, own.ID); a.MessageID == nil || *a.MessageID != msg.ID {
+		t.Fatalf("attachment not linked: %+v", a)
+	}
+	// An attachment belongs to one message.
+	if w := post(own.ID); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected reuse to be refused, got %d", w.Code)
+	}
+}
+
+// memberErrorStore fails every membership check.
+type memberErrorStore struct {
+	*memStore
+}
+
+func (memberErrorStore) IsMember(context.Context, int64, string) (bool, error) {
+	return false, errors.New("db down")
+}
+
+func TestAttachmentUploadFailsWhenMembershipCheckFails(t *testing.T) {
+	store := memberErrorStore{newMemStore()}
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("blob store: %v", err)
+	}
+	r := NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}, WithBlobStore(blobs, 1024))
+	body, contentType := multipartBody(t, map[string][]byte{"notes.txt": []byte("hello")})
+	req := httptest.NewRequest(http.MethodPost, "/channels/"+strconv.FormatInt(channel.ID, 10)+"/attachments", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+}
+
+func TestAttachmentUploadWithoutBlobStore(t *testing.T) {
+	r := NewRouter(newFakeNats(), newMemStore(), nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+	req := httptest.NewRequest(http.MethodPost, "/channels/1/attachments", io.NopCloser(bytes.NewReader(nil)))
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+}
+
+func TestMakeThumbnailRejectsNonImages(t *testing.T) {
+	if _, ok := makeThumbnail([]byte("plain text")); ok {
+		t.Fatalf("expected no thumbnail for text")
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	cases := map[string]string{
+		"../../etc/passwd": "passwd",
+		`C:\tmp\a.txt`:     "a.txt",
+		"":                 "file",
+		"bad\nname.txt":    "badname.txt",
+	}
+	for in, want := range cases {
+		if got := sanitizeFilename(in); got != want {
+			t.Fatalf("sanitizeFilename(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
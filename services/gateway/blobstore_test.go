@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalBlobStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("new local blob store: %v", err)
+	}
+
+	if err := blobs.Put(ctx, "channels/1/abc", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	rc, err := blobs.Get(ctx, "channels/1/abc")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	_ = rc.Close()
+	if string(data) != "hello" {
+		t.Fatalf("unexpected blob %q", string(data))
+	}
+
+	if err := blobs.Delete(ctx, "channels/1/abc"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := blobs.Get(ctx, "channels/1/abc"); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := blobs.Delete(ctx, "channels/1/abc"); err != nil {
+		t.Fatalf("delete missing: %v", err)
+	}
+}
+
+func TestLocalBlobStoreRejectsTraversal(t *testing.T) {
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("new local blob store: %v", err)
+	}
+	if err := blobs.Put(context.Background(), "../escape", strings.NewReader("x"), 1, ""); err == nil {
+		t.Fatalf("expected traversal to be rejected")
+	}
+}
+
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	auth    []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = append(f.auth, req.Header.Get("Authorization"))
+	if req.Header.Get("X-Amz-Date") == "" || req.Header.Get("X-Amz-Content-Sha256") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(req.Body)
+		if sha256Hex(body) != req.Header.Get("X-Amz-Content-Sha256") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[req.URL.Path] = body
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		body, ok := f.objects[req.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(body)
+	case http.MethodDelete:
+		delete(f.objects, req.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3BlobStoreRoundTrip(t *testing.T) {
+	backend := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(backend)
+	t.Cleanup(srv.Close)
+
+	blobs, err := NewS3BlobStore(S3Config{
+		Endpoint:        srv.URL,
+		Bucket:          "storm",
+		Region:          "eu-west-3",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatalf("new s3 blob store: %v", err)
+	}
+	blobs.(*s3BlobStore).now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	ctx := context.Background()
+	if err := blobs.Put(ctx, "channels/1/abc", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, ok := backend.objects["/storm/channels/1/abc"]; !ok {
+		t.Fatalf("expected path-style object key, got %v", backend.objects)
+	}
+	rc, err := blobs.Get(ctx, "channels/1/abc")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	_ = rc.Close()
+	if string(data) != "hello" {
+		t.Fatalf("unexpected blob %q", string(data))
+	}
+	if err := blobs.Delete(ctx, "channels/1/abc"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := blobs.Get(ctx, "channels/1/abc"); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	want := "AWS4-HMAC-SHA256 Credential=AKID/20260102/eu-west-3/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="
+	if !strings.HasPrefix(backend.auth[0], want) {
+		t.Fatalf("unexpected authorization header %q", backend.auth[0])
+	}
+}
+
+func TestS3BlobStoreRequiresCredentials(t *testing.T) {
+	if _, err := NewS3BlobStore(S3Config{Endpoint: "http://localhost:9000", Bucket: "storm"}); err == nil {
+		t.Fatalf("expected error without credentials")
+	}
+	if _, err := NewS3BlobStore(S3Config{Endpoint: "::bad", Bucket: "storm", AccessKeyID: "a", SecretAccessKey: "b"}); err == nil {
+		t.Fatalf("expected error for invalid endpoint")
+	}
+}
+
+func TestNewBlobStoreFromEnv(t *testing.T) {
+	t.Setenv("BLOB_STORE", "local")
+	t.Setenv("BLOB_LOCAL_DIR", t.TempDir())
+	if _, err := newBlobStoreFromEnv(); err != nil {
+		t.Fatalf("local: %v", err)
+	}
+	t.Setenv("BLOB_LOCAL_DIR", "")
+	if _, err := newBlobStoreFromEnv(); err == nil {
+		t.Fatalf("expected local store to require BLOB_LOCAL_DIR")
+	}
+	t.Setenv("BLOB_STORE", "none")
+	if blobs, err := newBlobStoreFromEnv(); err != nil || blobs != nil {
+		t.Fatalf("expected attachments disabled, got %v %v", blobs, err)
+	}
+	t.Setenv("BLOB_STORE", "ftp")
+	if _, err := newBlobStoreFromEnv(); err == nil {
+		t.Fatalf("expected error for unknown blob store")
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The conformance suites run against every Store and Presence. Postgres joins
+// when STORM_TEST_POSTGRES_DSN points at a scratch database; rows are keyed
+// by a per-run suffix so reruns do not collide.
+
+func storeBackends(t *testing.T) map[string]func(t *testing.T) Store {
+	t.Helper()
+	backends := map[string]func(t *testing.T) Store{
+		"memory": func(*testing.T) Store { return NewMemoryStore() },
+		"sqlite": func(t *testing.T) Store {
+			store, err := NewSQLiteStore(context.Background(), "sqlite://"+filepath.Join(t.TempDir(), "storm.db"))
+			if err != nil {
+				t.Fatalf("sqlite: %v", err)
+			}
+			t.Cleanup(func() { _ = store.Close() })
+			return store
+		},
+	}
+	if dsn := os.Getenv("STORM_TEST_POSTGRES_DSN"); dsn != "" {
+		backends["postgres"] = func(t *testing.T) Store {
+			store, err := NewPostgresStore(context.Background(), dsn)
+			if err != nil {
+				t.Fatalf("postgres: %v", err)
+			}
+			t.Cleanup(func() { _ = store.Close() })
+			return store
+		}
+	}
+	return backends
+}
+
+func presenceBackends() map[string]func(t *testing.T) Presence {
+	return map[string]func(t *testing.T) Presence{
+		"memory": func(*testing.T) Presence { return NewMemoryPresence() },
+		"redis":  newTestPresence,
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	t.Setenv("BCRYPT_COST", "4")
+	for name, open := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			suffix := "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+			t.Run("users", func(t *testing.T) { testStoreUsers(t, open(t), suffix) })
+			t.Run("channels", func(t *testing.T) { testStoreChannels(t, open(t), suffix) })
+			t.Run("messages", func(t *testing.T) { testStoreMessages(t, open(t), suffix) })
+			t.Run("batch", func(t *testing.T) { testStoreMessageBatch(t, open(t), suffix) })
+			t.Run("retention", func(t *testing.T) { testStoreRetention(t, open(t), suffix) })
+			t.Run("attachments", func(t *testing.T) { testStoreAttachments(t, open(t), suffix) })
+			t.Run("scheduled", func(t *testing.T) { testStoreScheduled(t, open(t), suffix) })
+			t.Run("registry", func(t *testing.T) { testStoreRegistry(t, open(t), suffix) })
+		})
+	}
+}
+
+func TestPresenceConformance(t *testing.T) {
+	for name, open := range presenceBackends() {
+		t.Run(name, func(t *testing.T) { testPresenceHeartbeats(t, open(t)) })
+	}
+}
+
+func testStoreUsers(t *testing.T, store Store, suffix string) {
+	ctx := context.Background()
+	alice, bob := "alice"+suffix, "bob"+suffix
+
+	if _, err := store.GetUser(ctx, alice); !isPgNotFound(err) {
+		t.Fatalf("expected not found for a missing user, got %v", err)
+	}
+	user, err := store.CreateUser(ctx, alice, "secret", "Alice")
+	if err != nil || user.ID != alice || user.DisplayName != "Alice" || user.CreatedAt.IsZero() {
+		t.Fatalf("create user: %+v %v", user, err)
+	}
+	if _, err := store.CreateUser(ctx, alice, "other", ""); err == nil {
+		t.Fatalf("expected duplicate user to fail")
+	}
+	if err := store.EnsureUser(ctx, alice); err != nil {
+		t.Fatalf("ensure existing user: %v", err)
+	}
+	if got, _ := store.GetUser(ctx, alice); got.DisplayName != "Alice" {
+		t.Fatalf("ensure user must not overwrite, got %+v", got)
+	}
+	if _, err := store.VerifyUserPassword(ctx, alice, "secret"); err != nil {
+		t.Fatalf("verify password: %v", err)
+	}
+	if _, err := store.VerifyUserPassword(ctx, alice, "wrong"); err == nil {
+		t.Fatalf("expected wrong password to fail")
+	}
+
+	if updated, err := store.UpdateUser(ctx, alice, "", "rotated"); err != nil || updated.DisplayName != "Alice" {
+		t.Fatalf("empty display name must be kept: %+v %v", updated, err)
+	}
+	if _, err := store.VerifyUserPassword(ctx, alice, "rotated"); err != nil {
+		t.Fatalf("verify rotated password: %v", err)
+	}
+	if _, err := store.UpdateUser(ctx, "missing"+suffix, "x", ""); !isPgNotFound(err) {
+		t.Fatalf("expected not found updating a missing user, got %v", err)
+	}
+
+	// Users created without a password can never log in with one.
+	_ = store.EnsureUser(ctx, bob)
+	if _, err := store.VerifyUserPassword(ctx, bob, ""); err == nil {
+		t.Fatalf("expected passwordless user to fail verification")
+	}
+	users, _ := store.ListUsers(ctx)
+	if i, j := slices.IndexFunc(users, func(u User) bool { return u.ID == alice }), slices.IndexFunc(users, func(u User) bool { return u.ID == bob }); i < 0 || j < 0 || i > j {
+		t.Fatalf("expected users listed by id, got %v", users)
+	}
+
+	token := "refresh" + suffix
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := store.SaveRefreshToken(ctx, alice, token, expires); err != nil {
+		t.Fatalf("save refresh token: %v", err)
+	}
+	if err := store.SaveRefreshToken(ctx, alice, token, expires); err == nil {
+		t.Fatalf("expected duplicate refresh token to fail")
+	}
+	if err := store.SaveRefreshToken(ctx, "missing"+suffix, "orphan"+suffix, expires); err == nil {
+		t.Fatalf("expected refresh token for a missing user to fail")
+	}
+	rt, err := store.GetRefreshToken(ctx, token)
+	if err != nil || rt.UserID != alice || rt.Revoked || !rt.ExpiresAt.Equal(expires) {
+		t.Fatalf("get refresh token: %+v %v", rt, err)
+	}
+	_ = store.RevokeRefreshToken(ctx, token)
+	if rt, _ := store.GetRefreshToken(ctx, token); !rt.Revoked {
+		t.Fatalf("expected token revoked")
+	}
+	if _, err := store.GetRefreshToken(ctx, "missing"+suffix); !isPgNotFound(err) {
+		t.Fatalf("expected not found for a missing token, got %v", err)
+	}
+
+	if err := store.DeleteUser(ctx, bob); err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+	if _, err := store.GetUser(ctx, bob); !isPgNotFound(err) {
+		t.Fatalf("expected deleted user gone, got %v", err)
+	}
+}
+
+func testStoreChannels(t *testing.T, store Store, suffix string) {
+	ctx := context.Background()
+	alice, bob := "alice"+suffix, "bob"+suffix
+	_ = store.EnsureUser(ctx, alice)
+	_ = store.EnsureUser(ctx, bob)
+
+	if _, err := store.CreateChannel(ctx, "orphan"+suffix, "missing"+suffix); err == nil {
+		t.Fatalf("expected channel by a missing user to fail")
+	}
+	general, err := store.CreateChannel(ctx, "general"+suffix, alice)
+	if err != nil || general.ID == 0 || general.CreatedBy != alice {
+		t.Fatalf("create channel: %+v %v", general, err)
+	}
+	if _, err := store.CreateChannel(ctx, "general"+suffix, bob); err == nil {
+		t.Fatalf("expected duplicate channel name to fail")
+	}
+	random, _ := store.CreateChannel(ctx, "random"+suffix, bob)
+	if _, err := store.GetChannel(ctx, random.ID+1000); !isPgNotFound(err) {
+		t.Fatalf("expected not found for a missing channel, got %v", err)
+	}
+
+	if ok, _ := store.IsMember(ctx, general.ID, bob); ok {
+		t.Fatalf("bob has not joined yet")
+	}
+	if err := store.EnsureMember(ctx, general.ID, "missing"+suffix); err == nil {
+		t.Fatalf("expected membership of a missing user to fail")
+	}
+	_ = store.EnsureMember(ctx, general.ID, alice)
+	_ = store.EnsureMember(ctx, general.ID, bob)
+	if err := store.EnsureMember(ctx, general.ID, bob); err != nil {
+		t.Fatalf("ensure member must be idempotent: %v", err)
+	}
+	if ok, _ := store.IsMember(ctx, general.ID, bob); !ok {
+		t.Fatalf("expected bob to be a member")
+	}
+
+	_, _ = store.SaveChannelMessage(ctx, general.ID, alice, []byte("hi @"+bob))
+	// Neither is a mention of bob: the name continues, or the @ is mid-word.
+	_, _ = store.SaveChannelMessage(ctx, general.ID, alice, []byte("ping @"+bob+"by"))
+	_, _ = store.SaveChannelMessage(ctx, general.ID, alice, []byte("mail x@"+bob+".com"))
+	second, _ := store.SaveChannelMessage(ctx, general.ID, alice, []byte("anyone?"))
+	_, _ = store.SaveChannelMessage(ctx, general.ID, bob, []byte("me"))
+
+	find := func(channels []Channel, id int64) Channel {
+		t.Helper()
+		i := slices.IndexFunc(channels, func(c Channel) bool { return c.ID == id })
+		if i < 0 {
+			t.Fatalf("channel %d not listed in %v", id, channels)
+		}
+		return channels[i]
+	}
+	channels, _ := store.ListChannels(ctx, bob)
+	if !slices.IsSortedFunc(channels, func(a, b Channel) int { return int(a.ID - b.ID) }) {
+		t.Fatalf("expected channels ordered by id, got %v", channels)
+	}
+	// Bob's own message never counts as unread.
+	if got := find(channels, general.ID); got.UnreadCount != 4 || got.MentionCount != 1 || got.LastReadMessageID != 0 {
+		t.Fatalf("unexpected unread state %+v", got)
+	}
+	if got := find(channels, random.ID); got.UnreadCount != 0 {
+		t.Fatalf("non-members have no unread counts, got %+v", got)
+	}
+
+	if lastRead, err := store.MarkChannelRead(ctx, general.ID, bob, second.ID); err != nil || lastRead != second.ID {
+		t.Fatalf("mark read: %d %v", lastRead, err)
+	}
+	if lastRead, _ := store.MarkChannelRead(ctx, general.ID, bob, second.ID-1); lastRead != second.ID {
+		t.Fatalf("read marker must not move backwards, got %d", lastRead)
+	}
+	channels, _ = store.ListChannels(ctx, bob)
+	if got := find(channels, general.ID); got.UnreadCount != 0 || got.LastReadMessageID != second.ID {
+		t.Fatalf("unexpected unread state after read %+v", got)
+	}
+	if _, err := store.MarkChannelRead(ctx, random.ID, alice, 0); !isPgNotFound(err) {
+		t.Fatalf("expected not found marking a channel the user has not joined, got %v", err)
+	}
+
+	seconds := int64(3600)
+	if err := store.SetChannelRetention(ctx, general.ID, &seconds); err != nil {
+		t.Fatalf("set retention: %v", err)
+	}
+	if got, _ := store.GetChannel(ctx, general.ID); got.RetentionSeconds == nil || *got.RetentionSeconds != 3600 {
+		t.Fatalf("retention not stored: %+v", got)
+	}
+	_ = store.SetChannelRetention(ctx, general.ID, nil)
+	if got, _ := store.GetChannel(ctx, general.ID); got.RetentionSeconds != nil {
+		t.Fatalf("expected retention reset, got %+v", got)
+	}
+	if err := store.SetChannelRetention(ctx, random.ID+1000, &seconds); !isPgNotFound(err) {
+		t.Fatalf("expected not found for a missing channel, got %v", err)
+	}
+
+	if cfg, err := store.GetModerationConfig(ctx, general.ID); err != nil || cfg != nil {
+		t.Fatalf("expected no moderation config, got %q %v", cfg, err)
+	}
+	_ = store.SetModerationConfig(ctx, general.ID, []byte(`{"slow_mode_seconds":5}`))
+	if cfg, _ := store.GetModerationConfig(ctx, general.ID); string(cfg) != `{"slow_mode_seconds":5}` {
+		t.Fatalf("unexpected moderation config %q", cfg)
+	}
+	_ = store.SetModerationConfig(ctx, general.ID, nil)
+	if cfg, _ := store.GetModerationConfig(ctx, general.ID); cfg != nil {
+		t.Fatalf("expected moderation config cleared, got %q", cfg)
+	}
+	if _, err := store.GetModerationConfig(ctx, random.ID+1000); !isPgNotFound(err) {
+		t.Fatalf("expected not found for a missing channel, got %v", err)
+	}
+}
+
+func testStoreMessageBatch(t *testing.T, store Store, suffix string) {
+	ctx := context.Background()
+	alice := "alice-batch" + suffix
+	if err := store.EnsureUser(ctx, alice); err != nil {
+		t.Fatalf("ensure user: %v", err)
+	}
+	channel, err := store.CreateChannel(ctx, "batch"+suffix, alice)
+	if err != nil {
+		t.Fatalf("create channel: %v", err)
+	}
+
+	msgs, errs := store.SaveChannelMessages(ctx, []PendingMessage{
+		{ChannelID: channel.ID, UserID: alice, Payload: []byte("a")},
+		{ChannelID: channel.ID + 1000, UserID: alice, Payload: []byte("lost")},
+		{ChannelID: channel.ID, UserID: alice, Payload: []byte("b")},
+	})
+	if len(msgs) != 3 || len(errs) != 3 {
+		t.Fatalf("expected one result per row, got %d/%d", len(msgs), len(errs))
+	}
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("expected only the missing channel to fail, got %v", errs)
+	}
+	if msgs[0].Payload != "a" || msgs[2].Payload != "b" || msgs[0].ID >= msgs[2].ID || msgs[2].Subject != channelSubject(channel.ID) {
+		t.Fatalf("expected rows in input order, got %+v", msgs)
+	}
+	if listed, _ := store.ListMessages(ctx, channel.ID, 10); len(listed) != 2 {
+		t.Fatalf("expected the two good rows saved, got %+v", listed)
+	}
+	if msgs, errs := store.SaveChannelMessages(ctx, nil); len(msgs) != 0 || len(errs) != 0 {
+		t.Fatalf("expected empty results for an empty batch")
+	}
+}
+
+func testStoreMessages(t *testing.T, store Store, suffix string) {
+	ctx := context.Background()
+	alice := "alice" + suffix
+	if _, err := store.CreateUser(ctx, alice, "secret", "Alice"); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	channel, _ := store.CreateChannel(ctx, "general"+suffix, alice)
+	if _, err := store.SaveChannelMessage(ctx, channel.ID+1000, alice, []byte("x")); err == nil {
+		t.Fatalf("expected message in a missing channel to fail")
+	}
+
+	var ids []int64
+	for _, p := range []string{"a", "b", "c"} {
+		msg, err := store.SaveChannelMessage(ctx, channel.ID, alice, []byte(p))
+		if err != nil || msg.Subject != channelSubject(channel.ID) || msg.Payload != p || msg.UserID != alice {
+			t.Fatalf("save message: %+v %v", msg, err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if !slices.IsSorted(ids) {
+		t.Fatalf("expected increasing ids, got %v", ids)
+	}
+	if err := store.SaveMessage(ctx, "storm.events", []byte("loose")); err != nil {
+		t.Fatalf("save subject message: %v", err)
+	}
+
+	latest, _ := store.ListMessages(ctx, channel.ID, 2)
+	if len(latest) != 2 || latest[0].Payload != "c" || latest[1].Payload != "b" {
+		t.Fatalf("expected newest first, got %+v", latest)
+	}
+	after, _ := store.ListMessagesAfter(ctx, channel.ID, ids[0], 10)
+	if len(after) != 2 || after[0].ID != ids[1] || after[1].ID != ids[2] {
+		t.Fatalf("expected oldest first after the cursor, got %+v", after)
+	}
+	if after, _ := store.ListMessagesAfter(ctx, channel.ID, ids[0], 1); len(after) != 1 || after[0].ID != ids[1] {
+		t.Fatalf("expected limit to apply, got %+v", after)
+	}
+
+	var exported []ExportedMessage
+	err := store.ExportMessages(ctx, channel.ID, ExportRange{}, func(m ExportedMessage) error {
+		exported = append(exported, m)
+		return nil
+	})
+	if err != nil || len(exported) != 3 || exported[0].ID != ids[0] || exported[0].DisplayName != "Alice" {
+		t.Fatalf("unexpected export %+v %v", exported, err)
+	}
+	future := time.Now().Add(time.Hour)
+	exported = nil
+	_ = store.ExportMessages(ctx, channel.ID, ExportRange{From: &future}, func(m ExportedMessage) error {
+		exported = append(exported, m)
+		return nil
+	})
+	if len(exported) != 0 {
+		t.Fatalf("expected range to exclude everything, got %+v", exported)
+	}
+	stop := errors.New("stop")
+	if err := store.ExportMessages(ctx, channel.ID, ExportRange{}, func(ExportedMessage) error { return stop }); !errors.Is(err, stop) {
+		t.Fatalf("expected callback error to end the export, got %v", err)
+	}
+
+	attachment, err := store.CreateAttachment(ctx, Attachment{ChannelID: channel.ID, UserID: alice, Filename: "a.png", ContentType: "image/png", Size: 3, StorageKey: "k"})
+	if err != nil || attachment.ID == 0 || attachment.CreatedAt.IsZero() {
+		t.Fatalf("create attachment: %+v %v", attachment, err)
+	}
+	if got, _ := store.GetAttachment(ctx, attachment.ID); got.StorageKey != "k" || got.Filename != "a.png" {
+		t.Fatalf("unexpected attachment %+v", got)
+	}
+	if _, err := store.GetAttachment(ctx, attachment.ID+1000); !isPgNotFound(err) {
+		t.Fatalf("expected not found for a missing attachment, got %v", err)
+	}
+}
+
+func testStoreRetention(t *testing.T, store Store, suffix string) {
+	ctx := context.Background()
+	alice := "alice" + suffix
+	_ = store.EnsureUser(ctx, alice)
+	short, _ := store.CreateChannel(ctx, "short"+suffix, alice)
+	forever, _ := store.CreateChannel(ctx, "forever"+suffix, alice)
+	second := int64(1)
+	_ = store.SetChannelRetention(ctx, short.ID, &second)
+	for _, ch := range []int64{short.ID, forever.ID} {
+		_, _ = store.SaveChannelMessage(ctx, ch, alice, []byte("a"))
+		_, _ = store.SaveChannelMessage(ctx, ch, alice, []byte("b"))
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	// Expired rows are hidden before the purge gets to them.
+	if msgs, _ := store.ListMessages(ctx, short.ID, 10); len(msgs) != 0 {
+		t.Fatalf("expected expired messages hidden, got %+v", msgs)
+	}
+	if msgs, _ := store.ListMessagesAfter(ctx, short.ID, 0, 10); len(msgs) != 0 {
+		t.Fatalf("expected expired messages hidden from resume, got %+v", msgs)
+	}
+	if n, err := store.CountExpiredMessages(ctx); err != nil || n < 2 {
+		t.Fatalf("expected expired messages counted, got %d %v", n, err)
+	}
+	if n, err := store.PurgeExpiredMessages(ctx, 1, true); err != nil || n != 1 {
+		t.Fatalf("expected the batch size honoured, got %d %v", n, err)
+	}
+	for {
+		n, err := store.PurgeExpiredMessages(ctx, 100, false)
+		if err != nil {
+			t.Fatalf("purge: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if n, _ := store.CountExpiredMessages(ctx); n != 0 {
+		t.Fatalf("expected nothing left to purge, got %d", n)
+	}
+	if msgs, _ := store.ListMessages(ctx, forever.ID, 10); len(msgs) != 2 {
+		t.Fatalf("expected channel without retention untouched, got %+v", msgs)
+	}
+}
+
+func testStoreAttachments(t *testing.T, store Store, suffix string) {
+	ctx := context.Background()
+	alice, bob := "alice"+suffix, "bob"+suffix
+	_ = store.EnsureUser(ctx, alice)
+	_ = store.EnsureUser(ctx, bob)
+	general, _ := store.CreateChannel(ctx, "files"+suffix, alice)
+
+	a, err := store.CreateAttachment(ctx, Attachment{ChannelID: general.ID, UserID: alice, Filename: "a.txt", ContentType: "text/plain", Size: 1, StorageKey: "a" + suffix})
+	if err != nil || a.ID == 0 {
+		t.Fatalf("create attachment: %+v %v", a, err)
+	}
+	b, _ := store.CreateAttachment(ctx, Attachment{ChannelID: general.ID, UserID: bob, Filename: "b.txt", ContentType: "text/plain", Size: 1, StorageKey: "b" + suffix})
+	msg, _ := store.SaveChannelMessage(ctx, general.ID, alice, []byte("see attached"))
+
+	// Bob's attachment makes the whole link fail, so alice's stays free.
+	if err := store.AttachToMessage(ctx, general.ID, msg.ID, alice, []int64{a.ID, b.ID}); !errors.Is(err, errAttachmentUnavailable) {
+		t.Fatalf("expected unavailable, got %v", err)
+	}
+	if got, _ := store.GetAttachment(ctx, a.ID); got.MessageID != nil {
+		t.Fatalf("a failed link must not attach anything: %+v", got)
+	}
+	if err := store.AttachToMessage(ctx, general.ID+1000, msg.ID, alice, []int64{a.ID}); !errors.Is(err, errAttachmentUnavailable) {
+		t.Fatalf("expected another channel to be refused, got %v", err)
+	}
+	if err := store.AttachToMessage(ctx, general.ID, msg.ID, alice, []int64{a.ID}); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if got, _ := store.GetAttachment(ctx, a.ID); got.MessageID == nil || *got.MessageID != msg.ID {
+		t.Fatalf("expected the attachment linked to %d: %+v", msg.ID, got)
+	}
+	if err := store.AttachToMessage(ctx, general.ID, msg.ID+1, alice, []int64{a.ID}); !errors.Is(err, errAttachmentUnavailable) {
+		t.Fatalf("expected an attached attachment to be refused, got %v", err)
+	}
+}
+
+func testStoreScheduled(t *testing.T, store Store, suffix string) {
+	ctx := context.Background()
+	alice, bob := "alice"+suffix, "bob"+suffix
+	_ = store.EnsureUser(ctx, alice)
+	_ = store.EnsureUser(ctx, bob)
+	channel, _ := store.CreateChannel(ctx, "general"+suffix, alice)
+
+	now := time.Now()
+	later, err := store.CreateScheduledMessage(ctx, ScheduledMessage{UserID: alice, ChannelID: &channel.ID, Payload: "later", DeliverAt: now.Add(time.Hour)})
+	if err != nil || later.ID == 0 || later.Status != scheduledPending {
+		t.Fatalf("create scheduled: %+v %v", later, err)
+	}
+	due, _ := store.CreateScheduledMessage(ctx, ScheduledMessage{UserID: alice, ChannelID: &channel.ID, Payload: "due", DeliverAt: now.Add(-time.Minute)})
+	cancelled, _ := store.CreateScheduledMessage(ctx, ScheduledMessage{UserID: alice, Payload: "cancel", DeliverAt: now.Add(-time.Minute)})
+
+	if err := store.CancelScheduledMessage(ctx, cancelled.ID, bob); !isPgNotFound(err) {
+		t.Fatalf("expected not found cancelling another user's item, got %v", err)
+	}
+	if err := store.CancelScheduledMessage(ctx, cancelled.ID, alice); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	pending, _ := store.ListScheduledMessages(ctx, alice)
+	if len(pending) != 2 || pending[0].ID != due.ID || pending[1].ID != later.ID {
+		t.Fatalf("expected pending items soonest first, got %+v", pending)
+	}
+
+	later.Payload = "edited"
+	if updated, err := store.UpdateScheduledMessage(ctx, later); err != nil || updated.Payload != "edited" {
+		t.Fatalf("update scheduled: %+v %v", updated, err)
+	}
+	later.UserID = bob
+	if _, err := store.UpdateScheduledMessage(ctx, later); !isPgNotFound(err) {
+		t.Fatalf("expected not found updating another user's item, got %v", err)
+	}
+
+	// An expired claim is handed out again, as when a dispatcher died
+	// before marking its items sent.
+	claimed, _ := store.ClaimDueScheduledMessages(ctx, 1000, -time.Second)
+	if !slices.ContainsFunc(claimed, func(sm ScheduledMessage) bool { return sm.ID == due.ID && sm.Status == scheduledSending }) {
+		t.Fatalf("expected the due item claimed, got %+v", claimed)
+	}
+	if slices.ContainsFunc(claimed, func(sm ScheduledMessage) bool { return sm.ID == later.ID || sm.ID == cancelled.ID }) {
+		t.Fatalf("only pending due items are claimed, got %+v", claimed)
+	}
+	if err := store.CancelScheduledMessage(ctx, due.ID, alice); !isPgNotFound(err) {
+		t.Fatalf("items in flight cannot be cancelled, got %v", err)
+	}
+	claimed, _ = store.ClaimDueScheduledMessages(ctx, 1000, time.Hour)
+	if !slices.ContainsFunc(claimed, func(sm ScheduledMessage) bool { return sm.ID == due.ID }) {
+		t.Fatalf("expected the expired claim to be retried, got %+v", claimed)
+	}
+	if again, _ := store.ClaimDueScheduledMessages(ctx, 1000, time.Hour); slices.ContainsFunc(again, func(sm ScheduledMessage) bool { return sm.ID == due.ID }) {
+		t.Fatalf("a live claim is not handed out twice")
+	}
+	if err := store.MarkScheduledMessageSent(ctx, due.ID); err != nil {
+		t.Fatalf("mark sent: %v", err)
+	}
+	if again, _ := store.ClaimDueScheduledMessages(ctx, 1000, -time.Second); slices.ContainsFunc(again, func(sm ScheduledMessage) bool { return sm.ID == due.ID }) {
+		t.Fatalf("sent items are never claimed again")
+	}
+	if err := store.MarkScheduledMessageFailed(ctx, due.ID); err != nil {
+		t.Fatalf("mark failed: %v", err)
+	}
+}
+
+func testStoreRegistry(t *testing.T, store Store, suffix string) {
+	ctx := context.Background()
+	lease := "lease" + suffix
+	if ok, _ := store.AcquireLease(ctx, lease, "a", time.Minute); !ok {
+		t.Fatalf("expected a free lease to be taken")
+	}
+	if ok, _ := store.AcquireLease(ctx, lease, "b", time.Minute); ok {
+		t.Fatalf("expected a held lease to be refused")
+	}
+	if ok, _ := store.AcquireLease(ctx, lease, "a", time.Millisecond); !ok {
+		t.Fatalf("expected the holder to renew")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if ok, _ := store.AcquireLease(ctx, lease, "b", time.Minute); !ok {
+		t.Fatalf("expected an expired lease to be taken over")
+	}
+
+	subject := "storm.conformance" + suffix
+	if err := store.PutSubjectSchema(ctx, subject, []byte(`{"type":"object"}`)); err != nil {
+		t.Fatalf("put schema: %v", err)
+	}
+	_ = store.PutSubjectSchema(ctx, subject, []byte(`{"type": "string"}`))
+	schemas, _ := store.ListSubjectSchemas(ctx)
+	i := slices.IndexFunc(schemas, func(ss SubjectSchema) bool { return ss.Subject == subject })
+	if i < 0 || schemas[i].UpdatedAt.IsZero() || len(schemas[i].Schema) == 0 {
+		t.Fatalf("expected schema listed, got %+v", schemas)
+	}
+	if !slices.IsSortedFunc(schemas, func(a, b SubjectSchema) int { return strings.Compare(a.Subject, b.Subject) }) {
+		t.Fatalf("expected schemas ordered by subject")
+	}
+	if err := store.DeleteSubjectSchema(ctx, subject); err != nil {
+		t.Fatalf("delete schema: %v", err)
+	}
+	if err := store.DeleteSubjectSchema(ctx, subject); !isPgNotFound(err) {
+		t.Fatalf("expected not found deleting twice, got %v", err)
+	}
+}
+
+func testPresenceHeartbeats(t *testing.T, pres Presence) {
+	ctx := context.Background()
+
+	if status, err := pres.Status(ctx, "alice"); err != nil || status.Online || status.LastSeen != nil {
+		t.Fatalf("expected unknown user offline, got %+v (%v)", status, err)
+	}
+	_ = pres.Heartbeat(ctx, "alice", "gw-1", []int64{1, 2}, time.Minute, false)
+	_ = pres.Heartbeat(ctx, "alice", "gw-2", []int64{1}, time.Minute, false)
+	_ = pres.Heartbeat(ctx, "bob", "gw-3", []int64{1}, time.Minute, false)
+	if users, _ := pres.Online(ctx, 1); !slices.Equal(users, []string{"alice", "bob"}) {
+		t.Fatalf("expected both users in channel 1 once each, got %v", users)
+	}
+
+	// Alice is away only once every tab is idle.
+	_ = pres.Heartbeat(ctx, "alice", "gw-1", []int64{1, 2}, time.Minute, true)
+	if status, _ := pres.Status(ctx, "alice"); !status.Online || status.Away {
+		t.Fatalf("alice has an active tab, got %+v", status)
+	}
+	_ = pres.Heartbeat(ctx, "alice", "gw-2", []int64{1}, time.Minute, true)
+	if status, _ := pres.Status(ctx, "alice"); !status.Away {
+		t.Fatalf("expected alice away, got %+v", status)
+	}
+
+	_ = pres.Leave(ctx, "alice", "gw-1", []int64{2})
+	if users, _ := pres.Online(ctx, 2); len(users) != 0 {
+		t.Fatalf("expected channel 2 empty after leave, got %v", users)
+	}
+
+	_ = pres.Disconnect(ctx, "alice", "gw-1", []int64{1})
+	if status, _ := pres.Status(ctx, "alice"); !status.Online {
+		t.Fatalf("alice still has a connection, got %+v", status)
+	}
+	_ = pres.Disconnect(ctx, "alice", "gw-2", []int64{1})
+	status, _ := pres.Status(ctx, "alice")
+	if status.Online || status.LastSeen == nil || time.Since(*status.LastSeen) > time.Minute {
+		t.Fatalf("expected alice offline with last seen, got %+v", status)
+	}
+
+	// A connection whose gateway died lapses with its heartbeat.
+	_ = pres.Heartbeat(ctx, "carol", "gw-4", []int64{3}, 10*time.Millisecond, false)
+	time.Sleep(20 * time.Millisecond)
+	if users, _ := pres.Online(ctx, 3); len(users) != 0 {
+		t.Fatalf("expected lapsed heartbeat to drop out, got %v", users)
+	}
+	if status, _ := pres.Status(ctx, "carol"); status.Online || status.LastSeen == nil {
+		t.Fatalf("expected carol offline with last seen, got %+v", status)
+	}
+
+	if err := pres.Incr(ctx, "storm.events"); err != nil {
+		t.Fatalf("incr: %v", err)
+	}
+	if err := pres.Decr(ctx, "storm.events"); err != nil {
+		t.Fatalf("decr: %v", err)
+	}
+}
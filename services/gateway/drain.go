@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricDraining = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "storm_gateway_draining",
+	Help: "1 while the gateway is shutting down and draining sockets",
+})
+
+const (
+	defaultReadinessDelay = 5 * time.Second
+	defaultDrainWindow    = 10 * time.Second
+	defaultFlushTimeout   = 10 * time.Second
+)
+
+// Drainer coordinates shutdown with the HTTP handlers. Once started, /healthz
+// reports not ready and /ws refuses upgrades; Drain then closes the sockets
+// already open, spread over a jitter window so clients do not all reconnect
+// to the remaining replicas at once.
+type Drainer struct {
+	draining atomic.Bool
+
+	mu      sync.Mutex
+	nextID  uint64
+	sockets map[uint64]func(reconnectAfter time.Duration)
+	empty   chan struct{}
+}
+
+func NewDrainer() *Drainer {
+	return &Drainer{sockets: make(map[uint64]func(time.Duration))}
+}
+
+// WithDrainer wires shutdown state into /healthz and /ws.
+func WithDrainer(d *Drainer) RouterOption {
+	return func(o *routerOptions) {
+		o.drainer = d
+	}
+}
+
+// Draining reports whether shutdown has begun.
+func (d *Drainer) Draining() bool {
+	return d != nil && d.draining.Load()
+}
+
+// Start flips the gateway to draining. It is safe to call more than once.
+func (d *Drainer) Start() {
+	if d == nil || d.draining.Swap(true) {
+		return
+	}
+	metricDraining.Set(1)
+	log.Printf("draining: readiness failing, new sockets refused")
+}
+
+// Track registers an open socket with the function that closes it. The
+// returned func must be called when the socket's handler exits.
+func (d *Drainer) Track(closeSocket func(reconnectAfter time.Duration)) func() {
+	if d == nil {
+		return func() {}
+	}
+	d.mu.Lock()
+	d.nextID++
+	id := d.nextID
+	d.sockets[id] = closeSocket
+	d.mu.Unlock()
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.sockets, id)
+		if len(d.sockets) == 0 && d.empty != nil {
+			close(d.empty)
+			d.empty = nil
+		}
+	}
+}
+
+// Drain closes every tracked socket at a random point within window, each
+// with its own random reconnect hint, and waits for their handlers to exit.
+// Sockets still open when ctx ends are closed at once.
+func (d *Drainer) Drain(ctx context.Context, window time.Duration) error {
+	if d == nil {
+		return nil
+	}
+	d.Start()
+	d.mu.Lock()
+	if len(d.sockets) == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+	empty := make(chan struct{})
+	d.empty = empty
+	sockets := make([]func(time.Duration), 0, len(d.sockets))
+	for _, closeSocket := range d.sockets {
+		sockets = append(sockets, closeSocket)
+	}
+	d.mu.Unlock()
+
+	log.Printf("draining %d sockets over %s", len(sockets), window)
+	timers := make([]*time.Timer, 0, len(sockets))
+	for _, closeSocket := range sockets {
+		closeSocket := closeSocket
+		timers = append(timers, time.AfterFunc(jitter(window), func() { closeSocket(jitter(window)) }))
+	}
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		for i, t := range timers {
+			if t.Stop() {
+				sockets[i](0)
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+func jitter(window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	return rand.N(window)
+}
+
+// closeForRestart sends the close frame used while draining: 1012 (service
+// restart) with a reconnect hint the client should wait before retrying.
+func closeForRestart(conn *websocket.Conn) func(time.Duration) {
+	return func(reconnectAfter time.Duration) {
+		reason := fmt.Sprintf(`{"reconnect_after_ms":%d}`, reconnectAfter.Milliseconds())
+		msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, reason)
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		_ = conn.Close()
+	}
+}
+
+// FlushTaskQueue persists whatever is left in asyncTaskQueue once the worker
+// pool has stopped, in batches of flushBatchSize. Failed rows are not
+// retried: spooled ones wait for the next start. It gives up when ctx ends
+// and reports what was lost.
+func FlushTaskQueue(ctx context.Context, store Store, queue *WriteQueue) (int, error) {
+	queue.drain()
+	flushed := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			log.Printf("flush stopped with %d tasks unsaved: %v", len(asyncTaskQueue), err)
+			return flushed, err
+		}
+		var tasks []asyncTask
+	fill:
+		for len(tasks) < flushBatchSize {
+			select {
+			case task := <-asyncTaskQueue:
+				tasks = append(tasks, task)
+			default:
+				break fill
+			}
+		}
+		if len(tasks) == 0 {
+			return flushed, nil
+		}
+		if err := runTasks(ctx, store, queue, tasks); err != nil {
+			log.Printf("flush: %v", err)
+		}
+		flushed += len(tasks)
+		metricSaveQueueLen.Set(float64(len(asyncTaskQueue)))
+	}
+}
+
+// ShutdownConfig times the phases of a graceful shutdown.
+type ShutdownConfig struct {
+	// ReadinessDelay keeps serving after readiness starts failing, so load
+	// balancers stop routing here before the listener closes.
+	ReadinessDelay time.Duration
+	DrainWindow    time.Duration
+	FlushTimeout   time.Duration
+}
+
+// drainSockets closes the tracked sockets and streams, waiting at most the
+// drain window plus a margin for their handlers to unwind. It runs alongside
+// http.Server.Shutdown, which would otherwise wait on SSE and long-poll
+// requests that only end when drained.
+func drainSockets(drainer *Drainer, cfg ShutdownConfig) {
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainWindow+5*time.Second)
+	defer cancel()
+	if err := drainer.Drain(drainCtx, cfg.DrainWindow); err != nil {
+		log.Printf("socket drain incomplete: %v", err)
+	}
+}
+
+// flushWrites runs once the HTTP server has stopped and the sockets have
+// drained: it stops the background workers, then persists the tasks they
+// left in asyncTaskQueue and syncs the write queue.
+func flushWrites(stopWorkers context.CancelFunc, workersDone <-chan struct{}, store Store, queue *WriteQueue, cfg ShutdownConfig) {
+	stopWorkers()
+	<-workersDone
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.FlushTimeout)
+	defer cancel()
+	n, err := FlushTaskQueue(flushCtx, store, queue)
+	if cerr := queue.Close(); cerr != nil {
+		log.Printf("write queue close: %v", cerr)
+	}
+	if err == nil {
+		log.Printf("shutdown complete, flushed %d queued tasks", n)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestDrainerClosesSocketsWithReconnectHint(t *testing.T) {
+	drainer := NewDrainer()
+	server := httptest.NewServer(NewRouter(newFakeNats(), nil, nil, AuthConfig{}, WithDrainer(drainer)))
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	defer conn.Close()
+
+	drained := make(chan error, 1)
+	go func() { drained <- drainer.Drain(context.Background(), 50*time.Millisecond) }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseServiceRestart || !strings.Contains(closeErr.Text, "reconnect_after_ms") {
+		t.Fatalf("expected service restart close with hint, got %v", err)
+	}
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatalf("drain: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("drain did not finish after the socket closed")
+	}
+
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected failing readiness, got %v (%v)", resp, err)
+	}
+	_ = resp.Body.Close()
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected new sockets to be refused, got %v", err)
+	}
+}
+
+func TestFlushTaskQueue(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "alice")
+	channel, _ := store.CreateChannel(context.Background(), "general", "alice")
+	for _, p := range []string{"a", "b"} {
+		asyncTaskQueue <- asyncTask{taskType: taskSaveMessage, channelID: channel.ID, userID: "alice", payload: []byte(p)}
+	}
+	if n, err := FlushTaskQueue(context.Background(), store, nil); err != nil || n != 2 {
+		t.Fatalf("expected 2 flushed, got %d (%v)", n, err)
+	}
+	if msgs, _ := store.ListMessages(context.Background(), channel.ID, 10); len(msgs) != 2 {
+		t.Fatalf("expected queued messages persisted, got %d", len(msgs))
+	}
+
+	asyncTaskQueue <- asyncTask{taskType: taskSaveMessage, channelID: channel.ID, userID: "alice", payload: []byte("late")}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := FlushTaskQueue(ctx, store, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected deadline to stop the flush, got %v", err)
+	}
+	<-asyncTaskQueue
+}
+
+func TestRunMainShutsDownOnSIGTERM(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	t.Setenv("NATS_URL", ns.ClientURL())
+	t.Setenv("BLOB_LOCAL_DIR", t.TempDir())
+	t.Setenv("SHUTDOWN_READINESS_DELAY", "0s")
+	t.Setenv("SHUTDOWN_DRAIN_WINDOW", "0s")
+
+	var healthz int
+	deps := runtimeDeps{
+		// #nosec G402 -- test uses local NATS without TLS.
+		NatsConnect: nats.Connect,
+		ConnectStore: func(context.Context, string, int, time.Duration) (Store, error) {
+			return dummyStore{}, nil
+		},
+		ConnectRedis: func(context.Context, string, string, int, int, time.Duration) (Presence, error) {
+			return dummyPresence{}, nil
+		},
+		ListenAndServe: func(ctx context.Context, _ string, handler http.Handler) error {
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				return errors.New("serve context not cancelled")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			healthz = w.Code
+			return http.ErrServerClosed
+		},
+	}
+	if err := runMain(deps); err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+	if healthz != http.StatusServiceUnavailable {
+		t.Fatalf("expected readiness to fail while draining, got %d", healthz)
+	}
+}
+
+func TestRunMainDrainsStreamsDuringShutdown(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	t.Setenv("NATS_URL", ns.ClientURL())
+	t.Setenv("BLOB_LOCAL_DIR", t.TempDir())
+	t.Setenv("JWT_SECRET", "test")
+	t.Setenv("SHUTDOWN_READINESS_DELAY", "0s")
+	t.Setenv("SHUTDOWN_DRAIN_WINDOW", "0s")
+
+	deps := runtimeDeps{
+		// #nosec G402 -- test uses local NATS without TLS.
+		NatsConnect: nats.Connect,
+		ConnectStore: func(context.Context, string, int, time.Duration) (Store, error) {
+			return dummyStore{}, nil
+		},
+		ConnectRedis: func(context.Context, string, string, int, int, time.Duration) (Presence, error) {
+			return dummyPresence{}, nil
+		},
+		ListenAndServe: func(ctx context.Context, _ string, handler http.Handler) error {
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+			polled := make(chan error, 1)
+			go func() {
+				resp, err := http.DefaultClient.Do(streamRequest(t, srv.URL+"/poll?subject=updates&timeout=30s", 0))
+				if err == nil {
+					_ = resp.Body.Close()
+				}
+				polled <- err
+			}()
+			subs := ns.NumSubscriptions()
+			deadline := time.Now().Add(2 * time.Second)
+			for ns.NumSubscriptions() == subs && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				return err
+			}
+			<-ctx.Done()
+			// Like http.Server.Shutdown, wait for the poll before returning.
+			select {
+			case err := <-polled:
+				if err != nil {
+					return err
+				}
+			case <-time.After(5 * time.Second):
+				return errors.New("poll not drained while the listener stopped")
+			}
+			return context.DeadlineExceeded
+		},
+	}
+	if err := runMain(deps); err != nil {
+		t.Fatalf("expected shutdown to finish despite the late listener, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newExportFixture(t *testing.T) (*memStore, Channel) {
+	t.Helper()
+	store := newMemStore()
+	_, _ = store.CreateUser(context.Background(), "user-1", "pass", "User One")
+	_, _ = store.CreateUser(context.Background(), "bob", "pass", "Bob")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	_, _ = store.SaveChannelMessage(context.Background(), channel.ID, "user-1", []byte(`{"message":"hi"}`))
+	_, _ = store.SaveChannelMessage(context.Background(), channel.ID, "bob", []byte("comma, \"quoted\""))
+	return store, channel
+}
+
+func TestExportChannelJSONL(t *testing.T) {
+	store, channel := newExportFixture(t)
+	r := NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+
+	req := httptest.NewRequest(http.MethodGet, "/channels/"+strconv.FormatInt(channel.ID, 10)+"/export", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	var rows []ExportedMessage
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var row ExportedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("decode line: %v", err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 2 || rows[0].DisplayName != "User One" || rows[1].DisplayName != "Bob" {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+}
+
+func TestExportChannelCSV(t *testing.T) {
+	store, channel := newExportFixture(t)
+	var buf bytes.Buffer
+	if err := exportChannel(context.Background(), store, &buf, "csv", channel.ID, ExportRange{}); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv: %v", err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != strings.Join(csvExportHeader, ",") {
+		t.Fatalf("unexpected csv: %v", records)
+	}
+	if records[2][5] != "comma, \"quoted\"" {
+		t.Fatalf("payload not round-tripped: %q", records[2][5])
+	}
+}
+
+func TestExportChannelAccess(t *testing.T) {
+	store, _ := newExportFixture(t)
+	other, _ := store.CreateChannel(context.Background(), "bobs", "bob")
+	path := "/channels/" + strconv.FormatInt(other.ID, 10) + "/export?format=csv"
+
+	r := NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-owner, got %d", w.Code)
+	}
+
+	r = NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true, Admins: []string{"user-1"}})
+	req = httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for admin, got %d", w.Code)
+	}
+}
+
+func TestExportChannelBadRequests(t *testing.T) {
+	store, channel := newExportFixture(t)
+	r := NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+	base := "/channels/" + strconv.FormatInt(channel.ID, 10) + "/export"
+	for _, query := range []string{"?format=xml", "?from=yesterday", "?from=2026-01-02T00:00:00Z&to=2026-01-01T00:00:00Z"} {
+		req := httptest.NewRequest(http.MethodGet, base+query, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestParseExportRange(t *testing.T) {
+	rng, err := parseExportRange("2026-01-01T00:00:00Z", "")
+	if err != nil || rng.From == nil || rng.To != nil {
+		t.Fatalf("unexpected range %+v (%v)", rng, err)
+	}
+	if !rng.From.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected from %v", rng.From)
+	}
+}
+
+func TestRunExportCommand(t *testing.T) {
+	store, channel := newExportFixture(t)
+	connect := func(context.Context, string, int, time.Duration) (Store, error) { return store, nil }
+
+	var stdout bytes.Buffer
+	args := []string{"-channel", strconv.FormatInt(channel.ID, 10), "-format", "jsonl"}
+	if err := runExportCommand(context.Background(), args, &stdout, connect); err != nil {
+		t.Fatalf("export command: %v", err)
+	}
+	if lines := strings.Count(stdout.String(), "\n"); lines != 2 {
+		t.Fatalf("expected 2 lines, got %d", lines)
+	}
+
+	out := filepath.Join(t.TempDir(), "export.csv")
+	args = []string{"-channel", strconv.FormatInt(channel.ID, 10), "-format", "csv", "-o", out}
+	if err := runExportCommand(context.Background(), args, &stdout, connect); err != nil {
+		t.Fatalf("export command to file: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil || !strings.HasPrefix(string(data), "id,channel_id,user_id,display_name") {
+		t.Fatalf("unexpected file contents %q (%v)", string(data), err)
+	}
+
+	if err := runExportCommand(context.Background(), nil, &stdout, connect); err == nil {
+		t.Fatalf("expected error without -channel")
+	}
+}
@@ -0,0 +1,834 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errMemoryConstraint mirrors the unique and foreign key violations
+// postgresStore gets from the database.
+var errMemoryConstraint = errors.New("constraint violation")
+
+type memoryUser struct {
+	user         User
+	passwordHash string
+}
+
+type memoryLease struct {
+	holder  string
+	expires time.Time
+}
+
+// memoryStore is a Store kept in process memory, for single-node and dev
+// deployments that run without Postgres. It follows postgresStore's
+// semantics, including pgx.ErrNoRows for missing rows, so handlers behave
+// the same on either; nothing survives a restart.
+type memoryStore struct {
+	mu          sync.Mutex
+	users       map[string]memoryUser
+	channels    map[int64]Channel
+	members     map[int64]map[string]int64
+	moderation  map[int64][]byte
+	messages    []Message
+	archive     map[int64]Message
+	attachments map[int64]Attachment
+	scheduled   map[int64]ScheduledMessage
+	claims      map[int64]time.Time // claimed_until of sending items
+	leases      map[string]memoryLease
+	schemas     map[string]SubjectSchema
+	refresh     map[string]RefreshToken
+
+	nextChannel    int64
+	nextMessage    int64
+	nextAttachment int64
+	nextScheduled  int64
+}
+
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:       make(map[string]memoryUser),
+		channels:    make(map[int64]Channel),
+		members:     make(map[int64]map[string]int64),
+		moderation:  make(map[int64][]byte),
+		archive:     make(map[int64]Message),
+		attachments: make(map[int64]Attachment),
+		scheduled:   make(map[int64]ScheduledMessage),
+		claims:      make(map[int64]time.Time),
+		leases:      make(map[string]memoryLease),
+		schemas:     make(map[string]SubjectSchema),
+		refresh:     make(map[string]RefreshToken),
+	}
+}
+
+func (m *memoryStore) EnsureUser(_ context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		m.users[userID] = memoryUser{user: User{ID: userID, CreatedAt: time.Now()}}
+	}
+	return nil
+}
+
+func (m *memoryStore) CreateUser(_ context.Context, userID, password, displayName string) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), getBcryptCost())
+	if err != nil {
+		return User{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; ok {
+		return User{}, errMemoryConstraint
+	}
+	user := User{ID: userID, DisplayName: displayName, CreatedAt: time.Now()}
+	m.users[userID] = memoryUser{user: user, passwordHash: string(hash)}
+	return user, nil
+}
+
+func (m *memoryStore) GetUser(_ context.Context, userID string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.users[userID]
+	if !ok {
+		return User{}, pgx.ErrNoRows
+	}
+	return rec.user, nil
+}
+
+func (m *memoryStore) ListUsers(context.Context) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []User
+	for _, rec := range m.users {
+		out = append(out, rec.user)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (m *memoryStore) UpdateUser(_ context.Context, userID, displayName, password string) (User, error) {
+	var hash []byte
+	if password != "" {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), getBcryptCost()); err != nil {
+			return User{}, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.users[userID]
+	if !ok {
+		return User{}, pgx.ErrNoRows
+	}
+	if displayName != "" {
+		rec.user.DisplayName = displayName
+	}
+	if hash != nil {
+		rec.passwordHash = string(hash)
+	}
+	m.users[userID] = rec
+	return rec.user, nil
+}
+
+func (m *memoryStore) DeleteUser(_ context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, userID)
+	return nil
+}
+
+func (m *memoryStore) VerifyUserPassword(_ context.Context, userID, password string) (User, error) {
+	m.mu.Lock()
+	rec, ok := m.users[userID]
+	m.mu.Unlock()
+	if !ok {
+		return User{}, pgx.ErrNoRows
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(rec.passwordHash), []byte(password)); err != nil {
+		return User{}, errors.New("invalid password")
+	}
+	return rec.user, nil
+}
+
+func (m *memoryStore) SaveRefreshToken(_ context.Context, userID, token string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.refresh[token]; ok {
+		return errMemoryConstraint
+	}
+	if _, ok := m.users[userID]; !ok {
+		return errMemoryConstraint
+	}
+	m.refresh[token] = RefreshToken{Token: token, UserID: userID, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (m *memoryStore) GetRefreshToken(_ context.Context, token string) (RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.refresh[token]
+	if !ok {
+		return RefreshToken{}, pgx.ErrNoRows
+	}
+	return rec, nil
+}
+
+func (m *memoryStore) RevokeRefreshToken(_ context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rec, ok := m.refresh[token]; ok {
+		rec.Revoked = true
+		m.refresh[token] = rec
+	}
+	return nil
+}
+
+func (m *memoryStore) CreateChannel(_ context.Context, name, createdBy string) (Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[createdBy]; !ok {
+		return Channel{}, errMemoryConstraint
+	}
+	for _, ch := range m.channels {
+		if ch.Name == name {
+			return Channel{}, errMemoryConstraint
+		}
+	}
+	m.nextChannel++
+	ch := Channel{ID: m.nextChannel, Name: name, CreatedBy: createdBy, CreatedAt: time.Now()}
+	m.channels[ch.ID] = ch
+	return ch, nil
+}
+
+func (m *memoryStore) ListChannels(_ context.Context, userID string) ([]Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []Channel
+	for _, ch := range m.channels {
+		if lastRead, ok := m.members[ch.ID][userID]; ok {
+			ch.LastReadMessageID = lastRead
+			for _, msg := range m.messages {
+				if msg.ChannelID != ch.ID || msg.ID <= lastRead || msg.UserID == userID {
+					continue
+				}
+				ch.UnreadCount++
+				if mentionsUser([]byte(msg.Payload), userID) {
+					ch.MentionCount++
+				}
+			}
+		}
+		out = append(out, ch)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (m *memoryStore) GetChannel(_ context.Context, channelID int64) (Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch, ok := m.channels[channelID]
+	if !ok {
+		return Channel{}, pgx.ErrNoRows
+	}
+	return ch, nil
+}
+
+func (m *memoryStore) SetChannelRetention(_ context.Context, channelID int64, seconds *int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch, ok := m.channels[channelID]
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	if seconds != nil {
+		v := *seconds
+		seconds = &v
+	}
+	ch.RetentionSeconds = seconds
+	m.channels[channelID] = ch
+	return nil
+}
+
+func (m *memoryStore) GetModerationConfig(_ context.Context, channelID int64) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.channels[channelID]; !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return slices.Clone(m.moderation[channelID]), nil
+}
+
+func (m *memoryStore) SetModerationConfig(_ context.Context, channelID int64, cfg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.channels[channelID]; !ok {
+		return pgx.ErrNoRows
+	}
+	if cfg == nil {
+		delete(m.moderation, channelID)
+		return nil
+	}
+	m.moderation[channelID] = slices.Clone(cfg)
+	return nil
+}
+
+func (m *memoryStore) EnsureMember(_ context.Context, channelID int64, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.channels[channelID]; !ok {
+		return errMemoryConstraint
+	}
+	if _, ok := m.users[userID]; !ok {
+		return errMemoryConstraint
+	}
+	if m.members[channelID] == nil {
+		m.members[channelID] = make(map[string]int64)
+	}
+	if _, ok := m.members[channelID][userID]; !ok {
+		m.members[channelID][userID] = 0
+	}
+	return nil
+}
+
+func (m *memoryStore) IsMember(_ context.Context, channelID int64, userID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.members[channelID][userID]
+	return ok, nil
+}
+
+// MarkChannelRead follows postgresStore: zero or out-of-range ids mark the
+// whole channel read and the marker never moves backwards.
+func (m *memoryStore) MarkChannelRead(_ context.Context, channelID int64, userID string, messageID int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lastRead, ok := m.members[channelID][userID]
+	if !ok {
+		return 0, pgx.ErrNoRows
+	}
+	var latest int64
+	for _, msg := range m.messages {
+		if msg.ChannelID == channelID {
+			latest = msg.ID
+		}
+	}
+	target := latest
+	if messageID > 0 && messageID < latest {
+		target = messageID
+	}
+	if target > lastRead {
+		lastRead = target
+		m.members[channelID][userID] = lastRead
+	}
+	return lastRead, nil
+}
+
+func (m *memoryStore) SaveChannelMessages(ctx context.Context, batch []PendingMessage) ([]Message, []error) {
+	msgs := make([]Message, len(batch))
+	errs := make([]error, len(batch))
+	for i, p := range batch {
+		msgs[i], errs[i] = m.SaveChannelMessage(ctx, p.ChannelID, p.UserID, p.Payload)
+	}
+	return msgs, errs
+}
+
+func (m *memoryStore) SaveChannelMessage(_ context.Context, channelID int64, userID string, payload []byte) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.channels[channelID]; !ok {
+		return Message{}, errMemoryConstraint
+	}
+	if _, ok := m.users[userID]; !ok {
+		return Message{}, errMemoryConstraint
+	}
+	return m.insertMessage(channelID, userID, channelSubject(channelID), payload), nil
+}
+
+func (m *memoryStore) SaveMessage(_ context.Context, subject string, payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.insertMessage(0, "", subject, payload)
+	return nil
+}
+
+// insertMessage appends a message; m.messages stays in id order.
+func (m *memoryStore) insertMessage(channelID int64, userID, subject string, payload []byte) Message {
+	m.nextMessage++
+	msg := Message{
+		ID:        m.nextMessage,
+		ChannelID: channelID,
+		UserID:    userID,
+		Subject:   subject,
+		Payload:   string(payload),
+		CreatedAt: time.Now(),
+	}
+	m.messages = append(m.messages, msg)
+	return msg
+}
+
+// expired reports whether msg is past its channel's retention, or the global
+// default for channels without an override and subject-only messages.
+func (m *memoryStore) expired(msg Message, now time.Time, fallback int64) bool {
+	seconds := fallback
+	if ch, ok := m.channels[msg.ChannelID]; ok && ch.RetentionSeconds != nil {
+		seconds = *ch.RetentionSeconds
+	}
+	return seconds > 0 && msg.CreatedAt.Before(now.Add(-time.Duration(seconds)*time.Second))
+}
+
+// live returns the channel's unexpired messages in id order.
+func (m *memoryStore) live(channelID int64) []Message {
+	now := time.Now()
+	fallback := retentionSeconds(getDefaultRetention())
+	var out []Message
+	for _, msg := range m.messages {
+		if msg.ChannelID == channelID && !m.expired(msg, now, fallback) {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func (m *memoryStore) ListMessages(_ context.Context, channelID int64, limit int) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msgs := m.live(channelID)
+	out := []Message{}
+	for i := len(msgs) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, msgs[i])
+	}
+	return out, nil
+}
+
+func (m *memoryStore) ListMessagesAfter(_ context.Context, channelID, afterID int64, limit int) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []Message{}
+	for _, msg := range m.live(channelID) {
+		if len(out) == limit {
+			break
+		}
+		if msg.ID > afterID {
+			out = append(out, msg)
+		}
+	}
+	return out, nil
+}
+
+// ExportMessages snapshots the matching rows before calling fn, so fn may
+// use the store.
+func (m *memoryStore) ExportMessages(_ context.Context, channelID int64, rng ExportRange, fn func(ExportedMessage) error) error {
+	m.mu.Lock()
+	var out []ExportedMessage
+	for _, msg := range m.live(channelID) {
+		if rng.From != nil && msg.CreatedAt.Before(*rng.From) {
+			continue
+		}
+		if rng.To != nil && !msg.CreatedAt.Before(*rng.To) {
+			continue
+		}
+		out = append(out, ExportedMessage{
+			ID:          msg.ID,
+			ChannelID:   msg.ChannelID,
+			UserID:      msg.UserID,
+			DisplayName: m.users[msg.UserID].user.DisplayName,
+			Payload:     msg.Payload,
+			CreatedAt:   msg.CreatedAt,
+		})
+	}
+	m.mu.Unlock()
+
+	for _, msg := range out {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) PurgeExpiredMessages(_ context.Context, batchSize int, archive bool) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	fallback := retentionSeconds(getDefaultRetention())
+	var purged int64
+	kept := m.messages[:0]
+	for _, msg := range m.messages {
+		if purged < int64(batchSize) && m.expired(msg, now, fallback) {
+			purged++
+			if _, ok := m.archive[msg.ID]; archive && !ok {
+				m.archive[msg.ID] = msg
+			}
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	clear(m.messages[len(kept):])
+	m.messages = kept
+	return purged, nil
+}
+
+func (m *memoryStore) CountExpiredMessages(context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	fallback := retentionSeconds(getDefaultRetention())
+	var n int64
+	for _, msg := range m.messages {
+		if m.expired(msg, now, fallback) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) CreateAttachment(_ context.Context, a Attachment) (Attachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.channels[a.ChannelID]; !ok {
+		return Attachment{}, errMemoryConstraint
+	}
+	if _, ok := m.users[a.UserID]; !ok {
+		return Attachment{}, errMemoryConstraint
+	}
+	m.nextAttachment++
+	a.ID = m.nextAttachment
+	a.CreatedAt = time.Now()
+	m.attachments[a.ID] = a
+	return a, nil
+}
+
+func (m *memoryStore) GetAttachment(_ context.Context, id int64) (Attachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.attachments[id]
+	if !ok {
+		return Attachment{}, pgx.ErrNoRows
+	}
+	return a, nil
+}
+
+func (m *memoryStore) AttachToMessage(_ context.Context, channelID, messageID int64, userID string, attachmentIDs []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range attachmentIDs {
+		a, ok := m.attachments[id]
+		if !ok || a.ChannelID != channelID || a.UserID != userID || a.MessageID != nil {
+			return errAttachmentUnavailable
+		}
+	}
+	for _, id := range attachmentIDs {
+		a := m.attachments[id]
+		a.MessageID = &messageID
+		m.attachments[id] = a
+	}
+	return nil
+}
+
+func (m *memoryStore) CreateScheduledMessage(_ context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[sm.UserID]; !ok {
+		return ScheduledMessage{}, errMemoryConstraint
+	}
+	if sm.ChannelID != nil {
+		if _, ok := m.channels[*sm.ChannelID]; !ok {
+			return ScheduledMessage{}, errMemoryConstraint
+		}
+	}
+	m.nextScheduled++
+	sm.ID = m.nextScheduled
+	sm.Status = scheduledPending
+	sm.CreatedAt = time.Now()
+	m.scheduled[sm.ID] = sm
+	return sm, nil
+}
+
+func sortScheduled(items []ScheduledMessage) {
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].DeliverAt.Equal(items[j].DeliverAt) {
+			return items[i].DeliverAt.Before(items[j].DeliverAt)
+		}
+		return items[i].ID < items[j].ID
+	})
+}
+
+func (m *memoryStore) ListScheduledMessages(_ context.Context, userID string) ([]ScheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []ScheduledMessage
+	for _, sm := range m.scheduled {
+		if sm.UserID == userID && sm.Status == scheduledPending {
+			out = append(out, sm)
+		}
+	}
+	sortScheduled(out)
+	return out, nil
+}
+
+func (m *memoryStore) UpdateScheduledMessage(_ context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, ok := m.scheduled[sm.ID]
+	if !ok || cur.UserID != sm.UserID || cur.Status != scheduledPending {
+		return ScheduledMessage{}, pgx.ErrNoRows
+	}
+	cur.Payload = sm.Payload
+	cur.DeliverAt = sm.DeliverAt
+	m.scheduled[sm.ID] = cur
+	return cur, nil
+}
+
+func (m *memoryStore) CancelScheduledMessage(_ context.Context, id int64, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, ok := m.scheduled[id]
+	if !ok || cur.UserID != userID || cur.Status != scheduledPending {
+		return pgx.ErrNoRows
+	}
+	cur.Status = scheduledCancelled
+	m.scheduled[id] = cur
+	return nil
+}
+
+func (m *memoryStore) ClaimDueScheduledMessages(_ context.Context, limit int, lease time.Duration) ([]ScheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var due []ScheduledMessage
+	for _, sm := range m.scheduled {
+		if (sm.Status == scheduledPending && !sm.DeliverAt.After(now)) ||
+			(sm.Status == scheduledSending && !m.claims[sm.ID].After(now)) {
+			due = append(due, sm)
+		}
+	}
+	sortScheduled(due)
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for i := range due {
+		due[i].Status = scheduledSending
+		m.scheduled[due[i].ID] = due[i]
+		m.claims[due[i].ID] = now.Add(lease)
+	}
+	return due, nil
+}
+
+func (m *memoryStore) MarkScheduledMessageSent(_ context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sm, ok := m.scheduled[id]; ok && sm.Status == scheduledSending {
+		sm.Status = scheduledSent
+		m.scheduled[id] = sm
+		delete(m.claims, id)
+	}
+	return nil
+}
+
+func (m *memoryStore) MarkScheduledMessageFailed(_ context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sm, ok := m.scheduled[id]; ok {
+		sm.Status = scheduledFailed
+		m.scheduled[id] = sm
+	}
+	return nil
+}
+
+func (m *memoryStore) AcquireLease(_ context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if cur, ok := m.leases[name]; ok && cur.holder != holder && !cur.expires.Before(now) {
+		return false, nil
+	}
+	m.leases[name] = memoryLease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *memoryStore) ListSubjectSchemas(context.Context) ([]SubjectSchema, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []SubjectSchema
+	for _, ss := range m.schemas {
+		ss.Schema = slices.Clone(ss.Schema)
+		out = append(out, ss)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Subject < out[j].Subject })
+	return out, nil
+}
+
+func (m *memoryStore) PutSubjectSchema(_ context.Context, subject string, schema []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schemas[subject] = SubjectSchema{Subject: subject, Schema: slices.Clone(schema), UpdatedAt: time.Now()}
+	return nil
+}
+
+func (m *memoryStore) DeleteSubjectSchema(_ context.Context, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.schemas[subject]; !ok {
+		return pgx.ErrNoRows
+	}
+	delete(m.schemas, subject)
+	return nil
+}
+
+func (m *memoryStore) Close() error { return nil }
+
+// memoryPresence is a Presence kept in process memory. It only sees the
+// connections of its own gateway, so it suits single-node deployments; the
+// bookkeeping mirrors redisPresence, with entries expiring on read.
+type memoryPresence struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	// conns, away and channels map members to the expiry of their last
+	// heartbeat; channel members are "<conn>/<user>" as in redisPresence.
+	conns    map[string]map[string]time.Time
+	away     map[string]map[string]time.Time
+	channels map[int64]map[string]time.Time
+	seen     map[string]time.Time
+}
+
+func NewMemoryPresence() Presence {
+	return newMemoryPresence()
+}
+
+func newMemoryPresence() *memoryPresence {
+	return &memoryPresence{
+		counters: make(map[string]int64),
+		conns:    make(map[string]map[string]time.Time),
+		away:     make(map[string]map[string]time.Time),
+		channels: make(map[int64]map[string]time.Time),
+		seen:     make(map[string]time.Time),
+	}
+}
+
+func (p *memoryPresence) Incr(_ context.Context, key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counters[key]++
+	return nil
+}
+
+func (p *memoryPresence) Decr(_ context.Context, key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counters[key]--
+	return nil
+}
+
+func touchPresence[K comparable](sets map[K]map[string]time.Time, key K, member string, expires time.Time) {
+	if sets[key] == nil {
+		sets[key] = make(map[string]time.Time)
+	}
+	sets[key][member] = expires
+}
+
+func dropPresence[K comparable](sets map[K]map[string]time.Time, key K, member string) {
+	delete(sets[key], member)
+	if len(sets[key]) == 0 {
+		delete(sets, key)
+	}
+}
+
+// livePresence prunes a set's expired members and returns the rest.
+func livePresence[K comparable](sets map[K]map[string]time.Time, key K, now time.Time) []string {
+	var out []string
+	for member, expires := range sets[key] {
+		if expires.After(now) {
+			out = append(out, member)
+		} else {
+			dropPresence(sets, key, member)
+		}
+	}
+	return out
+}
+
+func (p *memoryPresence) Heartbeat(_ context.Context, userID, connID string, channelIDs []int64, ttl time.Duration, away bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	expires := now.Add(ttl)
+	touchPresence(p.conns, userID, connID, expires)
+	if away {
+		touchPresence(p.away, userID, connID, expires)
+	} else {
+		dropPresence(p.away, userID, connID)
+	}
+	for _, channelID := range channelIDs {
+		touchPresence(p.channels, channelID, connID+"/"+userID, expires)
+	}
+	p.seen[userID] = now
+	return nil
+}
+
+func (p *memoryPresence) Leave(_ context.Context, userID, connID string, channelIDs []int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, channelID := range channelIDs {
+		dropPresence(p.channels, channelID, connID+"/"+userID)
+	}
+	return nil
+}
+
+func (p *memoryPresence) Disconnect(_ context.Context, userID, connID string, channelIDs []int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dropPresence(p.conns, userID, connID)
+	dropPresence(p.away, userID, connID)
+	for _, channelID := range channelIDs {
+		dropPresence(p.channels, channelID, connID+"/"+userID)
+	}
+	p.seen[userID] = time.Now()
+	return nil
+}
+
+func (p *memoryPresence) Online(_ context.Context, channelID int64) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	members := livePresence(p.channels, channelID, time.Now())
+	users := make([]string, 0, len(members))
+	for _, member := range members {
+		if _, userID, ok := strings.Cut(member, "/"); ok {
+			users = append(users, userID)
+		}
+	}
+	slices.Sort(users)
+	return slices.Compact(users), nil
+}
+
+func (p *memoryPresence) Status(_ context.Context, userID string) (UserPresence, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	status := UserPresence{UserID: userID}
+	conns := livePresence(p.conns, userID, now)
+	idle := livePresence(p.away, userID, now)
+	status.Online = len(conns) > 0
+	status.Away = status.Online && !slices.ContainsFunc(conns, func(connID string) bool {
+		return !slices.Contains(idle, connID)
+	})
+	if seen, ok := p.seen[userID]; ok {
+		// Redis keeps last seen in milliseconds.
+		at := time.UnixMilli(seen.UnixMilli()).UTC()
+		status.LastSeen = &at
+	}
+	return status, nil
+}
+
+func (p *memoryPresence) Close() error { return nil }
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrations are numbered pairs, NNNN_name.up.sql and NNNN_name.down.sql,
+// applied in version order and recorded in schema_migrations. A file whose
+// first line is noTransactionHeader runs outside a transaction, one
+// semicolon-separated statement at a time, so it can use CREATE INDEX
+// CONCURRENTLY on tables that take writes.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock every migration step takes, so
+// replicas starting together apply each version once.
+const migrationLockID = 0x73746f726d
+
+const noTransactionHeader = "-- migrate:no-transaction"
+
+const createMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version BIGINT PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+var errUnknownMigration = errors.New("applied migration not found in this build")
+
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	// UpNoTx and DownNoTx mark files with noTransactionHeader.
+	UpNoTx   bool
+	DownNoTx bool
+}
+
+// MigrationStatus is one known migration and when it was applied, if ever.
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads the migrations in fsys's root. Every version needs
+// both an up and a down file.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*migration)
+	for _, entry := range entries {
+		file := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		if entry.IsDir() || path.Ext(file) != ".sql" || !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.up.sql or NNNN_name.down.sql", file)
+		}
+		num, name, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(num, 10, 64)
+		if err != nil || version <= 0 || name == "" {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.up.sql or NNNN_name.down.sql", file)
+		}
+		body, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, name)
+		}
+		noTx := strings.HasPrefix(string(body), noTransactionHeader)
+		if direction == "up" {
+			m.Up, m.UpNoTx = string(body), noTx
+		} else {
+			m.Down, m.DownNoTx = string(body), noTx
+		}
+	}
+
+	out := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down files", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+func embeddedMigrations() ([]migration, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return loadMigrations(sub)
+}
+
+// pgxSession is one database connection, which a session-level advisory
+// lock and the statements it guards must share.
+type pgxSession interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+type migrator struct {
+	pool       pgxPool
+	migrations []migration
+	// acquire pins a connection for migrations run outside a transaction.
+	acquire func(context.Context) (pgxSession, func(), error)
+}
+
+func newMigrator(pool pgxPool) (*migrator, error) {
+	migrations, err := embeddedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	m := &migrator{pool: pool, migrations: migrations}
+	if p, ok := pool.(interface {
+		Acquire(context.Context) (*pgxpool.Conn, error)
+	}); ok {
+		m.acquire = func(ctx context.Context) (pgxSession, func(), error) {
+			conn, err := p.Acquire(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			return conn, conn.Release, nil
+		}
+	}
+	return m, nil
+}
+
+// step runs fn in its own transaction holding the migration lock. Each
+// migration commits on its own, so a failure keeps the versions before it.
+func (m *migrator) step(ctx context.Context, fn func(pgx.Tx, []int64) error) error {
+	tx, err := m.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(migrationLockID)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, createMigrationsTable); err != nil {
+		return err
+	}
+	applied, err := appliedVersions(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx, applied); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// outsideTx runs fn on one connection holding the migration lock for the
+// session, for migrations that cannot run in a transaction. It skips fn and
+// reports false when another replica already moved version to the wanted
+// state while this one waited for the lock. fn is not atomic: a migration
+// that fails part way must be safe to run again.
+func (m *migrator) outsideTx(ctx context.Context, version int64, wantApplied bool, fn func(pgxSession) error) (bool, error) {
+	if m.acquire == nil {
+		return false, fmt.Errorf("migration %d runs outside a transaction, which this pool does not support", version)
+	}
+	conn, release, err := m.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, int64(migrationLockID)); err != nil {
+		return false, err
+	}
+	defer func() {
+		// The lock is the session's, so it must be released before the
+		// connection returns to the pool.
+		_, _ = conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, int64(migrationLockID))
+	}()
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return false, err
+	}
+	if slices.Contains(applied, version) == wantApplied {
+		return false, nil
+	}
+	return true, fn(conn)
+}
+
+// execEach runs script's statements one at a time: several statements sent
+// together share an implicit transaction.
+func execEach(ctx context.Context, conn pgxSession, script string) error {
+	for _, stmt := range strings.Split(script, ";") {
+		if strings.TrimSpace(stripSQLComments(stmt)) == "" {
+			continue
+		}
+		if _, err := conn.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stripSQLComments(sql string) string {
+	lines := strings.Split(sql, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func appliedVersions(ctx context.Context, tx pgxSession) ([]int64, error) {
+	rows, err := tx.Query(ctx, `SELECT version FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []int64
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		out = append(out, version)
+	}
+	return out, rows.Err()
+}
+
+// Up applies every pending migration and returns how many ran.
+func (m *migrator) Up(ctx context.Context) (int, error) {
+	n := 0
+	for {
+		var next *migration
+		err := m.step(ctx, func(tx pgx.Tx, applied []int64) error {
+			for i := range m.migrations {
+				if !slices.Contains(applied, m.migrations[i].Version) {
+					next = &m.migrations[i]
+					break
+				}
+			}
+			if next == nil || next.UpNoTx {
+				return nil
+			}
+			if _, err := tx.Exec(ctx, next.Up); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", next.Version, next.Name, err)
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, next.Version, next.Name)
+			return err
+		})
+		if err != nil || next == nil {
+			return n, err
+		}
+		if next.UpNoTx {
+			ran, err := m.outsideTx(ctx, next.Version, true, func(conn pgxSession) error {
+				if err := execEach(ctx, conn, next.Up); err != nil {
+					return fmt.Errorf("migration %d_%s: %w", next.Version, next.Name, err)
+				}
+				_, err := conn.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, next.Version, next.Name)
+				return err
+			})
+			if err != nil {
+				return n, err
+			}
+			if !ran {
+				continue
+			}
+		}
+		log.Printf("migration %d_%s applied", next.Version, next.Name)
+		n++
+	}
+}
+
+// Down rolls back the latest steps applied migrations and returns how many
+// ran.
+func (m *migrator) Down(ctx context.Context, steps int) (int, error) {
+	n := 0
+	for ; n < steps; n++ {
+		var last *migration
+		err := m.step(ctx, func(tx pgx.Tx, applied []int64) error {
+			if len(applied) == 0 {
+				return nil
+			}
+			version := applied[len(applied)-1]
+			for i := range m.migrations {
+				if m.migrations[i].Version == version {
+					last = &m.migrations[i]
+				}
+			}
+			if last == nil {
+				return fmt.Errorf("migration %d: %w", version, errUnknownMigration)
+			}
+			if last.DownNoTx {
+				return nil
+			}
+			if _, err := tx.Exec(ctx, last.Down); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", last.Version, last.Name, err)
+			}
+			_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, version)
+			return err
+		})
+		if err != nil || last == nil {
+			return n, err
+		}
+		if last.DownNoTx {
+			ran, err := m.outsideTx(ctx, last.Version, false, func(conn pgxSession) error {
+				if err := execEach(ctx, conn, last.Down); err != nil {
+					return fmt.Errorf("migration %d_%s: %w", last.Version, last.Name, err)
+				}
+				_, err := conn.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, last.Version)
+				return err
+			})
+			if err != nil {
+				return n, err
+			}
+			if !ran {
+				// Rolled back elsewhere meanwhile; this step did nothing.
+				n--
+				continue
+			}
+		}
+		log.Printf("migration %d_%s rolled back", last.Version, last.Name)
+	}
+	return n, nil
+}
+
+// Status lists the known migrations with their applied time. It only reads,
+// so a database that was never migrated shows everything pending.
+func (m *migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied := make(map[int64]time.Time)
+	rows, err := m.pool.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &pgErr) && pgErr.Code == "42P01":
+		// undefined_table: nothing has been applied yet.
+	case err != nil:
+		return nil, err
+	default:
+		defer rows.Close()
+		for rows.Next() {
+			var version int64
+			var at time.Time
+			if err := rows.Scan(&version, &at); err != nil {
+				return nil, err
+			}
+			applied[version] = at
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		st := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if at, ok := applied[mig.Version]; ok {
+			st.AppliedAt = &at
+			delete(applied, mig.Version)
+		}
+		out = append(out, st)
+	}
+	// Versions applied by a newer build still show, without a name.
+	for version, at := range applied {
+		out = append(out, MigrationStatus{Version: version, AppliedAt: &at})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+func connectMigrationPool(ctx context.Context, dsn string) (pgxPool, error) {
+	return pgxpool.New(ctx, dsn)
+}
+
+// runMigrateCommand implements `gateway migrate up|down|status`.
+func runMigrateCommand(ctx context.Context, args []string, stdout io.Writer, connect func(context.Context, string) (pgxPool, error)) error {
+	if len(args) == 0 {
+		return errors.New("usage: gateway migrate up|down|status [flags]")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+	steps := fs.Int("steps", 1, "migrations to roll back (down only)")
+	dsn := fs.String("dsn", env("STORE_DSN", env("POSTGRES_DSN", defaultStoreDSN)), "postgres DSN")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if action != "up" && action != "down" && action != "status" {
+		return fmt.Errorf("unknown migrate action %q: want up, down or status", action)
+	}
+	if *steps < 1 {
+		return errors.New("-steps must be at least 1")
+	}
+	// SQLite files migrate themselves when opened; memory stores have no
+	// schema.
+	if scheme := storeScheme(*dsn); scheme != "postgres" && scheme != "postgresql" {
+		return fmt.Errorf("migrate only manages postgres, not %s DSNs", scheme)
+	}
+
+	pool, err := connect(ctx, *dsn)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	m, err := newMigrator(pool)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		n, err := m.Up(ctx)
+		fmt.Fprintf(stdout, "%d migration(s) applied\n", n)
+		return err
+	case "down":
+		n, err := m.Down(ctx, *steps)
+		fmt.Fprintf(stdout, "%d migration(s) rolled back\n", n)
+		return err
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, st := range statuses {
+		applied := "pending"
+		if st.AppliedAt != nil {
+			applied = st.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", st.Version, st.Name, applied)
+	}
+	return w.Flush()
+}
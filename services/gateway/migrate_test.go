@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v3"
+)
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	migrations, err := embeddedMigrations()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) || m.Up == "" || m.Down == "" {
+			t.Fatalf("migrations must be numbered from 1 without gaps, got %d_%s at %d", m.Version, m.Name, i)
+		}
+	}
+	if len(migrations) == 0 || !strings.Contains(migrations[0].Up, "CREATE TABLE IF NOT EXISTS users") {
+		t.Fatalf("expected the baseline schema first")
+	}
+	if len(migrations) < 2 || !migrations[1].UpNoTx || !strings.Contains(migrations[1].Up, "CONCURRENTLY") {
+		t.Fatalf("expected the index migration to build concurrently outside a transaction")
+	}
+}
+
+func TestLoadMigrationsRejectsBadFiles(t *testing.T) {
+	for name, fsys := range map[string]fstest.MapFS{
+		"missing down": {"0001_a.up.sql": {Data: []byte("x")}},
+		"bad name":     {"first.up.sql": {Data: []byte("x")}, "first.down.sql": {Data: []byte("x")}},
+		"bad suffix":   {"0001_a.sideways.sql": {Data: []byte("x")}},
+		"two names":    {"0001_a.up.sql": {Data: []byte("x")}, "0001_b.down.sql": {Data: []byte("x")}},
+	} {
+		if _, err := loadMigrations(fsys); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func expectMigrationStep(mock pgxmock.PgxPoolIface, applied ...int64) {
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs(int64(migrationLockID)).WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	rows := pgxmock.NewRows([]string{"version"})
+	for _, v := range applied {
+		rows.AddRow(v)
+	}
+	mock.ExpectQuery("SELECT version FROM schema_migrations").WillReturnRows(rows)
+}
+
+func TestMigratorUpAppliesPending(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+	m, _ := newMigrator(mock)
+	m.migrations = []migration{
+		{Version: 1, Name: "initial", Up: "CREATE TABLE a", Down: "DROP TABLE a"},
+		{Version: 2, Name: "extra", Up: "CREATE INDEX b", Down: "DROP INDEX b"},
+	}
+
+	expectMigrationStep(mock, 1)
+	mock.ExpectExec("CREATE INDEX b").WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(int64(2), "extra").WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit()
+	expectMigrationStep(mock, 1, 2)
+	mock.ExpectCommit()
+
+	if n, err := m.Up(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected one migration applied, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
+func TestMigratorUpStopsOnFailure(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+	m, _ := newMigrator(mock)
+	m.migrations = []migration{{Version: 1, Name: "initial", Up: "CREATE TABLE a", Down: "DROP TABLE a"}}
+
+	expectMigrationStep(mock)
+	mock.ExpectExec("CREATE TABLE a").WillReturnError(errors.New("boom"))
+	mock.ExpectRollback()
+
+	if n, err := m.Up(context.Background()); err == nil || n != 0 || !strings.Contains(err.Error(), "1_initial") {
+		t.Fatalf("expected failure naming the migration, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
+func TestMigratorUpOutsideTransaction(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+	m, _ := newMigrator(mock)
+	m.acquire = func(context.Context) (pgxSession, func(), error) { return mock, func() {}, nil }
+	m.migrations = []migration{
+		{Version: 1, Name: "initial", Up: "CREATE TABLE a", Down: "DROP TABLE a"},
+		{Version: 2, Name: "extra", Up: noTransactionHeader + "\nCREATE INDEX CONCURRENTLY b;\nCREATE INDEX CONCURRENTLY c;\n", Down: "DROP INDEX b", UpNoTx: true},
+	}
+
+	expectMigrationStep(mock, 1)
+	mock.ExpectCommit()
+	mock.ExpectExec("pg_advisory_lock").WithArgs(int64(migrationLockID)).WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mock.ExpectQuery("SELECT version FROM schema_migrations").WillReturnRows(pgxmock.NewRows([]string{"version"}).AddRow(int64(1)))
+	mock.ExpectExec("CREATE INDEX CONCURRENTLY b").WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	mock.ExpectExec("CREATE INDEX CONCURRENTLY c").WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(int64(2), "extra").WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec("pg_advisory_unlock").WithArgs(int64(migrationLockID)).WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	expectMigrationStep(mock, 1, 2)
+	mock.ExpectCommit()
+
+	if n, err := m.Up(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected one migration applied, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+
+	// Another replica applying it while this one waited for the lock is not
+	// an error, and the migration does not run twice.
+	expectMigrationStep(mock, 1)
+	mock.ExpectCommit()
+	mock.ExpectExec("pg_advisory_lock").WithArgs(int64(migrationLockID)).WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mock.ExpectQuery("SELECT version FROM schema_migrations").WillReturnRows(pgxmock.NewRows([]string{"version"}).AddRow(int64(1)).AddRow(int64(2)))
+	mock.ExpectExec("pg_advisory_unlock").WithArgs(int64(migrationLockID)).WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	expectMigrationStep(mock, 1, 2)
+	mock.ExpectCommit()
+	if n, err := m.Up(context.Background()); err != nil || n != 0 {
+		t.Fatalf("expected nothing applied, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
+func TestMigratorDown(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+	m, _ := newMigrator(mock)
+	m.migrations = []migration{
+		{Version: 1, Name: "initial", Up: "CREATE TABLE a", Down: "DROP TABLE a"},
+		{Version: 2, Name: "extra", Up: "CREATE INDEX b", Down: "DROP INDEX b"},
+	}
+
+	expectMigrationStep(mock, 1, 2)
+	mock.ExpectExec("DROP INDEX b").WillReturnResult(pgxmock.NewResult("DROP", 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(int64(2)).WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mock.ExpectCommit()
+	expectMigrationStep(mock, 1)
+	mock.ExpectExec("DROP TABLE a").WillReturnResult(pgxmock.NewResult("DROP", 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(int64(1)).WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mock.ExpectCommit()
+	expectMigrationStep(mock)
+	mock.ExpectCommit()
+
+	if n, err := m.Down(context.Background(), 5); err != nil || n != 2 {
+		t.Fatalf("expected two rolled back, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+
+	// A version this build does not know cannot be rolled back.
+	expectMigrationStep(mock, 9)
+	mock.ExpectRollback()
+	if _, err := m.Down(context.Background(), 1); !errors.Is(err, errUnknownMigration) {
+		t.Fatalf("expected unknown migration, got %v", err)
+	}
+}
+
+func TestMigrateStatusCommand(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+	connect := func(context.Context, string) (pgxPool, error) { return mock, nil }
+
+	applied := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+		WillReturnRows(pgxmock.NewRows([]string{"version", "applied_at"}).AddRow(int64(1), applied))
+	mock.ExpectClose()
+	var stdout bytes.Buffer
+	if err := runMigrateCommand(context.Background(), []string{"status", "-dsn", "x"}, &stdout, connect); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) < 3 || strings.Join(strings.Fields(lines[1]), " ") != "0001 initial 2026-01-02T03:04:05Z" || strings.Join(strings.Fields(lines[2]), " ") != "0002 indexes pending" {
+		t.Fatalf("unexpected status output:\n%s", stdout.String())
+	}
+
+	// A database that was never migrated shows everything pending.
+	mock, _ = pgxmock.NewPool()
+	defer mock.Close()
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").WillReturnError(&pgconn.PgError{Code: "42P01"})
+	m, _ := newMigrator(mock)
+	statuses, err := m.Status(context.Background())
+	if err != nil || len(statuses) == 0 || statuses[0].AppliedAt != nil {
+		t.Fatalf("expected all pending, got %+v %v", statuses, err)
+	}
+}
+
+func TestMigrateCommandRejectsBadArgs(t *testing.T) {
+	connect := func(context.Context, string) (pgxPool, error) {
+		t.Fatalf("must not connect")
+		return nil, nil
+	}
+	for _, args := range [][]string{nil, {"sideways"}, {"down", "-steps", "0"}, {"up", "-dsn", "sqlite:///tmp/storm.db"}} {
+		if err := runMigrateCommand(context.Background(), args, &bytes.Buffer{}, connect); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
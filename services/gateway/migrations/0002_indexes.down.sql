@@ -0,0 +1,5 @@
+-- migrate:no-transaction
+DROP INDEX CONCURRENTLY IF EXISTS scheduled_messages_user_idx;
+DROP INDEX CONCURRENTLY IF EXISTS scheduled_messages_due_idx;
+DROP INDEX CONCURRENTLY IF EXISTS messages_created_at_idx;
+DROP INDEX CONCURRENTLY IF EXISTS messages_channel_id_id_idx;
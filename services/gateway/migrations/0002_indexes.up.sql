@@ -0,0 +1,12 @@
+-- migrate:no-transaction
+-- Built concurrently so startup migrations do not block message writes. A
+-- failed build leaves an INVALID index that IF NOT EXISTS would keep, and
+-- startup retries this file on its own, so each index is dropped first.
+DROP INDEX CONCURRENTLY IF EXISTS messages_channel_id_id_idx;
+CREATE INDEX CONCURRENTLY messages_channel_id_id_idx ON messages (channel_id, id);
+DROP INDEX CONCURRENTLY IF EXISTS messages_created_at_idx;
+CREATE INDEX CONCURRENTLY messages_created_at_idx ON messages (created_at);
+DROP INDEX CONCURRENTLY IF EXISTS scheduled_messages_due_idx;
+CREATE INDEX CONCURRENTLY scheduled_messages_due_idx ON scheduled_messages (deliver_at) WHERE status = 'pending';
+DROP INDEX CONCURRENTLY IF EXISTS scheduled_messages_user_idx;
+CREATE INDEX CONCURRENTLY scheduled_messages_user_idx ON scheduled_messages (user_id, deliver_at);
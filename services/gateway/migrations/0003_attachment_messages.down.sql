@@ -0,0 +1 @@
+ALTER TABLE attachments DROP COLUMN IF EXISTS message_id;
@@ -0,0 +1,3 @@
+-- Attachments are linked to the message that references them. No foreign
+-- key: retention deletes messages and archived ones keep their id.
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS message_id BIGINT NULL;
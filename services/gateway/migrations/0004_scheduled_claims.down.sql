@@ -0,0 +1,2 @@
+UPDATE scheduled_messages SET status = 'pending' WHERE status = 'sending';
+ALTER TABLE scheduled_messages DROP COLUMN IF EXISTS claimed_until;
@@ -0,0 +1,4 @@
+-- Due items are claimed as 'sending' until claimed_until, and only marked
+-- 'sent' once delivered; a claim whose dispatcher died is retried after it
+-- expires.
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ NULL;
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS subject_schemas;
+DROP TABLE IF EXISTS leader_leases;
+DROP TABLE IF EXISTS scheduled_messages;
+DROP TABLE IF EXISTS messages_archive;
+DROP TABLE IF EXISTS attachments;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS channel_members;
+DROP TABLE IF EXISTS channels;
+DROP TABLE IF EXISTS users;
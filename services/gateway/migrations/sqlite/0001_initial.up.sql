@@ -0,0 +1,93 @@
+-- Timestamps are unix nanoseconds. AUTOINCREMENT keeps ids from being
+-- reused after a purge, as BIGSERIAL does, so read markers stay valid.
+
+CREATE TABLE IF NOT EXISTS users (
+  id TEXT PRIMARY KEY,
+  password_hash TEXT NOT NULL DEFAULT '',
+  display_name TEXT NOT NULL DEFAULT '',
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS channels (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL UNIQUE,
+  created_by TEXT NOT NULL REFERENCES users(id),
+  created_at INTEGER NOT NULL,
+  retention_seconds INTEGER NULL,
+  moderation BLOB NULL
+);
+
+CREATE TABLE IF NOT EXISTS channel_members (
+  channel_id INTEGER NOT NULL REFERENCES channels(id),
+  user_id TEXT NOT NULL REFERENCES users(id),
+  last_read_message_id INTEGER NOT NULL DEFAULT 0,
+  created_at INTEGER NOT NULL,
+  PRIMARY KEY (channel_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  channel_id INTEGER NULL REFERENCES channels(id),
+  user_id TEXT NULL REFERENCES users(id),
+  subject TEXT NOT NULL,
+  payload BLOB NOT NULL,
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS attachments (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  channel_id INTEGER NOT NULL REFERENCES channels(id),
+  user_id TEXT NOT NULL REFERENCES users(id),
+  filename TEXT NOT NULL,
+  content_type TEXT NOT NULL,
+  size_bytes INTEGER NOT NULL,
+  storage_key TEXT NOT NULL,
+  thumbnail_key TEXT NOT NULL DEFAULT '',
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS messages_archive (
+  id INTEGER PRIMARY KEY,
+  channel_id INTEGER NULL,
+  user_id TEXT NULL,
+  subject TEXT NOT NULL,
+  payload BLOB NOT NULL,
+  created_at INTEGER NOT NULL,
+  archived_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id TEXT NOT NULL REFERENCES users(id),
+  channel_id INTEGER NULL REFERENCES channels(id),
+  payload BLOB NOT NULL,
+  deliver_at INTEGER NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending',
+  sent_at INTEGER NULL,
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS leader_leases (
+  name TEXT PRIMARY KEY,
+  holder TEXT NOT NULL,
+  expires_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS subject_schemas (
+  subject TEXT PRIMARY KEY,
+  schema TEXT NOT NULL,
+  updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+  token TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users(id),
+  expires_at INTEGER NOT NULL,
+  revoked INTEGER NOT NULL DEFAULT 0,
+  created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS messages_channel_id_id_idx ON messages (channel_id, id);
+CREATE INDEX IF NOT EXISTS messages_created_at_idx ON messages (created_at);
+CREATE INDEX IF NOT EXISTS scheduled_messages_due_idx ON scheduled_messages (deliver_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS scheduled_messages_user_idx ON scheduled_messages (user_id, deliver_at);
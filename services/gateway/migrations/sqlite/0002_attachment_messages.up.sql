@@ -0,0 +1 @@
+ALTER TABLE attachments ADD COLUMN message_id INTEGER NULL;
@@ -0,0 +1 @@
+ALTER TABLE scheduled_messages ADD COLUMN claimed_until INTEGER NULL;
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricModerationDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "storm_moderation_decisions_total",
+	Help: "Moderation filter decisions other than allow, by filter, action and ingress path",
+}, []string{"filter", "action", "ingress"})
+
+const (
+	// moderationSubjectPrefix carries moderation reports, which may quote
+	// private channels. Clients cannot address it directly.
+	moderationSubjectPrefix = "moderation."
+	// moderationFlaggedSubject receives flagged messages for human review.
+	moderationFlaggedSubject = moderationSubjectPrefix + "flagged"
+	// defaultModerationCacheTTL bounds how long other replicas keep serving a
+	// channel's old filters after it is changed.
+	defaultModerationCacheTTL = 30 * time.Second
+)
+
+// ModerationAction is what a filter decided to do with a message.
+type ModerationAction int
+
+const (
+	ModerationAllow ModerationAction = iota
+	ModerationFlag
+	ModerationRedact
+	ModerationReject
+)
+
+func (a ModerationAction) String() string {
+	switch a {
+	case ModerationFlag:
+		return "flag"
+	case ModerationRedact:
+		return "redact"
+	case ModerationReject:
+		return "reject"
+	default:
+		return "allow"
+	}
+}
+
+func parseModerationAction(raw string) (ModerationAction, error) {
+	switch raw {
+	case "flag":
+		return ModerationFlag, nil
+	case "redact":
+		return ModerationRedact, nil
+	case "reject", "":
+		return ModerationReject, nil
+	default:
+		return ModerationAllow, fmt.Errorf("unknown moderation action %q", raw)
+	}
+}
+
+// ModerationVerdict is a single filter's decision. Payload holds the rewritten
+// message when Action is ModerationRedact.
+type ModerationVerdict struct {
+	Action  ModerationAction
+	Payload []byte
+	Reason  string
+}
+
+// ModerationFilter inspects one inbound payload.
+type ModerationFilter interface {
+	Name() string
+	Moderate(payload []byte) ModerationVerdict
+}
+
+// ModerationConfig is the JSON form of a filter chain, used both for the
+// global MODERATION_CONFIG and per-channel overrides. SlowModeSeconds only
+// applies per channel: the minimum gap between one user's messages there.
+type ModerationConfig struct {
+	Filters         []FilterConfig `json:"filters"`
+	SlowModeSeconds int            `json:"slow_mode_seconds,omitempty"`
+}
+
+// FilterConfig describes one filter. Type is words, regex, links or max_mentions.
+type FilterConfig struct {
+	Type         string   `json:"type"`
+	Action       string   `json:"action,omitempty"`
+	Words        []string `json:"words,omitempty"`
+	Pattern      string   `json:"pattern,omitempty"`
+	AllowDomains []string `json:"allow_domains,omitempty"`
+	Max          int      `json:"max,omitempty"`
+}
+
+// ModerationPipeline applies filters in order. Redactions feed into later
+// filters, a rejection stops the chain, and flags accumulate.
+type ModerationPipeline struct {
+	filters []ModerationFilter
+}
+
+// ModerationResult is the outcome of running a pipeline.
+type ModerationResult struct {
+	Action  ModerationAction
+	Payload []byte
+	Filter  string
+	Reason  string
+	Flags   []string
+}
+
+// NewModerationPipeline compiles cfg; it fails on unknown filter types or bad patterns.
+func NewModerationPipeline(cfg ModerationConfig) (*ModerationPipeline, error) {
+	p := &ModerationPipeline{}
+	for i, fc := range cfg.Filters {
+		action, err := parseModerationAction(fc.Action)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i, err)
+		}
+		var f ModerationFilter
+		switch fc.Type {
+		case "words":
+			f, err = newWordListFilter(fc.Words, action)
+		case "regex":
+			f, err = newRegexFilter(fc.Pattern, action)
+		case "links":
+			f = &linkFilter{allow: fc.AllowDomains, action: action}
+		case "max_mentions":
+			switch {
+			case fc.Max < 0:
+				err = errors.New("max must be >= 0")
+			case action == ModerationRedact:
+				err = errors.New("max_mentions cannot redact")
+			}
+			f = &maxMentionsFilter{max: fc.Max, action: action}
+		default:
+			err = fmt.Errorf("unknown filter type %q", fc.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i, err)
+		}
+		p.filters = append(p.filters, f)
+	}
+	return p, nil
+}
+
+// Run applies the pipeline to payload. A nil pipeline allows everything.
+func (p *ModerationPipeline) Run(payload []byte) ModerationResult {
+	res := ModerationResult{Action: ModerationAllow, Payload: payload}
+	if p == nil {
+		return res
+	}
+	for _, f := range p.filters {
+		v := f.Moderate(res.Payload)
+		switch v.Action {
+		case ModerationReject:
+			return ModerationResult{Action: ModerationReject, Payload: res.Payload, Filter: f.Name(), Reason: v.Reason, Flags: res.Flags}
+		case ModerationRedact:
+			res.Payload = v.Payload
+			if res.Action < ModerationRedact {
+				res.Action = ModerationRedact
+			}
+			res.Filter, res.Reason = f.Name(), v.Reason
+		case ModerationFlag:
+			res.Flags = append(res.Flags, f.Name()+": "+v.Reason)
+			if res.Action < ModerationFlag {
+				res.Action = ModerationFlag
+				res.Filter, res.Reason = f.Name(), v.Reason
+			}
+		}
+	}
+	return res
+}
+
+// patternFilter matches a regexp; word lists are compiled down to one.
+type patternFilter struct {
+	name   string
+	re     *regexp.Regexp
+	action ModerationAction
+	reason string
+}
+
+func newWordListFilter(words []string, action ModerationAction) (ModerationFilter, error) {
+	var quoted []string
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil, errors.New("words required")
+	}
+	re := regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	return &patternFilter{name: "words", re: re, action: action, reason: "blocked word"}, nil
+}
+
+func newRegexFilter(pattern string, action ModerationAction) (ModerationFilter, error) {
+	if pattern == "" {
+		return nil, errors.New("pattern required")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &patternFilter{name: "regex", re: re, action: action, reason: "matched blocked pattern"}, nil
+}
+
+func (f *patternFilter) Name() string { return f.name }
+
+func (f *patternFilter) Moderate(payload []byte) ModerationVerdict {
+	if !f.re.Match(payload) {
+		return ModerationVerdict{Action: ModerationAllow}
+	}
+	if f.action != ModerationRedact {
+		return ModerationVerdict{Action: f.action, Reason: f.reason}
+	}
+	redacted := f.re.ReplaceAllFunc(payload, func(m []byte) []byte {
+		return bytes.Repeat([]byte("*"), len([]rune(string(m))))
+	})
+	return ModerationVerdict{Action: ModerationRedact, Payload: redacted, Reason: f.reason}
+}
+
+var linkRe = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s"'<>\\]+`)
+
+// linkFilter blocks links whose host is not in (a subdomain of) allow.
+type linkFilter struct {
+	allow  []string
+	action ModerationAction
+}
+
+func (f *linkFilter) Name() string { return "links" }
+
+func (f *linkFilter) allowed(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range f.allow {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *linkFilter) Moderate(payload []byte) ModerationVerdict {
+	blocked := false
+	redacted := linkRe.ReplaceAllFunc(payload, func(m []byte) []byte {
+		if f.allowed(string(m)) {
+			return m
+		}
+		blocked = true
+		return []byte("[link removed]")
+	})
+	if !blocked {
+		return ModerationVerdict{Action: ModerationAllow}
+	}
+	if f.action == ModerationRedact {
+		return ModerationVerdict{Action: ModerationRedact, Payload: redacted, Reason: "link not allowed"}
+	}
+	return ModerationVerdict{Action: f.action, Reason: "link not allowed"}
+}
+
+var mentionRe = regexp.MustCompile(`(?:^|[^\w@])@[\w.-]+`)
+
+type maxMentionsFilter struct {
+	max    int
+	action ModerationAction
+}
+
+func (f *maxMentionsFilter) Name() string { return "max_mentions" }
+
+func (f *maxMentionsFilter) Moderate(payload []byte) ModerationVerdict {
+	if n := len(mentionRe.FindAll(payload, -1)); n > f.max {
+		return ModerationVerdict{Action: f.action, Reason: fmt.Sprintf("too many mentions (%d > %d)", n, f.max)}
+	}
+	return ModerationVerdict{Action: ModerationAllow}
+}
+
+// moderationConfigFromEnv reads the global chain from MODERATION_CONFIG
+// (inline JSON) or the file named by MODERATION_CONFIG_FILE.
+func moderationConfigFromEnv() (ModerationConfig, error) {
+	var cfg ModerationConfig
+	raw := []byte(os.Getenv("MODERATION_CONFIG"))
+	if path := os.Getenv("MODERATION_CONFIG_FILE"); len(raw) == 0 && path != "" {
+		data, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return cfg, fmt.Errorf("read moderation config: %w", err)
+		}
+		raw = data
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return cfg, nil
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse moderation config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Moderator resolves the pipeline for a message: the global chain followed by
+// the channel's own filters. Channel chains are cached for ttl.
+type Moderator struct {
+	store  Store
+	nc     NatsClient
+	global ModerationConfig
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[int64]cachedPipeline
+}
+
+type cachedPipeline struct {
+	pipeline *ModerationPipeline
+	slowMode time.Duration
+	expires  time.Time
+}
+
+// NewModerator validates the global chain up front.
+func NewModerator(store Store, nc NatsClient, global ModerationConfig, ttl time.Duration) (*Moderator, error) {
+	if _, err := NewModerationPipeline(global); err != nil {
+		return nil, err
+	}
+	return &Moderator{store: store, nc: nc, global: global, ttl: ttl, cache: make(map[int64]cachedPipeline)}, nil
+}
+
+func (m *Moderator) pipeline(ctx context.Context, channelID int64) (*ModerationPipeline, error) {
+	cached, err := m.load(ctx, channelID)
+	return cached.pipeline, err
+}
+
+// load returns the channel's cached settings, refreshing them from the store
+// once they expire.
+func (m *Moderator) load(ctx context.Context, channelID int64) (cachedPipeline, error) {
+	m.mu.Lock()
+	cached, ok := m.cache[channelID]
+	m.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	cfg := ModerationConfig{Filters: append([]FilterConfig(nil), m.global.Filters...)}
+	if channelID != 0 && m.store != nil {
+		raw, err := m.store.GetModerationConfig(ctx, channelID)
+		if err != nil && !isPgNotFound(err) {
+			return cachedPipeline{}, err
+		}
+		if len(raw) > 0 {
+			var channelCfg ModerationConfig
+			if err := json.Unmarshal(raw, &channelCfg); err != nil {
+				return cachedPipeline{}, err
+			}
+			cfg.Filters = append(cfg.Filters, channelCfg.Filters...)
+			cfg.SlowModeSeconds = channelCfg.SlowModeSeconds
+		}
+	}
+	p, err := NewModerationPipeline(cfg)
+	if err != nil {
+		return cachedPipeline{}, err
+	}
+	cached = cachedPipeline{pipeline: p, slowMode: time.Duration(cfg.SlowModeSeconds) * time.Second, expires: time.Now().Add(m.ttl)}
+	m.mu.Lock()
+	m.cache[channelID] = cached
+	m.mu.Unlock()
+	return cached, nil
+}
+
+// SlowMode returns the minimum gap between one user's messages in a channel,
+// or 0 when the channel has no slow mode or its config cannot be loaded.
+func (m *Moderator) SlowMode(ctx context.Context, channelID int64) time.Duration {
+	if m == nil || channelID == 0 {
+		return 0
+	}
+	cached, err := m.load(ctx, channelID)
+	if err != nil {
+		log.Printf("moderation config for channel %d failed: %v", channelID, err)
+		return 0
+	}
+	return cached.slowMode
+}
+
+// Invalidate drops the cached chain for a channel after its config changes.
+func (m *Moderator) Invalidate(channelID int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.cache, channelID)
+	m.mu.Unlock()
+}
+
+// Check moderates one message from userID arriving on ingress (ws, publish or
+// rest). A nil Moderator allows everything. If the channel config cannot be
+// loaded the global chain still applies.
+func (m *Moderator) Check(ctx context.Context, ingress string, channelID int64, userID string, payload []byte) ModerationResult {
+	if m == nil {
+		return ModerationResult{Action: ModerationAllow, Payload: payload}
+	}
+	p, err := m.pipeline(ctx, channelID)
+	if err != nil {
+		log.Printf("moderation config for channel %d failed: %v", channelID, err)
+		p, _ = NewModerationPipeline(m.global)
+	}
+	res := p.Run(payload)
+	if res.Action == ModerationAllow {
+		return res
+	}
+	metricModerationDecisions.WithLabelValues(res.Filter, res.Action.String(), ingress).Inc()
+	if res.Action == ModerationFlag && m.nc != nil {
+		report, _ := json.Marshal(map[string]any{
+			"channel_id": channelID,
+			"user_id":    userID,
+			"ingress":    ingress,
+			"flags":      res.Flags,
+			"payload":    string(res.Payload),
+		})
+		if err := m.nc.Publish(moderationFlaggedSubject, report); err != nil {
+			log.Printf("publish moderation flag failed: %v", err)
+		}
+	}
+	return res
+}
+
+// moderationRejection is the body sent back to a sender whose message was rejected.
+type moderationRejection struct {
+	Type   string `json:"type"`
+	Code   string `json:"code"`
+	Filter string `json:"filter"`
+	Reason string `json:"reason"`
+}
+
+func newModerationRejection(res ModerationResult) moderationRejection {
+	return moderationRejection{Type: "error", Code: "moderation_rejected", Filter: res.Filter, Reason: res.Reason}
+}
+
+// channelFromSubject maps "channels.<id>" back to its channel, or 0.
+func channelFromSubject(subject string) int64 {
+	raw, ok := strings.CutPrefix(subject, "channels.")
+	if !ok {
+		return 0
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id <= 0 {
+		return 0
+	}
+	return id
+}
+
+// moderationConfigHandler serves GET/PUT /channels/{id}/moderation. Only the
+// channel owner or an admin may change the filters.
+func moderationConfigHandler(store Store, auth AuthConfig, moderator *Moderator) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if store == nil {
+			http.Error(w, "store not configured", http.StatusServiceUnavailable)
+			return
+		}
+		channelID, err := parseID(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "invalid channel id", http.StatusBadRequest)
+			return
+		}
+		channel, err := store.GetChannel(req.Context(), channelID)
+		if err != nil {
+			http.Error(w, "channel not found", http.StatusNotFound)
+			return
+		}
+
+		if req.Method == http.MethodGet {
+			raw, err := store.GetModerationConfig(req.Context(), channelID)
+			if err != nil && !isPgNotFound(err) {
+				http.Error(w, "get moderation failed", http.StatusInternalServerError)
+				return
+			}
+			cfg := ModerationConfig{Filters: []FilterConfig{}}
+			if len(raw) > 0 {
+				if err := json.Unmarshal(raw, &cfg); err != nil {
+					http.Error(w, "stored moderation config is invalid", http.StatusInternalServerError)
+					return
+				}
+			}
+			writeJSON(w, http.StatusOK, cfg)
+			return
+		}
+
+		userID := userFromContext(req.Context())
+		if channel.CreatedBy != userID && !auth.IsAdmin(userID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var cfg ModerationConfig
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodyBytes)).Decode(&cfg); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		if _, err := NewModerationPipeline(cfg); err != nil {
+			http.Error(w, "invalid moderation config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg.SlowModeSeconds < 0 {
+			http.Error(w, "invalid moderation config: slow_mode_seconds must be >= 0", http.StatusBadRequest)
+			return
+		}
+		raw, _ := json.Marshal(cfg)
+		if err := store.SetModerationConfig(req.Context(), channelID, raw); err != nil {
+			log.Printf("set moderation failed: %v", err)
+			http.Error(w, "set moderation failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		moderator.Invalidate(channelID)
+		writeJSON(w, http.StatusOK, cfg)
+	}
+}
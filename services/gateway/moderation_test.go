@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func mustPipeline(t *testing.T, filters ...FilterConfig) *ModerationPipeline {
+	t.Helper()
+	p, err := NewModerationPipeline(ModerationConfig{Filters: filters})
+	if err != nil {
+		t.Fatalf("pipeline: %v", err)
+	}
+	return p
+}
+
+func TestModerationPipelineFilters(t *testing.T) {
+	cases := []struct {
+		name    string
+		filter  FilterConfig
+		payload string
+		action  ModerationAction
+		out     string
+	}{
+		{"words redact", FilterConfig{Type: "words", Action: "redact", Words: []string{"darn"}}, `{"message":"well DARN it"}`, ModerationRedact, `{"message":"well **** it"}`},
+		{"words ignore substrings", FilterConfig{Type: "words", Words: []string{"ass"}}, "classic", ModerationAllow, "classic"},
+		{"regex reject", FilterConfig{Type: "regex", Pattern: `\d{4}-\d{4}-\d{4}-\d{4}`}, "card 1234-5678-9012-3456", ModerationReject, ""},
+		{"links allowlisted", FilterConfig{Type: "links", AllowDomains: []string{"example.com"}}, "see https://docs.example.com/x", ModerationAllow, "see https://docs.example.com/x"},
+		{"links redact", FilterConfig{Type: "links", Action: "redact"}, "go to www.spam.test now", ModerationRedact, "go to [link removed] now"},
+		{"mentions under limit", FilterConfig{Type: "max_mentions", Max: 2}, "@a @b mail@host", ModerationAllow, "@a @b mail@host"},
+		{"mentions over limit", FilterConfig{Type: "max_mentions", Max: 2}, "@a @b @c", ModerationReject, ""},
+		{"flag", FilterConfig{Type: "words", Action: "flag", Words: []string{"scam"}}, "not a scam", ModerationFlag, "not a scam"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := mustPipeline(t, tc.filter).Run([]byte(tc.payload))
+			if res.Action != tc.action {
+				t.Fatalf("expected %s, got %s (%s)", tc.action, res.Action, res.Reason)
+			}
+			if tc.action != ModerationReject && string(res.Payload) != tc.out {
+				t.Fatalf("unexpected payload %q", res.Payload)
+			}
+		})
+	}
+}
+
+func TestModerationPipelineOrder(t *testing.T) {
+	p := mustPipeline(t,
+		FilterConfig{Type: "words", Action: "flag", Words: []string{"heck"}},
+		FilterConfig{Type: "words", Action: "redact", Words: []string{"darn"}},
+		// Runs on the redacted payload, so it must not fire.
+		FilterConfig{Type: "regex", Pattern: "darn"},
+	)
+	res := p.Run([]byte("heck, darn"))
+	if res.Action != ModerationRedact || string(res.Payload) != "heck, ****" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if len(res.Flags) != 1 || !strings.HasPrefix(res.Flags[0], "words") {
+		t.Fatalf("expected flag to be kept, got %v", res.Flags)
+	}
+
+	p = mustPipeline(t,
+		FilterConfig{Type: "max_mentions", Max: 0},
+		FilterConfig{Type: "words", Action: "redact", Words: []string{"darn"}},
+	)
+	if res := p.Run([]byte("@bob darn")); res.Action != ModerationReject || res.Filter != "max_mentions" {
+		t.Fatalf("expected reject to stop the chain, got %+v", res)
+	}
+}
+
+func TestModerationPipelineInvalidConfig(t *testing.T) {
+	for _, fc := range []FilterConfig{
+		{Type: "nope"},
+		{Type: "words"},
+		{Type: "regex", Pattern: "("},
+		{Type: "words", Words: []string{"x"}, Action: "shout"},
+		{Type: "max_mentions", Max: -1},
+		{Type: "max_mentions", Action: "redact"},
+	} {
+		if _, err := NewModerationPipeline(ModerationConfig{Filters: []FilterConfig{fc}}); err == nil {
+			t.Fatalf("expected error for %+v", fc)
+		}
+	}
+}
+
+func TestModerationConfigFromEnv(t *testing.T) {
+	t.Setenv("MODERATION_CONFIG", `{"filters":[{"type":"links"}]}`)
+	cfg, err := moderationConfigFromEnv()
+	if err != nil || len(cfg.Filters) != 1 || cfg.Filters[0].Type != "links" {
+		t.Fatalf("unexpected config %+v (%v)", cfg, err)
+	}
+	t.Setenv("MODERATION_CONFIG", "{")
+	if _, err := moderationConfigFromEnv(); err == nil {
+		t.Fatalf("expected parse error")
+	}
+}
+
+func TestChannelModerationRoutes(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	_ = store.EnsureUser(context.Background(), "bob")
+	own, _ := store.CreateChannel(context.Background(), "mine", "user-1")
+	other, _ := store.CreateChannel(context.Background(), "theirs", "bob")
+	nc := newFakeNats()
+	r := NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	ownPath := "/channels/" + strconv.FormatInt(own.ID, 10)
+
+	cfg := `{"filters":[{"type":"words","action":"redact","words":["darn"]},{"type":"links"}]}`
+	if w := do(http.MethodPut, ownPath+"/moderation", cfg); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPut, ownPath+"/moderation", `{"filters":[{"type":"regex","pattern":"("}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/channels/"+strconv.FormatInt(other.ID, 10)+"/moderation", cfg); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	w := do(http.MethodGet, ownPath+"/moderation", "")
+	var got ModerationConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got.Filters) != 2 {
+		t.Fatalf("unexpected config %s (%v)", w.Body.String(), err)
+	}
+
+	w = do(http.MethodPost, ownPath+"/messages", `{"message":"darn it"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	msgs, _ := store.ListMessages(context.Background(), own.ID, 10)
+	if len(msgs) != 1 || msgs[0].Payload != `{"message":"**** it"}` {
+		t.Fatalf("expected redacted message, got %+v", msgs)
+	}
+
+	w = do(http.MethodPost, ownPath+"/messages", `{"message":"https://spam.test"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", w.Code)
+	}
+	var rejection moderationRejection
+	if err := json.Unmarshal(w.Body.Bytes(), &rejection); err != nil || rejection.Code != "moderation_rejected" || rejection.Filter != "links" {
+		t.Fatalf("unexpected rejection %s", w.Body.String())
+	}
+	if msgs, _ := store.ListMessages(context.Background(), own.ID, 10); len(msgs) != 1 {
+		t.Fatalf("rejected message must not be stored")
+	}
+	if len(nc.published) != 1 {
+		t.Fatalf("rejected message must not be published, got %d publishes", len(nc.published))
+	}
+}
+
+func TestPublishGlobalModeration(t *testing.T) {
+	nc := newFakeNats()
+	moderator, err := NewModerator(nil, nc, ModerationConfig{Filters: []FilterConfig{
+		{Type: "words", Words: []string{"spam"}},
+		{Type: "words", Action: "flag", Words: []string{"maybe"}},
+	}}, time.Minute)
+	if err != nil {
+		t.Fatalf("moderator: %v", err)
+	}
+	r := NewRouter(nc, nil, nil, AuthConfig{Secret: []byte("test"), Enabled: true}, WithModerator(moderator))
+
+	publish := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/publish?subject=storm.events", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := publish("buy spam"); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", code)
+	}
+	if code := publish("maybe fine"); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	subjects := make([]string, 0, len(nc.published))
+	for _, p := range nc.published {
+		subjects = append(subjects, p.subject)
+	}
+	if strings.Join(subjects, ",") != moderationFlaggedSubject+",storm.events" {
+		t.Fatalf("unexpected publishes %v", subjects)
+	}
+}
+
+func TestWebSocketModerationRejection(t *testing.T) {
+	store := newMemStore()
+	_, _ = store.CreateUser(context.Background(), "user-1", "pass", "User One")
+	chanRec, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	_ = store.SetModerationConfig(context.Background(), chanRec.ID, []byte(`{"filters":[{"type":"max_mentions","max":1}]}`))
+
+	nc := newFakeNats()
+	server := httptest.NewServer(NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+	t.Cleanup(server.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?channel_id=" + strconv.FormatInt(chanRec.ID, 10)
+	header := http.Header{}
+	header.Set("Cookie", "access_token="+testToken(t, "test"))
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("@a @b")); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ws read: %v", err)
+	}
+	var rejection moderationRejection
+	if err := json.Unmarshal(msg, &rejection); err != nil || rejection.Filter != "max_mentions" {
+		t.Fatalf("unexpected notice %q", msg)
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if len(nc.published) != 0 {
+		t.Fatalf("rejected frame must not be published")
+	}
+}
+
+func TestChannelFromSubject(t *testing.T) {
+	if channelFromSubject("channels.42") != 42 || channelFromSubject("storm.events") != 0 || channelFromSubject("channels.x") != 0 {
+		t.Fatalf("unexpected channel mapping")
+	}
+}
+
+func TestModerationSubjectReserved(t *testing.T) {
+	nc := newFakeNats()
+	r := NewRouter(nc, nil, nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+	for _, target := range []string{"POST /publish", "GET /ws", "GET /events", "GET /poll"} {
+		method, path, _ := strings.Cut(target, " ")
+		req := httptest.NewRequest(method, path+"?subject="+moderationFlaggedSubject, strings.NewReader("forged report"))
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", target, w.Code)
+		}
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if len(nc.published) != 0 || len(nc.subjectCh) != 0 {
+		t.Fatalf("reserved subject must not be published or subscribed")
+	}
+}
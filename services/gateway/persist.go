@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricPersistBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "storm_persist_batch_size",
+		Help:    "Histogram of the number of messages written per batch",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250, 500},
+	})
+	metricPersistFlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "storm_persist_flush_duration_seconds",
+		Help:    "Histogram of batch write latencies",
+		Buckets: prometheus.DefBuckets,
+	})
+	metricPersistFailedRows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storm_persist_failed_rows_total",
+		Help: "The total number of messages a batch write could not save",
+	})
+)
+
+const (
+	defaultPersistBatchSize = 100
+	defaultPersistMaxWait   = 10 * time.Millisecond
+	// flushBatchSize is used by the shutdown flush, which has no latency to
+	// protect and always fills its batches.
+	flushBatchSize = 500
+)
+
+// BatchConfig controls how workers coalesce queued messages into a single
+// write. A batch is flushed when it holds Size tasks or MaxWait after its
+// first task arrived, whichever comes first.
+type BatchConfig struct {
+	Size    int
+	MaxWait time.Duration
+}
+
+// StartWorkerPool persists queued tasks until ctx is cancelled. The returned
+// channel closes once every worker has written its current batch, after
+// which FlushTaskQueue can drain the rest.
+func StartWorkerPool(ctx context.Context, store Store, queue *WriteQueue, numWorkers int, batch BatchConfig) <-chan struct{} {
+	if batch.Size < 1 {
+		batch.Size = 1
+	}
+	log.Printf("starting message worker pool with %d workers, batches of up to %d", numWorkers, batch.Size)
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case task := <-asyncTaskQueue:
+					tasks := collectBatch(ctx, task, batch)
+					metricSaveQueueLen.Set(float64(len(asyncTaskQueue)))
+					if err := runTasks(context.Background(), store, queue, tasks); err != nil {
+						log.Printf("worker %d: %v", id, err)
+					}
+				}
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// collectBatch gathers more tasks behind first until the batch is full,
+// MaxWait has passed, or ctx ends.
+func collectBatch(ctx context.Context, first asyncTask, cfg BatchConfig) []asyncTask {
+	tasks := []asyncTask{first}
+	if cfg.Size <= 1 {
+		return tasks
+	}
+	timer := time.NewTimer(cfg.MaxWait)
+	defer timer.Stop()
+	for len(tasks) < cfg.Size {
+		select {
+		case task := <-asyncTaskQueue:
+			tasks = append(tasks, task)
+		case <-timer.C:
+			return tasks
+		case <-ctx.Done():
+			return tasks
+		}
+	}
+	return tasks
+}
+
+// runTasks writes the channel messages in tasks as one batch. Failed rows
+// go back to queue for another attempt; each done callback gets its
+// message's final outcome.
+func runTasks(ctx context.Context, store Store, queue *WriteQueue, tasks []asyncTask) error {
+	var pending []PendingMessage
+	var saves []asyncTask
+	for _, task := range tasks {
+		switch task.taskType {
+		case taskSaveMessage:
+			pending = append(pending, PendingMessage{ChannelID: task.channelID, UserID: task.userID, Payload: task.payload})
+			saves = append(saves, task)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	msgs, errs := store.SaveChannelMessages(ctx, pending)
+	metricPersistFlushDuration.Observe(time.Since(start).Seconds())
+	metricPersistBatchSize.Observe(float64(len(pending)))
+
+	failed := 0
+	var firstErr error
+	for i, task := range saves {
+		if errs[i] == nil {
+			queue.saved(task)
+		} else {
+			failed++
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			if queue.retry(task, errs[i]) {
+				continue
+			}
+		}
+		if task.done != nil {
+			task.done(msgs[i], errs[i])
+		}
+	}
+	if failed > 0 {
+		metricPersistFailedRows.Add(float64(failed))
+		return fmt.Errorf("store message failed for %d of %d rows: %w", failed, len(pending), firstErr)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type batchRecordingStore struct {
+	*memStore
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (s *batchRecordingStore) SaveChannelMessages(ctx context.Context, batch []PendingMessage) ([]Message, []error) {
+	s.mu.Lock()
+	s.sizes = append(s.sizes, len(batch))
+	s.mu.Unlock()
+	return s.memStore.SaveChannelMessages(ctx, batch)
+}
+
+func TestCollectBatchFlushesBySizeOrTime(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		asyncTaskQueue <- asyncTask{taskType: taskSaveMessage}
+	}
+	t.Cleanup(func() {
+		for len(asyncTaskQueue) > 0 {
+			<-asyncTaskQueue
+		}
+	})
+
+	if tasks := collectBatch(context.Background(), <-asyncTaskQueue, BatchConfig{Size: 3, MaxWait: time.Minute}); len(tasks) != 3 {
+		t.Fatalf("expected a full batch of 3, got %d", len(tasks))
+	}
+	start := time.Now()
+	tasks := collectBatch(context.Background(), <-asyncTaskQueue, BatchConfig{Size: 10, MaxWait: 20 * time.Millisecond})
+	if len(tasks) != 1 || time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("expected a partial batch after the wait, got %d in %s", len(tasks), time.Since(start))
+	}
+}
+
+func TestRunTasksReportsPerRowOutcome(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "alice")
+	channel, _ := store.CreateChannel(context.Background(), "general", "alice")
+
+	outcomes := make([]error, 3)
+	var saved []Message
+	tasks := make([]asyncTask, 0, 3)
+	for i, ch := range []int64{channel.ID, channel.ID + 99, channel.ID} {
+		tasks = append(tasks, asyncTask{taskType: taskSaveMessage, channelID: ch, userID: "alice", payload: []byte("x"), done: func(msg Message, err error) {
+			outcomes[i] = err
+			if err == nil {
+				saved = append(saved, msg)
+			}
+		}})
+	}
+	err := runTasks(context.Background(), store, nil, tasks)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3") {
+		t.Fatalf("expected one failed row reported, got %v", err)
+	}
+	if outcomes[0] != nil || outcomes[1] == nil || outcomes[2] != nil || len(saved) != 2 || saved[0].ID == 0 {
+		t.Fatalf("expected each sender told its own outcome, got %v %+v", outcomes, saved)
+	}
+}
+
+func TestWorkerPoolWritesOneBatch(t *testing.T) {
+	store := &batchRecordingStore{memStore: newMemStore()}
+	_ = store.EnsureUser(context.Background(), "alice")
+	channel, _ := store.CreateChannel(context.Background(), "general", "alice")
+
+	var wg sync.WaitGroup
+	for _, p := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		asyncTaskQueue <- asyncTask{taskType: taskSaveMessage, channelID: channel.ID, userID: "alice", payload: []byte(p), done: func(Message, error) { wg.Done() }}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := StartWorkerPool(ctx, store, nil, 1, BatchConfig{Size: 3, MaxWait: time.Second})
+	wg.Wait()
+	cancel()
+	<-done
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.sizes) != 1 || store.sizes[0] != 3 {
+		t.Fatalf("expected a single batch of 3, got %v", store.sizes)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricPresenceFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storm_presence_heartbeat_failures_total",
+		Help: "Presence heartbeats and leaves that failed to reach the presence store",
+	})
+	metricPresenceEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "storm_presence_events_total",
+		Help: "Presence transitions published, by status (online, away, offline, joined, left)",
+	}, []string{"status"})
+)
+
+const (
+	defaultPresenceHeartbeat = 20 * time.Second
+	defaultPresenceTTL       = time.Minute
+	defaultPresenceDebounce  = 5 * time.Second
+	defaultPresenceAwayAfter = 5 * time.Minute
+
+	// presenceSubjectPrefix carries users' global transitions, on
+	// presence.users.<id>. Clients cannot address it directly.
+	presenceSubjectPrefix = "presence."
+
+	typePresence    = "presence"
+	presenceOnline  = "online"
+	presenceAway    = "away"
+	presenceOffline = "offline"
+	presenceJoined  = "joined"
+	presenceLeft    = "left"
+)
+
+// presenceUserSubject carries a user's online, away and offline transitions.
+func presenceUserSubject(userID string) string {
+	return presenceSubjectPrefix + "users." + userID
+}
+
+// UserPresence is a user's global online status. LastSeen is the last
+// heartbeat or disconnect of any of their connections; Away is set when
+// every connection has been idle for the away threshold.
+type UserPresence struct {
+	UserID   string     `json:"user_id"`
+	Online   bool       `json:"online"`
+	Away     bool       `json:"away,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// PresenceEvent is one presence transition. Channel events (joined, left,
+// and the away and online changes of users in the channel) go out on
+// channelEventsSubject, global ones on presenceUserSubject.
+type PresenceEvent struct {
+	Type      string `json:"type"`
+	Status    string `json:"status"`
+	ChannelID int64  `json:"channel_id,omitempty"`
+	UserID    string `json:"user_id"`
+}
+
+// parsePresenceEvent decodes a presence message from channelEventsSubject.
+func parsePresenceEvent(data []byte) (PresenceEvent, bool) {
+	var ev PresenceEvent
+	if err := json.Unmarshal(data, &ev); err != nil || ev.UserID == "" {
+		return PresenceEvent{}, false
+	}
+	return ev, ev.Type == typePresence
+}
+
+// PresenceConfig sets how often connections heartbeat and how long a
+// heartbeat keeps them online. A connection whose gateway dies drops out
+// after TTL. Leaving is only announced once Debounce has passed without the
+// user coming back, and a user whose connections have all been idle for
+// AwayAfter is away.
+type PresenceConfig struct {
+	Heartbeat time.Duration
+	TTL       time.Duration
+	Debounce  time.Duration
+	AwayAfter time.Duration
+}
+
+func (c PresenceConfig) withDefaults() PresenceConfig {
+	if c.Heartbeat <= 0 {
+		c.Heartbeat = defaultPresenceHeartbeat
+	}
+	if c.TTL <= c.Heartbeat {
+		c.TTL = 3 * c.Heartbeat
+	}
+	if c.Debounce <= 0 {
+		c.Debounce = defaultPresenceDebounce
+	}
+	if c.AwayAfter <= 0 {
+		c.AwayAfter = defaultPresenceAwayAfter
+	}
+	return c
+}
+
+// WithPresenceConfig overrides the default presence timings.
+func WithPresenceConfig(cfg PresenceConfig) RouterOption {
+	return func(o *routerOptions) {
+		o.presenceCfg = cfg
+	}
+}
+
+// presenceBeat heartbeats one connection's presence until stopped and
+// announces the transitions it causes. Other connections of the same user,
+// on any replica, are seen through the presence store, so a user's tabs
+// collapse into one state: only the first to arrive announces them and only
+// the last to leave, after the debounce, announces them gone. A nil
+// presenceBeat, for unauthenticated connections or without a presence
+// store, does nothing.
+type presenceBeat struct {
+	nc       NatsClient
+	presence Presence
+	cfg      PresenceConfig
+	userID   string
+	connID   string
+	channels func() []int64
+	touched  chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	// lastActive is the UnixNano of the last inbound frame.
+	lastActive atomic.Int64
+
+	// unannounced is set while the user's coming online has not reached
+	// any channel yet, as the connection may subscribe after its first
+	// beat. Only beat touches it.
+	unannounced bool
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	away    bool
+	joined  map[int64]bool
+}
+
+// startPresence marks the connection online in the channels it reports and
+// keeps it there with a heartbeat every cfg.Heartbeat.
+func startPresence(nc NatsClient, presence Presence, cfg PresenceConfig, userID, connID string, channels func() []int64) *presenceBeat {
+	if presence == nil || userID == "" {
+		return nil
+	}
+	b := &presenceBeat{
+		nc:       nc,
+		presence: presence,
+		cfg:      cfg.withDefaults(),
+		userID:   userID,
+		connID:   connID,
+		channels: channels,
+		touched:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		joined:   make(map[int64]bool),
+	}
+	b.lastActive.Store(time.Now().UnixNano())
+	b.beat()
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+func (b *presenceBeat) publish(subject string, ev PresenceEvent) {
+	ev.Type, ev.UserID = typePresence, b.userID
+	data, _ := json.Marshal(ev)
+	if err := b.nc.Publish(subject, data); err != nil {
+		log.Printf("presence publish failed: %v", err)
+		return
+	}
+	metricPresenceEvents.WithLabelValues(ev.Status).Inc()
+}
+
+// status reads the user's state across all their connections. Errors read
+// as unknown, which announces nothing.
+func (b *presenceBeat) status(ctx context.Context) (UserPresence, bool) {
+	status, err := b.presence.Status(ctx, b.userID)
+	if err != nil {
+		log.Printf("presence status failed: %v", err)
+		return status, false
+	}
+	return status, true
+}
+
+// inChannel reports whether any of the user's connections is in channelID.
+func (b *presenceBeat) inChannel(ctx context.Context, channelID int64) (bool, bool) {
+	users, err := b.presence.Online(ctx, channelID)
+	if err != nil {
+		log.Printf("presence online failed: %v", err)
+		return false, false
+	}
+	return slices.Contains(users, b.userID), true
+}
+
+func (b *presenceBeat) beat() {
+	ctx, cancel := context.WithTimeout(context.Background(), b.cfg.Heartbeat)
+	defer cancel()
+	channels := b.channels()
+	away := time.Since(time.Unix(0, b.lastActive.Load())) > b.cfg.AwayAfter
+
+	b.mu.Lock()
+	first := !b.started
+	awayChanged := away != b.away
+	var fresh []int64
+	for _, channelID := range channels {
+		if !b.joined[channelID] {
+			fresh = append(fresh, channelID)
+		}
+	}
+	b.mu.Unlock()
+
+	// What the user's other connections already show decides what this
+	// one announces.
+	var before UserPresence
+	known := true
+	if first || awayChanged {
+		before, known = b.status(ctx)
+	}
+	var joins []int64
+	for _, channelID := range fresh {
+		if present, ok := b.inChannel(ctx, channelID); ok && !present {
+			joins = append(joins, channelID)
+		}
+	}
+	if err := b.presence.Heartbeat(ctx, b.userID, b.connID, channels, b.cfg.TTL, away); err != nil {
+		metricPresenceFailures.Inc()
+		log.Printf("presence heartbeat failed: %v", err)
+		return
+	}
+
+	b.mu.Lock()
+	b.started, b.away = true, away
+	for _, channelID := range fresh {
+		b.joined[channelID] = true
+	}
+	b.mu.Unlock()
+
+	// Global transitions also go to the channels, the only subjects sockets
+	// can follow.
+	if first && known && !before.Online {
+		b.publish(presenceUserSubject(b.userID), PresenceEvent{Status: presenceOnline})
+		b.unannounced = true
+	}
+	if b.unannounced && len(channels) > 0 {
+		b.unannounced = false
+		for _, channelID := range channels {
+			b.publish(channelEventsSubject(channelID), PresenceEvent{Status: presenceOnline, ChannelID: channelID})
+		}
+	}
+	for _, channelID := range joins {
+		b.publish(channelEventsSubject(channelID), PresenceEvent{Status: presenceJoined, ChannelID: channelID})
+	}
+	if !first && awayChanged && known {
+		if after, ok := b.status(ctx); ok && after.Away != before.Away {
+			status := presenceOnline
+			if after.Away {
+				status = presenceAway
+			}
+			b.publish(presenceUserSubject(b.userID), PresenceEvent{Status: status})
+			for _, channelID := range channels {
+				b.publish(channelEventsSubject(channelID), PresenceEvent{Status: status, ChannelID: channelID})
+			}
+		}
+	}
+}
+
+func (b *presenceBeat) run() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.cfg.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		case <-b.touched:
+		}
+		b.beat()
+	}
+}
+
+// touch heartbeats now, so a channel the connection just joined lists it
+// without waiting for the next tick.
+func (b *presenceBeat) touch() {
+	if b == nil {
+		return
+	}
+	select {
+	case b.touched <- struct{}{}:
+	default:
+	}
+}
+
+// active records an inbound frame. A connection that was away comes back at
+// once rather than on the next tick.
+func (b *presenceBeat) active() {
+	if b == nil {
+		return
+	}
+	b.lastActive.Store(time.Now().UnixNano())
+	b.mu.Lock()
+	away := b.away
+	b.mu.Unlock()
+	if away {
+		b.touch()
+	}
+}
+
+// leave takes the connection out of a channel it stopped following, once
+// the debounce has passed without it coming back.
+func (b *presenceBeat) leave(channelID int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if b.stopped || !b.joined[channelID] {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.joined, channelID)
+	b.mu.Unlock()
+	time.AfterFunc(b.cfg.Debounce, func() {
+		b.mu.Lock()
+		rejoined := b.joined[channelID]
+		b.mu.Unlock()
+		if rejoined {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), b.cfg.Heartbeat)
+		defer cancel()
+		if err := b.presence.Leave(ctx, b.userID, b.connID, []int64{channelID}); err != nil {
+			metricPresenceFailures.Inc()
+			log.Printf("presence leave failed: %v", err)
+			return
+		}
+		if present, ok := b.inChannel(ctx, channelID); ok && !present {
+			b.publish(channelEventsSubject(channelID), PresenceEvent{Status: presenceLeft, ChannelID: channelID})
+		}
+	})
+}
+
+// stop ends the heartbeat and, after the debounce, takes the connection
+// offline everywhere. A user who reconnected in the meantime is still
+// online through the new connection and nothing is announced.
+func (b *presenceBeat) stop() {
+	if b == nil {
+		return
+	}
+	b.stopOnce.Do(func() {
+		close(b.done)
+		b.wg.Wait()
+		b.mu.Lock()
+		b.stopped = true
+		channels := make([]int64, 0, len(b.joined))
+		for channelID := range b.joined {
+			channels = append(channels, channelID)
+		}
+		b.mu.Unlock()
+		time.AfterFunc(b.cfg.Debounce, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), b.cfg.Heartbeat)
+			defer cancel()
+			if err := b.presence.Disconnect(ctx, b.userID, b.connID, channels); err != nil {
+				metricPresenceFailures.Inc()
+				log.Printf("presence disconnect failed: %v", err)
+				return
+			}
+			for _, channelID := range channels {
+				if present, ok := b.inChannel(ctx, channelID); ok && !present {
+					b.publish(channelEventsSubject(channelID), PresenceEvent{Status: presenceLeft, ChannelID: channelID})
+				}
+			}
+			if status, ok := b.status(ctx); ok && !status.Online {
+				b.publish(presenceUserSubject(b.userID), PresenceEvent{Status: presenceOffline})
+				for _, channelID := range channels {
+					b.publish(channelEventsSubject(channelID), PresenceEvent{Status: presenceOffline, ChannelID: channelID})
+				}
+			}
+		})
+	})
+}
+
+// channelPresenceHandler serves GET /channels/{id}/presence.
+func channelPresenceHandler(presence Presence) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if presence == nil {
+			http.Error(w, "presence not configured", http.StatusServiceUnavailable)
+			return
+		}
+		channelID, err := parseID(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "invalid channel id", http.StatusBadRequest)
+			return
+		}
+		users, err := presence.Online(req.Context(), channelID)
+		if err != nil {
+			http.Error(w, "presence failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"channel_id": channelID, "users": users})
+	}
+}
+
+// userPresenceHandler serves GET /users/{id}/presence.
+func userPresenceHandler(presence Presence) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if presence == nil {
+			http.Error(w, "presence not configured", http.StatusServiceUnavailable)
+			return
+		}
+		status, err := presence.Status(req.Context(), chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "presence failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
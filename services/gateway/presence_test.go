@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func newTestPresence(t *testing.T) Presence {
+	t.Helper()
+	srv := miniredis.RunT(t)
+	pres, err := NewRedisPresence(context.Background(), srv.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("presence: %v", err)
+	}
+	t.Cleanup(func() { _ = pres.Close() })
+	return pres
+}
+
+func TestPresenceRoutes(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	_ = store.EnsureMember(context.Background(), channel.ID, "user-1")
+	pres := newTestPresence(t)
+	router := NewRouter(newFakeNats(), store, pres, AuthConfig{Secret: []byte("test"), Enabled: true}, WithPresenceConfig(PresenceConfig{Debounce: 10 * time.Millisecond}))
+
+	get := func(path string, out any) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, w.Code, w.Body.String())
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), out)
+	}
+	channelPath := "/channels/" + strconv.FormatInt(channel.ID, 10) + "/presence"
+
+	conn := dialMultiplexed(t, router)
+	if env := roundTrip(t, conn, wsEnvelope{Type: "subscribe", ID: "1", ChannelID: channel.ID}); env.Type != "subscribed" {
+		t.Fatalf("unexpected subscribe reply %+v", env)
+	}
+	var online struct {
+		Users []string `json:"users"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(online.Users) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		get(channelPath, &online)
+	}
+	if !slices.Equal(online.Users, []string{"user-1"}) {
+		t.Fatalf("expected user-1 online in channel, got %v", online.Users)
+	}
+	var status UserPresence
+	if get("/users/user-1/presence", &status); !status.Online {
+		t.Fatalf("expected user-1 online, got %+v", status)
+	}
+
+	_ = conn.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for status.Online && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		get("/users/user-1/presence", &status)
+	}
+	if status.Online || status.LastSeen == nil {
+		t.Fatalf("expected user-1 offline with last seen, got %+v", status)
+	}
+	get(channelPath, &online)
+	if len(online.Users) != 0 {
+		t.Fatalf("expected channel empty after disconnect, got %v", online.Users)
+	}
+}
+
+func TestPresenceTransitionsCollapseTabs(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("nats connect: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	transitions := make(chan *nats.Msg, 64)
+	if _, err := nc.ChanSubscribe(presenceSubjectPrefix+">", transitions); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	store := newMemStore()
+	ctx := context.Background()
+	_ = store.EnsureUser(ctx, "user-1")
+	_ = store.EnsureUser(ctx, "bob")
+	channel, _ := store.CreateChannel(ctx, "general", "bob")
+	_ = store.EnsureMember(ctx, channel.ID, "bob")
+	_ = store.EnsureMember(ctx, channel.ID, "user-1")
+	auth := AuthConfig{Secret: []byte("test"), Enabled: true}
+	router := NewRouter(NewNatsAdapter(nc), store, newTestPresence(t), auth, WithPresenceConfig(PresenceConfig{Debounce: 100 * time.Millisecond}))
+
+	bobToken, _ := signToken(auth.Secret, "bob", time.Hour)
+	bob := dialWithToken(t, router, "mode=multiplex", bobToken)
+	subscribe := func(conn *websocket.Conn) {
+		t.Helper()
+		if env := roundTrip(t, conn, wsEnvelope{Type: "subscribe", ID: "s", ChannelID: channel.ID}); env.Type != "subscribed" {
+			t.Fatalf("unexpected subscribe reply %+v", env)
+		}
+	}
+	subscribe(bob)
+
+	tabA := dialMultiplexed(t, router)
+	subscribe(tabA)
+	if env := readEnvelope(t, bob); env.Type != typePresence || env.Status != presenceOnline || env.UserID != "user-1" || env.ChannelID != channel.ID {
+		t.Fatalf("expected user-1 online, got %+v", env)
+	}
+	if env := readEnvelope(t, bob); env.Type != typePresence || env.Status != presenceJoined || env.UserID != "user-1" || env.ChannelID != channel.ID {
+		t.Fatalf("expected user-1 joined, got %+v", env)
+	}
+
+	// A second tab, and the first one closing, change nothing for bob.
+	tabB := dialMultiplexed(t, router)
+	subscribe(tabB)
+	_ = tabA.Close()
+	time.Sleep(300 * time.Millisecond)
+	_ = tabB.Close()
+	if env := readEnvelope(t, bob); env.Type != typePresence || env.Status != presenceLeft || env.UserID != "user-1" {
+		t.Fatalf("expected user-1 left, got %+v", env)
+	}
+	if env := readEnvelope(t, bob); env.Type != typePresence || env.Status != presenceOffline || env.UserID != "user-1" {
+		t.Fatalf("expected user-1 offline, got %+v", env)
+	}
+
+	var statuses []string
+	deadline := time.After(2 * time.Second)
+	for len(statuses) < 2 {
+		select {
+		case msg := <-transitions:
+			if ev, ok := parsePresenceEvent(msg.Data); ok && ev.UserID == "user-1" {
+				statuses = append(statuses, ev.Status)
+			}
+		case <-deadline:
+			t.Fatalf("expected online and offline, got %v", statuses)
+		}
+	}
+	if !slices.Equal(statuses, []string{presenceOnline, presenceOffline}) {
+		t.Fatalf("expected one online and one offline for user-1, got %v", statuses)
+	}
+	select {
+	case msg := <-transitions:
+		if ev, _ := parsePresenceEvent(msg.Data); ev.UserID == "user-1" {
+			t.Fatalf("unexpected extra transition %s", msg.Data)
+		}
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var (
+	metricRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "storm_rate_limited_total",
+		Help: "Messages refused by inbound rate limits, by route (ws, publish, messages) and scope (connection, user, slow_mode)",
+	}, []string{"route", "scope"})
+	metricRateLimitDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storm_rate_limit_disconnects_total",
+		Help: "Sockets closed for ignoring rate limit warnings",
+	})
+)
+
+const (
+	defaultUserRate       = 10
+	defaultUserBurst      = 20
+	defaultConnRate       = 5
+	defaultConnBurst      = 10
+	defaultMaxWarnings    = 3
+	rateLimitWarnWindow   = 10 * time.Second
+	closeRateLimited      = 4029
+	codeRateLimited       = "rate_limited"
+	scopeConnection       = "connection"
+	scopeUser             = "user"
+	scopeSlowMode         = "slow_mode"
+	slowModePruneInterval = time.Minute
+)
+
+// RateLimitConfig sets the inbound message limits. Rates are messages per
+// second; the user bucket is shared by a user's sockets, /publish and
+// POST /channels/{id}/messages, the connection bucket by one socket's sends.
+type RateLimitConfig struct {
+	UserRate  int
+	UserBurst int
+	ConnRate  int
+	ConnBurst int
+	// MaxWarnings is how many refused sends within rateLimitWarnWindow a
+	// socket is warned about; the next one disconnects it.
+	MaxWarnings int
+}
+
+// RateLimits enforces RateLimitConfig and per-channel slow mode, read from
+// the channel's moderation config through moderator; without a moderator
+// there is no slow mode. A nil RateLimits allows everything.
+type RateLimits struct {
+	cfg       RateLimitConfig
+	users     *rateLimiter
+	moderator *Moderator
+
+	mu        sync.Mutex
+	lastSend  map[slowModeKey]slowModeSend
+	lastPrune time.Time
+}
+
+type slowModeKey struct {
+	channelID int64
+	userID    string
+}
+
+// slowModeSend is a user's last message in a channel and the slow mode gap
+// in force when it was sent, which bounds how long it needs remembering.
+type slowModeSend struct {
+	at  time.Time
+	gap time.Duration
+}
+
+// NewRateLimits applies defaults to unset fields of cfg.
+func NewRateLimits(cfg RateLimitConfig, moderator *Moderator) *RateLimits {
+	if cfg.UserRate <= 0 {
+		cfg.UserRate = defaultUserRate
+	}
+	if cfg.UserBurst <= 0 {
+		cfg.UserBurst = defaultUserBurst
+	}
+	if cfg.ConnRate <= 0 {
+		cfg.ConnRate = defaultConnRate
+	}
+	if cfg.ConnBurst <= 0 {
+		cfg.ConnBurst = defaultConnBurst
+	}
+	if cfg.MaxWarnings <= 0 {
+		cfg.MaxWarnings = defaultMaxWarnings
+	}
+	return &RateLimits{
+		cfg:       cfg,
+		users:     newRateLimiter(rate.Limit(cfg.UserRate), cfg.UserBurst),
+		moderator: moderator,
+		lastSend:  make(map[slowModeKey]slowModeSend),
+		lastPrune: time.Now(),
+	}
+}
+
+// WithRateLimits turns on inbound rate limiting for sockets and message routes.
+func WithRateLimits(l *RateLimits) RouterOption {
+	return func(o *routerOptions) {
+		o.limits = l
+	}
+}
+
+// rateRefusal says which limit refused a message and when to retry.
+type rateRefusal struct {
+	scope      string
+	retryAfter time.Duration
+}
+
+func refusal(scope string, r *rate.Reservation) *rateRefusal {
+	delay := r.Delay()
+	r.Cancel()
+	return &rateRefusal{scope: scope, retryAfter: delay}
+}
+
+// allow checks one message from key (a user, or a client address without
+// auth) against slow mode, conn (nil outside sockets) and the user bucket.
+// Tokens are only spent when every check passes. Under slow mode the whole
+// check holds l.mu, so one user's concurrent sockets cannot all slip through.
+func (l *RateLimits) allow(ctx context.Context, route string, conn *rate.Limiter, channelID int64, key string) *rateRefusal {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	slow := l.moderator.SlowMode(ctx, channelID)
+	sk := slowModeKey{channelID: channelID, userID: key}
+	if slow > 0 {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		last, ok := l.lastSend[sk]
+		if wait := slow - now.Sub(last.at); ok && wait > 0 {
+			metricRateLimited.WithLabelValues(route, scopeSlowMode).Inc()
+			return &rateRefusal{scope: scopeSlowMode, retryAfter: wait}
+		}
+	}
+	var connRes *rate.Reservation
+	if conn != nil {
+		if connRes = conn.ReserveN(now, 1); connRes.Delay() > 0 {
+			metricRateLimited.WithLabelValues(route, scopeConnection).Inc()
+			return refusal(scopeConnection, connRes)
+		}
+	}
+	if userRes := l.users.get(key).ReserveN(now, 1); userRes.Delay() > 0 {
+		if connRes != nil {
+			connRes.Cancel()
+		}
+		metricRateLimited.WithLabelValues(route, scopeUser).Inc()
+		return refusal(scopeUser, userRes)
+	}
+	if slow > 0 {
+		l.lastSend[sk] = slowModeSend{at: now, gap: slow}
+		l.pruneLocked(now)
+	}
+	return nil
+}
+
+// pruneLocked forgets slow mode sends whose gap has passed. It runs at most
+// once per slowModePruneInterval.
+func (l *RateLimits) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < slowModePruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for k, send := range l.lastSend {
+		if now.Sub(send.at) > send.gap {
+			delete(l.lastSend, k)
+		}
+	}
+}
+
+// limitKey identifies the sender for the user bucket.
+func limitKey(req *http.Request) string {
+	if userID := userFromContext(req.Context()); userID != "" {
+		return userID
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// allowRequest applies the limits to a REST message and answers 429 when
+// they refuse it.
+func (l *RateLimits) allowRequest(w http.ResponseWriter, req *http.Request, route string, channelID int64) bool {
+	refused := l.allow(req.Context(), route, nil, channelID, limitKey(req))
+	if refused == nil {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(refused.retryAfter.Round(time.Second)/time.Second)+1))
+	writeJSON(w, http.StatusTooManyRequests, map[string]any{
+		"type":           "error",
+		"code":           codeRateLimited,
+		"scope":          refused.scope,
+		"retry_after_ms": refused.retryAfter.Milliseconds(),
+	})
+	return false
+}
+
+// sendGuard limits one socket's sends: its own bucket, the user's, and slow
+// mode. Refusals are warnings until the socket collects more than
+// MaxWarnings of them within rateLimitWarnWindow.
+type sendGuard struct {
+	limits *RateLimits
+	key    string
+	bucket *rate.Limiter
+
+	mu      sync.Mutex
+	strikes int
+	since   time.Time
+}
+
+// guard returns the socket's sendGuard, or nil when limits are off.
+func (l *RateLimits) guard(req *http.Request) *sendGuard {
+	if l == nil {
+		return nil
+	}
+	return &sendGuard{limits: l, key: limitKey(req), bucket: rate.NewLimiter(rate.Limit(l.cfg.ConnRate), l.cfg.ConnBurst)}
+}
+
+// check returns nil when the send may go ahead. Otherwise it reports the
+// refusal and whether the socket is out of warnings.
+func (g *sendGuard) check(ctx context.Context, channelID int64) (*rateRefusal, bool) {
+	if g == nil {
+		return nil, false
+	}
+	refused := g.limits.allow(ctx, "ws", g.bucket, channelID, g.key)
+	if refused == nil {
+		return nil, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if now.Sub(g.since) > rateLimitWarnWindow {
+		g.strikes, g.since = 0, now
+	}
+	g.strikes++
+	if g.strikes > g.limits.cfg.MaxWarnings {
+		metricRateLimitDisconnects.Inc()
+		return refused, true
+	}
+	return refused, false
+}
+
+// rateLimitedFrame is the warning sent for a refused socket send.
+func rateLimitedFrame(id string, channelID int64, refused *rateRefusal) wsEnvelope {
+	env := nackFrame(id, channelID, codeRateLimited, "slow down: "+refused.scope+" limit reached", nil)
+	env.Reason = refused.scope
+	env.RetryAfter = refused.retryAfter.Milliseconds()
+	return env
+}
+
+// rateLimitWarning is the warning for sockets that do not acknowledge sends.
+func rateLimitWarning(channelID int64, refused *rateRefusal) wsEnvelope {
+	env := rateLimitedFrame("", channelID, refused)
+	env.Type = "error"
+	return env
+}
+
+// disconnectFlooder closes a socket that kept sending through its warnings.
+func disconnectFlooder(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(closeRateLimited, "rate limit exceeded")
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	_ = conn.Close()
+}
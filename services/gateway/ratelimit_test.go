@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPublishRateLimited(t *testing.T) {
+	limits := NewRateLimits(RateLimitConfig{UserRate: 1, UserBurst: 2}, nil)
+	r := NewRouter(newFakeNats(), nil, nil, AuthConfig{Secret: []byte("test"), Enabled: true}, WithRateLimits(limits))
+
+	publish := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/publish?subject=storm.events", strings.NewReader(`{"msg":"hi"}`))
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := publish(); w.Code != http.StatusAccepted {
+			t.Fatalf("publish %d: expected 202, got %d", i, w.Code)
+		}
+	}
+	w := publish()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["code"] != codeRateLimited || body["scope"] != scopeUser {
+		t.Fatalf("unexpected body %s", w.Body.String())
+	}
+}
+
+func TestChannelSlowMode(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "slow", "user-1")
+	moderator, err := NewModerator(store, newFakeNats(), ModerationConfig{}, time.Minute)
+	if err != nil {
+		t.Fatalf("moderator: %v", err)
+	}
+	limits := NewRateLimits(RateLimitConfig{}, moderator)
+	r := NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}, WithModerator(moderator), WithRateLimits(limits))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	path := "/channels/" + strconv.FormatInt(channel.ID, 10)
+	if w := do(http.MethodPut, path+"/moderation", `{"slow_mode_seconds":-1}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for negative slow mode, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, path+"/moderation", `{"slow_mode_seconds":30}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPost, path+"/messages", `{"n":1}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	w := do(http.MethodPost, path+"/messages", `{"n":2}`)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), scopeSlowMode) {
+		t.Fatalf("expected slow mode refusal, got %d %s", w.Code, w.Body.String())
+	}
+	if retry, _ := strconv.Atoi(w.Header().Get("Retry-After")); retry < 29 || retry > 31 {
+		t.Fatalf("unexpected Retry-After %q", w.Header().Get("Retry-After"))
+	}
+	if w := do(http.MethodPost, "/publish?subject="+channelSubject(channel.ID), `{"n":3}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("slow mode should cover /publish on the channel, got %d", w.Code)
+	}
+}
+
+func slowModeLimits(t *testing.T, seconds int) (*RateLimits, int64) {
+	t.Helper()
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "slow", "user-1")
+	raw, _ := json.Marshal(ModerationConfig{SlowModeSeconds: seconds})
+	if err := store.SetModerationConfig(context.Background(), channel.ID, raw); err != nil {
+		t.Fatalf("set moderation: %v", err)
+	}
+	moderator, err := NewModerator(store, newFakeNats(), ModerationConfig{}, time.Minute)
+	if err != nil {
+		t.Fatalf("moderator: %v", err)
+	}
+	return NewRateLimits(RateLimitConfig{}, moderator), channel.ID
+}
+
+func TestSlowModeLongerThanPruneInterval(t *testing.T) {
+	limits, channelID := slowModeLimits(t, 120)
+	ctx := context.Background()
+	if refused := limits.allow(ctx, "test", nil, channelID, "alice"); refused != nil {
+		t.Fatalf("first send refused: %+v", refused)
+	}
+	// Ninety seconds later another send triggers a prune.
+	limits.mu.Lock()
+	key := slowModeKey{channelID: channelID, userID: "alice"}
+	send := limits.lastSend[key]
+	send.at = send.at.Add(-90 * time.Second)
+	limits.lastSend[key] = send
+	limits.lastPrune = time.Now().Add(-2 * slowModePruneInterval)
+	limits.mu.Unlock()
+	if refused := limits.allow(ctx, "test", nil, channelID, "bob"); refused != nil {
+		t.Fatalf("bob refused: %+v", refused)
+	}
+	refused := limits.allow(ctx, "test", nil, channelID, "alice")
+	if refused == nil || refused.scope != scopeSlowMode || refused.retryAfter < 29*time.Second {
+		t.Fatalf("expected alice still in slow mode, got %+v", refused)
+	}
+}
+
+func TestSlowModeConcurrentSends(t *testing.T) {
+	limits, channelID := slowModeLimits(t, 30)
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limits.allow(context.Background(), "test", nil, channelID, "alice") == nil {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != 1 {
+		t.Fatalf("expected one send through slow mode, got %d", got)
+	}
+}
+
+func TestSocketWarnedThenDisconnected(t *testing.T) {
+	limits := NewRateLimits(RateLimitConfig{ConnRate: 1, ConnBurst: 1, MaxWarnings: 1}, nil)
+	conn := dialMultiplexed(t, NewRouter(newFakeNats(), nil, nil, AuthConfig{Secret: []byte("test"), Enabled: true}, WithRateLimits(limits)))
+
+	if env := roundTrip(t, conn, wsEnvelope{Type: "send", ID: "1", Subject: "storm.events", Payload: "a"}); env.Type != "ack" {
+		t.Fatalf("expected ack, got %+v", env)
+	}
+	env := roundTrip(t, conn, wsEnvelope{Type: "send", ID: "2", Subject: "storm.events", Payload: "b"})
+	if env.Type != "nack" || env.ID != "2" || env.Code != codeRateLimited || env.Reason != scopeConnection || env.RetryAfter <= 0 {
+		t.Fatalf("expected rate_limited nack, got %+v", env)
+	}
+	if err := conn.WriteJSON(wsEnvelope{Type: "send", ID: "3", Subject: "storm.events", Payload: "c"}); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeRateLimited {
+		t.Fatalf("expected rate limit close, got %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricReauth = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "storm_ws_reauth_total",
+	Help: "In-band token refreshes on long-lived connections, by result (accepted, rejected, expired)",
+}, []string{"result"})
+
+const (
+	defaultReauthLead  = time.Minute
+	closeTokenExpired  = 4001
+	typeReauth         = "reauth"
+	typeReauthed       = "reauthed"
+	typeReauthRequired = "reauth_required"
+	codeInvalidToken   = "invalid_token"
+	codeUserMismatch   = "user_mismatch"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errUserMismatch = errors.New("token belongs to another user")
+)
+
+type ctxTokenExpiryKey struct{}
+
+// tokenExpiryFromContext returns when the request's access token expires, or
+// the zero time when auth is off or the token never expires.
+func tokenExpiryFromContext(ctx context.Context) time.Time {
+	exp, _ := ctx.Value(ctxTokenExpiryKey{}).(time.Time)
+	return exp
+}
+
+// parseAccessToken verifies an access token signed with cfg.Secret.
+func parseAccessToken(cfg AuthConfig, token string) (*jwt.RegisteredClaims, error) {
+	claims := &jwt.RegisteredClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return cfg.Secret, nil
+	})
+	if err != nil || !parsed.Valid || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+// tokenWatch enforces access token expiry on one long-lived connection. Ahead
+// of expiry it sends reauth_required; a fresh token for the same user pushes
+// expiry back, and without one expire runs when the token lapses.
+type tokenWatch struct {
+	auth   AuthConfig
+	store  Store
+	userID string
+	notify func(wsEnvelope)
+	expire func()
+
+	mu        sync.Mutex
+	expiresAt time.Time
+	timer     *time.Timer
+	// gen invalidates timers that fired while a new token arrived.
+	gen     int
+	stopped bool
+}
+
+// watchToken starts watching the request's token. It returns nil, which
+// watches nothing, when the connection is unauthenticated or never expires.
+func watchToken(req *http.Request, options routerOptions, store Store, notify func(wsEnvelope), expire func()) *tokenWatch {
+	exp := tokenExpiryFromContext(req.Context())
+	if !options.auth.Enabled || exp.IsZero() {
+		return nil
+	}
+	t := &tokenWatch{auth: options.auth, store: store, userID: userFromContext(req.Context()), notify: notify, expire: expire}
+	t.schedule(exp)
+	return t
+}
+
+func (t *tokenWatch) lead() time.Duration {
+	if t.auth.ReauthLead > 0 {
+		return t.auth.ReauthLead
+	}
+	return defaultReauthLead
+}
+
+// schedule arms the warning for a token expiring at exp.
+func (t *tokenWatch) schedule(exp time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	t.gen++
+	t.expiresAt = exp
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	gen := t.gen
+	t.timer = time.AfterFunc(time.Until(exp.Add(-t.lead())), func() { t.warn(gen) })
+}
+
+func (t *tokenWatch) warn(gen int) {
+	t.mu.Lock()
+	if t.stopped || gen != t.gen {
+		t.mu.Unlock()
+		return
+	}
+	left := time.Until(t.expiresAt)
+	t.timer = time.AfterFunc(left, func() { t.lapse(gen) })
+	t.mu.Unlock()
+	t.notify(wsEnvelope{Type: typeReauthRequired, ExpiresIn: max(left, 0).Milliseconds()})
+}
+
+func (t *tokenWatch) lapse(gen int) {
+	t.mu.Lock()
+	if t.stopped || gen != t.gen {
+		t.mu.Unlock()
+		return
+	}
+	t.stopped = true
+	t.mu.Unlock()
+	metricReauth.WithLabelValues("expired").Inc()
+	t.expire()
+}
+
+// reauth accepts a fresh access token for the connection's user and returns
+// the reply for the client. A rejected token leaves the old expiry in place.
+// Connections without a watch have nothing to refresh and are just answered.
+func (t *tokenWatch) reauth(ctx context.Context, cmd wsEnvelope) wsEnvelope {
+	if t == nil {
+		return wsEnvelope{Type: typeReauthed, ID: cmd.ID}
+	}
+	claims, err := parseAccessToken(t.auth, cmd.Token)
+	if err == nil && claims.Subject != t.userID {
+		err = errUserMismatch
+	}
+	if err == nil && t.store != nil {
+		// Deleted users cannot keep their sockets with a token issued earlier.
+		if _, lookupErr := t.store.GetUser(ctx, t.userID); lookupErr != nil {
+			err = errInvalidToken
+		}
+	}
+	if err != nil {
+		metricReauth.WithLabelValues("rejected").Inc()
+		code := codeInvalidToken
+		if errors.Is(err, errUserMismatch) {
+			code = codeUserMismatch
+		}
+		return wsEnvelope{Type: "error", ID: cmd.ID, Code: code, Message: err.Error()}
+	}
+	metricReauth.WithLabelValues("accepted").Inc()
+	if claims.ExpiresAt == nil {
+		t.stop()
+		return wsEnvelope{Type: typeReauthed, ID: cmd.ID}
+	}
+	t.schedule(claims.ExpiresAt.Time)
+	return wsEnvelope{Type: typeReauthed, ID: cmd.ID, ExpiresIn: time.Until(claims.ExpiresAt.Time).Milliseconds()}
+}
+
+// stop disarms the watch. A nil watch is a no-op.
+func (t *tokenWatch) stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// reauthCommand recognises {"type":"reauth","token":"..."} frames, with an
+// optional id, on plain channel sockets.
+func reauthCommand(frame []byte) (wsEnvelope, bool) {
+	frame = bytes.TrimSpace(frame)
+	if len(frame) == 0 || frame[0] != '{' {
+		return wsEnvelope{}, false
+	}
+	var cmd struct {
+		Type  string `json:"type"`
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(frame, &cmd); err != nil || cmd.Type != typeReauth || cmd.Token == "" {
+		return wsEnvelope{}, false
+	}
+	return wsEnvelope{Type: typeReauth, ID: cmd.ID, Token: cmd.Token}, true
+}
+
+// closeExpired closes a socket whose token lapsed without a refresh.
+func closeExpired(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(closeTokenExpired, "token expired")
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	_ = conn.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialWithToken(t *testing.T, handler http.Handler, query, token string) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	header := http.Header{}
+	header.Set("Cookie", "access_token="+token)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?"+query, header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestMultiplexedReauth(t *testing.T) {
+	auth := AuthConfig{Secret: []byte("test"), Enabled: true, ReauthLead: 2 * time.Second}
+	// Token expiry has second precision.
+	short, _ := signToken(auth.Secret, "user-1", 2*time.Second)
+	conn := dialWithToken(t, NewRouter(newFakeNats(), nil, nil, auth), "mode=multiplex", short)
+
+	env := readEnvelope(t, conn)
+	if env.Type != typeReauthRequired || env.ExpiresIn <= 0 || env.ExpiresIn > 2000 {
+		t.Fatalf("expected reauth_required, got %+v", env)
+	}
+
+	other, _ := signToken(auth.Secret, "bob", time.Hour)
+	if env := roundTrip(t, conn, wsEnvelope{Type: typeReauth, ID: "1", Token: other}); env.Type != "error" || env.Code != codeUserMismatch {
+		t.Fatalf("expected user_mismatch, got %+v", env)
+	}
+	if env := roundTrip(t, conn, wsEnvelope{Type: typeReauth, ID: "2", Token: "garbage"}); env.Type != "error" || env.Code != codeInvalidToken {
+		t.Fatalf("expected invalid_token, got %+v", env)
+	}
+	fresh, _ := signToken(auth.Secret, "user-1", time.Hour)
+	if env := roundTrip(t, conn, wsEnvelope{Type: typeReauth, ID: "3", Token: fresh}); env.Type != typeReauthed || env.ID != "3" || env.ExpiresIn < (59*time.Minute).Milliseconds() {
+		t.Fatalf("expected reauthed, got %+v", env)
+	}
+
+	// The old token's expiry has passed; the socket stays open on the new one.
+	time.Sleep(2 * time.Second)
+	if env := roundTrip(t, conn, wsEnvelope{Type: "ping", ID: "4"}); env.Type != "pong" {
+		t.Fatalf("expected pong after refresh, got %+v", env)
+	}
+}
+
+func TestLegacySocketClosedOnExpiry(t *testing.T) {
+	auth := AuthConfig{Secret: []byte("test"), Enabled: true, ReauthLead: time.Second}
+	token, _ := signToken(auth.Secret, "user-1", 2*time.Second)
+	conn := dialWithToken(t, NewRouter(newFakeNats(), nil, nil, auth), "subject=storm.events", token)
+
+	if env := readEnvelope(t, conn); env.Type != typeReauthRequired {
+		t.Fatalf("expected reauth_required, got %+v", env)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeTokenExpired {
+		t.Fatalf("expected token expired close, got %v", err)
+	}
+}
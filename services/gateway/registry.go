@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// gatewayControlPrefix is reserved for gateway-to-gateway traffic.
+	gatewayControlPrefix      = "gateway."
+	connectionsControlSubject = "gateway.connections"
+	registryReplyPrefix       = "gateway.replies."
+	defaultRegistryGather     = 500 * time.Millisecond
+	closeAdminDisconnect      = 4009
+	registryOpList            = "list"
+	registryOpDisconnect      = "disconnect"
+	registryOpDisconnectUser  = "disconnect_user"
+)
+
+// ConnectionInfo describes one live socket or SSE stream.
+type ConnectionInfo struct {
+	ID          string    `json:"id"`
+	Instance    string    `json:"instance"`
+	UserID      string    `json:"user_id"`
+	Transport   string    `json:"transport"`
+	Subjects    []string  `json:"subjects"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+}
+
+// liveConn is a registered connection. Its byte counters are updated by the
+// handler that owns it; a nil liveConn counts nothing.
+type liveConn struct {
+	info       ConnectionInfo
+	subjects   func() []string
+	disconnect func()
+	in, out    atomic.Int64
+}
+
+func (c *liveConn) received(n int) {
+	if c != nil {
+		c.in.Add(int64(n))
+	}
+}
+
+func (c *liveConn) sent(n int) {
+	if c != nil {
+		c.out.Add(int64(n))
+	}
+}
+
+// id returns the connection's registry id, or "" for a nil liveConn.
+func (c *liveConn) id() string {
+	if c == nil {
+		return ""
+	}
+	return c.info.ID
+}
+
+func (c *liveConn) snapshot() ConnectionInfo {
+	info := c.info
+	if c.subjects != nil {
+		info.Subjects = c.subjects()
+	}
+	if info.Subjects == nil {
+		info.Subjects = []string{}
+	}
+	info.BytesIn, info.BytesOut = c.in.Load(), c.out.Load()
+	return info
+}
+
+// ConnRegistry tracks this replica's live connections. With a NATS client it
+// also answers, and asks, the other replicas on connectionsControlSubject, so
+// listing and disconnecting work cluster-wide.
+type ConnRegistry struct {
+	instance string
+	nc       NatsClient
+	gather   time.Duration
+
+	mu    sync.Mutex
+	next  uint64
+	conns map[string]*liveConn
+}
+
+// NewConnRegistry returns a registry for this replica. A nil nc keeps it
+// local; gather bounds how long cluster queries wait for other replicas.
+func NewConnRegistry(nc NatsClient, instance string, gather time.Duration) *ConnRegistry {
+	if gather <= 0 {
+		gather = defaultRegistryGather
+	}
+	return &ConnRegistry{instance: instance, nc: nc, gather: gather, conns: make(map[string]*liveConn)}
+}
+
+// WithConnRegistry wires the registry into /ws, /events and /admin/connections.
+func WithConnRegistry(r *ConnRegistry) RouterOption {
+	return func(o *routerOptions) {
+		o.connections = r
+	}
+}
+
+// Register adds a connection. subjects, if set, is read on every listing for
+// connections whose subscriptions change; disconnect closes the connection
+// on an operator's request. The returned func must run when it ends.
+func (r *ConnRegistry) Register(info ConnectionInfo, subjects func() []string, disconnect func()) (*liveConn, func()) {
+	if r == nil {
+		return nil, func() {}
+	}
+	r.mu.Lock()
+	r.next++
+	info.ID = r.instance + "-" + strconv.FormatUint(r.next, 10)
+	info.Instance = r.instance
+	info.ConnectedAt = time.Now().UTC()
+	c := &liveConn{info: info, subjects: subjects, disconnect: disconnect}
+	r.conns[info.ID] = c
+	r.mu.Unlock()
+	return c, func() {
+		r.mu.Lock()
+		delete(r.conns, info.ID)
+		r.mu.Unlock()
+	}
+}
+
+// Local lists this replica's connections.
+func (r *ConnRegistry) Local() []ConnectionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]ConnectionInfo, 0, len(r.conns))
+	for _, c := range r.conns {
+		out = append(out, c.snapshot())
+	}
+	return out
+}
+
+// disconnectLocal closes this replica's connections that match and reports
+// how many it closed.
+func (r *ConnRegistry) disconnectLocal(match func(ConnectionInfo) bool) int {
+	r.mu.Lock()
+	var targets []*liveConn
+	for _, c := range r.conns {
+		if match(c.info) {
+			targets = append(targets, c)
+		}
+	}
+	r.mu.Unlock()
+	for _, c := range targets {
+		c.disconnect()
+	}
+	return len(targets)
+}
+
+type registryRequest struct {
+	Op     string `json:"op"`
+	ID     string `json:"id,omitempty"`
+	UserID string `json:"user_id,omitempty"`
+	From   string `json:"from"`
+	Reply  string `json:"reply"`
+}
+
+type registryReply struct {
+	Instance    string           `json:"instance"`
+	Connections []ConnectionInfo `json:"connections,omitempty"`
+	Closed      int              `json:"closed"`
+}
+
+// serve answers one request from another replica.
+func (r *ConnRegistry) serve(req registryRequest) registryReply {
+	reply := registryReply{Instance: r.instance}
+	switch req.Op {
+	case registryOpList:
+		reply.Connections = r.Local()
+	case registryOpDisconnect:
+		reply.Closed = r.disconnectLocal(func(c ConnectionInfo) bool { return c.ID == req.ID })
+	case registryOpDisconnectUser:
+		reply.Closed = r.disconnectLocal(func(c ConnectionInfo) bool { return c.UserID == req.UserID })
+	}
+	return reply
+}
+
+// Listen answers the other replicas' queries until ctx is cancelled.
+func (r *ConnRegistry) Listen(ctx context.Context) error {
+	if r.nc == nil {
+		return nil
+	}
+	ch := make(chan *nats.Msg, 64)
+	sub, err := r.nc.ChanSubscribe(connectionsControlSubject, ch)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer func() { _ = sub.Unsubscribe() }()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-ch:
+				var req registryRequest
+				if err := json.Unmarshal(msg.Data, &req); err != nil || req.From == r.instance || req.Reply == "" {
+					continue
+				}
+				data, _ := json.Marshal(r.serve(req))
+				if err := r.nc.Publish(req.Reply, data); err != nil {
+					log.Printf("registry reply failed: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// ask runs req here and broadcasts it to the other replicas, collecting
+// their replies for the gather window. It stops early once done says so.
+func (r *ConnRegistry) ask(ctx context.Context, req registryRequest, done func([]registryReply) bool) []registryReply {
+	replies := []registryReply{r.serve(req)}
+	if r.nc == nil || done(replies) {
+		return replies
+	}
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	req.From, req.Reply = r.instance, registryReplyPrefix+hex.EncodeToString(buf)
+	ch := make(chan *nats.Msg, 64)
+	sub, err := r.nc.ChanSubscribe(req.Reply, ch)
+	if err != nil {
+		log.Printf("registry subscribe failed: %v", err)
+		return replies
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	data, _ := json.Marshal(req)
+	if err := r.nc.Publish(connectionsControlSubject, data); err != nil {
+		log.Printf("registry broadcast failed: %v", err)
+		return replies
+	}
+	timer := time.NewTimer(r.gather)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return replies
+		case <-timer.C:
+			return replies
+		case msg := <-ch:
+			var reply registryReply
+			if err := json.Unmarshal(msg.Data, &reply); err != nil {
+				continue
+			}
+			replies = append(replies, reply)
+			if done(replies) {
+				return replies
+			}
+		}
+	}
+}
+
+func closedCount(replies []registryReply) int {
+	n := 0
+	for _, reply := range replies {
+		n += reply.Closed
+	}
+	return n
+}
+
+// List returns the connections of every replica that answered in time, and
+// which replicas those were.
+func (r *ConnRegistry) List(ctx context.Context) ([]ConnectionInfo, []string) {
+	replies := r.ask(ctx, registryRequest{Op: registryOpList}, func([]registryReply) bool { return false })
+	conns := []ConnectionInfo{}
+	instances := make([]string, 0, len(replies))
+	for _, reply := range replies {
+		conns = append(conns, reply.Connections...)
+		instances = append(instances, reply.Instance)
+	}
+	slices.SortFunc(conns, func(a, b ConnectionInfo) int { return a.ConnectedAt.Compare(b.ConnectedAt) })
+	slices.Sort(instances)
+	return conns, instances
+}
+
+// Disconnect closes the connection with id, wherever it lives. It reports
+// whether any replica had it.
+func (r *ConnRegistry) Disconnect(ctx context.Context, id string) bool {
+	replies := r.ask(ctx, registryRequest{Op: registryOpDisconnect, ID: id}, func(replies []registryReply) bool {
+		return closedCount(replies) > 0
+	})
+	return closedCount(replies) > 0
+}
+
+// DisconnectUser closes every connection of userID across the cluster and
+// reports how many were closed.
+func (r *ConnRegistry) DisconnectUser(ctx context.Context, userID string) int {
+	replies := r.ask(ctx, registryRequest{Op: registryOpDisconnectUser, UserID: userID}, func([]registryReply) bool { return false })
+	return closedCount(replies)
+}
+
+// disconnectByAdmin closes a socket an operator asked to drop.
+func disconnectByAdmin(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(closeAdminDisconnect, "disconnected by administrator")
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	_ = conn.Close()
+}
+
+// connectionAdminRoutes serves /admin/connections.
+func connectionAdminRoutes(registry *ConnRegistry) func(chi.Router) {
+	return func(cr chi.Router) {
+		cr.Get("/", func(w http.ResponseWriter, req *http.Request) {
+			conns, instances := registry.List(req.Context())
+			if userID := req.URL.Query().Get("user_id"); userID != "" {
+				conns = slices.DeleteFunc(conns, func(c ConnectionInfo) bool { return c.UserID != userID })
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"connections": conns, "instances": instances})
+		})
+
+		// Disconnects every connection of ?user_id=.
+		cr.Delete("/", func(w http.ResponseWriter, req *http.Request) {
+			userID := req.URL.Query().Get("user_id")
+			if userID == "" {
+				http.Error(w, "user_id required", http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]int{"closed": registry.DisconnectUser(req.Context(), userID)})
+		})
+
+		cr.Delete("/{id}", func(w http.ResponseWriter, req *http.Request) {
+			if !registry.Disconnect(req.Context(), chi.URLParam(req, "id")) {
+				http.Error(w, "connection not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
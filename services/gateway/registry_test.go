@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestConnectionAdminListAndDisconnect(t *testing.T) {
+	registry := NewConnRegistry(nil, "gw-a", 0)
+	router := NewRouter(newFakeNats(), nil, nil, AuthConfig{Secret: []byte("test"), Enabled: true, Admins: []string{"user-1"}}, WithConnRegistry(registry))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	header := http.Header{}
+	header.Set("Cookie", "access_token="+testToken(t, "test"))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?mode=multiplex", header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	defer conn.Close()
+	if env := roundTrip(t, conn, wsEnvelope{Type: "subscribe", ID: "1", Subject: "storm.events"}); env.Type != "subscribed" {
+		t.Fatalf("unexpected subscribe reply %+v", env)
+	}
+
+	admin := func(method, path string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.Header.Set("Cookie", "access_token="+testToken(t, "test"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp
+	}
+
+	resp := admin(http.MethodGet, "/admin/connections")
+	var listing struct {
+		Connections []ConnectionInfo `json:"connections"`
+		Instances   []string         `json:"instances"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&listing)
+	_ = resp.Body.Close()
+	if len(listing.Connections) != 1 || len(listing.Instances) != 1 {
+		t.Fatalf("expected one connection on one instance, got %+v", listing)
+	}
+	c := listing.Connections[0]
+	if c.UserID != "user-1" || c.Instance != "gw-a" || len(c.Subjects) != 1 || c.Subjects[0] != "storm.events" || c.BytesIn == 0 || c.BytesOut == 0 || c.RemoteAddr == "" {
+		t.Fatalf("unexpected connection %+v", c)
+	}
+
+	if resp := admin(http.MethodDelete, "/admin/connections/gw-a-999"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown id, got %d", resp.StatusCode)
+	}
+	if resp := admin(http.MethodDelete, "/admin/connections/"+c.ID); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeAdminDisconnect {
+		t.Fatalf("expected admin close, got %v", err)
+	}
+}
+
+func TestConnRegistryAcrossReplicas(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	replica := func(instance string) *ConnRegistry {
+		conn, err := nats.Connect(ns.ClientURL())
+		if err != nil {
+			t.Fatalf("nats connect: %v", err)
+		}
+		t.Cleanup(conn.Close)
+		r := NewConnRegistry(NewNatsAdapter(conn), instance, 200*time.Millisecond)
+		if err := r.Listen(ctx); err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		return r
+	}
+	a, b := replica("gw-a"), replica("gw-b")
+
+	var closedA, closedB atomic.Int32
+	_, _ = a.Register(ConnectionInfo{UserID: "alice", Transport: "ws"}, nil, func() { closedA.Add(1) })
+	bob, _ := b.Register(ConnectionInfo{UserID: "bob", Transport: "sse"}, nil, func() { closedB.Add(1) })
+	_, _ = b.Register(ConnectionInfo{UserID: "alice", Transport: "ws"}, nil, func() { closedB.Add(1) })
+	bob.sent(42)
+
+	conns, instances := a.List(ctx)
+	if len(conns) != 3 || len(instances) != 2 || instances[0] != "gw-a" || instances[1] != "gw-b" {
+		t.Fatalf("expected both replicas' connections, got %+v from %v", conns, instances)
+	}
+	for _, c := range conns {
+		if c.UserID == "bob" && (c.Instance != "gw-b" || c.BytesOut != 42) {
+			t.Fatalf("unexpected remote connection %+v", c)
+		}
+	}
+
+	if !a.Disconnect(ctx, bob.info.ID) || closedB.Load() != 1 {
+		t.Fatalf("expected remote disconnect by id")
+	}
+	if a.Disconnect(ctx, "gw-b-404") {
+		t.Fatalf("unknown id should not be found")
+	}
+	if n := a.DisconnectUser(ctx, "alice"); n != 2 || closedA.Load() != 1 || closedB.Load() != 2 {
+		t.Fatalf("expected alice disconnected on both replicas, got %d", n)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricReplayedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storm_ws_replayed_messages_total",
+		Help: "The total number of messages replayed to resuming sockets",
+	})
+	metricReplayGaps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "storm_ws_replay_gaps_total",
+		Help: "Resumes that could not be replayed in full, by code",
+	}, []string{"code"})
+)
+
+// messageIDHeader carries the persisted id of a channel message on NATS, so
+// live frames can be matched against replayed history.
+const messageIDHeader = "Storm-Message-Id"
+
+// messageSenderHeader carries the sender of a channel message published
+// before it was saved (legacy sockets), so a resuming socket can tell it
+// apart from the replayed copy of the same row.
+const messageSenderHeader = "Storm-Message-Sender"
+
+// defaultReplayLimit bounds how many messages a resuming socket is replayed
+// before it is told to refetch history instead.
+const defaultReplayLimit = 500
+
+// headerPublisher is implemented by NATS clients that can publish headers.
+type headerPublisher interface {
+	PublishMsg(msg *nats.Msg) error
+}
+
+// publishChannelMessage publishes a persisted channel message with its id in
+// messageIDHeader. Clients without header support publish the bare payload.
+func publishChannelMessage(nc NatsClient, msg Message, payload []byte) error {
+	hp, ok := nc.(headerPublisher)
+	if !ok {
+		return nc.Publish(msg.Subject, payload)
+	}
+	out := nats.NewMsg(msg.Subject)
+	out.Data = payload
+	out.Header.Set(messageIDHeader, strconv.FormatInt(msg.ID, 10))
+	return hp.PublishMsg(out)
+}
+
+// publishUnsaved publishes a channel message whose save is still queued,
+// with its sender in messageSenderHeader.
+func publishUnsaved(nc NatsClient, subject, userID string, payload []byte) error {
+	hp, ok := nc.(headerPublisher)
+	if !ok {
+		return nc.Publish(subject, payload)
+	}
+	out := nats.NewMsg(subject)
+	out.Data = payload
+	out.Header.Set(messageSenderHeader, userID)
+	return hp.PublishMsg(out)
+}
+
+// messageIDFromHeader returns the persisted id of msg, or 0 when the message
+// was published without one (legacy sockets, /publish).
+func messageIDFromHeader(msg *nats.Msg) int64 {
+	if msg.Header == nil {
+		return 0
+	}
+	id, err := strconv.ParseInt(msg.Header.Get(messageIDHeader), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// senderFromHeader returns the sender publishUnsaved recorded on msg, if any.
+func senderFromHeader(msg *nats.Msg) string {
+	if msg.Header == nil {
+		return ""
+	}
+	return msg.Header.Get(messageSenderHeader)
+}
+
+// replayKey matches an id-less live frame to a replayed row.
+type replayKey struct {
+	userID  string
+	payload string
+}
+
+// hold buffers a live frame for a subscription that is still replaying. It
+// reports whether the frame was taken. Past the replay window the frame is
+// dropped and the overflow is reported as a gap when the replay ends.
+func (s *muxSession) hold(subject string, env wsEnvelope) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.subs[subject]
+	if !ok || !m.replaying {
+		return false
+	}
+	if len(m.pending) >= s.replay {
+		m.overflow = true
+		return true
+	}
+	m.pending = append(m.pending, env)
+	return true
+}
+
+func (s *muxSession) gap(channelID int64, code, message string) {
+	metricReplayGaps.WithLabelValues(code).Inc()
+	s.reply(wsEnvelope{Type: "gap", ChannelID: channelID, Code: code, Message: message})
+}
+
+// resume replays a channel's messages after the client's last seen id, then
+// switches the subscription to live delivery. Live frames that arrived during
+// the replay are flushed afterwards, minus any the replay already covered.
+// Gaps larger than the replay window are not replayed; the client gets a gap
+// frame and refetches history over REST.
+func (s *muxSession) resume(m *muxSubscription, after int64) {
+	subject := channelSubject(m.channelID)
+	last := after
+	replayed := make(map[replayKey]int)
+	msgs, err := s.store.ListMessagesAfter(s.ctx, m.channelID, after, s.replay+1)
+	switch {
+	case err != nil:
+		log.Printf("ws replay failed: %v", err)
+		s.gap(m.channelID, "replay_failed", "replay unavailable, refetch history")
+	case len(msgs) > s.replay:
+		s.gap(m.channelID, "gap_too_large", "gap too large, refetch history")
+	default:
+		for _, msg := range msgs {
+			s.reply(wsEnvelope{Type: "message", ChannelID: m.channelID, Subject: subject, Payload: msg.Payload, MessageID: msg.ID, Replayed: true})
+			last = msg.ID
+			replayed[replayKey{msg.UserID, msg.Payload}]++
+		}
+		metricReplayedMessages.Add(float64(len(msgs)))
+	}
+
+	s.deliverMu.Lock()
+	defer s.deliverMu.Unlock()
+	s.mu.Lock()
+	pending, overflow := m.pending, m.overflow
+	m.pending, m.overflow, m.replaying = nil, false, false
+	s.mu.Unlock()
+	if overflow {
+		s.gap(m.channelID, "gap_too_large", "live backlog overflowed during replay, refetch history")
+	}
+	s.reply(wsEnvelope{Type: "resumed", ChannelID: m.channelID, Subject: subject, MessageID: last})
+	for _, env := range pending {
+		if env.MessageID != 0 && env.MessageID <= last {
+			continue
+		}
+		// Frames published before their save have no id; each replayed row
+		// from the same sender with the same payload accounts for one.
+		if key := (replayKey{env.sender, env.Payload}); env.MessageID == 0 && env.sender != "" && replayed[key] > 0 {
+			replayed[key]--
+			continue
+		}
+		s.reply(env)
+	}
+}
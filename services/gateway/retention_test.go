@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type purgeStore struct {
+	*memStore
+	batches  []int64
+	archived []bool
+	expired  int64
+	err      error
+}
+
+func (p *purgeStore) PurgeExpiredMessages(_ context.Context, _ int, archive bool) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0, p.err
+	}
+	if len(p.batches) == 0 {
+		return 0, nil
+	}
+	n := p.batches[0]
+	p.batches = p.batches[1:]
+	p.archived = append(p.archived, archive)
+	return n, nil
+}
+
+func (p *purgeStore) CountExpiredMessages(context.Context) (int64, error) {
+	return p.expired, p.err
+}
+
+func TestRunRetentionPassDrainsBatches(t *testing.T) {
+	store := &purgeStore{memStore: newMemStore(), batches: []int64{10, 10, 4, 99}}
+	total, err := runRetentionPass(context.Background(), store, RetentionConfig{BatchSize: 10, Archive: true})
+	if err != nil {
+		t.Fatalf("retention pass: %v", err)
+	}
+	if total != 24 {
+		t.Fatalf("expected 24 purged, got %d", total)
+	}
+	if len(store.archived) != 3 || !store.archived[0] {
+		t.Fatalf("expected 3 archive batches, got %v", store.archived)
+	}
+}
+
+func TestRunRetentionPassDryRunOnlyCounts(t *testing.T) {
+	store := &purgeStore{memStore: newMemStore(), batches: []int64{10}, expired: 7}
+	total, err := runRetentionPass(context.Background(), store, RetentionConfig{BatchSize: 10, DryRun: true})
+	if err != nil {
+		t.Fatalf("retention pass: %v", err)
+	}
+	if total != 7 {
+		t.Fatalf("expected 7, got %d", total)
+	}
+	if len(store.batches) != 1 {
+		t.Fatalf("dry run must not purge")
+	}
+	// A second pass over the same rows reports them again, not twice as many.
+	purged := testutil.ToFloat64(metricRetentionPurged.WithLabelValues("dry_run"))
+	if _, err := runRetentionPass(context.Background(), store, RetentionConfig{BatchSize: 10, DryRun: true}); err != nil {
+		t.Fatalf("retention pass: %v", err)
+	}
+	if got := testutil.ToFloat64(metricRetentionEligible); got != 7 {
+		t.Fatalf("expected 7 eligible, got %v", got)
+	}
+	if got := testutil.ToFloat64(metricRetentionPurged.WithLabelValues("dry_run")); got != purged {
+		t.Fatalf("dry run must not count as purged, got %v", got)
+	}
+}
+
+func TestRunRetentionPassError(t *testing.T) {
+	store := &purgeStore{memStore: newMemStore(), err: errors.New("boom")}
+	if _, err := runRetentionPass(context.Background(), store, RetentionConfig{BatchSize: 10}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestStartRetentionJobRunsUntilCancelled(t *testing.T) {
+	store := &purgeStore{memStore: newMemStore(), batches: []int64{1}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartRetentionJob(ctx, store, RetentionConfig{Interval: 10 * time.Millisecond, BatchSize: 10})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		store.mu.Lock()
+		done := len(store.archived) > 0
+		store.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("retention job did not run")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestChannelRetentionRoute(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	_ = store.EnsureUser(context.Background(), "bob")
+	own, _ := store.CreateChannel(context.Background(), "mine", "user-1")
+	other, _ := store.CreateChannel(context.Background(), "theirs", "bob")
+	r := NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+
+	put := func(id int64, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/channels/"+strconv.FormatInt(id, 10)+"/retention", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := put(own.ID, `{"retention_seconds":3600}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	got, _ := store.GetChannel(context.Background(), own.ID)
+	if got.RetentionSeconds == nil || *got.RetentionSeconds != 3600 {
+		t.Fatalf("retention not stored: %+v", got)
+	}
+	if code := put(own.ID, `{"retention_seconds":null}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if got, _ := store.GetChannel(context.Background(), own.ID); got.RetentionSeconds != nil {
+		t.Fatalf("expected retention reset to default")
+	}
+	if code := put(own.ID, `{"retention_seconds":-5}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	if code := put(other.ID, `{"retention_seconds":60}`); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", code)
+	}
+	if code := put(999, `{"retention_seconds":60}`); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricScheduledDispatched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "storm_scheduled_dispatched_total",
+		Help: "Scheduled items delivered, by kind (message, reminder)",
+	}, []string{"kind"})
+	metricScheduledErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storm_scheduled_dispatch_errors_total",
+		Help: "The total number of scheduled items that failed to deliver",
+	})
+	metricSchedulerLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "storm_scheduler_leader",
+		Help: "1 when this replica holds the scheduler lease",
+	})
+)
+
+const (
+	scheduledPending   = "pending"
+	scheduledSending   = "sending"
+	scheduledSent      = "sent"
+	scheduledCancelled = "cancelled"
+	scheduledFailed    = "failed"
+
+	schedulerLeaseName = "scheduler"
+
+	defaultScheduleHorizon = 365 * 24 * time.Hour
+)
+
+// SchedulerConfig controls the scheduled message dispatcher. Only the replica
+// holding the lease dispatches; LeaseTTL must exceed Interval so the leader
+// renews before it expires.
+type SchedulerConfig struct {
+	Interval  time.Duration
+	LeaseTTL  time.Duration
+	BatchSize int
+	Holder    string
+}
+
+// Reminder is pushed to the owner's sockets when a personal reminder is due.
+type Reminder struct {
+	Type      string    `json:"type"`
+	ID        int64     `json:"id"`
+	Payload   string    `json:"payload"`
+	DeliverAt time.Time `json:"deliver_at"`
+}
+
+// instanceID identifies this replica, in the lease table and the connection
+// registry.
+func instanceID() string {
+	host, _ := os.Hostname()
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return host + "-" + hex.EncodeToString(buf)
+}
+
+// StartScheduler dispatches due scheduled items every cfg.Interval until ctx
+// is cancelled.
+func StartScheduler(ctx context.Context, store Store, nc NatsClient, cfg SchedulerConfig) {
+	if cfg.Interval <= 0 {
+		log.Printf("scheduler disabled")
+		return
+	}
+	if cfg.LeaseTTL <= cfg.Interval {
+		cfg.LeaseTTL = 3 * cfg.Interval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.Holder == "" {
+		cfg.Holder = instanceID()
+	}
+	log.Printf("starting scheduler (interval=%s lease=%s holder=%s)", cfg.Interval, cfg.LeaseTTL, cfg.Holder)
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		defer metricSchedulerLeader.Set(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := runSchedulerPass(ctx, store, nc, cfg); err != nil {
+					log.Printf("scheduler pass failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// runSchedulerPass renews the lease and, if this replica is the leader,
+// delivers due items batch by batch.
+func runSchedulerPass(ctx context.Context, store Store, nc NatsClient, cfg SchedulerConfig) (int, error) {
+	leader, err := store.AcquireLease(ctx, schedulerLeaseName, cfg.Holder, cfg.LeaseTTL)
+	if err != nil {
+		metricSchedulerLeader.Set(0)
+		return 0, err
+	}
+	if !leader {
+		metricSchedulerLeader.Set(0)
+		return 0, nil
+	}
+	metricSchedulerLeader.Set(1)
+
+	total := 0
+	for ctx.Err() == nil {
+		// Claims outlast the scheduler lease, so a replica taking over from
+		// a dead leader retries what it left in flight.
+		due, err := store.ClaimDueScheduledMessages(ctx, cfg.BatchSize, cfg.LeaseTTL)
+		if err != nil {
+			return total, err
+		}
+		for _, sm := range due {
+			if err := dispatchScheduled(ctx, store, nc, sm); err != nil {
+				metricScheduledErrors.Inc()
+				log.Printf("dispatch scheduled %d failed: %v", sm.ID, err)
+				if err := store.MarkScheduledMessageFailed(context.Background(), sm.ID); err != nil {
+					log.Printf("mark scheduled %d failed: %v", sm.ID, err)
+				}
+				continue
+			}
+			// Marked only once delivered: a dispatcher dying in between
+			// leaves the claim to expire and the item to be sent again,
+			// which is preferable to losing it.
+			if err := store.MarkScheduledMessageSent(context.Background(), sm.ID); err != nil {
+				log.Printf("mark scheduled %d sent failed: %v", sm.ID, err)
+			}
+			total++
+		}
+		if len(due) < cfg.BatchSize {
+			break
+		}
+	}
+	return total, ctx.Err()
+}
+
+// dispatchScheduled delivers one item through the same path as a live send.
+func dispatchScheduled(ctx context.Context, store Store, nc NatsClient, sm ScheduledMessage) error {
+	if sm.ChannelID == nil {
+		data, _ := json.Marshal(Reminder{Type: "reminder", ID: sm.ID, Payload: sm.Payload, DeliverAt: sm.DeliverAt})
+		if err := nc.Publish(userSubject(sm.UserID), data); err != nil {
+			return err
+		}
+		metricScheduledDispatched.WithLabelValues("reminder").Inc()
+		return nil
+	}
+	msg, err := store.SaveChannelMessage(ctx, *sm.ChannelID, sm.UserID, []byte(sm.Payload))
+	if err != nil {
+		return err
+	}
+	if err := publishChannelMessage(nc, msg, []byte(sm.Payload)); err != nil {
+		// The message is persisted; live subscribers just miss it.
+		log.Printf("nats publish failed: %v", err)
+	}
+	metricScheduledDispatched.WithLabelValues("message").Inc()
+	return nil
+}
+
+type scheduledRequest struct {
+	ChannelID *int64  `json:"channel_id"`
+	Payload   *string `json:"payload"`
+	DeliverAt *string `json:"deliver_at"`
+}
+
+func parseDeliverAt(raw string, maxHorizon time.Duration) (time.Time, error) {
+	at, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return at, errors.New("invalid deliver_at (want RFC3339)")
+	}
+	now := time.Now()
+	if !at.After(now) {
+		return at, errors.New("deliver_at must be in the future")
+	}
+	if maxHorizon > 0 && at.After(now.Add(maxHorizon)) {
+		return at, errors.New("deliver_at is too far in the future")
+	}
+	return at.UTC(), nil
+}
+
+// scheduledRoutes serves /scheduled: the caller's pending scheduled messages
+// and reminders. Payloads are moderated when they are written, not at delivery.
+func scheduledRoutes(store Store, moderator *Moderator, maxHorizon time.Duration) func(chi.Router) {
+	moderate := func(w http.ResponseWriter, req *http.Request, channelID *int64, userID, payload string) (string, bool) {
+		var id int64
+		if channelID != nil {
+			id = *channelID
+		}
+		verdict := moderator.Check(req.Context(), "scheduled", id, userID, []byte(payload))
+		if verdict.Action == ModerationReject {
+			writeJSON(w, http.StatusUnprocessableEntity, newModerationRejection(verdict))
+			return "", false
+		}
+		return string(verdict.Payload), true
+	}
+
+	return func(sr chi.Router) {
+		sr.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if store == nil {
+					http.Error(w, "store not configured", http.StatusServiceUnavailable)
+					return
+				}
+				if userFromContext(req.Context()) == "" {
+					http.Error(w, "missing user", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, req)
+			})
+		})
+
+		sr.Get("/", func(w http.ResponseWriter, req *http.Request) {
+			items, err := store.ListScheduledMessages(req.Context(), userFromContext(req.Context()))
+			if err != nil {
+				log.Printf("list scheduled failed: %v", err)
+				http.Error(w, "list scheduled failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if items == nil {
+				items = []ScheduledMessage{}
+			}
+			writeJSON(w, http.StatusOK, items)
+		})
+
+		sr.Post("/", func(w http.ResponseWriter, req *http.Request) {
+			userID := userFromContext(req.Context())
+			var payload scheduledRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodyBytes)).Decode(&payload); err != nil ||
+				payload.Payload == nil || strings.TrimSpace(*payload.Payload) == "" || payload.DeliverAt == nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			deliverAt, err := parseDeliverAt(*payload.DeliverAt, maxHorizon)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := store.EnsureUser(req.Context(), userID); err != nil {
+				http.Error(w, "ensure user failed", http.StatusInternalServerError)
+				return
+			}
+			if payload.ChannelID != nil {
+				if _, err := store.GetChannel(req.Context(), *payload.ChannelID); err != nil {
+					http.Error(w, "channel not found", http.StatusNotFound)
+					return
+				}
+				if err := store.EnsureMember(req.Context(), *payload.ChannelID, userID); err != nil {
+					log.Printf("ensure member failed: %v", err)
+				}
+			}
+			body, ok := moderate(w, req, payload.ChannelID, userID, *payload.Payload)
+			if !ok {
+				return
+			}
+			sm, err := store.CreateScheduledMessage(req.Context(), ScheduledMessage{
+				UserID:    userID,
+				ChannelID: payload.ChannelID,
+				Payload:   body,
+				DeliverAt: deliverAt,
+			})
+			if err != nil {
+				log.Printf("create scheduled failed: %v", err)
+				http.Error(w, "create scheduled failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusCreated, sm)
+		})
+
+		sr.Patch("/{id}", func(w http.ResponseWriter, req *http.Request) {
+			userID := userFromContext(req.Context())
+			id, err := parseID(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid scheduled id", http.StatusBadRequest)
+				return
+			}
+			var payload scheduledRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodyBytes)).Decode(&payload); err != nil ||
+				(payload.Payload == nil && payload.DeliverAt == nil) ||
+				(payload.Payload != nil && strings.TrimSpace(*payload.Payload) == "") {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if payload.ChannelID != nil {
+				http.Error(w, "channel_id cannot be changed", http.StatusBadRequest)
+				return
+			}
+
+			var current *ScheduledMessage
+			items, err := store.ListScheduledMessages(req.Context(), userID)
+			if err != nil {
+				http.Error(w, "get scheduled failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for i := range items {
+				if items[i].ID == id {
+					current = &items[i]
+					break
+				}
+			}
+			if current == nil {
+				http.Error(w, "scheduled item not found", http.StatusNotFound)
+				return
+			}
+
+			update := *current
+			if payload.DeliverAt != nil {
+				if update.DeliverAt, err = parseDeliverAt(*payload.DeliverAt, maxHorizon); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if payload.Payload != nil {
+				body, ok := moderate(w, req, current.ChannelID, userID, *payload.Payload)
+				if !ok {
+					return
+				}
+				update.Payload = body
+			}
+			sm, err := store.UpdateScheduledMessage(req.Context(), update)
+			if err != nil {
+				if isPgNotFound(err) {
+					// Dispatched or cancelled since we read it.
+					http.Error(w, "scheduled item not found", http.StatusNotFound)
+					return
+				}
+				log.Printf("update scheduled failed: %v", err)
+				http.Error(w, "update scheduled failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, sm)
+		})
+
+		sr.Delete("/{id}", func(w http.ResponseWriter, req *http.Request) {
+			id, err := parseID(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid scheduled id", http.StatusBadRequest)
+				return
+			}
+			if err := store.CancelScheduledMessage(req.Context(), id, userFromContext(req.Context())); err != nil {
+				if isPgNotFound(err) {
+					http.Error(w, "scheduled item not found", http.StatusNotFound)
+					return
+				}
+				log.Printf("cancel scheduled failed: %v", err)
+				http.Error(w, "cancel scheduled failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunSchedulerPassDispatchesDueItems(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "alice")
+	channel, _ := store.CreateChannel(context.Background(), "general", "alice")
+	past := time.Now().Add(-time.Second)
+	_, _ = store.CreateScheduledMessage(context.Background(), ScheduledMessage{UserID: "alice", ChannelID: &channel.ID, Payload: "hello later", DeliverAt: past})
+	_, _ = store.CreateScheduledMessage(context.Background(), ScheduledMessage{UserID: "alice", Payload: "stand up", DeliverAt: past})
+	future, _ := store.CreateScheduledMessage(context.Background(), ScheduledMessage{UserID: "alice", Payload: "not yet", DeliverAt: time.Now().Add(time.Hour)})
+
+	nc := newFakeNats()
+	n, err := runSchedulerPass(context.Background(), store, nc, SchedulerConfig{BatchSize: 10, Holder: "a", LeaseTTL: time.Minute})
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 dispatched, got %d (%v)", n, err)
+	}
+	msgs, _ := store.ListMessages(context.Background(), channel.ID, 10)
+	if len(msgs) != 1 || msgs[0].Payload != "hello later" || msgs[0].UserID != "alice" {
+		t.Fatalf("scheduled message not saved: %+v", msgs)
+	}
+
+	var reminder Reminder
+	subjects := map[string]bool{}
+	for _, p := range nc.published {
+		subjects[p.subject] = true
+		if p.subject == userSubject("alice") {
+			_ = json.Unmarshal(p.data, &reminder)
+		}
+	}
+	if !subjects[channelSubject(channel.ID)] || reminder.Type != "reminder" || reminder.Payload != "stand up" {
+		t.Fatalf("unexpected publishes %v / %+v", nc.published, reminder)
+	}
+	if pending, _ := store.ListScheduledMessages(context.Background(), "alice"); len(pending) != 1 || pending[0].ID != future.ID {
+		t.Fatalf("expected only the future item pending, got %+v", pending)
+	}
+}
+
+func TestRunSchedulerPassRequiresLease(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "alice")
+	_, _ = store.CreateScheduledMessage(context.Background(), ScheduledMessage{UserID: "alice", Payload: "x", DeliverAt: time.Now().Add(-time.Second)})
+	if ok, _ := store.AcquireLease(context.Background(), schedulerLeaseName, "other", time.Minute); !ok {
+		t.Fatalf("expected other replica to take the lease")
+	}
+
+	nc := newFakeNats()
+	n, err := runSchedulerPass(context.Background(), store, nc, SchedulerConfig{BatchSize: 10, Holder: "a", LeaseTTL: time.Minute})
+	if err != nil || n != 0 || len(nc.published) != 0 {
+		t.Fatalf("follower must not dispatch: %d %v %v", n, err, nc.published)
+	}
+	if n, _ := runSchedulerPass(context.Background(), store, nc, SchedulerConfig{BatchSize: 10, Holder: "other", LeaseTTL: time.Minute}); n != 1 {
+		t.Fatalf("leader should dispatch, got %d", n)
+	}
+}
+
+type failingSaveStore struct {
+	*memStore
+}
+
+func (f failingSaveStore) SaveChannelMessage(context.Context, int64, string, []byte) (Message, error) {
+	return Message{}, errors.New("db down")
+}
+
+func TestRunSchedulerPassMarksFailures(t *testing.T) {
+	store := failingSaveStore{newMemStore()}
+	_ = store.EnsureUser(context.Background(), "alice")
+	channel, _ := store.CreateChannel(context.Background(), "general", "alice")
+	sm, _ := store.CreateScheduledMessage(context.Background(), ScheduledMessage{UserID: "alice", ChannelID: &channel.ID, Payload: "x", DeliverAt: time.Now().Add(-time.Second)})
+	n, err := runSchedulerPass(context.Background(), store, newFakeNats(), SchedulerConfig{BatchSize: 10, Holder: "a", LeaseTTL: time.Minute})
+	if err != nil || n != 0 {
+		t.Fatalf("unexpected result %d %v", n, err)
+	}
+	if got := store.scheduled[sm.ID].Status; got != scheduledFailed {
+		t.Fatalf("expected failed status, got %q", got)
+	}
+}
+
+// crashAfterSaveStore loses its connection once a message is saved, like a
+// dispatcher dying between delivery and marking the item sent.
+type crashAfterSaveStore struct {
+	*memStore
+}
+
+func (crashAfterSaveStore) MarkScheduledMessageSent(context.Context, int64) error {
+	return errors.New("connection reset")
+}
+
+func TestRunSchedulerPassRetriesUnconfirmedItems(t *testing.T) {
+	mem := newMemStore()
+	_ = mem.EnsureUser(context.Background(), "alice")
+	channel, _ := mem.CreateChannel(context.Background(), "general", "alice")
+	sm, _ := mem.CreateScheduledMessage(context.Background(), ScheduledMessage{UserID: "alice", ChannelID: &channel.ID, Payload: "x", DeliverAt: time.Now().Add(-time.Second)})
+
+	cfg := SchedulerConfig{BatchSize: 10, Holder: "a", LeaseTTL: 20 * time.Millisecond}
+	if n, err := runSchedulerPass(context.Background(), crashAfterSaveStore{mem}, newFakeNats(), cfg); err != nil || n != 1 {
+		t.Fatalf("unexpected result %d %v", n, err)
+	}
+	if got := mem.scheduled[sm.ID].Status; got != scheduledSending {
+		t.Fatalf("an unconfirmed item must stay in flight, got %q", got)
+	}
+	if n, _ := runSchedulerPass(context.Background(), mem, newFakeNats(), cfg); n != 0 {
+		t.Fatalf("a live claim must not be dispatched again, got %d", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if n, err := runSchedulerPass(context.Background(), mem, newFakeNats(), cfg); err != nil || n != 1 {
+		t.Fatalf("expected the expired claim to be retried, got %d %v", n, err)
+	}
+	if got := mem.scheduled[sm.ID].Status; got != scheduledSent {
+		t.Fatalf("expected sent, got %q", got)
+	}
+}
+
+func TestScheduledRoutes(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	_ = store.SetModerationConfig(context.Background(), channel.ID, []byte(`{"filters":[{"type":"links"}]}`))
+	r := NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	chanID := strconv.FormatInt(channel.ID, 10)
+
+	w := do(http.MethodPost, "/scheduled", `{"channel_id":`+chanID+`,"payload":"later","deliver_at":"`+at+`"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created ScheduledMessage
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+	if created.Status != scheduledPending || created.ChannelID == nil || *created.ChannelID != channel.ID {
+		t.Fatalf("unexpected item %+v", created)
+	}
+	if w := do(http.MethodPost, "/scheduled", `{"payload":"remind me","deliver_at":"`+at+`"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected reminder 201, got %d", w.Code)
+	}
+
+	for _, body := range []string{
+		`{"payload":"x","deliver_at":"2000-01-01T00:00:00Z"}`,
+		`{"payload":"x","deliver_at":"` + time.Now().Add(2*defaultScheduleHorizon).UTC().Format(time.RFC3339) + `"}`,
+		`{"payload":" ","deliver_at":"` + at + `"}`,
+		`{"payload":"x"}`,
+	} {
+		if w := do(http.MethodPost, "/scheduled", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+	if w := do(http.MethodPost, "/scheduled", `{"channel_id":999,"payload":"x","deliver_at":"`+at+`"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/scheduled", `{"channel_id":`+chanID+`,"payload":"https://spam.test","deliver_at":"`+at+`"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", w.Code)
+	}
+
+	w = do(http.MethodGet, "/scheduled", "")
+	var items []ScheduledMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil || len(items) != 2 {
+		t.Fatalf("unexpected list %s", w.Body.String())
+	}
+
+	path := "/scheduled/" + strconv.FormatInt(created.ID, 10)
+	later := time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339)
+	w = do(http.MethodPatch, path, `{"payload":"edited","deliver_at":"`+later+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var updated ScheduledMessage
+	_ = json.Unmarshal(w.Body.Bytes(), &updated)
+	if updated.Payload != "edited" || updated.DeliverAt.Format(time.RFC3339) != later {
+		t.Fatalf("unexpected update %+v", updated)
+	}
+	if w := do(http.MethodPatch, path, `{"payload":"https://spam.test"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected channel moderation on edit, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, path, `{"channel_id":1}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+
+	if w := do(http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, path, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after cancel, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, path, `{"payload":"again"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 editing cancelled item, got %d", w.Code)
+	}
+}
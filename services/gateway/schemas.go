@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+var metricSchemaValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "storm_schema_validation_failures_total",
+	Help: "Payloads rejected by subject schema validation, by registered subject pattern",
+}, []string{"subject"})
+
+const (
+	defaultSchemaCacheTTL = 30 * time.Second
+	// schemaLoadTimeout bounds a background reload, which outlives the
+	// request that noticed the set was stale.
+	schemaLoadTimeout = 5 * time.Second
+)
+
+var subjectTokenRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validSubjectPattern accepts NATS-style patterns: dot-separated tokens where
+// "*" matches one token and a trailing ">" matches the rest.
+func validSubjectPattern(pattern string) bool {
+	tokens := strings.Split(pattern, ".")
+	for i, tok := range tokens {
+		switch {
+		case tok == "*":
+		case tok == ">" && i == len(tokens)-1:
+		case subjectTokenRe.MatchString(tok):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func subjectMatches(pattern, subject string) bool {
+	pt := strings.Split(pattern, ".")
+	st := strings.Split(subject, ".")
+	for i, tok := range pt {
+		if tok == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) || (tok != "*" && tok != st[i]) {
+			return false
+		}
+	}
+	return len(pt) == len(st)
+}
+
+// patternSpecificity ranks patterns so the most specific match wins: literal
+// tokens beat "*", which beats ">".
+func patternSpecificity(pattern string) int {
+	score := 0
+	for _, tok := range strings.Split(pattern, ".") {
+		switch tok {
+		case ">":
+		case "*":
+			score++
+		default:
+			score += 2
+		}
+	}
+	return score
+}
+
+func compileSubjectSchema(subject string, raw []byte) (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	// Schemas are self-contained; never let a $ref read files or the network.
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("external $ref %q not allowed", s)
+	}
+	loc := "storm://schemas/" + url.PathEscape(subject) + ".json"
+	if err := c.AddResource(loc, bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return c.Compile(loc)
+}
+
+// SchemaViolation is one failed keyword, located by JSON pointer.
+type SchemaViolation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// schemaRejection is the body sent back for a payload that fails its schema.
+type schemaRejection struct {
+	Type    string            `json:"type"`
+	Code    string            `json:"code"`
+	Subject string            `json:"subject"`
+	Errors  []SchemaViolation `json:"errors"`
+}
+
+func schemaViolations(err error) []SchemaViolation {
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []SchemaViolation{{Path: "", Message: err.Error()}}
+	}
+	var out []SchemaViolation
+	var walk func(*jsonschema.ValidationError)
+	walk = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 {
+			out = append(out, SchemaViolation{Path: ve.InstanceLocation, Message: ve.Message})
+			return
+		}
+		for _, cause := range ve.Causes {
+			walk(cause)
+		}
+	}
+	walk(ve)
+	return out
+}
+
+type compiledSchema struct {
+	pattern string
+	schema  *jsonschema.Schema
+}
+
+// schemaSet is one immutable load of the registry, swapped in whole.
+type schemaSet struct {
+	compiled []compiledSchema
+	loadedAt time.Time
+}
+
+// SchemaRegistry maps subject patterns to JSON Schemas. Schemas from config
+// are fixed at startup; schemas registered through the admin API live in the
+// store, override config for the same pattern, and are reloaded every ttl.
+// Lookups read the current set without locking; a stale set keeps serving
+// while one background reload replaces it.
+type SchemaRegistry struct {
+	store  Store
+	static map[string]json.RawMessage
+	ttl    time.Duration
+
+	current    atomic.Pointer[schemaSet]
+	refreshing atomic.Bool
+	// mu serializes reloads; lookups never take it.
+	mu sync.Mutex
+}
+
+// NewSchemaRegistry compiles the config schemas up front so a bad file fails startup.
+func NewSchemaRegistry(store Store, static map[string]json.RawMessage, ttl time.Duration) (*SchemaRegistry, error) {
+	for pattern, raw := range static {
+		if !validSubjectPattern(pattern) {
+			return nil, fmt.Errorf("invalid subject pattern %q", pattern)
+		}
+		if _, err := compileSubjectSchema(pattern, raw); err != nil {
+			return nil, fmt.Errorf("schema for %s: %w", pattern, err)
+		}
+	}
+	return &SchemaRegistry{store: store, static: static, ttl: ttl}, nil
+}
+
+// schemasFromEnv reads SUBJECT_SCHEMAS_FILE, a JSON object of subject pattern
+// to schema.
+func schemasFromEnv() (map[string]json.RawMessage, error) {
+	path := os.Getenv("SUBJECT_SCHEMAS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("read subject schemas: %w", err)
+	}
+	var out map[string]json.RawMessage
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("parse subject schemas: %w", err)
+	}
+	return out, nil
+}
+
+func (r *SchemaRegistry) load(ctx context.Context) ([]compiledSchema, error) {
+	raw := make(map[string]json.RawMessage, len(r.static))
+	for pattern, schema := range r.static {
+		raw[pattern] = schema
+	}
+	if r.store != nil {
+		stored, err := r.store.ListSubjectSchemas(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range stored {
+			raw[s.Subject] = s.Schema
+		}
+	}
+	out := make([]compiledSchema, 0, len(raw))
+	for pattern, schema := range raw {
+		compiled, err := compileSubjectSchema(pattern, schema)
+		if err != nil {
+			log.Printf("schema for %s skipped: %v", pattern, err)
+			continue
+		}
+		out = append(out, compiledSchema{pattern: pattern, schema: compiled})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		si, sj := patternSpecificity(out[i].pattern), patternSpecificity(out[j].pattern)
+		if si != sj {
+			return si > sj
+		}
+		return out[i].pattern < out[j].pattern
+	})
+	return out, nil
+}
+
+func (r *SchemaRegistry) lookup(ctx context.Context, subject string) *compiledSchema {
+	set := r.current.Load()
+	switch {
+	case set == nil:
+		// Nothing to serve yet, so the first lookups wait for one load.
+		set = r.refreshIfUnchanged(ctx, nil)
+	case time.Since(set.loadedAt) > r.ttl && r.refreshing.CompareAndSwap(false, true):
+		go func() {
+			defer r.refreshing.Store(false)
+			loadCtx, cancel := context.WithTimeout(context.Background(), schemaLoadTimeout)
+			defer cancel()
+			r.refreshIfUnchanged(loadCtx, set)
+		}()
+	}
+	for i := range set.compiled {
+		if subjectMatches(set.compiled[i].pattern, subject) {
+			return &set.compiled[i]
+		}
+	}
+	return nil
+}
+
+// refreshIfUnchanged reloads unless another caller replaced seen while this
+// one waited for the lock.
+func (r *SchemaRegistry) refreshIfUnchanged(ctx context.Context, seen *schemaSet) *schemaSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current := r.current.Load(); current != seen {
+		return current
+	}
+	return r.reload(ctx)
+}
+
+// reload loads and publishes a new set. The caller must hold r.mu.
+func (r *SchemaRegistry) reload(ctx context.Context) *schemaSet {
+	set := &schemaSet{loadedAt: time.Now()}
+	compiled, err := r.load(ctx)
+	if err != nil {
+		// Keep validating against the last good set.
+		log.Printf("load subject schemas failed: %v", err)
+		if prev := r.current.Load(); prev != nil {
+			compiled = prev.compiled
+		}
+	}
+	set.compiled = compiled
+	r.current.Store(set)
+	return set
+}
+
+// Invalidate reloads schemas from the store so a change made through the
+// admin API applies on this replica at once.
+func (r *SchemaRegistry) Invalidate(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reload(ctx)
+}
+
+// Check validates payload against the most specific schema registered for
+// subject. It returns nil when the payload is valid or no schema applies.
+func (r *SchemaRegistry) Check(ctx context.Context, subject string, payload []byte) *schemaRejection {
+	if r == nil {
+		return nil
+	}
+	match := r.lookup(ctx, subject)
+	if match == nil {
+		return nil
+	}
+	var violations []SchemaViolation
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil || dec.More() {
+		violations = []SchemaViolation{{Path: "", Message: "payload is not valid JSON"}}
+	} else if err := match.schema.Validate(doc); err != nil {
+		violations = schemaViolations(err)
+	}
+	if violations == nil {
+		return nil
+	}
+	metricSchemaValidationFailures.WithLabelValues(match.pattern).Inc()
+	return &schemaRejection{Type: "error", Code: "schema_validation_failed", Subject: subject, Errors: violations}
+}
+
+// requireAdmin limits a route group to AuthConfig.Admins.
+func requireAdmin(auth AuthConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !auth.IsAdmin(userFromContext(req.Context())) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+type subjectSchemaEntry struct {
+	Subject string          `json:"subject"`
+	Schema  json.RawMessage `json:"schema"`
+	Source  string          `json:"source"`
+}
+
+// schemaAdminRoutes serves /admin/schemas. Config schemas are listed but can
+// only be overridden, not deleted, through the API.
+func schemaAdminRoutes(store Store, registry *SchemaRegistry) func(chi.Router) {
+	return func(sr chi.Router) {
+		sr.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if store == nil {
+					http.Error(w, "store not configured", http.StatusServiceUnavailable)
+					return
+				}
+				next.ServeHTTP(w, req)
+			})
+		})
+
+		sr.Get("/", func(w http.ResponseWriter, req *http.Request) {
+			stored, err := store.ListSubjectSchemas(req.Context())
+			if err != nil {
+				log.Printf("list schemas failed: %v", err)
+				http.Error(w, "list schemas failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			entries := make(map[string]subjectSchemaEntry)
+			if registry != nil {
+				for pattern, schema := range registry.static {
+					entries[pattern] = subjectSchemaEntry{Subject: pattern, Schema: schema, Source: "config"}
+				}
+			}
+			for _, s := range stored {
+				entries[s.Subject] = subjectSchemaEntry{Subject: s.Subject, Schema: s.Schema, Source: "admin"}
+			}
+			out := make([]subjectSchemaEntry, 0, len(entries))
+			for _, e := range entries {
+				out = append(out, e)
+			}
+			sort.Slice(out, func(i, j int) bool { return out[i].Subject < out[j].Subject })
+			writeJSON(w, http.StatusOK, out)
+		})
+
+		sr.Put("/{subject}", func(w http.ResponseWriter, req *http.Request) {
+			subject := chi.URLParam(req, "subject")
+			if !validSubjectPattern(subject) {
+				http.Error(w, "invalid subject pattern", http.StatusBadRequest)
+				return
+			}
+			raw, err := readBody(w, req)
+			if err != nil {
+				if errors.Is(err, errPayloadTooLarge) {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := compileSubjectSchema(subject, raw); err != nil {
+				http.Error(w, "invalid schema: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := store.PutSubjectSchema(req.Context(), subject, raw); err != nil {
+				log.Printf("put schema failed: %v", err)
+				http.Error(w, "put schema failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			registry.Invalidate(req.Context())
+			writeJSON(w, http.StatusOK, subjectSchemaEntry{Subject: subject, Schema: raw, Source: "admin"})
+		})
+
+		sr.Delete("/{subject}", func(w http.ResponseWriter, req *http.Request) {
+			if err := store.DeleteSubjectSchema(req.Context(), chi.URLParam(req, "subject")); err != nil {
+				if isPgNotFound(err) {
+					http.Error(w, "schema not found", http.StatusNotFound)
+					return
+				}
+				log.Printf("delete schema failed: %v", err)
+				http.Error(w, "delete schema failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			registry.Invalidate(req.Context())
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
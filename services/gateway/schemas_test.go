@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const orderSchema = `{
+  "type": "object",
+  "required": ["id", "qty"],
+  "properties": {
+    "id": {"type": "string"},
+    "qty": {"type": "integer", "minimum": 1}
+  }
+}`
+
+func TestSubjectPatterns(t *testing.T) {
+	cases := []struct {
+		pattern, subject string
+		match            bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.created.eu", false},
+		{"orders.>", "orders.created.eu", true},
+		{"orders.>", "orders", false},
+		{"*.created", "orders.created", true},
+	}
+	for _, tc := range cases {
+		if got := subjectMatches(tc.pattern, tc.subject); got != tc.match {
+			t.Fatalf("%s ~ %s: expected %v", tc.pattern, tc.subject, tc.match)
+		}
+	}
+	for _, bad := range []string{"", "orders.>.x", "orders..x", "orders.a b"} {
+		if validSubjectPattern(bad) {
+			t.Fatalf("expected %q to be invalid", bad)
+		}
+	}
+	if patternSpecificity("orders.created") <= patternSpecificity("orders.*") || patternSpecificity("orders.*") <= patternSpecificity("orders.>") {
+		t.Fatalf("unexpected specificity order")
+	}
+}
+
+func TestSchemaRegistryCheck(t *testing.T) {
+	registry, err := NewSchemaRegistry(nil, map[string]json.RawMessage{
+		"orders.*":      json.RawMessage(orderSchema),
+		"orders.legacy": json.RawMessage(`{}`),
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("registry: %v", err)
+	}
+	ctx := context.Background()
+
+	if r := registry.Check(ctx, "orders.created", []byte(`{"id":"a","qty":2}`)); r != nil {
+		t.Fatalf("expected valid, got %+v", r)
+	}
+	if r := registry.Check(ctx, "storm.events", []byte("not json")); r != nil {
+		t.Fatalf("subjects without a schema must pass")
+	}
+	if r := registry.Check(ctx, "orders.legacy", []byte(`{"anything":true}`)); r != nil {
+		t.Fatalf("most specific schema should win, got %+v", r)
+	}
+
+	before := testutil.ToFloat64(metricSchemaValidationFailures.WithLabelValues("orders.*"))
+	r := registry.Check(ctx, "orders.created", []byte(`{"id":1,"qty":0}`))
+	if r == nil || r.Code != "schema_validation_failed" || len(r.Errors) != 2 {
+		t.Fatalf("expected two violations, got %+v", r)
+	}
+	paths := []string{r.Errors[0].Path, r.Errors[1].Path}
+	if !strings.Contains(strings.Join(paths, ","), "/id") || !strings.Contains(strings.Join(paths, ","), "/qty") {
+		t.Fatalf("unexpected violation paths %v", paths)
+	}
+	if r := registry.Check(ctx, "orders.created", []byte(`{"id":"a"} trailing`)); r == nil || r.Errors[0].Message != "payload is not valid JSON" {
+		t.Fatalf("expected invalid JSON rejection, got %+v", r)
+	}
+	if after := testutil.ToFloat64(metricSchemaValidationFailures.WithLabelValues("orders.*")); after != before+2 {
+		t.Fatalf("expected 2 failures counted, got %v", after-before)
+	}
+}
+
+func TestSchemaRegistryRejectsBadConfig(t *testing.T) {
+	if _, err := NewSchemaRegistry(nil, map[string]json.RawMessage{"orders.*": json.RawMessage(`{"type": 5}`)}, time.Minute); err == nil {
+		t.Fatalf("expected invalid schema error")
+	}
+	if _, err := NewSchemaRegistry(nil, map[string]json.RawMessage{"bad subject": json.RawMessage(`{}`)}, time.Minute); err == nil {
+		t.Fatalf("expected invalid pattern error")
+	}
+	if _, err := compileSubjectSchema("x", []byte(`{"$ref": "file:///etc/passwd"}`)); err == nil {
+		t.Fatalf("external refs must not load")
+	}
+}
+
+func TestSchemasFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+	if err := os.WriteFile(path, []byte(`{"orders.*": `+orderSchema+`}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	t.Setenv("SUBJECT_SCHEMAS_FILE", path)
+	schemas, err := schemasFromEnv()
+	if err != nil || len(schemas) != 1 {
+		t.Fatalf("unexpected schemas %v (%v)", schemas, err)
+	}
+}
+
+func TestSchemaAdminAPIAndPublish(t *testing.T) {
+	store := newMemStore()
+	auth := AuthConfig{Secret: []byte("test"), Enabled: true, Admins: []string{"user-1"}}
+	r := NewRouter(newFakeNats(), store, nil, auth)
+
+	do := func(r http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	schemaPath := "/admin/schemas/" + url.PathEscape("orders.>")
+
+	if w := do(r, http.MethodPut, schemaPath, orderSchema); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(r, http.MethodPut, schemaPath, `{"type": 5}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid schema, got %d", w.Code)
+	}
+	if w := do(r, http.MethodPut, "/admin/schemas/"+url.PathEscape("a b"), `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid pattern, got %d", w.Code)
+	}
+	w := do(r, http.MethodGet, "/admin/schemas", "")
+	var entries []subjectSchemaEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].Source != "admin" {
+		t.Fatalf("unexpected list %s", w.Body.String())
+	}
+
+	w = do(r, http.MethodPost, "/publish?subject=orders.created", `{"id":"a"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", w.Code)
+	}
+	var rejection schemaRejection
+	if err := json.Unmarshal(w.Body.Bytes(), &rejection); err != nil || len(rejection.Errors) == 0 || rejection.Subject != "orders.created" {
+		t.Fatalf("unexpected rejection %s", w.Body.String())
+	}
+	if w := do(r, http.MethodPost, "/publish?subject=orders.created", `{"id":"a","qty":1}`); w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", w.Code)
+	}
+
+	if w := do(r, http.MethodDelete, schemaPath, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if w := do(r, http.MethodDelete, schemaPath, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if w := do(r, http.MethodPost, "/publish?subject=orders.created", `{"id":"a"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("expected schema removal to take effect, got %d", w.Code)
+	}
+
+	nonAdmin := NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+	if w := do(nonAdmin, http.MethodGet, "/admin/schemas", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-admin, got %d", w.Code)
+	}
+}
+
+func TestWebSocketSchemaRejection(t *testing.T) {
+	registry, err := NewSchemaRegistry(nil, map[string]json.RawMessage{"orders.*": json.RawMessage(orderSchema)}, time.Minute)
+	if err != nil {
+		t.Fatalf("registry: %v", err)
+	}
+	nc := newFakeNats()
+	server := httptest.NewServer(NewRouter(nc, nil, nil, AuthConfig{Secret: []byte("test"), Enabled: true}, WithSchemaRegistry(registry)))
+	t.Cleanup(server.Close)
+
+	header := http.Header{}
+	header.Set("Cookie", "access_token="+testToken(t, "test"))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?subject=orders.created", header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"qty":"many"}`)); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ws read: %v", err)
+	}
+	var rejection schemaRejection
+	if err := json.Unmarshal(msg, &rejection); err != nil || rejection.Code != "schema_validation_failed" {
+		t.Fatalf("unexpected notice %q", msg)
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if len(nc.published) != 0 {
+		t.Fatalf("invalid frame must not be published")
+	}
+}
+
+// slowSchemaStore blocks schema loads until release is closed.
+type slowSchemaStore struct {
+	*memStore
+	release chan struct{}
+}
+
+func (s slowSchemaStore) ListSubjectSchemas(ctx context.Context) ([]SubjectSchema, error) {
+	<-s.release
+	return s.memStore.ListSubjectSchemas(ctx)
+}
+
+func TestSchemaRegistryServesStaleSetWhileReloading(t *testing.T) {
+	ctx := context.Background()
+	store := slowSchemaStore{memStore: newMemStore(), release: make(chan struct{})}
+	_ = store.PutSubjectSchema(ctx, "orders.*", []byte(orderSchema))
+	registry, err := NewSchemaRegistry(store, nil, time.Millisecond)
+	if err != nil {
+		t.Fatalf("registry: %v", err)
+	}
+	close(store.release)
+	if r := registry.Check(ctx, "orders.created", []byte(`{}`)); r == nil {
+		t.Fatalf("expected the stored schema to apply")
+	}
+
+	store.release = make(chan struct{})
+	registry.store = store
+	_ = store.DeleteSubjectSchema(ctx, "orders.*")
+	time.Sleep(5 * time.Millisecond)
+	done := make(chan *schemaRejection, 1)
+	go func() { done <- registry.Check(ctx, "orders.created", []byte(`{}`)) }()
+	select {
+	case r := <-done:
+		if r == nil {
+			t.Fatalf("expected the last good set while the reload is pending")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("lookup waited on a slow reload")
+	}
+	close(store.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for registry.Check(ctx, "orders.created", []byte(`{}`)) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("background reload never published the new set")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricWSDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "storm_ws_dropped_messages_total",
+	Help: "Messages not delivered to slow sockets, by reason (drop_oldest, drop_newest, drop_oldest_fallback, disconnect)",
+}, []string{"reason"})
+
+// SendQueuePolicy decides what happens when a socket's send queue is full.
+type SendQueuePolicy string
+
+const (
+	QueueDropOldest SendQueuePolicy = "drop_oldest"
+	QueueDropNewest SendQueuePolicy = "drop_newest"
+	QueueDisconnect SendQueuePolicy = "disconnect"
+)
+
+const defaultSendQueueSize = 256
+
+// dropOldestFallback counts deliveries drop_oldest had to refuse because only
+// replies, which are never dropped, were queued.
+const dropOldestFallback = "drop_oldest_fallback"
+
+// closeSlowConsumer is the close code sent when the disconnect policy trips.
+// Clients should reconnect and resume rather than retry at the same pace.
+const closeSlowConsumer = 4008
+
+func parseSendQueuePolicy(s string) (SendQueuePolicy, error) {
+	switch p := SendQueuePolicy(s); p {
+	case "":
+		return QueueDropOldest, nil
+	case QueueDropOldest, QueueDropNewest, QueueDisconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown send queue policy %q", s)
+	}
+}
+
+// SendQueueConfig sizes every socket's outbound queue. The zero value means
+// defaultSendQueueSize with drop_oldest.
+type SendQueueConfig struct {
+	Size   int
+	Policy SendQueuePolicy
+}
+
+// WithSendQueue sets the outbound queue size and overflow policy of sockets.
+func WithSendQueue(cfg SendQueueConfig) RouterOption {
+	return func(o *routerOptions) {
+		o.sendQueue = cfg
+	}
+}
+
+// missedNotice tells a client that frames were dropped since the last one it got.
+type missedNotice struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+type queuedFrame struct {
+	data []byte
+	// keep marks replies and notices, which are never dropped.
+	keep bool
+}
+
+// sendQueue is a socket's outbound queue. NATS traffic is offered without
+// blocking, so the subscription channel is always drained and NATS never
+// flags the connection as a slow consumer; the overflow policy applies here
+// instead, where drops can be counted and reported to the client. Replies
+// are put with backpressure and are never dropped.
+type sendQueue struct {
+	limit  int
+	policy SendQueuePolicy
+
+	mu     sync.Mutex
+	frames []queuedFrame
+	missed int
+
+	ready chan struct{}
+	space chan struct{}
+
+	// notice encodes the missed-messages notice; nil means JSON.
+	notice func(count int) []byte
+}
+
+func newSendQueue(cfg SendQueueConfig) *sendQueue {
+	if cfg.Size <= 0 {
+		cfg.Size = defaultSendQueueSize
+	}
+	if cfg.Policy == "" {
+		cfg.Policy = QueueDropOldest
+	}
+	return &sendQueue{
+		limit:  cfg.Size,
+		policy: cfg.Policy,
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// offer enqueues a delivery, applying the overflow policy when the queue is
+// full. It returns false when the socket must be disconnected.
+func (q *sendQueue) offer(data []byte) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer wake(q.ready)
+	if len(q.frames) < q.limit {
+		q.frames = append(q.frames, queuedFrame{data: data})
+		return true
+	}
+	switch q.policy {
+	case QueueDisconnect:
+		metricWSDropped.WithLabelValues(string(QueueDisconnect)).Inc()
+		return false
+	case QueueDropOldest:
+		for i, f := range q.frames {
+			if f.keep {
+				continue
+			}
+			q.frames = append(q.frames[:i], q.frames[i+1:]...)
+			q.frames = append(q.frames, queuedFrame{data: data})
+			q.missed++
+			metricWSDropped.WithLabelValues(string(QueueDropOldest)).Inc()
+			return true
+		}
+	}
+	// drop_newest, or drop_oldest with nothing droppable queued.
+	q.missed++
+	reason := string(QueueDropNewest)
+	if q.policy == QueueDropOldest {
+		reason = dropOldestFallback
+	}
+	metricWSDropped.WithLabelValues(reason).Inc()
+	return true
+}
+
+// put enqueues a reply, waiting for room rather than dropping anything.
+func (q *sendQueue) put(ctx context.Context, data []byte) error {
+	for {
+		q.mu.Lock()
+		if len(q.frames) < q.limit {
+			q.frames = append(q.frames, queuedFrame{data: data, keep: true})
+			q.mu.Unlock()
+			wake(q.ready)
+			return nil
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// push enqueues a reply without waiting, past the limit if need be. It is
+// for replies produced off the read loop, such as acks from the worker pool,
+// whose producer must not block on a slow socket. They are bounded by the
+// sends the client has in flight.
+func (q *sendQueue) push(data []byte) {
+	q.mu.Lock()
+	q.frames = append(q.frames, queuedFrame{data: data, keep: true})
+	q.mu.Unlock()
+	wake(q.ready)
+}
+
+// next returns the next frame to write. A pending missed notice comes first.
+func (q *sendQueue) next() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.missed > 0 {
+		var notice []byte
+		if q.notice != nil {
+			notice = q.notice(q.missed)
+		} else {
+			notice, _ = json.Marshal(missedNotice{Type: "missed", Count: q.missed})
+		}
+		q.missed = 0
+		return notice, true
+	}
+	if len(q.frames) == 0 {
+		return nil, false
+	}
+	f := q.frames[0]
+	q.frames[0] = queuedFrame{}
+	q.frames = q.frames[1:]
+	wake(q.space)
+	return f.data, true
+}
+
+// disconnectSlowConsumer closes a socket whose queue overflowed under the
+// disconnect policy. WriteControl may run alongside the writer goroutine.
+func disconnectSlowConsumer(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(closeSlowConsumer, "send queue overflow")
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	_ = conn.Close()
+}
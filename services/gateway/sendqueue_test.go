@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func drain(q *sendQueue) []string {
+	var out []string
+	for data, ok := q.next(); ok; data, ok = q.next() {
+		out = append(out, string(data))
+	}
+	return out
+}
+
+func TestSendQueuePolicies(t *testing.T) {
+	oldest := newSendQueue(SendQueueConfig{Size: 2, Policy: QueueDropOldest})
+	for _, f := range []string{"a", "b", "c"} {
+		if !oldest.offer([]byte(f)) {
+			t.Fatalf("drop_oldest must not disconnect")
+		}
+	}
+	if got := strings.Join(drain(oldest), ","); got != `{"type":"missed","count":1},b,c` {
+		t.Fatalf("drop_oldest: unexpected frames %s", got)
+	}
+
+	newest := newSendQueue(SendQueueConfig{Size: 2, Policy: QueueDropNewest})
+	before := testutil.ToFloat64(metricWSDropped.WithLabelValues(string(QueueDropNewest)))
+	for _, f := range []string{"a", "b", "c", "d"} {
+		newest.offer([]byte(f))
+	}
+	if got := strings.Join(drain(newest), ","); got != `{"type":"missed","count":2},a,b` {
+		t.Fatalf("drop_newest: unexpected frames %s", got)
+	}
+	if after := testutil.ToFloat64(metricWSDropped.WithLabelValues(string(QueueDropNewest))); after != before+2 {
+		t.Fatalf("expected 2 drops counted, got %v", after-before)
+	}
+
+	disconnect := newSendQueue(SendQueueConfig{Size: 1, Policy: QueueDisconnect})
+	if !disconnect.offer([]byte("a")) || disconnect.offer([]byte("b")) {
+		t.Fatalf("disconnect policy should trip on overflow")
+	}
+}
+
+func TestSendQueueKeepsReplies(t *testing.T) {
+	q := newSendQueue(SendQueueConfig{Size: 2, Policy: QueueDropOldest})
+	_ = q.put(context.Background(), []byte("reply"))
+	q.offer([]byte("a"))
+	q.offer([]byte("b"))
+	if got := strings.Join(drain(q), ","); got != `{"type":"missed","count":1},reply,b` {
+		t.Fatalf("replies must survive drop_oldest, got %s", got)
+	}
+
+	// With only replies queued the new delivery is dropped instead, under
+	// its own reason rather than drop_newest.
+	full := newSendQueue(SendQueueConfig{Size: 1, Policy: QueueDropOldest})
+	_ = full.put(context.Background(), []byte("reply"))
+	newest := testutil.ToFloat64(metricWSDropped.WithLabelValues(string(QueueDropNewest)))
+	fallback := testutil.ToFloat64(metricWSDropped.WithLabelValues(dropOldestFallback))
+	full.offer([]byte("a"))
+	if testutil.ToFloat64(metricWSDropped.WithLabelValues(dropOldestFallback)) != fallback+1 ||
+		testutil.ToFloat64(metricWSDropped.WithLabelValues(string(QueueDropNewest))) != newest {
+		t.Fatalf("expected the drop counted as %s", dropOldestFallback)
+	}
+
+	_ = q.put(context.Background(), []byte("x"))
+	_ = q.put(context.Background(), []byte("y"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.put(ctx, []byte("z")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("put on a full queue should wait, got %v", err)
+	}
+	if _, err := parseSendQueuePolicy("drop_all"); err == nil {
+		t.Fatalf("expected unknown policy error")
+	}
+}
+
+func TestWebSocketSlowConsumerDisconnect(t *testing.T) {
+	nc := newFakeNats()
+	router := NewRouter(nc, nil, nil, AuthConfig{}, WithSendQueue(SendQueueConfig{Size: 1, Policy: QueueDisconnect}))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?subject=storm.events", http.Header{})
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	defer conn.Close()
+	select {
+	case <-nc.subscribed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("subscription not established")
+	}
+
+	// Nobody reads, so the writer stalls once the socket buffers fill.
+	payload := []byte(strings.Repeat("x", 64<<10))
+	for i := 0; i < 400; i++ {
+		_ = nc.Publish("storm.events", payload)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, closeSlowConsumer) {
+				t.Fatalf("expected close %d, got %v", closeSlowConsumer, err)
+			}
+			return
+		}
+	}
+}
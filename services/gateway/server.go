@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -49,7 +53,6 @@ type asyncTaskType int
 
 const (
 	taskSaveMessage asyncTaskType = iota
-	taskSaveRefreshToken
 )
 
 type asyncTask struct {
@@ -57,44 +60,21 @@ type asyncTask struct {
 	channelID int64
 	userID    string
 	payload   []byte
-	token     string
-	expiresAt time.Time
+	// seq is the task's place in the write queue spool, 0 when unspooled.
+	seq      uint64
+	attempts int
+	// done, when set, receives the final outcome of a taskSaveMessage.
+	done func(Message, error)
 }
 
 var (
 	asyncTaskQueue = make(chan asyncTask, 50000)
 )
 
-func StartWorkerPool(ctx context.Context, store Store, numWorkers int) {
-	log.Printf("starting message worker pool with %d workers", numWorkers)
-	for i := 0; i < numWorkers; i++ {
-		go func(id int) {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case task := <-asyncTaskQueue:
-					metricSaveQueueLen.Set(float64(len(asyncTaskQueue)))
-					switch task.taskType {
-					case taskSaveMessage:
-						if _, err := store.SaveChannelMessage(context.Background(), task.channelID, task.userID, task.payload); err != nil {
-							log.Printf("worker %d: store message failed: %v", id, err)
-						}
-					case taskSaveRefreshToken:
-						if err := store.SaveRefreshToken(context.Background(), task.userID, task.token, task.expiresAt); err != nil {
-							log.Printf("worker %d: store refresh token failed: %v", id, err)
-						}
-					}
-				}
-			}
-		}(i)
-	}
-}
-
-
 const (
-	defaultSubject = "storm.events"
-	maxBodyBytes   = 1 << 20
+	defaultSubject    = "storm.events"
+	userSubjectPrefix = "users."
+	maxBodyBytes      = 1 << 20
 )
 
 var subjectRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
@@ -193,18 +173,65 @@ type Store interface {
 	GetRefreshToken(ctx context.Context, token string) (RefreshToken, error)
 	RevokeRefreshToken(ctx context.Context, token string) error
 	CreateChannel(ctx context.Context, name, createdBy string) (Channel, error)
-	ListChannels(ctx context.Context) ([]Channel, error)
+	ListChannels(ctx context.Context, userID string) ([]Channel, error)
+	GetChannel(ctx context.Context, channelID int64) (Channel, error)
+	SetChannelRetention(ctx context.Context, channelID int64, seconds *int64) error
+	GetModerationConfig(ctx context.Context, channelID int64) ([]byte, error)
+	SetModerationConfig(ctx context.Context, channelID int64, cfg []byte) error
 	EnsureMember(ctx context.Context, channelID int64, userID string) error
+	IsMember(ctx context.Context, channelID int64, userID string) (bool, error)
+	MarkChannelRead(ctx context.Context, channelID int64, userID string, messageID int64) (int64, error)
+	CreateAttachment(ctx context.Context, attachment Attachment) (Attachment, error)
+	GetAttachment(ctx context.Context, id int64) (Attachment, error)
+	// AttachToMessage links attachments the user uploaded to the channel,
+	// and has not attached yet, to messageID. If any of them does not
+	// qualify, none is linked and errAttachmentUnavailable is returned.
+	AttachToMessage(ctx context.Context, channelID, messageID int64, userID string, attachmentIDs []int64) error
 	SaveChannelMessage(ctx context.Context, channelID int64, userID string, payload []byte) (Message, error)
+	// SaveChannelMessages persists a batch, returning one message and one
+	// error per entry; a failing row does not stop the others.
+	SaveChannelMessages(ctx context.Context, batch []PendingMessage) ([]Message, []error)
 	ListMessages(ctx context.Context, channelID int64, limit int) ([]Message, error)
+	ListMessagesAfter(ctx context.Context, channelID, afterID int64, limit int) ([]Message, error)
+	ExportMessages(ctx context.Context, channelID int64, rng ExportRange, fn func(ExportedMessage) error) error
+	PurgeExpiredMessages(ctx context.Context, batchSize int, archive bool) (int64, error)
+	CountExpiredMessages(ctx context.Context) (int64, error)
 	SaveMessage(ctx context.Context, subject string, payload []byte) error
+	CreateScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error)
+	ListScheduledMessages(ctx context.Context, userID string) ([]ScheduledMessage, error)
+	UpdateScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error)
+	CancelScheduledMessage(ctx context.Context, id int64, userID string) error
+	// ClaimDueScheduledMessages moves up to limit due items, and items whose
+	// earlier claim expired, to sending for lease and returns them.
+	ClaimDueScheduledMessages(ctx context.Context, limit int, lease time.Duration) ([]ScheduledMessage, error)
+	MarkScheduledMessageSent(ctx context.Context, id int64) error
+	MarkScheduledMessageFailed(ctx context.Context, id int64) error
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	ListSubjectSchemas(ctx context.Context) ([]SubjectSchema, error)
+	PutSubjectSchema(ctx context.Context, subject string, schema []byte) error
+	DeleteSubjectSchema(ctx context.Context, subject string) error
 	Close() error
 }
 
-// Presence tracks active connections.
+// Presence tracks active connections. Incr and Decr keep the per-channel
+// connection counters; the rest is heartbeat-based and survives a gateway
+// dying, since entries lapse when their heartbeats stop.
 type Presence interface {
 	Incr(ctx context.Context, key string) error
 	Decr(ctx context.Context, key string) error
+	// Heartbeat marks connID of userID online, and in channelIDs, for ttl.
+	// away marks the connection idle; a user is away when all theirs are.
+	Heartbeat(ctx context.Context, userID, connID string, channelIDs []int64, ttl time.Duration, away bool) error
+	// Leave takes connID out of channelIDs at once.
+	Leave(ctx context.Context, userID, connID string, channelIDs []int64) error
+	// Disconnect takes connID offline and out of channelIDs, recording
+	// when the user was last seen.
+	Disconnect(ctx context.Context, userID, connID string, channelIDs []int64) error
+	// Online lists the users with a live connection in the channel.
+	Online(ctx context.Context, channelID int64) ([]string, error)
+	// Status reports whether the user has any live connection, and
+	// whether all of them are away.
+	Status(ctx context.Context, userID string) (UserPresence, error)
 	Close() error
 }
 
@@ -218,26 +245,89 @@ type AuthConfig struct {
 	CookieDomain  string
 	CookieSecure  bool
 	CorsOrigin    string
+	Admins        []string
+	// ReauthLead is how long before its token expires a socket is asked
+	// for a fresh one.
+	ReauthLead time.Duration
+}
+
+// IsAdmin reports whether userID is listed as a gateway administrator.
+func (c AuthConfig) IsAdmin(userID string) bool {
+	return userID != "" && slices.Contains(c.Admins, userID)
 }
 
-// Channel model.
+// Channel model. Read state fields are relative to the requesting user.
 type Channel struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	CreatedBy string    `json:"created_by"`
-	CreatedAt time.Time `json:"created_at"`
+	ID                int64     `json:"id"`
+	Name              string    `json:"name"`
+	CreatedBy         string    `json:"created_by"`
+	CreatedAt         time.Time `json:"created_at"`
+	RetentionSeconds  *int64    `json:"retention_seconds"`
+	LastReadMessageID int64     `json:"last_read_message_id"`
+	UnreadCount       int64     `json:"unread_count"`
+	MentionCount      int64     `json:"mention_count"`
+}
+
+// ReadMarker is pushed to a user's other sockets when their read position moves.
+type ReadMarker struct {
+	Type              string `json:"type"`
+	ChannelID         int64  `json:"channel_id"`
+	LastReadMessageID int64  `json:"last_read_message_id"`
 }
 
 // Message model.
 type Message struct {
+	ID            int64     `json:"id"`
+	ChannelID     int64     `json:"channel_id"`
+	UserID        string    `json:"user_id"`
+	Subject       string    `json:"subject"`
+	Payload       string    `json:"payload"`
+	AttachmentIDs []int64   `json:"attachment_ids,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// PendingMessage is a channel message queued for a batched save.
+type PendingMessage struct {
+	ChannelID int64
+	UserID    string
+	Payload   []byte
+}
+
+// Attachment model. Blob keys stay server-side; clients use the URLs.
+type Attachment struct {
+	ID           int64     `json:"id"`
+	ChannelID    int64     `json:"channel_id"`
+	UserID       string    `json:"user_id"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	StorageKey   string    `json:"-"`
+	ThumbnailKey string    `json:"-"`
+	MessageID    *int64    `json:"message_id,omitempty"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ScheduledMessage is a channel message or, when ChannelID is nil, a personal
+// reminder delivered at DeliverAt.
+type ScheduledMessage struct {
 	ID        int64     `json:"id"`
-	ChannelID int64     `json:"channel_id"`
 	UserID    string    `json:"user_id"`
-	Subject   string    `json:"subject"`
+	ChannelID *int64    `json:"channel_id"`
 	Payload   string    `json:"payload"`
+	DeliverAt time.Time `json:"deliver_at"`
+	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// SubjectSchema is a JSON Schema registered for a NATS subject pattern.
+type SubjectSchema struct {
+	Subject   string          `json:"subject"`
+	Schema    json.RawMessage `json:"schema"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
 // User model.
 type User struct {
 	ID          string    `json:"id"`
@@ -269,6 +359,14 @@ func (n *natsAdapter) Publish(subject string, data []byte) error {
 	return err
 }
 
+// PublishMsg publishes a message with headers; see publishChannelMessage.
+func (n *natsAdapter) PublishMsg(msg *nats.Msg) error {
+	start := time.Now()
+	err := n.conn.PublishMsg(msg)
+	metricNatsPublishDuration.Observe(time.Since(start).Seconds())
+	return err
+}
+
 func (n *natsAdapter) ChanSubscribe(subject string, ch chan *nats.Msg) (Subscription, error) {
 	sub, err := n.conn.ChanSubscribe(subject, ch)
 	if err != nil {
@@ -289,11 +387,78 @@ func (s *natsSubscription) Unsubscribe() error {
 	return s.sub.Unsubscribe()
 }
 
-func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) http.Handler {
+// RouterOption enables optional gateway features on NewRouter.
+type RouterOption func(*routerOptions)
+
+type routerOptions struct {
+	blobs              BlobStore
+	maxAttachmentBytes int64
+	moderator          *Moderator
+	schemas            *SchemaRegistry
+	sendQueue          SendQueueConfig
+	typing             *TypingTracker
+	compression        CompressionConfig
+	drainer            *Drainer
+	connections        *ConnRegistry
+	limits             *RateLimits
+	presenceCfg        PresenceConfig
+	writes             *WriteQueue
+	// auth is NewRouter's auth config, for sockets that refresh in-band.
+	auth AuthConfig
+}
+
+// WithBlobStore enables attachment uploads of at most maxBytes per file.
+func WithBlobStore(blobs BlobStore, maxBytes int64) RouterOption {
+	return func(o *routerOptions) {
+		o.blobs = blobs
+		o.maxAttachmentBytes = maxBytes
+	}
+}
+
+// WithModerator replaces the default moderator, which only applies
+// per-channel filters, with one that also runs a global chain.
+func WithModerator(m *Moderator) RouterOption {
+	return func(o *routerOptions) {
+		o.moderator = m
+	}
+}
+
+// WithSchemaRegistry replaces the default registry, which only knows schemas
+// registered through the admin API, with one that also has config schemas.
+func WithSchemaRegistry(r *SchemaRegistry) RouterOption {
+	return func(o *routerOptions) {
+		o.schemas = r
+	}
+}
+
+func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig, opts ...RouterOption) http.Handler {
+	var options routerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.moderator == nil {
+		options.moderator, _ = NewModerator(store, nc, ModerationConfig{}, defaultModerationCacheTTL)
+	}
+	if options.schemas == nil {
+		options.schemas, _ = NewSchemaRegistry(store, nil, defaultSchemaCacheTTL)
+	}
+	if options.typing == nil {
+		options.typing = NewTypingTracker(nc, defaultTypingThrottle, defaultTypingTTL)
+	}
+	if options.connections == nil {
+		options.connections = NewConnRegistry(nil, "local", 0)
+	}
+	options.auth = auth
+
 	r := chi.NewRouter()
 	r.Use(corsMiddleware(auth.CorsOrigin))
 
 	r.Get("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		// Failing readiness while draining moves traffic to other replicas.
+		if options.drainer.Draining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
@@ -360,7 +525,11 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 				http.Error(w, "invalid credentials", http.StatusUnauthorized)
 				return
 			}
-			issueSession(w, auth, store, user.ID)
+			if err := issueSession(req.Context(), w, auth, store, user.ID); err != nil {
+				log.Printf("login %s: %v", user.ID, err)
+				http.Error(w, "session store unavailable", http.StatusServiceUnavailable)
+				return
+			}
 			writeJSON(w, http.StatusOK, user)
 		})
 
@@ -392,8 +561,14 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 				return
 			}
 
+			// The old token is only revoked once its replacement is saved, so a
+			// failed refresh can be retried.
+			if err := issueSession(req.Context(), w, auth, store, claims.Subject); err != nil {
+				log.Printf("refresh %s: %v", claims.Subject, err)
+				http.Error(w, "session store unavailable", http.StatusServiceUnavailable)
+				return
+			}
 			_ = store.RevokeRefreshToken(req.Context(), refreshToken)
-			issueSession(w, auth, store, claims.Subject)
 			writeJSON(w, http.StatusOK, map[string]string{"status": "refreshed"})
 		})
 
@@ -445,9 +620,22 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			if !options.limits.allowRequest(w, req, "publish", channelFromSubject(subject)) {
+				return
+			}
 			if len(body) == 0 {
 				body = []byte(`{"msg":"hello from gateway"}`)
 			}
+			if rejection := options.schemas.Check(req.Context(), subject, body); rejection != nil {
+				writeJSON(w, http.StatusUnprocessableEntity, rejection)
+				return
+			}
+			verdict := options.moderator.Check(req.Context(), "publish", channelFromSubject(subject), userFromContext(req.Context()), body)
+			if verdict.Action == ModerationReject {
+				writeJSON(w, http.StatusUnprocessableEntity, newModerationRejection(verdict))
+				return
+			}
+			body = verdict.Payload
 
 			if err := nc.Publish(subject, body); err != nil {
 				http.Error(w, "publish failed: "+err.Error(), http.StatusBadGateway)
@@ -463,8 +651,9 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 		})
 
 
-
-		pr.Get("/ws", wsHandler(nc, store, presence))
+		pr.Get("/ws", wsHandler(nc, store, presence, options))
+		pr.Get("/events", sseHandler(nc, store, presence, options))
+		pr.Get("/poll", pollHandler(nc, store, presence, options))
 
 		pr.Route("/channels", func(cr chi.Router) {
 			cr.Get("/", func(w http.ResponseWriter, req *http.Request) {
@@ -472,7 +661,7 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 					http.Error(w, "store not configured", http.StatusServiceUnavailable)
 					return
 				}
-				channels, err := store.ListChannels(req.Context())
+				channels, err := store.ListChannels(req.Context(), userFromContext(req.Context()))
 				if err != nil {
 					log.Printf("list channels failed: %v", err)
 					http.Error(w, "list channels failed: "+err.Error(), http.StatusInternalServerError)
@@ -539,7 +728,7 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 						log.Printf("ensure member failed: %v", err)
 					}
 
-					payload, err := readMessagePayload(req)
+					payload, attachmentIDs, err := readMessagePayload(req)
 					if err != nil {
 						if errors.Is(err, errPayloadTooLarge) {
 							http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
@@ -548,18 +737,152 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 						http.Error(w, err.Error(), http.StatusBadRequest)
 						return
 					}
+					if !options.limits.allowRequest(w, req, "messages", channelID) {
+						return
+					}
+					if rejection := options.schemas.Check(req.Context(), channelSubject(channelID), payload); rejection != nil {
+						writeJSON(w, http.StatusUnprocessableEntity, rejection)
+						return
+					}
+					verdict := options.moderator.Check(req.Context(), "rest", channelID, userID, payload)
+					if verdict.Action == ModerationReject {
+						writeJSON(w, http.StatusUnprocessableEntity, newModerationRejection(verdict))
+						return
+					}
+					payload = verdict.Payload
+					if err := checkAttachmentRefs(req.Context(), store, channelID, userID, attachmentIDs); err != nil {
+						if errors.Is(err, errAttachmentUnavailable) {
+							http.Error(w, err.Error(), http.StatusBadRequest)
+							return
+						}
+						log.Printf("check attachments failed: %v", err)
+						http.Error(w, "check attachments failed", http.StatusInternalServerError)
+						return
+					}
 					msg, err := store.SaveChannelMessage(req.Context(), channelID, userID, payload)
 					if err != nil {
 						log.Printf("save message failed: %v", err)
 						http.Error(w, "save message failed: "+err.Error(), http.StatusInternalServerError)
 						return
 					}
-					if err := nc.Publish(msg.Subject, payload); err != nil {
+					if len(attachmentIDs) > 0 {
+						// Checked above, so this only fails when a concurrent
+						// send referenced the same attachment first.
+						if err := store.AttachToMessage(req.Context(), channelID, msg.ID, userID, attachmentIDs); err != nil {
+							log.Printf("attach to message %d failed: %v", msg.ID, err)
+							http.Error(w, "attach failed: "+err.Error(), http.StatusConflict)
+							return
+						}
+						msg.AttachmentIDs = attachmentIDs
+					}
+					if err := publishChannelMessage(nc, msg, payload); err != nil {
 						log.Printf("nats publish failed: %v", err)
 					}
 					writeJSON(w, http.StatusCreated, msg)
 				})
 
+				ir.Get("/export", exportHandler(store, auth))
+				ir.Get("/presence", channelPresenceHandler(presence))
+				ir.Get("/moderation", moderationConfigHandler(store, auth, options.moderator))
+				ir.Put("/moderation", moderationConfigHandler(store, auth, options.moderator))
+
+				ir.Put("/retention", func(w http.ResponseWriter, req *http.Request) {
+					if store == nil {
+						http.Error(w, "store not configured", http.StatusServiceUnavailable)
+						return
+					}
+					channelID, err := parseID(chi.URLParam(req, "id"))
+					if err != nil {
+						http.Error(w, "invalid channel id", http.StatusBadRequest)
+						return
+					}
+					var payload struct {
+						RetentionSeconds *int64 `json:"retention_seconds"`
+					}
+					if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+						http.Error(w, "invalid payload", http.StatusBadRequest)
+						return
+					}
+					if payload.RetentionSeconds != nil && *payload.RetentionSeconds < 0 {
+						http.Error(w, "retention_seconds must be >= 0", http.StatusBadRequest)
+						return
+					}
+					channel, err := store.GetChannel(req.Context(), channelID)
+					if err != nil {
+						http.Error(w, "channel not found", http.StatusNotFound)
+						return
+					}
+					if channel.CreatedBy != userFromContext(req.Context()) {
+						http.Error(w, "forbidden", http.StatusForbidden)
+						return
+					}
+					if err := store.SetChannelRetention(req.Context(), channelID, payload.RetentionSeconds); err != nil {
+						log.Printf("set retention failed: %v", err)
+						http.Error(w, "set retention failed: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+					channel.RetentionSeconds = payload.RetentionSeconds
+					writeJSON(w, http.StatusOK, channel)
+				})
+
+				ir.Post("/attachments", uploadAttachmentsHandler(store, options.blobs, options.maxAttachmentBytes))
+
+				ir.Post("/read", func(w http.ResponseWriter, req *http.Request) {
+					if store == nil {
+						http.Error(w, "store not configured", http.StatusServiceUnavailable)
+						return
+					}
+					channelID, err := parseID(chi.URLParam(req, "id"))
+					if err != nil {
+						http.Error(w, "invalid channel id", http.StatusBadRequest)
+						return
+					}
+					userID := userFromContext(req.Context())
+					if userID == "" {
+						http.Error(w, "missing user", http.StatusUnauthorized)
+						return
+					}
+					var payload struct {
+						MessageID int64 `json:"message_id"`
+					}
+					if req.ContentLength != 0 {
+						if err := json.NewDecoder(req.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+							http.Error(w, "invalid payload", http.StatusBadRequest)
+							return
+						}
+					}
+					if payload.MessageID < 0 {
+						http.Error(w, "invalid message id", http.StatusBadRequest)
+						return
+					}
+					member, err := store.IsMember(req.Context(), channelID, userID)
+					if err != nil {
+						http.Error(w, "membership check failed", http.StatusInternalServerError)
+						return
+					}
+					if !member {
+						http.Error(w, "not a channel member", http.StatusNotFound)
+						return
+					}
+					lastRead, err := store.MarkChannelRead(req.Context(), channelID, userID, payload.MessageID)
+					if err != nil {
+						if isPgNotFound(err) {
+							http.Error(w, "not a channel member", http.StatusNotFound)
+							return
+						}
+						log.Printf("mark read failed: %v", err)
+						http.Error(w, "mark read failed: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+					marker := ReadMarker{Type: "read", ChannelID: channelID, LastReadMessageID: lastRead}
+					if data, err := json.Marshal(marker); err == nil {
+						if err := nc.Publish(userSubject(userID), data); err != nil {
+							log.Printf("nats publish read marker failed: %v", err)
+						}
+					}
+					writeJSON(w, http.StatusOK, marker)
+				})
+
 				ir.Get("/messages", func(w http.ResponseWriter, req *http.Request) {
 					if store == nil {
 						http.Error(w, "store not configured", http.StatusServiceUnavailable)
@@ -582,6 +905,17 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 			})
 		})
 
+		pr.Get("/attachments/{id}", downloadAttachmentHandler(store, options.blobs, false))
+		pr.Get("/attachments/{id}/thumbnail", downloadAttachmentHandler(store, options.blobs, true))
+
+		pr.Route("/admin", func(ar chi.Router) {
+			ar.Use(requireAdmin(auth))
+			ar.Route("/schemas", schemaAdminRoutes(store, options.schemas))
+			ar.Route("/connections", connectionAdminRoutes(options.connections))
+		})
+
+		pr.Route("/scheduled", scheduledRoutes(store, options.moderator, envDuration("SCHEDULE_MAX_HORIZON", defaultScheduleHorizon)))
+
 		pr.Route("/users", func(ur chi.Router) {
 			ur.Get("/", func(w http.ResponseWriter, req *http.Request) {
 				if store == nil {
@@ -609,6 +943,8 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 				writeJSON(w, http.StatusOK, user)
 			})
 
+			ur.Get("/{id}/presence", userPresenceHandler(presence))
+
 			ur.Post("/", func(w http.ResponseWriter, req *http.Request) {
 				if store == nil {
 					http.Error(w, "store not configured", http.StatusServiceUnavailable)
@@ -679,6 +1015,9 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 					http.Error(w, "delete user failed", http.StatusInternalServerError)
 					return
 				}
+				// Open sockets would otherwise outlive the account until
+				// their token expires.
+				options.connections.DisconnectUser(req.Context(), targetID)
 				writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
 			})
 		})
@@ -687,30 +1026,55 @@ func NewRouter(nc NatsClient, store Store, presence Presence, auth AuthConfig) h
 	return r
 }
 
-func wsHandler(nc NatsClient, store Store, presence Presence) http.HandlerFunc {
+func wsHandler(nc NatsClient, store Store, presence Presence, options routerOptions) http.HandlerFunc {
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(_ *http.Request) bool { return true },
+		CheckOrigin:       func(_ *http.Request) bool { return true },
+		EnableCompression: options.compression.Enabled,
 	}
 
 	return func(w http.ResponseWriter, req *http.Request) {
+		if options.drainer.Draining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		multiplexed := req.URL.Query().Get("mode") == "multiplex"
+		// Acked legacy sockets send {"type":"send","id":...,"payload":...}
+		// frames and get an ack or nack for each.
+		acked, _ := strconv.ParseBool(req.URL.Query().Get("ack"))
 		subject, channelID, err := subjectOrChannel(req)
-		if err != nil {
+		if err != nil && !multiplexed {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		conn, err := upgrader.Upgrade(w, req, nil)
+		var header http.Header
+		codec := envelopeCodec(jsonCodec{})
+		if multiplexed {
+			var protocol string
+			if protocol, codec = negotiateProtocol(req); protocol != "" {
+				header = http.Header{"Sec-Websocket-Protocol": {protocol}}
+			}
+		}
+
+		conn, err := upgrader.Upgrade(w, req, header)
 		if err != nil {
 			log.Printf("ws dial: %v", err)
 			return
 		}
 
 		metricActiveWebSockets.Inc()
+		untrack := options.drainer.Track(closeForRestart(conn))
 		defer func() {
+			untrack()
 			metricActiveWebSockets.Dec()
 			_ = conn.Close()
 		}()
 
+		if multiplexed {
+			serveMultiplexed(conn, req, nc, store, presence, options, codec)
+			return
+		}
+
 		ctx, cancel := context.WithCancel(req.Context())
 		defer cancel()
 
@@ -741,8 +1105,30 @@ func wsHandler(nc NatsClient, store Store, presence Presence) http.HandlerFunc {
 			_ = conn.WriteMessage(websocket.TextMessage, []byte("subscribe failed"))
 			return
 		}
+		// Per-user events (e.g. read markers) keep the user's sockets in sync.
+		var userSub Subscription
+		if userID != "" {
+			userSub, err = nc.ChanSubscribe(userSubject(userID), ch)
+			if err != nil {
+				log.Printf("user subscribe failed: %v", err)
+			}
+		}
+		// Typing and other ephemeral events for the channel share the socket.
+		var eventsSub Subscription
+		if channelID != 0 {
+			eventsSub, err = nc.ChanSubscribe(channelEventsSubject(channelID), ch)
+			if err != nil {
+				log.Printf("events subscribe failed: %v", err)
+			}
+		}
 		defer func() {
 			_ = sub.Unsubscribe()
+			if userSub != nil {
+				_ = userSub.Unsubscribe()
+			}
+			if eventsSub != nil {
+				_ = eventsSub.Unsubscribe()
+			}
 			close(ch)
 		}()
 
@@ -759,6 +1145,53 @@ func wsHandler(nc NatsClient, store Store, presence Presence) http.HandlerFunc {
 			return nil
 		})
 
+		limit := options.limits.guard(req)
+		live, unregister := options.connections.Register(
+			ConnectionInfo{UserID: userID, Transport: "ws", Subjects: []string{subject}, RemoteAddr: req.RemoteAddr},
+			nil, func() { disconnectByAdmin(conn) })
+		defer unregister()
+		if channelID != 0 && userID != "" {
+			defer options.typing.Stop(channelID, userID, live.id(), "disconnected")
+		}
+		beat := startPresence(nc, presence, options.presenceCfg, userID, live.id(), func() []int64 {
+			if channelID == 0 {
+				return nil
+			}
+			return []int64{channelID}
+		})
+		defer beat.stop()
+
+		// Drain the subscription into the send queue, where the overflow
+		// policy applies; the writer goroutine owns conn writes.
+		queue := newSendQueue(options.sendQueue)
+		watch := watchToken(req, options, store, func(env wsEnvelope) {
+			_ = queue.put(ctx, jsonCodec{}.encode(env))
+		}, func() {
+			closeExpired(conn)
+			cancel()
+		})
+		defer watch.stop()
+		go func() {
+			overflowed := false
+			for msg := range ch {
+				// Typists do not get their own signals back.
+				if channelID != 0 && msg.Subject == channelEventsSubject(channelID) {
+					if ev, ok := parseTypingEvent(msg.Data); ok && ev.UserID == userID {
+						continue
+					}
+					if ev, ok := parsePresenceEvent(msg.Data); ok && ev.UserID == userID {
+						continue
+					}
+				}
+				if !overflowed && !queue.offer(msg.Data) {
+					overflowed = true
+					disconnectSlowConsumer(conn)
+					cancel()
+				}
+			}
+		}()
+
+		writer := newFrameWriter(conn, options.compression, "raw", live)
 		done := make(chan struct{})
 		pingTicker := time.NewTicker(30 * time.Second)
 		go func() {
@@ -770,16 +1203,19 @@ func wsHandler(nc NatsClient, store Store, presence Presence) http.HandlerFunc {
 					return
 				case <-pingTicker.C:
 					_ = conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(5*time.Second))
-				case msg, ok := <-ch:
-					if !ok {
-						return
-					}
-					if err := conn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
-						log.Printf("ws write deadline failed: %v", err)
-						return
-					}
-					if err := conn.WriteMessage(websocket.TextMessage, msg.Data); err != nil {
-						return
+				case <-queue.ready:
+					for {
+						data, ok := queue.next()
+						if !ok {
+							break
+						}
+						if err := conn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
+							log.Printf("ws write deadline failed: %v", err)
+							return
+						}
+						if err := writer.write(websocket.TextMessage, data); err != nil {
+							return
+						}
 					}
 				}
 			}
@@ -794,18 +1230,53 @@ func wsHandler(nc NatsClient, store Store, presence Presence) http.HandlerFunc {
 			if len(message) == 0 {
 				continue
 			}
-			if err := nc.Publish(subject, message); err != nil {
-				log.Printf("ws publish failed: %v", err)
+			countInbound("raw", message)
+			live.received(len(message))
+			beat.active()
+			if cmd, ok := reauthCommand(message); ok {
+				_ = queue.put(ctx, jsonCodec{}.encode(watch.reauth(ctx, cmd)))
+				continue
 			}
-			if store != nil && channelID != 0 && userID != "" {
-				// We copy the message because the original slice might be reused by the websocket reader
-				msgCopy := make([]byte, len(message))
-				copy(msgCopy, message)
-				select {
-				case asyncTaskQueue <- asyncTask{taskType: taskSaveMessage, channelID: channelID, userID: userID, payload: msgCopy}:
-					metricSaveQueueLen.Set(float64(len(asyncTaskQueue)))
-				default:
-					log.Printf("async task queue full, dropping message from %s", userID)
+			// Typing signals are ephemeral: fanned out, never persisted.
+			if kind, ok := typingSignal(message); ok && channelID != 0 {
+				if userID != "" {
+					options.typing.Signal(channelID, userID, live.id(), kind)
+				}
+				continue
+			}
+			refused, flooded := limit.check(ctx, channelID)
+			if flooded {
+				disconnectFlooder(conn)
+				cancel()
+				break
+			}
+			if !acked {
+				if refused != nil {
+					_ = queue.put(ctx, jsonCodec{}.encode(rateLimitWarning(channelID, refused)))
+					continue
+				}
+				if rejection := wsIngress(ctx, nc, store, options, subject, channelID, userID, message, nil); rejection != nil {
+					notice, _ := json.Marshal(rejection)
+					_ = queue.put(ctx, notice)
+				}
+				continue
+			}
+			cmd, err := (jsonCodec{}).decode(message)
+			switch {
+			case err != nil || cmd.Type != "send":
+				_ = queue.put(ctx, jsonCodec{}.encode(nackFrame("", channelID, nackInvalidFrame, "frames must be send commands", nil)))
+			case cmd.ID == "":
+				_ = queue.put(ctx, jsonCodec{}.encode(nackFrame("", channelID, nackMissingID, "sends need an id to be acknowledged", nil)))
+			case refused != nil:
+				_ = queue.put(ctx, jsonCodec{}.encode(rateLimitedFrame(cmd.ID, channelID, refused)))
+			default:
+				// Saves finish on the worker pool, which must not wait on
+				// this socket, so the answer is pushed past the queue limit.
+				done := func(msg Message, err error) {
+					queue.push(jsonCodec{}.encode(sendResult(cmd.ID, channelID, msg, err)))
+				}
+				if rejection := wsIngress(ctx, nc, store, options, subject, channelID, userID, []byte(cmd.Payload), done); rejection != nil {
+					_ = queue.put(ctx, jsonCodec{}.encode(rejectionNack(cmd.ID, channelID, rejection)))
 				}
 			}
 		}
@@ -814,6 +1285,59 @@ func wsHandler(nc NatsClient, store Store, presence Presence) http.HandlerFunc {
 	}
 }
 
+// wsCheck runs schema validation and moderation on a socket frame. It returns
+// the payload to publish, or the rejection to send back instead.
+func wsCheck(ctx context.Context, options routerOptions, subject string, channelID int64, userID string, message []byte) ([]byte, any) {
+	if rejection := options.schemas.Check(ctx, subject, message); rejection != nil {
+		return nil, rejection
+	}
+	verdict := options.moderator.Check(ctx, "ws", channelID, userID, message)
+	if verdict.Action == ModerationReject {
+		return nil, newModerationRejection(verdict)
+	}
+	return verdict.Payload, nil
+}
+
+// wsIngress runs one inbound socket frame through schema validation and
+// moderation, publishes it, and queues channel messages for persistence. It
+// returns the rejection to send back to the client, or nil. When done is set
+// it receives the outcome of every frame that was not rejected: the saved
+// message once the worker pool persists it, or the error that stopped it.
+func wsIngress(ctx context.Context, nc NatsClient, store Store, options routerOptions, subject string, channelID int64, userID string, message []byte, done func(Message, error)) any {
+	message, rejection := wsCheck(ctx, options, subject, channelID, userID, message)
+	if rejection != nil {
+		return rejection
+	}
+	if store != nil && channelID != 0 && userID != "" {
+		// We copy the message because the original slice might be reused by the websocket reader
+		msgCopy := make([]byte, len(message))
+		copy(msgCopy, message)
+		if err := options.writes.Enqueue(ctx, asyncTask{taskType: taskSaveMessage, channelID: channelID, userID: userID, payload: msgCopy, done: done}); err != nil {
+			if done != nil {
+				// The sender will retry, so nobody should see this copy.
+				done(Message{}, err)
+				return nil
+			}
+			log.Printf("write queue rejected message from %s: %v", userID, err)
+		}
+		if err := publishUnsaved(nc, subject, userID, message); err != nil {
+			log.Printf("ws publish failed: %v", err)
+		}
+		return nil
+	}
+	if err := nc.Publish(subject, message); err != nil {
+		log.Printf("ws publish failed: %v", err)
+		if done != nil {
+			done(Message{}, errPublishFailed)
+		}
+		return nil
+	}
+	if done != nil {
+		done(Message{CreatedAt: time.Now()}, nil)
+	}
+	return nil
+}
+
 func authMiddleware(cfg AuthConfig) func(http.Handler) http.Handler {
 	if !cfg.Enabled {
 		return func(next http.Handler) http.Handler { return next }
@@ -827,19 +1351,16 @@ func authMiddleware(cfg AuthConfig) func(http.Handler) http.Handler {
 				return
 			}
 
-			claims := &jwt.RegisteredClaims{}
-			parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
-				if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, errors.New("unexpected signing method")
-				}
-				return cfg.Secret, nil
-			})
-			if err != nil || !parsed.Valid || claims.Subject == "" {
+			claims, err := parseAccessToken(cfg, token)
+			if err != nil {
 				http.Error(w, "invalid token", http.StatusUnauthorized)
 				return
 			}
 
 			ctx := context.WithValue(req.Context(), ctxUserIDKey{}, claims.Subject)
+			if claims.ExpiresAt != nil {
+				ctx = context.WithValue(ctx, ctxTokenExpiryKey{}, claims.ExpiresAt.Time)
+			}
 			next.ServeHTTP(w, req.WithContext(ctx))
 		})
 	}
@@ -875,31 +1396,32 @@ func tokenFromCookie(req *http.Request, name string) string {
 	return cookie.Value
 }
 
-func issueSession(w http.ResponseWriter, cfg AuthConfig, store Store, userID string) {
+// issueSession saves the refresh token before handing out the cookies, so a
+// client never holds a refresh token the store has not seen. On error no
+// cookies are set.
+func issueSession(ctx context.Context, w http.ResponseWriter, cfg AuthConfig, store Store, userID string) error {
 	accessToken, accessExp := signToken(cfg.Secret, userID, cfg.AccessTTL)
 	refreshToken, refreshExp := signToken(cfg.RefreshSecret, userID, cfg.RefreshTTL)
 
 	if store != nil {
-		select {
-		case asyncTaskQueue <- asyncTask{
-			taskType:  taskSaveRefreshToken,
-			userID:    userID,
-			token:     refreshToken,
-			expiresAt: refreshExp,
-		}:
-			metricSaveQueueLen.Set(float64(len(asyncTaskQueue)))
-		default:
-			log.Printf("async task queue full, dropping refresh token for %s", userID)
+		if err := store.SaveRefreshToken(ctx, userID, refreshToken, refreshExp); err != nil {
+			return fmt.Errorf("store refresh token failed: %w", err)
 		}
 	}
 
 	setCookie(w, "access_token", accessToken, accessExp, cfg)
 	setCookie(w, "refresh_token", refreshToken, refreshExp, cfg)
+	return nil
 }
 
 func signToken(secret []byte, userID string, ttl time.Duration) (string, time.Time) {
 	exp := time.Now().Add(ttl)
+	// The random ID keeps two tokens signed in the same second distinct;
+	// refresh tokens are stored by value.
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
 	claims := jwt.RegisteredClaims{
+		ID:        hex.EncodeToString(buf),
 		Subject:   userID,
 		IssuedAt:  jwt.NewNumericDate(time.Now()),
 		ExpiresAt: jwt.NewNumericDate(exp),
@@ -937,7 +1459,7 @@ func subjectFromRequest(req *http.Request) (string, error) {
 	if subject == "" {
 		subject = defaultSubject
 	}
-	if !subjectRe.MatchString(subject) {
+	if !subjectRe.MatchString(subject) || isReservedSubject(subject) {
 		return "", errors.New("invalid subject")
 	}
 	return subject, nil
@@ -952,7 +1474,7 @@ func subjectOrChannel(req *http.Request) (string, int64, error) {
 		return channelSubject(id), id, nil
 	}
 	if raw := req.URL.Query().Get("subject"); raw != "" {
-		if !subjectRe.MatchString(raw) {
+		if !subjectRe.MatchString(raw) || isReservedSubject(raw) {
 			return "", 0, errors.New("invalid subject")
 		}
 		return raw, 0, nil
@@ -964,6 +1486,20 @@ func channelSubject(id int64) string {
 	return "channels." + strconv.FormatInt(id, 10)
 }
 
+// userSubject is the private NATS subject for events addressed to one user.
+// The ID is hex-encoded because user IDs are not restricted to subject tokens.
+func userSubject(userID string) string {
+	return userSubjectPrefix + hex.EncodeToString([]byte(userID))
+}
+
+// isReservedSubject reports whether clients are barred from addressing subject
+// directly through /publish or /ws.
+func isReservedSubject(subject string) bool {
+	return strings.HasPrefix(subject, userSubjectPrefix) || strings.HasPrefix(subject, ephemeralSubjectPrefix) ||
+		strings.HasPrefix(subject, gatewayControlPrefix) || strings.HasPrefix(subject, presenceSubjectPrefix) ||
+		strings.HasPrefix(subject, moderationSubjectPrefix)
+}
+
 func parseID(raw string) (int64, error) {
 	id, err := strconv.ParseInt(raw, 10, 64)
 	if err != nil || id <= 0 {
@@ -988,6 +1524,25 @@ func envInt(key string, fallback int) int {
 	return fallback
 }
 
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
+func envList(key string) []string {
+	var out []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func envIntFromQuery(req *http.Request, key string, fallback int) int {
 	if v := req.URL.Query().Get(key); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
@@ -1038,28 +1593,36 @@ func readBody(w http.ResponseWriter, req *http.Request) ([]byte, error) {
 	return body, nil
 }
 
-func readMessagePayload(req *http.Request) ([]byte, error) {
+// readMessagePayload returns the message body and, for JSON bodies, the
+// attachments it references (deduplicated).
+func readMessagePayload(req *http.Request) ([]byte, []int64, error) {
 	body, err := readBody(nil, req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if len(body) == 0 {
-		return nil, errors.New("empty payload")
+		return nil, nil, errors.New("empty payload")
 	}
 	contentType := req.Header.Get("Content-Type")
 	if strings.HasPrefix(contentType, "application/json") {
 		var payload struct {
-			Payload string `json:"payload"`
+			Payload       string  `json:"payload"`
+			AttachmentIDs []int64 `json:"attachment_ids"`
 		}
 		if err := json.Unmarshal(body, &payload); err != nil {
-			return nil, errors.New("invalid json payload")
+			return nil, nil, errors.New("invalid json payload")
 		}
 		if strings.TrimSpace(payload.Payload) == "" {
-			return nil, errors.New("empty payload")
+			return nil, nil, errors.New("empty payload")
+		}
+		slices.Sort(payload.AttachmentIDs)
+		attachmentIDs := slices.Compact(payload.AttachmentIDs)
+		if len(attachmentIDs) > maxAttachmentsPerUpload {
+			return nil, nil, errors.New("too many attachments")
 		}
-		return []byte(payload.Payload), nil
+		return []byte(payload.Payload), attachmentIDs, nil
 	}
-	return body, nil
+	return body, nil, nil
 }
 
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
@@ -1079,7 +1642,7 @@ func corsMiddleware(origin string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			if req.Method == http.MethodOptions {
@@ -59,6 +59,17 @@ func TestCorsDefaultOrigin(t *testing.T) {
 	}
 }
 
+func TestCorsPreflightAllowsPut(t *testing.T) {
+	handler := corsMiddleware("")(http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodOptions, "/channels/1/retention", nil)
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || !strings.Contains(rec.Header().Get("Access-Control-Allow-Methods"), "PUT") {
+		t.Fatalf("expected PUT allowed by preflight, got %d %q", rec.Code, rec.Header().Get("Access-Control-Allow-Methods"))
+	}
+}
+
 func TestReadBodyWithMaxBytesReader(t *testing.T) {
 	payload := bytes.Repeat([]byte("a"), 10)
 	req := httptest.NewRequest(http.MethodPost, "/publish", bytes.NewBuffer(payload))
@@ -160,7 +171,6 @@ func TestAuthRefreshExpiredToken(t *testing.T) {
 	}
 }
 
-
 func TestSignToken(t *testing.T) {
 	secret := []byte("secret")
 	tokenStr, exp := signToken(secret, "user-1", time.Minute)
@@ -279,7 +289,6 @@ func (s sendingNats) ChanSubscribe(_ string, ch chan *nats.Msg) (Subscription, e
 
 func (s sendingNats) IsConnected() bool { return true }
 
-
 type errReadCloser struct{}
 
 func (errReadCloser) Read([]byte) (int, error) { return 0, errors.New("read failed") }
@@ -336,21 +345,72 @@ func (errStore) VerifyUserPassword(context.Context, string, string) (User, error
 func (errStore) SaveRefreshToken(context.Context, string, string, time.Time) error {
 	return errors.New("save refresh failed")
 }
-func (errStore) GetRefreshToken(context.Context, string) (RefreshToken, error) { return RefreshToken{}, nil }
-func (errStore) RevokeRefreshToken(context.Context, string) error               { return nil }
+func (errStore) GetRefreshToken(context.Context, string) (RefreshToken, error) {
+	return RefreshToken{}, nil
+}
+func (errStore) RevokeRefreshToken(context.Context, string) error { return nil }
 func (errStore) CreateChannel(context.Context, string, string) (Channel, error) {
 	return Channel{}, nil
 }
-func (errStore) ListChannels(context.Context) ([]Channel, error) { return nil, nil }
+func (errStore) ListChannels(context.Context, string) ([]Channel, error)    { return nil, nil }
+func (errStore) GetChannel(context.Context, int64) (Channel, error)         { return Channel{}, nil }
+func (errStore) SetChannelRetention(context.Context, int64, *int64) error   { return nil }
+func (errStore) GetModerationConfig(context.Context, int64) ([]byte, error) { return nil, nil }
+func (errStore) SetModerationConfig(context.Context, int64, []byte) error   { return nil }
+func (errStore) CreateScheduledMessage(_ context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	return sm, nil
+}
+func (errStore) ListScheduledMessages(context.Context, string) ([]ScheduledMessage, error) {
+	return nil, nil
+}
+func (errStore) UpdateScheduledMessage(_ context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	return sm, nil
+}
+func (errStore) CancelScheduledMessage(context.Context, int64, string) error { return nil }
+func (errStore) ClaimDueScheduledMessages(context.Context, int, time.Duration) ([]ScheduledMessage, error) {
+	return nil, nil
+}
+func (errStore) MarkScheduledMessageSent(context.Context, int64) error   { return nil }
+func (errStore) MarkScheduledMessageFailed(context.Context, int64) error { return nil }
+func (errStore) AcquireLease(context.Context, string, string, time.Duration) (bool, error) {
+	return false, nil
+}
+func (errStore) ListSubjectSchemas(context.Context) ([]SubjectSchema, error) { return nil, nil }
+func (errStore) PutSubjectSchema(context.Context, string, []byte) error      { return nil }
+func (errStore) DeleteSubjectSchema(context.Context, string) error           { return nil }
 func (errStore) EnsureMember(context.Context, int64, string) error {
 	return nil
 }
+func (errStore) IsMember(context.Context, int64, string) (bool, error) { return false, nil }
+func (errStore) MarkChannelRead(context.Context, int64, string, int64) (int64, error) {
+	return 0, nil
+}
 func (errStore) SaveChannelMessage(context.Context, int64, string, []byte) (Message, error) {
 	return Message{}, nil
 }
+func (errStore) SaveChannelMessages(_ context.Context, batch []PendingMessage) ([]Message, []error) {
+	return make([]Message, len(batch)), make([]error, len(batch))
+}
+func (errStore) CreateAttachment(context.Context, Attachment) (Attachment, error) {
+	return Attachment{}, nil
+}
+func (errStore) GetAttachment(context.Context, int64) (Attachment, error) {
+	return Attachment{}, nil
+}
+func (errStore) AttachToMessage(context.Context, int64, int64, string, []int64) error {
+	return nil
+}
 func (errStore) ListMessages(context.Context, int64, int) ([]Message, error) { return nil, nil }
-func (errStore) SaveMessage(context.Context, string, []byte) error           { return nil }
-func (errStore) Close() error                                                { return nil }
+func (errStore) ListMessagesAfter(context.Context, int64, int64, int) ([]Message, error) {
+	return nil, errors.New("boom")
+}
+func (errStore) ExportMessages(context.Context, int64, ExportRange, func(ExportedMessage) error) error {
+	return nil
+}
+func (errStore) PurgeExpiredMessages(context.Context, int, bool) (int64, error) { return 0, nil }
+func (errStore) CountExpiredMessages(context.Context) (int64, error)            { return 0, nil }
+func (errStore) SaveMessage(context.Context, string, []byte) error              { return nil }
+func (errStore) Close() error                                                   { return nil }
 
 func TestIssueSessionStoreErrorAdditional(t *testing.T) {
 	cfg := AuthConfig{
@@ -360,10 +420,11 @@ func TestIssueSessionStoreErrorAdditional(t *testing.T) {
 		RefreshTTL:    2 * time.Minute,
 	}
 	w := httptest.NewRecorder()
-	issueSession(w, cfg, errStore{}, "user-1")
-	cookies := w.Result().Cookies()
-	if len(cookies) < 2 {
-		t.Fatalf("expected cookies to be set")
+	if err := issueSession(context.Background(), w, cfg, errStore{}, "user-1"); err == nil {
+		t.Fatalf("expected the store error")
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("expected no cookies for an unsaved session, got %d", len(cookies))
 	}
 }
 
@@ -8,7 +8,6 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,7 +18,6 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/time/rate"
 )
 
@@ -44,6 +42,7 @@ type fakeNats struct {
 type publishCall struct {
 	subject string
 	data    []byte
+	header  nats.Header
 }
 
 type noFlushRecorder struct {
@@ -110,42 +109,55 @@ func (f *fakeNats) Publish(subject string, data []byte) error {
 	return nil
 }
 
+func (f *fakeNats) PublishMsg(msg *nats.Msg) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, publishCall{subject: msg.Subject, data: append([]byte(nil), msg.Data...), header: msg.Header})
+	if ch, ok := f.subjectCh[msg.Subject]; ok {
+		select {
+		case ch <- &nats.Msg{Subject: msg.Subject, Data: append([]byte(nil), msg.Data...), Header: msg.Header}:
+		default:
+		}
+	}
+	return nil
+}
+
 func (f *fakeNats) ChanSubscribe(subject string, ch chan *nats.Msg) (Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.subCh = ch
 	f.subjectCh[subject] = ch
 	select {
 	case f.subscribed <- struct{}{}:
 	default:
 	}
-	return &fakeSub{}, nil
+	return &fakeNatsSub{f: f, subject: subject, ch: ch}, nil
 }
 
-func (f *fakeNats) IsConnected() bool { return true }
-
-type userRecord struct {
-	user         User
-	passwordHash string
+// fakeNatsSub stops delivery on Unsubscribe, so handlers can close their
+// channel afterwards as they would with a real connection.
+type fakeNatsSub struct {
+	f       *fakeNats
+	subject string
+	ch      chan *nats.Msg
 }
 
-type memStore struct {
-	mu          sync.Mutex
-	users       map[string]userRecord
-	channels    map[int64]Channel
-	channelMsgs map[int64][]Message
-	refresh     map[string]RefreshToken
-	nextChanID  int64
-	nextMessage int64
+func (s *fakeNatsSub) Unsubscribe() error {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if s.f.subjectCh[s.subject] == s.ch {
+		delete(s.f.subjectCh, s.subject)
+	}
+	return nil
 }
 
+func (f *fakeNats) IsConnected() bool { return true }
+
+// memStore is the in-memory Store; tests reach into its maps directly.
+type memStore = memoryStore
+
 func newMemStore() *memStore {
-	return &memStore{
-		users:       make(map[string]userRecord),
-		channels:    make(map[int64]Channel),
-		channelMsgs: make(map[int64][]Message),
-		refresh:     make(map[string]RefreshToken),
-		nextChanID:  1,
-		nextMessage: 1,
-	}
+	return newMemoryStore()
 }
 
 type errorStore struct {
@@ -157,201 +169,6 @@ func (e *errorStore) EnsureUser(_ context.Context, _ string) error {
 	return e.ensureUserErr
 }
 
-func (m *memStore) EnsureUser(_ context.Context, userID string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if _, ok := m.users[userID]; ok {
-		return nil
-	}
-	m.users[userID] = userRecord{
-		user: User{
-			ID:        userID,
-			CreatedAt: time.Now(),
-		},
-	}
-	return nil
-}
-
-func (m *memStore) CreateUser(_ context.Context, userID, password, displayName string) (User, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if _, ok := m.users[userID]; ok {
-		return User{}, errors.New("user exists")
-	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return User{}, err
-	}
-	user := User{ID: userID, DisplayName: displayName, CreatedAt: time.Now()}
-	m.users[userID] = userRecord{user: user, passwordHash: string(hash)}
-	return user, nil
-}
-
-func (m *memStore) GetUser(_ context.Context, userID string) (User, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	rec, ok := m.users[userID]
-	if !ok {
-		return User{}, errors.New("not found")
-	}
-	return rec.user, nil
-}
-
-func (m *memStore) ListUsers(_ context.Context) ([]User, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	out := make([]User, 0, len(m.users))
-	for _, rec := range m.users {
-		out = append(out, rec.user)
-	}
-	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
-	return out, nil
-}
-
-func (m *memStore) UpdateUser(_ context.Context, userID, displayName, password string) (User, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	rec, ok := m.users[userID]
-	if !ok {
-		return User{}, errors.New("not found")
-	}
-	if displayName != "" {
-		rec.user.DisplayName = displayName
-	}
-	if password != "" {
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		if err != nil {
-			return User{}, err
-		}
-		rec.passwordHash = string(hash)
-	}
-	m.users[userID] = rec
-	return rec.user, nil
-}
-
-func (m *memStore) DeleteUser(_ context.Context, userID string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.users, userID)
-	return nil
-}
-
-func (m *memStore) VerifyUserPassword(_ context.Context, userID, password string) (User, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	rec, ok := m.users[userID]
-	if !ok || rec.passwordHash == "" {
-		return User{}, errors.New("invalid user")
-	}
-	if err := bcrypt.CompareHashAndPassword([]byte(rec.passwordHash), []byte(password)); err != nil {
-		return User{}, errors.New("invalid password")
-	}
-	return rec.user, nil
-}
-
-func (m *memStore) SaveRefreshToken(_ context.Context, userID, token string, expiresAt time.Time) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.refresh[token] = RefreshToken{Token: token, UserID: userID, ExpiresAt: expiresAt}
-	return nil
-}
-
-func (m *memStore) GetRefreshToken(_ context.Context, token string) (RefreshToken, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	rec, ok := m.refresh[token]
-	if !ok {
-		return RefreshToken{}, errors.New("not found")
-	}
-	return rec, nil
-}
-
-func (m *memStore) RevokeRefreshToken(_ context.Context, token string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	rec, ok := m.refresh[token]
-	if !ok {
-		return nil
-	}
-	rec.Revoked = true
-	m.refresh[token] = rec
-	return nil
-}
-
-func (m *memStore) CreateChannel(_ context.Context, name, createdBy string) (Channel, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if _, ok := m.users[createdBy]; !ok {
-		return Channel{}, errors.New("user not found")
-	}
-	id := m.nextChanID
-	m.nextChanID++
-	ch := Channel{ID: id, Name: name, CreatedBy: createdBy, CreatedAt: time.Now()}
-	m.channels[id] = ch
-	return ch, nil
-}
-
-func (m *memStore) ListChannels(_ context.Context) ([]Channel, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	out := make([]Channel, 0, len(m.channels))
-	for _, ch := range m.channels {
-		out = append(out, ch)
-	}
-	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
-	return out, nil
-}
-
-func (m *memStore) EnsureMember(_ context.Context, channelID int64, userID string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if _, ok := m.channels[channelID]; !ok {
-		return errors.New("channel not found")
-	}
-	if _, ok := m.users[userID]; !ok {
-		return errors.New("user not found")
-	}
-	return nil
-}
-
-func (m *memStore) SaveChannelMessage(_ context.Context, channelID int64, userID string, payload []byte) (Message, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	msg := Message{
-		ID:        m.nextMessage,
-		ChannelID: channelID,
-		UserID:    userID,
-		Subject:   channelSubject(channelID),
-		Payload:   string(payload),
-		CreatedAt: time.Now(),
-	}
-	m.nextMessage++
-	m.channelMsgs[channelID] = append(m.channelMsgs[channelID], msg)
-	return msg, nil
-}
-
-func (m *memStore) ListMessages(_ context.Context, channelID int64, limit int) ([]Message, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	msgs := m.channelMsgs[channelID]
-	if len(msgs) == 0 {
-		return []Message{}, nil
-	}
-	// Return newest first to mirror DB query.
-	out := make([]Message, 0, len(msgs))
-	for i := len(msgs) - 1; i >= 0; i-- {
-		out = append(out, msgs[i])
-		if len(out) >= limit {
-			break
-		}
-	}
-	return out, nil
-}
-
-func (m *memStore) SaveMessage(_ context.Context, _ string, _ []byte) error { return nil }
-
-func (m *memStore) Close() error { return nil }
-
 func TestHealthz(t *testing.T) {
 	nc := newFakeNats()
 	r := NewRouter(nc, nil, nil, AuthConfig{Secret: []byte("test-secret"), Enabled: true})
@@ -522,7 +339,7 @@ func TestAuthMiddlewareAcceptsCookieToken(t *testing.T) {
 func TestReadMessagePayloadJSON(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/channels/1/messages", strings.NewReader(`{"payload":"hello"}`))
 	req.Header.Set("Content-Type", "application/json")
-	payload, err := readMessagePayload(req)
+	payload, _, err := readMessagePayload(req)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -534,7 +351,7 @@ func TestReadMessagePayloadJSON(t *testing.T) {
 func TestReadMessagePayloadEmpty(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/channels/1/messages", strings.NewReader(`{"payload":""}`))
 	req.Header.Set("Content-Type", "application/json")
-	_, err := readMessagePayload(req)
+	_, _, err := readMessagePayload(req)
 	if err == nil {
 		t.Fatalf("expected error")
 	}
@@ -626,7 +443,9 @@ func TestCookieDomainAndSecureFlags(t *testing.T) {
 	}
 
 	w := httptest.NewRecorder()
-	issueSession(w, cfg, nil, "user-1")
+	if err := issueSession(context.Background(), w, cfg, nil, "user-1"); err != nil {
+		t.Fatalf("issue session: %v", err)
+	}
 	cookies := w.Result().Cookies()
 	if len(cookies) == 0 {
 		t.Fatalf("expected cookies")
@@ -983,7 +802,7 @@ func TestWebSocketChannelFlow(t *testing.T) {
 }
 
 func TestWebSocketSubscribeError(t *testing.T) {
-	srv := httptest.NewServer(http.HandlerFunc(wsHandler(errNats{}, nil, nil)))
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler(errNats{}, nil, nil, routerOptions{})))
 	t.Cleanup(srv.Close)
 
 	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?subject=storm.events"
@@ -1216,6 +1035,117 @@ func TestChannelsAndMessagesFlow(t *testing.T) {
 	resp.Body.Close()
 }
 
+func TestChannelReadMarkersAndUnreadCounts(t *testing.T) {
+	store := newMemStore()
+	nc := newFakeNats()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	_ = store.EnsureUser(context.Background(), "bob")
+	channel, _ := store.CreateChannel(context.Background(), "general", "bob")
+	_ = store.EnsureMember(context.Background(), channel.ID, "user-1")
+	first, _ := store.SaveChannelMessage(context.Background(), channel.ID, "bob", []byte("hello"))
+	_, _ = store.SaveChannelMessage(context.Background(), channel.ID, "bob", []byte("ping @user-1"))
+	_, _ = store.SaveChannelMessage(context.Background(), channel.ID, "user-1", []byte("my own message"))
+
+	auth := AuthConfig{Secret: []byte("test"), RefreshSecret: []byte("refresh"), Enabled: true}
+	r := NewRouter(nc, store, nil, auth)
+
+	listChannels := func() Channel {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/channels", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		var channels []Channel
+		if err := json.NewDecoder(w.Body).Decode(&channels); err != nil || len(channels) != 1 {
+			t.Fatalf("decode channels: %v (%d)", err, len(channels))
+		}
+		return channels[0]
+	}
+
+	if got := listChannels(); got.UnreadCount != 2 || got.MentionCount != 1 {
+		t.Fatalf("unexpected counts before read: %+v", got)
+	}
+
+	path := "/channels/" + strconv.FormatInt(channel.ID, 10) + "/read"
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"message_id":`+strconv.FormatInt(first.ID, 10)+`}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if got := listChannels(); got.UnreadCount != 1 || got.MentionCount != 1 || got.LastReadMessageID != first.ID {
+		t.Fatalf("unexpected counts after partial read: %+v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if got := listChannels(); got.UnreadCount != 0 || got.MentionCount != 0 {
+		t.Fatalf("unexpected counts after full read: %+v", got)
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	var synced int
+	for _, call := range nc.published {
+		if call.subject == userSubject("user-1") && strings.Contains(string(call.data), `"type":"read"`) {
+			synced++
+		}
+	}
+	if synced != 2 {
+		t.Fatalf("expected 2 read marker events, got %d", synced)
+	}
+}
+
+func TestChannelReadRequiresMembership(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "bob")
+	channel, _ := store.CreateChannel(context.Background(), "general", "bob")
+	r := NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+
+	req := httptest.NewRequest(http.MethodPost, "/channels/"+strconv.FormatInt(channel.ID, 10)+"/read", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if member, _ := store.IsMember(context.Background(), channel.ID, "user-1"); member {
+		t.Fatalf("marking a channel read must not join it")
+	}
+}
+
+func TestChannelReadInvalidPayload(t *testing.T) {
+	r := NewRouter(newFakeNats(), newMemStore(), nil, AuthConfig{Secret: []byte("test"), Enabled: true})
+	req := httptest.NewRequest(http.MethodPost, "/channels/1/read", strings.NewReader(`{"message_id":-1}`))
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "test"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestReservedUserSubjectRejected(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ws?subject="+userSubject("alice"), nil)
+	if _, _, err := subjectOrChannel(req); err == nil {
+		t.Fatalf("expected reserved subject to be rejected")
+	}
+	req = httptest.NewRequest(http.MethodPost, "/publish?subject="+userSubject("alice"), nil)
+	if _, err := subjectFromRequest(req); err == nil {
+		t.Fatalf("expected reserved subject to be rejected")
+	}
+}
+
 func TestClamp(t *testing.T) {
 	if got := clamp(5, 1, 10); got != 5 {
 		t.Fatalf("expected 5, got %d", got)
@@ -1231,7 +1161,7 @@ func TestClamp(t *testing.T) {
 func TestReadMessagePayloadInvalidJSON(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader(`{"payload":`))
 	req.Header.Set("Content-Type", "application/json")
-	if _, err := readMessagePayload(req); err == nil {
+	if _, _, err := readMessagePayload(req); err == nil {
 		t.Fatalf("expected error")
 	}
 }
@@ -1239,7 +1169,7 @@ func TestReadMessagePayloadInvalidJSON(t *testing.T) {
 func TestReadMessagePayloadEmptyJSON(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader(`{"payload":"   "}`))
 	req.Header.Set("Content-Type", "application/json")
-	if _, err := readMessagePayload(req); err == nil {
+	if _, _, err := readMessagePayload(req); err == nil {
 		t.Fatalf("expected error")
 	}
 }
@@ -1263,7 +1193,7 @@ func TestAuthMiddlewareDisabled(t *testing.T) {
 }
 
 func TestWSHandlerInvalidSubject(t *testing.T) {
-	handler := wsHandler(&fakeNats{}, nil, nil)
+	handler := wsHandler(&fakeNats{}, nil, nil, routerOptions{})
 	req := httptest.NewRequest(http.MethodGet, "/ws?subject=bad%20subject", nil)
 	rec := httptest.NewRecorder()
 	handler(rec, req)
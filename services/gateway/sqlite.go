@@ -0,0 +1,807 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+	"modernc.org/sqlite"
+)
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrationFiles embed.FS
+
+var sqliteJournalModes = []string{"wal", "delete", "truncate", "persist"}
+
+func init() {
+	// storm_mentions(payload, user_id) counts mentions the way memoryStore
+	// and postgresStore do.
+	sqlite.MustRegisterDeterministicScalarFunction("storm_mentions", 2, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		var payload []byte
+		switch v := args[0].(type) {
+		case []byte:
+			payload = v
+		case string:
+			payload = []byte(v)
+		}
+		userID, _ := args[1].(string)
+		if mentionsUser(payload, userID) {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	})
+}
+
+// sqliteStore is a Store on a single SQLite file, for small deployments
+// without Postgres. It keeps postgresStore's semantics, including
+// pgx.ErrNoRows for missing rows; timestamps are stored as unix nanoseconds.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqliteFileDSN turns sqlite:///abs/path.db or sqlite://rel/path.db into a
+// driver DSN. The journal defaults to WAL so readers never block the
+// writer; ?journal_mode= picks another one.
+func sqliteFileDSN(dsn string) (string, error) {
+	rest := dsn
+	for _, prefix := range []string{"sqlite3://", "sqlite://", "sqlite3:", "sqlite:"} {
+		if strings.HasPrefix(rest, prefix) {
+			rest = strings.TrimPrefix(rest, prefix)
+			break
+		}
+	}
+	path, rawQuery, _ := strings.Cut(rest, "?")
+	if path == "" {
+		return "", fmt.Errorf("sqlite DSN %q has no file path", dsn)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", err
+	}
+	journal := strings.ToLower(query.Get("journal_mode"))
+	if journal == "" {
+		journal = "wal"
+	}
+	if !slices.Contains(sqliteJournalModes, journal) {
+		return "", fmt.Errorf("sqlite journal_mode %q: want one of %s", journal, strings.Join(sqliteJournalModes, ", "))
+	}
+	// Writers take the lock at BEGIN and wait for each other rather than
+	// failing with SQLITE_BUSY mid-transaction.
+	return "file:" + path +
+		"?_pragma=journal_mode(" + journal + ")" +
+		"&_pragma=busy_timeout(5000)" +
+		"&_pragma=foreign_keys(1)" +
+		"&_pragma=synchronous(NORMAL)" +
+		"&_txlock=immediate", nil
+}
+
+func NewSQLiteStore(ctx context.Context, dsn string) (Store, error) {
+	fileDSN, err := sqliteFileDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", fileDSN)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqliteStore{db: db}
+	if err := s.migrate(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the pending SQLite migrations in one transaction; the
+// database lock keeps concurrent openers from racing.
+func (s *sqliteStore) migrate(ctx context.Context) error {
+	sub, err := fs.Sub(sqliteMigrationFiles, "migrations/sqlite")
+	if err != nil {
+		return err
+	}
+	migrations, err := loadMigrations(sub)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at INTEGER NOT NULL
+)`); err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	var applied []int64
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied = append(applied, version)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if slices.Contains(applied, m.Version) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+			return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`, m.Version, m.Name, nowNanos()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func nowNanos() int64 {
+	return time.Now().UnixNano()
+}
+
+func fromNanos(ns int64) time.Time {
+	return time.Unix(0, ns)
+}
+
+// sqliteErr maps database/sql's not-found error onto the one handlers test
+// for with isPgNotFound.
+func sqliteErr(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return pgx.ErrNoRows
+	}
+	return err
+}
+
+func sqliteNotFoundIfNone(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+type sqliteScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSQLiteUser(row sqliteScanner) (User, error) {
+	var user User
+	var created int64
+	if err := row.Scan(&user.ID, &user.DisplayName, &created); err != nil {
+		return User{}, sqliteErr(err)
+	}
+	user.CreatedAt = fromNanos(created)
+	return user, nil
+}
+
+func (s *sqliteStore) EnsureUser(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO users (id, created_at) VALUES (?, ?) ON CONFLICT DO NOTHING`, userID, nowNanos())
+	return err
+}
+
+func (s *sqliteStore) CreateUser(ctx context.Context, userID, password, displayName string) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), getBcryptCost())
+	if err != nil {
+		return User{}, err
+	}
+	return scanSQLiteUser(s.db.QueryRowContext(ctx, `
+INSERT INTO users (id, password_hash, display_name, created_at)
+VALUES (?, ?, ?, ?)
+RETURNING id, display_name, created_at
+`, userID, string(hash), displayName, nowNanos()))
+}
+
+func (s *sqliteStore) GetUser(ctx context.Context, userID string) (User, error) {
+	return scanSQLiteUser(s.db.QueryRowContext(ctx, `SELECT id, display_name, created_at FROM users WHERE id = ?`, userID))
+}
+
+func (s *sqliteStore) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, display_name, created_at FROM users ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []User
+	for rows.Next() {
+		user, err := scanSQLiteUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, user)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) UpdateUser(ctx context.Context, userID, displayName, password string) (User, error) {
+	if displayName != "" {
+		if _, err := s.db.ExecContext(ctx, `UPDATE users SET display_name = ? WHERE id = ?`, displayName, userID); err != nil {
+			return User{}, err
+		}
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), getBcryptCost())
+		if err != nil {
+			return User{}, err
+		}
+		if _, err := s.db.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE id = ?`, string(hash), userID); err != nil {
+			return User{}, err
+		}
+	}
+	return s.GetUser(ctx, userID)
+}
+
+func (s *sqliteStore) DeleteUser(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, userID)
+	return err
+}
+
+func (s *sqliteStore) VerifyUserPassword(ctx context.Context, userID, password string) (User, error) {
+	var hash string
+	var user User
+	var created int64
+	err := s.db.QueryRowContext(ctx, `SELECT id, password_hash, display_name, created_at FROM users WHERE id = ?`, userID).
+		Scan(&user.ID, &hash, &user.DisplayName, &created)
+	if err != nil {
+		return User{}, sqliteErr(err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return User{}, errors.New("invalid password")
+	}
+	user.CreatedAt = fromNanos(created)
+	return user, nil
+}
+
+func (s *sqliteStore) SaveRefreshToken(ctx context.Context, userID, token string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO refresh_tokens (token, user_id, expires_at, revoked, created_at)
+VALUES (?, ?, ?, 0, ?)
+`, token, userID, expiresAt.UnixNano(), nowNanos())
+	return err
+}
+
+func (s *sqliteStore) GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	var out RefreshToken
+	var expires int64
+	err := s.db.QueryRowContext(ctx, `SELECT token, user_id, expires_at, revoked FROM refresh_tokens WHERE token = ?`, token).
+		Scan(&out.Token, &out.UserID, &expires, &out.Revoked)
+	if err != nil {
+		return RefreshToken{}, sqliteErr(err)
+	}
+	out.ExpiresAt = fromNanos(expires)
+	return out, nil
+}
+
+func (s *sqliteStore) RevokeRefreshToken(ctx context.Context, token string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE token = ?`, token)
+	return err
+}
+
+func scanSQLiteChannel(row sqliteScanner, extra ...any) (Channel, error) {
+	var c Channel
+	var created int64
+	var retention sql.NullInt64
+	dest := append([]any{&c.ID, &c.Name, &c.CreatedBy, &created, &retention}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return Channel{}, sqliteErr(err)
+	}
+	c.CreatedAt = fromNanos(created)
+	if retention.Valid {
+		c.RetentionSeconds = &retention.Int64
+	}
+	return c, nil
+}
+
+func (s *sqliteStore) CreateChannel(ctx context.Context, name, createdBy string) (Channel, error) {
+	return scanSQLiteChannel(s.db.QueryRowContext(ctx, `
+INSERT INTO channels (name, created_by, created_at)
+VALUES (?, ?, ?)
+RETURNING id, name, created_by, created_at, retention_seconds
+`, name, createdBy, nowNanos()))
+}
+
+func (s *sqliteStore) ListChannels(ctx context.Context, userID string) ([]Channel, error) {
+	// Same counts as postgresStore: only for channels the caller joined,
+	// never counting the caller's own messages.
+	rows, err := s.db.QueryContext(ctx, `
+SELECT c.id, c.name, c.created_by, c.created_at, c.retention_seconds,
+  COALESCE(cm.last_read_message_id, 0),
+  COUNT(m.id),
+  COUNT(CASE WHEN storm_mentions(m.payload, ?1) THEN 1 END)
+FROM channels c
+LEFT JOIN channel_members cm ON cm.channel_id = c.id AND cm.user_id = ?1
+LEFT JOIN messages m ON cm.user_id IS NOT NULL
+  AND m.channel_id = c.id
+  AND m.id > cm.last_read_message_id
+  AND m.user_id IS NOT ?1
+GROUP BY c.id, cm.last_read_message_id
+ORDER BY c.id ASC
+`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Channel
+	for rows.Next() {
+		var lastRead, unread, mentions int64
+		c, err := scanSQLiteChannel(rows, &lastRead, &unread, &mentions)
+		if err != nil {
+			return nil, err
+		}
+		c.LastReadMessageID, c.UnreadCount, c.MentionCount = lastRead, unread, mentions
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) GetChannel(ctx context.Context, channelID int64) (Channel, error) {
+	return scanSQLiteChannel(s.db.QueryRowContext(ctx, `SELECT id, name, created_by, created_at, retention_seconds FROM channels WHERE id = ?`, channelID))
+}
+
+func (s *sqliteStore) SetChannelRetention(ctx context.Context, channelID int64, seconds *int64) error {
+	return sqliteNotFoundIfNone(s.db.ExecContext(ctx, `UPDATE channels SET retention_seconds = ? WHERE id = ?`, seconds, channelID))
+}
+
+func (s *sqliteStore) GetModerationConfig(ctx context.Context, channelID int64) ([]byte, error) {
+	var raw []byte
+	err := s.db.QueryRowContext(ctx, `SELECT moderation FROM channels WHERE id = ?`, channelID).Scan(&raw)
+	return raw, sqliteErr(err)
+}
+
+func (s *sqliteStore) SetModerationConfig(ctx context.Context, channelID int64, cfg []byte) error {
+	return sqliteNotFoundIfNone(s.db.ExecContext(ctx, `UPDATE channels SET moderation = ? WHERE id = ?`, cfg, channelID))
+}
+
+func (s *sqliteStore) EnsureMember(ctx context.Context, channelID int64, userID string) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO channel_members (channel_id, user_id, created_at)
+VALUES (?, ?, ?)
+ON CONFLICT DO NOTHING
+`, channelID, userID, nowNanos())
+	return err
+}
+
+func (s *sqliteStore) IsMember(ctx context.Context, channelID int64, userID string) (bool, error) {
+	var ok bool
+	err := s.db.QueryRowContext(ctx, `
+SELECT EXISTS (SELECT 1 FROM channel_members WHERE channel_id = ? AND user_id = ?)
+`, channelID, userID).Scan(&ok)
+	return ok, err
+}
+
+// MarkChannelRead advances the member's read marker as postgresStore does.
+func (s *sqliteStore) MarkChannelRead(ctx context.Context, channelID int64, userID string, messageID int64) (int64, error) {
+	var lastRead int64
+	err := s.db.QueryRowContext(ctx, `
+UPDATE channel_members
+SET last_read_message_id = MAX(
+  last_read_message_id,
+  (SELECT CASE WHEN ?3 > 0 AND ?3 < latest THEN ?3 ELSE latest END
+   FROM (SELECT COALESCE(MAX(id), 0) AS latest FROM messages WHERE channel_id = ?1))
+)
+WHERE channel_id = ?1 AND user_id = ?2
+RETURNING last_read_message_id
+`, channelID, userID, messageID).Scan(&lastRead)
+	return lastRead, sqliteErr(err)
+}
+
+const sqliteMessageColumns = `id, COALESCE(channel_id, 0), COALESCE(user_id, ''), subject, payload, created_at`
+
+func scanSQLiteMessage(row sqliteScanner) (Message, error) {
+	var msg Message
+	var payload []byte
+	var created int64
+	if err := row.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Subject, &payload, &created); err != nil {
+		return Message{}, sqliteErr(err)
+	}
+	msg.Payload = string(payload)
+	msg.CreatedAt = fromNanos(created)
+	return msg, nil
+}
+
+func (s *sqliteStore) SaveChannelMessage(ctx context.Context, channelID int64, userID string, payload []byte) (Message, error) {
+	return scanSQLiteMessage(s.db.QueryRowContext(ctx, `
+INSERT INTO messages (channel_id, user_id, subject, payload, created_at)
+VALUES (?, ?, ?, ?, ?)
+RETURNING `+sqliteMessageColumns, channelID, userID, channelSubject(channelID), payload, nowNanos()))
+}
+
+// SaveChannelMessages inserts the batch in one transaction, so it costs a
+// single fsync. A failing row leaves the transaction usable for the rest.
+func (s *sqliteStore) SaveChannelMessages(ctx context.Context, batch []PendingMessage) ([]Message, []error) {
+	msgs := make([]Message, len(batch))
+	errs := make([]error, len(batch))
+	fail := func(err error) ([]Message, []error) {
+		for i := range errs {
+			msgs[i], errs[i] = Message{}, err
+		}
+		return msgs, errs
+	}
+	if len(batch) == 0 {
+		return msgs, errs
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	stmt, err := tx.PrepareContext(ctx, `
+INSERT INTO messages (channel_id, user_id, subject, payload, created_at)
+VALUES (?, ?, ?, ?, ?)
+RETURNING `+sqliteMessageColumns)
+	if err != nil {
+		return fail(err)
+	}
+	defer stmt.Close()
+	for i, p := range batch {
+		msgs[i], errs[i] = scanSQLiteMessage(stmt.QueryRowContext(ctx, p.ChannelID, p.UserID, channelSubject(p.ChannelID), p.Payload, nowNanos()))
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return msgs, errs
+}
+
+func (s *sqliteStore) SaveMessage(ctx context.Context, subject string, payload []byte) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO messages (subject, payload, created_at) VALUES (?, ?, ?)`, subject, payload, nowNanos())
+	return err
+}
+
+// sqliteLiveFilter keeps messages of channel ?1 inside its retention; ?2 is
+// the global default in seconds and ?3 the current time.
+const sqliteLiveFilter = `
+  AND (
+    COALESCE((SELECT retention_seconds FROM channels WHERE id = ?1), ?2) <= 0
+    OR created_at >= ?3 - COALESCE((SELECT retention_seconds FROM channels WHERE id = ?1), ?2) * 1000000000
+  )`
+
+func (s *sqliteStore) queryMessages(ctx context.Context, query string, args ...any) ([]Message, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Message
+	for rows.Next() {
+		msg, err := scanSQLiteMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, msg)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) ListMessages(ctx context.Context, channelID int64, limit int) ([]Message, error) {
+	return s.queryMessages(ctx, `
+SELECT `+sqliteMessageColumns+`
+FROM messages
+WHERE channel_id = ?1`+sqliteLiveFilter+`
+ORDER BY id DESC
+LIMIT ?4
+`, channelID, retentionSeconds(getDefaultRetention()), nowNanos(), limit)
+}
+
+func (s *sqliteStore) ListMessagesAfter(ctx context.Context, channelID, afterID int64, limit int) ([]Message, error) {
+	return s.queryMessages(ctx, `
+SELECT `+sqliteMessageColumns+`
+FROM messages
+WHERE channel_id = ?1 AND id > ?4`+sqliteLiveFilter+`
+ORDER BY id ASC
+LIMIT ?5
+`, channelID, retentionSeconds(getDefaultRetention()), nowNanos(), afterID, limit)
+}
+
+// ExportMessages streams rows as fn consumes them, like postgresStore.
+func (s *sqliteStore) ExportMessages(ctx context.Context, channelID int64, rng ExportRange, fn func(ExportedMessage) error) error {
+	var from, to sql.NullInt64
+	if rng.From != nil {
+		from = sql.NullInt64{Int64: rng.From.UnixNano(), Valid: true}
+	}
+	if rng.To != nil {
+		to = sql.NullInt64{Int64: rng.To.UnixNano(), Valid: true}
+	}
+	rows, err := s.db.QueryContext(ctx, `
+SELECT m.id, m.channel_id, COALESCE(m.user_id, ''), COALESCE(u.display_name, ''), m.payload, m.created_at
+FROM messages m
+LEFT JOIN users u ON u.id = m.user_id
+WHERE m.channel_id = ?1
+  AND (?4 IS NULL OR m.created_at >= ?4)
+  AND (?5 IS NULL OR m.created_at < ?5)`+strings.ReplaceAll(sqliteLiveFilter, "created_at", "m.created_at")+`
+ORDER BY m.id ASC
+`, channelID, retentionSeconds(getDefaultRetention()), nowNanos(), from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg ExportedMessage
+		var payload []byte
+		var created int64
+		if err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.DisplayName, &payload, &created); err != nil {
+			return err
+		}
+		msg.Payload = string(payload)
+		msg.CreatedAt = fromNanos(created)
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// sqliteExpiredMessages selects messages past their channel's retention,
+// falling back to the global default (?1); ?2 is the current time.
+const sqliteExpiredMessages = `
+SELECT m.id
+FROM messages m
+LEFT JOIN channels c ON c.id = m.channel_id
+WHERE COALESCE(c.retention_seconds, ?1) > 0
+  AND m.created_at < ?2 - COALESCE(c.retention_seconds, ?1) * 1000000000
+`
+
+func (s *sqliteStore) PurgeExpiredMessages(ctx context.Context, batchSize int, archive bool) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	now := nowNanos()
+	batch := sqliteExpiredMessages + `ORDER BY m.id LIMIT ?3`
+	args := []any{retentionSeconds(getDefaultRetention()), now, batchSize}
+	if archive {
+		if _, err := tx.ExecContext(ctx, `
+INSERT OR IGNORE INTO messages_archive (id, channel_id, user_id, subject, payload, created_at, archived_at)
+SELECT id, channel_id, user_id, subject, payload, created_at, ?2 FROM messages WHERE id IN (`+batch+`)
+`, args...); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id IN (`+batch+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (s *sqliteStore) CountExpiredMessages(ctx context.Context) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM (`+sqliteExpiredMessages+`)`, retentionSeconds(getDefaultRetention()), nowNanos()).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) CreateAttachment(ctx context.Context, a Attachment) (Attachment, error) {
+	var created int64
+	err := s.db.QueryRowContext(ctx, `
+INSERT INTO attachments (channel_id, user_id, filename, content_type, size_bytes, storage_key, thumbnail_key, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+RETURNING id, created_at
+`, a.ChannelID, a.UserID, a.Filename, a.ContentType, a.Size, a.StorageKey, a.ThumbnailKey, nowNanos()).Scan(&a.ID, &created)
+	a.CreatedAt = fromNanos(created)
+	return a, err
+}
+
+func (s *sqliteStore) GetAttachment(ctx context.Context, id int64) (Attachment, error) {
+	var a Attachment
+	var created int64
+	err := s.db.QueryRowContext(ctx, `
+SELECT id, channel_id, user_id, filename, content_type, size_bytes, storage_key, thumbnail_key, message_id, created_at
+FROM attachments
+WHERE id = ?
+`, id).Scan(&a.ID, &a.ChannelID, &a.UserID, &a.Filename, &a.ContentType, &a.Size, &a.StorageKey, &a.ThumbnailKey, &a.MessageID, &created)
+	if err != nil {
+		return Attachment{}, sqliteErr(err)
+	}
+	a.CreatedAt = fromNanos(created)
+	return a, nil
+}
+
+func (s *sqliteStore) AttachToMessage(ctx context.Context, channelID, messageID int64, userID string, attachmentIDs []int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	for _, id := range attachmentIDs {
+		res, err := tx.ExecContext(ctx, `
+UPDATE attachments SET message_id = ?
+WHERE id = ? AND channel_id = ? AND user_id = ? AND message_id IS NULL
+`, messageID, id, channelID, userID)
+		if err := sqliteNotFoundIfNone(res, err); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return errAttachmentUnavailable
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func scanSQLiteScheduled(row sqliteScanner) (ScheduledMessage, error) {
+	var sm ScheduledMessage
+	var channelID sql.NullInt64
+	var payload []byte
+	var deliver, created int64
+	if err := row.Scan(&sm.ID, &sm.UserID, &channelID, &payload, &deliver, &sm.Status, &created); err != nil {
+		return ScheduledMessage{}, sqliteErr(err)
+	}
+	if channelID.Valid {
+		sm.ChannelID = &channelID.Int64
+	}
+	sm.Payload = string(payload)
+	sm.DeliverAt = fromNanos(deliver)
+	sm.CreatedAt = fromNanos(created)
+	return sm, nil
+}
+
+func (s *sqliteStore) queryScheduled(ctx context.Context, query string, args ...any) ([]ScheduledMessage, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ScheduledMessage
+	for rows.Next() {
+		sm, err := scanSQLiteScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sm)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) CreateScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	return scanSQLiteScheduled(s.db.QueryRowContext(ctx, `
+INSERT INTO scheduled_messages (user_id, channel_id, payload, deliver_at, created_at)
+VALUES (?, ?, ?, ?, ?)
+RETURNING `+scheduledColumns, sm.UserID, sm.ChannelID, []byte(sm.Payload), sm.DeliverAt.UnixNano(), nowNanos()))
+}
+
+func (s *sqliteStore) ListScheduledMessages(ctx context.Context, userID string) ([]ScheduledMessage, error) {
+	return s.queryScheduled(ctx, `
+SELECT `+scheduledColumns+`
+FROM scheduled_messages
+WHERE user_id = ? AND status = 'pending'
+ORDER BY deliver_at ASC, id ASC
+`, userID)
+}
+
+func (s *sqliteStore) UpdateScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	return scanSQLiteScheduled(s.db.QueryRowContext(ctx, `
+UPDATE scheduled_messages SET payload = ?3, deliver_at = ?4
+WHERE id = ?1 AND user_id = ?2 AND status = 'pending'
+RETURNING `+scheduledColumns, sm.ID, sm.UserID, []byte(sm.Payload), sm.DeliverAt.UnixNano()))
+}
+
+func (s *sqliteStore) CancelScheduledMessage(ctx context.Context, id int64, userID string) error {
+	return sqliteNotFoundIfNone(s.db.ExecContext(ctx, `UPDATE scheduled_messages SET status = 'cancelled' WHERE id = ? AND user_id = ? AND status = 'pending'`, id, userID))
+}
+
+// ClaimDueScheduledMessages claims due and expired items for lease, as with
+// postgresStore.
+func (s *sqliteStore) ClaimDueScheduledMessages(ctx context.Context, limit int, lease time.Duration) ([]ScheduledMessage, error) {
+	now := nowNanos()
+	out, err := s.queryScheduled(ctx, `
+UPDATE scheduled_messages SET status = 'sending', claimed_until = ?1 + ?3
+WHERE id IN (
+  SELECT id FROM scheduled_messages
+  WHERE (status = 'pending' AND deliver_at <= ?1)
+     OR (status = 'sending' AND claimed_until <= ?1)
+  ORDER BY deliver_at ASC
+  LIMIT ?2
+)
+RETURNING `+scheduledColumns, now, limit, int64(lease))
+	sortScheduled(out)
+	return out, err
+}
+
+func (s *sqliteStore) MarkScheduledMessageSent(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE scheduled_messages SET status = 'sent', sent_at = ? WHERE id = ? AND status = 'sending'`, nowNanos(), id)
+	return err
+}
+
+func (s *sqliteStore) MarkScheduledMessageFailed(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE scheduled_messages SET status = 'failed' WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqliteStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	now := nowNanos()
+	res, err := s.db.ExecContext(ctx, `
+INSERT INTO leader_leases (name, holder, expires_at)
+VALUES (?1, ?2, ?3)
+ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+WHERE leader_leases.holder = excluded.holder OR leader_leases.expires_at < ?4
+`, name, holder, now+int64(ttl), now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqliteStore) ListSubjectSchemas(ctx context.Context) ([]SubjectSchema, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT subject, schema, updated_at FROM subject_schemas ORDER BY subject`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []SubjectSchema
+	for rows.Next() {
+		var ss SubjectSchema
+		var raw string
+		var updated int64
+		if err := rows.Scan(&ss.Subject, &raw, &updated); err != nil {
+			return nil, err
+		}
+		ss.Schema = []byte(raw)
+		ss.UpdatedAt = fromNanos(updated)
+		out = append(out, ss)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Subject < out[j].Subject })
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) PutSubjectSchema(ctx context.Context, subject string, schema []byte) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO subject_schemas (subject, schema, updated_at) VALUES (?1, ?2, ?3)
+ON CONFLICT (subject) DO UPDATE SET schema = excluded.schema, updated_at = excluded.updated_at
+`, subject, string(schema), nowNanos())
+	return err
+}
+
+func (s *sqliteStore) DeleteSubjectSchema(ctx context.Context, subject string) error {
+	return sqliteNotFoundIfNone(s.db.ExecContext(ctx, `DELETE FROM subject_schemas WHERE subject = ?`, subject))
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSQLiteFileDSN(t *testing.T) {
+	got, err := sqliteFileDSN("sqlite:///var/lib/storm/storm.db")
+	if err != nil || !strings.HasPrefix(got, "file:/var/lib/storm/storm.db?") || !strings.Contains(got, "journal_mode(wal)") || !strings.Contains(got, "foreign_keys(1)") {
+		t.Fatalf("unexpected dsn %q %v", got, err)
+	}
+	got, err = sqliteFileDSN("sqlite://data/storm.db?journal_mode=DELETE")
+	if err != nil || !strings.HasPrefix(got, "file:data/storm.db?") || !strings.Contains(got, "journal_mode(delete)") {
+		t.Fatalf("unexpected dsn %q %v", got, err)
+	}
+	for _, dsn := range []string{"sqlite://", "sqlite://x.db?journal_mode=off"} {
+		if _, err := sqliteFileDSN(dsn); err == nil {
+			t.Fatalf("%s: expected error", dsn)
+		}
+	}
+}
+
+func TestSQLiteStoreWALAndReopen(t *testing.T) {
+	t.Setenv("BCRYPT_COST", "4")
+	ctx := context.Background()
+	dsn := "sqlite://" + filepath.Join(t.TempDir(), "storm.db")
+
+	store, err := connectStore(ctx, dsn, 1, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	var mode string
+	if err := store.(*sqliteStore).db.QueryRowContext(ctx, `PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("expected wal journal, got %q %v", mode, err)
+	}
+	if _, err := store.CreateUser(ctx, "alice", "pw", "Alice"); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	ch, err := store.CreateChannel(ctx, "general", "alice")
+	if err != nil {
+		t.Fatalf("create channel: %v", err)
+	}
+	if _, err := store.SaveChannelMessage(ctx, ch.ID, "alice", []byte("hi")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	_ = store.Close()
+
+	// Reopening reapplies no migration and keeps the data.
+	store, err = NewSQLiteStore(ctx, dsn)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.VerifyUserPassword(ctx, "alice", "pw"); err != nil {
+		t.Fatalf("verify after reopen: %v", err)
+	}
+	msgs, err := store.ListMessages(ctx, ch.ID, 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Payload != "hi" {
+		t.Fatalf("expected message to survive reopen, got %+v %v", msgs, err)
+	}
+}
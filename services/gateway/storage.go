@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -12,13 +15,16 @@ import (
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 type pgxPool interface {
 	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
 	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
 	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
 	Close()
 }
 
@@ -33,9 +39,12 @@ func NewPostgresStore(ctx context.Context, dsn string) (Store, error) {
 	}
 
 	s := &postgresStore{pool: pool}
-	if err := s.ensureSchema(ctx); err != nil {
-		pool.Close()
-		return nil, err
+	// MIGRATE_ON_START=false leaves migrations to `gateway migrate up`.
+	if envBool("MIGRATE_ON_START", true) {
+		if err := s.migrate(ctx); err != nil {
+			pool.Close()
+			return nil, err
+		}
 	}
 	return s, nil
 }
@@ -44,54 +53,14 @@ func newPostgresStoreWithPool(pool pgxPool) *postgresStore {
 	return &postgresStore{pool: pool}
 }
 
-func (s *postgresStore) ensureSchema(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
-	_, err := s.pool.Exec(ctx, `
-CREATE TABLE IF NOT EXISTS users (
-  id TEXT PRIMARY KEY,
-  password_hash TEXT NOT NULL,
-  display_name TEXT NOT NULL DEFAULT '',
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-CREATE TABLE IF NOT EXISTS channels (
-  id BIGSERIAL PRIMARY KEY,
-  name TEXT NOT NULL UNIQUE,
-  created_by TEXT NOT NULL REFERENCES users(id),
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-CREATE TABLE IF NOT EXISTS channel_members (
-  channel_id BIGINT NOT NULL REFERENCES channels(id),
-  user_id TEXT NOT NULL REFERENCES users(id),
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  PRIMARY KEY (channel_id, user_id)
-);
-
-CREATE TABLE IF NOT EXISTS messages (
-  id BIGSERIAL PRIMARY KEY,
-  channel_id BIGINT NULL REFERENCES channels(id),
-  user_id TEXT NULL REFERENCES users(id),
-  subject TEXT NOT NULL,
-  payload BYTEA NOT NULL,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-CREATE TABLE IF NOT EXISTS refresh_tokens (
-  token TEXT PRIMARY KEY,
-  user_id TEXT NOT NULL REFERENCES users(id),
-  expires_at TIMESTAMPTZ NOT NULL,
-  revoked BOOLEAN NOT NULL DEFAULT false,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-ALTER TABLE messages ADD COLUMN IF NOT EXISTS channel_id BIGINT NULL;
-ALTER TABLE messages ADD COLUMN IF NOT EXISTS user_id TEXT NULL;
-ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT '';
-ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT NOT NULL DEFAULT '';
-`)
+// migrate brings the schema up to date. Replicas can run it together; the
+// advisory lock in migrator applies each version once.
+func (s *postgresStore) migrate(ctx context.Context) error {
+	m, err := newMigrator(s.pool)
+	if err != nil {
+		return err
+	}
+	_, err = m.Up(ctx)
 	return err
 }
 
@@ -243,11 +212,75 @@ RETURNING id, name, created_by, created_at
 	return channel, err
 }
 
-func (s *postgresStore) ListChannels(ctx context.Context) ([]Channel, error) {
+// mentionsUser reports whether payload mentions userID: "@userID" not
+// preceded by a word character or '@' and not followed by a word character
+// or '-', so "@bobby" and "x@bob.com" do not mention bob. Non-ASCII bytes
+// count as word characters.
+func mentionsUser(payload []byte, userID string) bool {
+	needle := []byte("@" + userID)
+	for i := 0; ; {
+		j := bytes.Index(payload[i:], needle)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(needle)
+		before := start == 0 || !isMentionByte(payload[start-1]) && payload[start-1] != '@'
+		after := end == len(payload) || !isMentionByte(payload[end]) && payload[end] != '-'
+		if before && after {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+func isMentionByte(b byte) bool {
+	return b >= 0x80 || b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// mentionPattern is the Postgres regex equivalent of mentionsUser, matched
+// against encode(payload, 'escape'), which turns non-ASCII bytes into \nnn
+// and doubles backslashes.
+func mentionPattern(userID string) string {
+	var b strings.Builder
+	b.WriteString(`(?<![A-Za-z0-9_@])@`)
+	for _, c := range []byte(userID) {
+		switch {
+		case c >= 0x80 || c == 0:
+			fmt.Fprintf(&b, `\\%03o`, c)
+		case c == '\\':
+			b.WriteString(`\\\\`)
+		case isMentionByte(c):
+			b.WriteByte(c)
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		}
+	}
+	b.WriteString(`(?![A-Za-z0-9_-]|\\[23])`)
+	return b.String()
+}
+
+func (s *postgresStore) ListChannels(ctx context.Context, userID string) ([]Channel, error) {
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	rows, err := s.pool.Query(ctx, `SELECT id, name, created_by, created_at FROM channels ORDER BY id ASC`)
+	// Unread counts only apply to channels the caller is a member of; the
+	// caller's own messages never count as unread.
+	rows, err := s.pool.Query(ctx, `
+SELECT c.id, c.name, c.created_by, c.created_at, c.retention_seconds,
+  COALESCE(cm.last_read_message_id, 0),
+  COUNT(m.id),
+  COUNT(m.id) FILTER (WHERE position(convert_to('@' || $1, 'UTF8') IN m.payload) > 0
+    AND encode(m.payload, 'escape') ~ $2)
+FROM channels c
+LEFT JOIN channel_members cm ON cm.channel_id = c.id AND cm.user_id = $1
+LEFT JOIN messages m ON cm.user_id IS NOT NULL
+  AND m.channel_id = c.id
+  AND m.id > cm.last_read_message_id
+  AND m.user_id IS DISTINCT FROM $1
+GROUP BY c.id, cm.last_read_message_id
+ORDER BY c.id ASC
+`, userID, mentionPattern(userID))
 	if err != nil {
 		return nil, err
 	}
@@ -256,7 +289,7 @@ func (s *postgresStore) ListChannels(ctx context.Context) ([]Channel, error) {
 	var out []Channel
 	for rows.Next() {
 		var c Channel
-		if err := rows.Scan(&c.ID, &c.Name, &c.CreatedBy, &c.CreatedAt); err != nil {
+		if err := rows.Scan(&c.ID, &c.Name, &c.CreatedBy, &c.CreatedAt, &c.RetentionSeconds, &c.LastReadMessageID, &c.UnreadCount, &c.MentionCount); err != nil {
 			return nil, err
 		}
 		out = append(out, c)
@@ -264,6 +297,58 @@ func (s *postgresStore) ListChannels(ctx context.Context) ([]Channel, error) {
 	return out, rows.Err()
 }
 
+func (s *postgresStore) GetChannel(ctx context.Context, channelID int64) (Channel, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var c Channel
+	err := s.pool.QueryRow(ctx, `SELECT id, name, created_by, created_at, retention_seconds FROM channels WHERE id = $1`, channelID).
+		Scan(&c.ID, &c.Name, &c.CreatedBy, &c.CreatedAt, &c.RetentionSeconds)
+	return c, err
+}
+
+// SetChannelRetention overrides the global retention for one channel. A nil
+// value reverts to the global default; zero keeps messages forever.
+func (s *postgresStore) SetChannelRetention(ctx context.Context, channelID int64, seconds *int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, `UPDATE channels SET retention_seconds = $1 WHERE id = $2`, seconds, channelID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// GetModerationConfig returns the channel's raw moderation config, or nil
+// when the channel only uses the global filters.
+func (s *postgresStore) GetModerationConfig(ctx context.Context, channelID int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var raw []byte
+	err := s.pool.QueryRow(ctx, `SELECT moderation FROM channels WHERE id = $1`, channelID).Scan(&raw)
+	return raw, err
+}
+
+// SetModerationConfig stores the channel's moderation config; nil clears it.
+func (s *postgresStore) SetModerationConfig(ctx context.Context, channelID int64, cfg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, `UPDATE channels SET moderation = $1 WHERE id = $2`, cfg, channelID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
 func (s *postgresStore) EnsureMember(ctx context.Context, channelID int64, userID string) error {
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
@@ -276,6 +361,40 @@ ON CONFLICT DO NOTHING
 	return err
 }
 
+func (s *postgresStore) IsMember(ctx context.Context, channelID int64, userID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var ok bool
+	err := s.pool.QueryRow(ctx, `
+SELECT EXISTS (SELECT 1 FROM channel_members WHERE channel_id = $1 AND user_id = $2)
+`, channelID, userID).Scan(&ok)
+	return ok, err
+}
+
+// MarkChannelRead advances the member's read marker. A zero or out-of-range
+// messageID marks the whole channel as read; the marker never moves backwards.
+func (s *postgresStore) MarkChannelRead(ctx context.Context, channelID int64, userID string, messageID int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var lastRead int64
+	err := s.pool.QueryRow(ctx, `
+WITH latest AS (
+  SELECT COALESCE(MAX(id), 0) AS id FROM messages WHERE channel_id = $1
+)
+UPDATE channel_members cm
+SET last_read_message_id = GREATEST(
+  cm.last_read_message_id,
+  CASE WHEN $3::bigint > 0 AND $3::bigint < latest.id THEN $3::bigint ELSE latest.id END
+)
+FROM latest
+WHERE cm.channel_id = $1 AND cm.user_id = $2
+RETURNING cm.last_read_message_id
+`, channelID, userID, messageID).Scan(&lastRead)
+	return lastRead, err
+}
+
 func (s *postgresStore) SaveChannelMessage(ctx context.Context, channelID int64, userID string, payload []byte) (Message, error) {
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
@@ -296,17 +415,138 @@ RETURNING id, channel_id, user_id, subject, payload, created_at
 	return msg, err
 }
 
+// SaveChannelMessages writes the batch as one multi-row insert. If that
+// fails, the rows are retried one by one so a single bad row (a channel
+// deleted meanwhile, say) only fails itself. The insert runs in its own
+// transaction, so a failure while reading back its rows rolls it back
+// before the retry instead of saving the batch twice.
+func (s *postgresStore) SaveChannelMessages(ctx context.Context, batch []PendingMessage) ([]Message, []error) {
+	msgs := make([]Message, len(batch))
+	errs := make([]error, len(batch))
+	if len(batch) == 0 {
+		return msgs, errs
+	}
+
+	channelIDs := make([]int64, len(batch))
+	userIDs := make([]string, len(batch))
+	subjects := make([]string, len(batch))
+	payloads := make([][]byte, len(batch))
+	for i, p := range batch {
+		channelIDs[i], userIDs[i], subjects[i], payloads[i] = p.ChannelID, p.UserID, channelSubject(p.ChannelID), p.Payload
+	}
+	saved, err := s.insertMessages(ctx, channelIDs, userIDs, subjects, payloads)
+	if err == nil {
+		return saved, errs
+	}
+	log.Printf("batch insert of %d messages failed, retrying per row: %v", len(batch), err)
+	for i, p := range batch {
+		msgs[i], errs[i] = s.SaveChannelMessage(ctx, p.ChannelID, p.UserID, p.Payload)
+	}
+	return msgs, errs
+}
+
+// insertMessages inserts the rows in order and commits only once every row
+// has been read back. Ids come from the sequence in that order, so sorting
+// the returned rows by id lines them up with the input.
+func (s *postgresStore) insertMessages(ctx context.Context, channelIDs []int64, userIDs, subjects []string, payloads [][]byte) ([]Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+	rows, err := tx.Query(ctx, `
+INSERT INTO messages (channel_id, user_id, subject, payload)
+SELECT channel_id, user_id, subject, payload
+FROM unnest($1::bigint[], $2::text[], $3::text[], $4::bytea[]) WITH ORDINALITY AS t(channel_id, user_id, subject, payload, n)
+ORDER BY n
+RETURNING id, channel_id, user_id, subject, payload, created_at
+`, channelIDs, userIDs, subjects, payloads)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Message
+	for rows.Next() {
+		var msg Message
+		var dbPayload []byte
+		if err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Subject, &dbPayload, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		msg.Payload = string(dbPayload)
+		out = append(out, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) != len(channelIDs) {
+		return nil, fmt.Errorf("batch insert returned %d of %d rows", len(out), len(channelIDs))
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
 func (s *postgresStore) ListMessages(ctx context.Context, channelID int64, limit int) ([]Message, error) {
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	// Expired rows are filtered here too so history never shows messages the
+	// purge job simply has not reached yet.
 	rows, err := s.pool.Query(ctx, `
 SELECT id, channel_id, user_id, subject, payload, created_at
 FROM messages
 WHERE channel_id = $1
+  AND (
+    COALESCE((SELECT retention_seconds FROM channels WHERE id = $1), $3::bigint) <= 0
+    OR created_at >= now() - make_interval(secs => COALESCE((SELECT retention_seconds FROM channels WHERE id = $1), $3::bigint))
+  )
 ORDER BY id DESC
 LIMIT $2
-`, channelID, limit)
+`, channelID, limit, retentionSeconds(getDefaultRetention()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Message
+	for rows.Next() {
+		var msg Message
+		var payload []byte
+		if err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Subject, &payload, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		msg.Payload = string(payload)
+		out = append(out, msg)
+	}
+	return out, rows.Err()
+}
+
+// ListMessagesAfter returns up to limit messages with an id above afterID, oldest
+// first. It backs socket resume, so the same retention filter applies.
+func (s *postgresStore) ListMessagesAfter(ctx context.Context, channelID, afterID int64, limit int) ([]Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, `
+SELECT id, channel_id, user_id, subject, payload, created_at
+FROM messages
+WHERE channel_id = $1
+  AND id > $2
+  AND (
+    COALESCE((SELECT retention_seconds FROM channels WHERE id = $1), $4::bigint) <= 0
+    OR created_at >= now() - make_interval(secs => COALESCE((SELECT retention_seconds FROM channels WHERE id = $1), $4::bigint))
+  )
+ORDER BY id ASC
+LIMIT $3
+`, channelID, afterID, limit, retentionSeconds(getDefaultRetention()))
 	if err != nil {
 		return nil, err
 	}
@@ -325,6 +565,338 @@ LIMIT $2
 	return out, rows.Err()
 }
 
+// ExportMessages streams a channel's history in id order, calling fn per row.
+// Rows are read from the connection as fn consumes them, so exports of any
+// size run in constant memory. Expired messages are excluded as in ListMessages.
+func (s *postgresStore) ExportMessages(ctx context.Context, channelID int64, rng ExportRange, fn func(ExportedMessage) error) error {
+	rows, err := s.pool.Query(ctx, `
+SELECT m.id, m.channel_id, COALESCE(m.user_id, ''), COALESCE(u.display_name, ''), m.payload, m.created_at
+FROM messages m
+LEFT JOIN users u ON u.id = m.user_id
+WHERE m.channel_id = $1
+  AND ($2::timestamptz IS NULL OR m.created_at >= $2)
+  AND ($3::timestamptz IS NULL OR m.created_at < $3)
+  AND (
+    COALESCE((SELECT retention_seconds FROM channels WHERE id = $1), $4::bigint) <= 0
+    OR m.created_at >= now() - make_interval(secs => COALESCE((SELECT retention_seconds FROM channels WHERE id = $1), $4::bigint))
+  )
+ORDER BY m.id ASC
+`, channelID, rng.From, rng.To, retentionSeconds(getDefaultRetention()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg ExportedMessage
+		var payload []byte
+		if err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.DisplayName, &payload, &msg.CreatedAt); err != nil {
+			return err
+		}
+		msg.Payload = string(payload)
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// expiredMessagesSQL selects messages past their channel's retention, falling
+// back to the global default ($1) for channels without an override and for
+// subject-only messages.
+const expiredMessagesSQL = `
+SELECT m.id
+FROM messages m
+LEFT JOIN channels c ON c.id = m.channel_id
+WHERE COALESCE(c.retention_seconds, $1::bigint) > 0
+  AND m.created_at < now() - make_interval(secs => COALESCE(c.retention_seconds, $1::bigint))
+`
+
+// PurgeExpiredMessages deletes (or moves to messages_archive) at most
+// batchSize expired messages. Rows locked by other writers are skipped so the
+// purge never waits on hot rows.
+func (s *postgresStore) PurgeExpiredMessages(ctx context.Context, batchSize int, archive bool) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	query := `
+WITH expired AS (` + expiredMessagesSQL + `
+  LIMIT $2
+  FOR UPDATE OF m SKIP LOCKED
+)
+DELETE FROM messages WHERE id IN (SELECT id FROM expired)
+`
+	if archive {
+		query = `
+WITH expired AS (` + expiredMessagesSQL + `
+  LIMIT $2
+  FOR UPDATE OF m SKIP LOCKED
+), moved AS (
+  DELETE FROM messages m USING expired e WHERE m.id = e.id
+  RETURNING m.id, m.channel_id, m.user_id, m.subject, m.payload, m.created_at
+)
+INSERT INTO messages_archive (id, channel_id, user_id, subject, payload, created_at)
+SELECT id, channel_id, user_id, subject, payload, created_at FROM moved
+ON CONFLICT (id) DO NOTHING
+`
+	}
+	tag, err := s.pool.Exec(ctx, query, retentionSeconds(getDefaultRetention()), batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *postgresStore) CountExpiredMessages(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var n int64
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM (`+expiredMessagesSQL+`) expired`, retentionSeconds(getDefaultRetention())).Scan(&n)
+	return n, err
+}
+
+func (s *postgresStore) CreateAttachment(ctx context.Context, a Attachment) (Attachment, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := s.pool.QueryRow(ctx, `
+INSERT INTO attachments (channel_id, user_id, filename, content_type, size_bytes, storage_key, thumbnail_key)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id, created_at
+`, a.ChannelID, a.UserID, a.Filename, a.ContentType, a.Size, a.StorageKey, a.ThumbnailKey).Scan(&a.ID, &a.CreatedAt)
+	return a, err
+}
+
+func (s *postgresStore) GetAttachment(ctx context.Context, id int64) (Attachment, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var a Attachment
+	err := s.pool.QueryRow(ctx, `
+SELECT id, channel_id, user_id, filename, content_type, size_bytes, storage_key, thumbnail_key, message_id, created_at
+FROM attachments
+WHERE id = $1
+`, id).Scan(&a.ID, &a.ChannelID, &a.UserID, &a.Filename, &a.ContentType, &a.Size, &a.StorageKey, &a.ThumbnailKey, &a.MessageID, &a.CreatedAt)
+	return a, err
+}
+
+func (s *postgresStore) AttachToMessage(ctx context.Context, channelID, messageID int64, userID string, attachmentIDs []int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+	tag, err := tx.Exec(ctx, `
+UPDATE attachments SET message_id = $1
+WHERE id = ANY($2) AND channel_id = $3 AND user_id = $4 AND message_id IS NULL
+`, messageID, attachmentIDs, channelID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() != int64(len(attachmentIDs)) {
+		return errAttachmentUnavailable
+	}
+	return tx.Commit(ctx)
+}
+
+const scheduledColumns = `id, user_id, channel_id, payload, deliver_at, status, created_at`
+
+func scanScheduledMessage(row pgx.Row) (ScheduledMessage, error) {
+	var sm ScheduledMessage
+	var payload []byte
+	err := row.Scan(&sm.ID, &sm.UserID, &sm.ChannelID, &payload, &sm.DeliverAt, &sm.Status, &sm.CreatedAt)
+	sm.Payload = string(payload)
+	return sm, err
+}
+
+func (s *postgresStore) CreateScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	return scanScheduledMessage(s.pool.QueryRow(ctx, `
+INSERT INTO scheduled_messages (user_id, channel_id, payload, deliver_at)
+VALUES ($1, $2, $3, $4)
+RETURNING `+scheduledColumns, sm.UserID, sm.ChannelID, []byte(sm.Payload), sm.DeliverAt))
+}
+
+// ListScheduledMessages returns the user's pending items, soonest first.
+func (s *postgresStore) ListScheduledMessages(ctx context.Context, userID string) ([]ScheduledMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, `
+SELECT `+scheduledColumns+`
+FROM scheduled_messages
+WHERE user_id = $1 AND status = 'pending'
+ORDER BY deliver_at ASC, id ASC
+`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ScheduledMessage
+	for rows.Next() {
+		sm, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sm)
+	}
+	return out, rows.Err()
+}
+
+// UpdateScheduledMessage changes the payload and delivery time of a pending
+// item owned by sm.UserID. It returns pgx.ErrNoRows once the item has been
+// sent or cancelled.
+func (s *postgresStore) UpdateScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	return scanScheduledMessage(s.pool.QueryRow(ctx, `
+UPDATE scheduled_messages SET payload = $3, deliver_at = $4
+WHERE id = $1 AND user_id = $2 AND status = 'pending'
+RETURNING `+scheduledColumns, sm.ID, sm.UserID, []byte(sm.Payload), sm.DeliverAt))
+}
+
+func (s *postgresStore) CancelScheduledMessage(ctx context.Context, id int64, userID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, `UPDATE scheduled_messages SET status = 'cancelled' WHERE id = $1 AND user_id = $2 AND status = 'pending'`, id, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// ClaimDueScheduledMessages marks up to limit due items as sending until the
+// lease expires and returns them. A claim keeps replicas whose scheduler
+// leases briefly overlap from both delivering; one that expires, because its
+// dispatcher died before MarkScheduledMessageSent, is claimed again.
+func (s *postgresStore) ClaimDueScheduledMessages(ctx context.Context, limit int, lease time.Duration) ([]ScheduledMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, `
+UPDATE scheduled_messages SET status = 'sending', claimed_until = now() + make_interval(secs => $2)
+WHERE id IN (
+  SELECT id FROM scheduled_messages
+  WHERE (status = 'pending' AND deliver_at <= now())
+     OR (status = 'sending' AND claimed_until <= now())
+  ORDER BY deliver_at ASC
+  LIMIT $1
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING `+scheduledColumns, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ScheduledMessage
+	for rows.Next() {
+		sm, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sm)
+	}
+	return out, rows.Err()
+}
+
+// MarkScheduledMessageSent records the delivery of a claimed item.
+func (s *postgresStore) MarkScheduledMessageSent(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, `UPDATE scheduled_messages SET status = 'sent', sent_at = now() WHERE id = $1 AND status = 'sending'`, id)
+	return err
+}
+
+func (s *postgresStore) MarkScheduledMessageFailed(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, `UPDATE scheduled_messages SET status = 'failed' WHERE id = $1`, id)
+	return err
+}
+
+// AcquireLease takes or renews the named lease for holder. It succeeds when
+// the lease is free, expired, or already held by holder.
+func (s *postgresStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, `
+INSERT INTO leader_leases (name, holder, expires_at)
+VALUES ($1, $2, now() + make_interval(secs => $3))
+ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+WHERE leader_leases.holder = EXCLUDED.holder OR leader_leases.expires_at < now()
+`, name, holder, ttl.Seconds())
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *postgresStore) ListSubjectSchemas(ctx context.Context) ([]SubjectSchema, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, `SELECT subject, schema, updated_at FROM subject_schemas ORDER BY subject`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []SubjectSchema
+	for rows.Next() {
+		var ss SubjectSchema
+		var raw []byte
+		if err := rows.Scan(&ss.Subject, &raw, &ss.UpdatedAt); err != nil {
+			return nil, err
+		}
+		ss.Schema = raw
+		out = append(out, ss)
+	}
+	return out, rows.Err()
+}
+
+func (s *postgresStore) PutSubjectSchema(ctx context.Context, subject string, schema []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO subject_schemas (subject, schema) VALUES ($1, $2)
+ON CONFLICT (subject) DO UPDATE SET schema = EXCLUDED.schema, updated_at = now()
+`, subject, schema)
+	return err
+}
+
+func (s *postgresStore) DeleteSubjectSchema(ctx context.Context, subject string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, `DELETE FROM subject_schemas WHERE subject = $1`, subject)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
 func (s *postgresStore) SaveMessage(ctx context.Context, subject string, payload []byte) error {
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
@@ -369,6 +941,123 @@ func (r *redisPresence) Decr(ctx context.Context, key string) error {
 	return r.client.Decr(ctx, r.key(key)).Err()
 }
 
+// Heartbeats live in sorted sets scored by expiry: presence:online:user:<id>
+// holds connection ids, presence:away:user:<id> those of them that are idle,
+// and presence:online:channel:<id> "<conn>/<user>" pairs. Expired members
+// are pruned on read; the sets themselves expire with the last heartbeat.
+func (r *redisPresence) onlineUserKey(userID string) string {
+	return r.key("online:user:" + userID)
+}
+
+func (r *redisPresence) onlineChannelKey(channelID int64) string {
+	return r.key("online:channel:" + strconv.FormatInt(channelID, 10))
+}
+
+func (r *redisPresence) awayUserKey(userID string) string {
+	return r.key("away:user:" + userID)
+}
+
+func (r *redisPresence) seenKey(userID string) string {
+	return r.key("seen:" + userID)
+}
+
+func (r *redisPresence) Heartbeat(ctx context.Context, userID, connID string, channelIDs []int64, ttl time.Duration, away bool) error {
+	now := time.Now()
+	expires := float64(now.Add(ttl).UnixMilli())
+	pipe := r.client.TxPipeline()
+	pipe.ZAdd(ctx, r.onlineUserKey(userID), redis.Z{Score: expires, Member: connID})
+	pipe.PExpire(ctx, r.onlineUserKey(userID), ttl)
+	if away {
+		pipe.ZAdd(ctx, r.awayUserKey(userID), redis.Z{Score: expires, Member: connID})
+		pipe.PExpire(ctx, r.awayUserKey(userID), ttl)
+	} else {
+		pipe.ZRem(ctx, r.awayUserKey(userID), connID)
+	}
+	for _, channelID := range channelIDs {
+		pipe.ZAdd(ctx, r.onlineChannelKey(channelID), redis.Z{Score: expires, Member: connID + "/" + userID})
+		pipe.PExpire(ctx, r.onlineChannelKey(channelID), ttl)
+	}
+	pipe.Set(ctx, r.seenKey(userID), now.UnixMilli(), 0)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisPresence) Leave(ctx context.Context, userID, connID string, channelIDs []int64) error {
+	if len(channelIDs) == 0 {
+		return nil
+	}
+	pipe := r.client.TxPipeline()
+	for _, channelID := range channelIDs {
+		pipe.ZRem(ctx, r.onlineChannelKey(channelID), connID+"/"+userID)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisPresence) Disconnect(ctx context.Context, userID, connID string, channelIDs []int64) error {
+	pipe := r.client.TxPipeline()
+	pipe.ZRem(ctx, r.onlineUserKey(userID), connID)
+	pipe.ZRem(ctx, r.awayUserKey(userID), connID)
+	for _, channelID := range channelIDs {
+		pipe.ZRem(ctx, r.onlineChannelKey(channelID), connID+"/"+userID)
+	}
+	pipe.Set(ctx, r.seenKey(userID), time.Now().UnixMilli(), 0)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// live prunes a presence set's expired members and returns the rest.
+func (r *redisPresence) live(ctx context.Context, key string) ([]string, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	pipe := r.client.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", now)
+	members := pipe.ZRange(ctx, key, 0, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return members.Val(), nil
+}
+
+func (r *redisPresence) Online(ctx context.Context, channelID int64) ([]string, error) {
+	members, err := r.live(ctx, r.onlineChannelKey(channelID))
+	if err != nil {
+		return nil, err
+	}
+	users := make([]string, 0, len(members))
+	for _, member := range members {
+		if _, userID, ok := strings.Cut(member, "/"); ok {
+			users = append(users, userID)
+		}
+	}
+	slices.Sort(users)
+	return slices.Compact(users), nil
+}
+
+func (r *redisPresence) Status(ctx context.Context, userID string) (UserPresence, error) {
+	status := UserPresence{UserID: userID}
+	conns, err := r.live(ctx, r.onlineUserKey(userID))
+	if err != nil {
+		return status, err
+	}
+	status.Online = len(conns) > 0
+	idle, err := r.live(ctx, r.awayUserKey(userID))
+	if err != nil {
+		return status, err
+	}
+	status.Away = status.Online && !slices.ContainsFunc(conns, func(connID string) bool {
+		return !slices.Contains(idle, connID)
+	})
+	seen, err := r.client.Get(ctx, r.seenKey(userID)).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return status, err
+	}
+	if err == nil {
+		at := time.UnixMilli(seen).UTC()
+		status.LastSeen = &at
+	}
+	return status, nil
+}
+
 func (r *redisPresence) Close() error {
 	return r.client.Close()
 }
@@ -377,6 +1066,20 @@ func isPgNotFound(err error) bool {
 	return errors.Is(err, pgx.ErrNoRows)
 }
 
+// getDefaultRetention is the global message retention (MESSAGE_RETENTION,
+// e.g. "720h"). Zero, the default, keeps messages forever.
+func getDefaultRetention() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("MESSAGE_RETENTION"))
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+func retentionSeconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
 func getBcryptCost() int {
 	costStr := os.Getenv("BCRYPT_COST")
 	if costStr == "" {
@@ -13,24 +13,6 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-func TestPostgresStoreEnsureSchema(t *testing.T) {
-	mock, err := pgxmock.NewPool()
-	if err != nil {
-		t.Fatalf("mock: %v", err)
-	}
-	defer mock.Close()
-
-	mock.ExpectExec("CREATE TABLE").WillReturnResult(pgxmock.NewResult("CREATE", 1))
-
-	s := newPostgresStoreWithPool(mock)
-	if err := s.ensureSchema(context.Background()); err != nil {
-		t.Fatalf("ensure schema: %v", err)
-	}
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Fatalf("expectations: %v", err)
-	}
-}
-
 func TestPostgresStoreUserFlow(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	if err != nil {
@@ -141,12 +123,17 @@ func TestPostgresStoreChannelsAndMessages(t *testing.T) {
 		t.Fatalf("create channel: %v", err)
 	}
 
-	mock.ExpectQuery("SELECT id, name").WillReturnRows(
-		pgxmock.NewRows([]string{"id", "name", "created_by", "created_at"}).AddRow(int64(1), "general", "alice", time.Now()),
+	mock.ExpectQuery("SELECT c.id, c.name").WithArgs("alice", mentionPattern("alice")).WillReturnRows(
+		pgxmock.NewRows([]string{"id", "name", "created_by", "created_at", "retention_seconds", "last_read_message_id", "unread_count", "mention_count"}).
+			AddRow(int64(1), "general", "alice", time.Now(), nil, int64(2), int64(3), int64(1)),
 	)
-	if _, err := s.ListChannels(context.Background()); err != nil {
+	channels, err := s.ListChannels(context.Background(), "alice")
+	if err != nil {
 		t.Fatalf("list channels: %v", err)
 	}
+	if len(channels) != 1 || channels[0].UnreadCount != 3 || channels[0].MentionCount != 1 || channels[0].LastReadMessageID != 2 {
+		t.Fatalf("unexpected channels: %+v", channels)
+	}
 
 	mock.ExpectExec("INSERT INTO channel_members").WithArgs(int64(1), "alice").WillReturnResult(pgxmock.NewResult("INSERT", 1))
 	if err := s.EnsureMember(context.Background(), 1, "alice"); err != nil {
@@ -161,7 +148,7 @@ func TestPostgresStoreChannelsAndMessages(t *testing.T) {
 		t.Fatalf("save channel message: %v", err)
 	}
 
-	mock.ExpectQuery("SELECT id, channel_id").WithArgs(int64(1), 10).WillReturnRows(
+	mock.ExpectQuery("SELECT id, channel_id").WithArgs(int64(1), 10, int64(0)).WillReturnRows(
 		pgxmock.NewRows([]string{"id", "channel_id", "user_id", "subject", "payload", "created_at"}).AddRow(int64(1), int64(1), "alice", "channels.1", payload, time.Now()),
 	)
 	if _, err := s.ListMessages(context.Background(), 1, 10); err != nil {
@@ -178,16 +165,35 @@ func TestPostgresStoreChannelsAndMessages(t *testing.T) {
 	}
 }
 
-func TestIsPgNotFound(t *testing.T) {
-	if !isPgNotFound(pgx.ErrNoRows) {
-		t.Fatalf("expected true")
+func TestPostgresStoreMarkChannelRead(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
 	}
-	if isPgNotFound(context.Canceled) {
-		t.Fatalf("expected false")
+	defer mock.Close()
+
+	s := newPostgresStoreWithPool(mock)
+	mock.ExpectQuery("UPDATE channel_members").WithArgs(int64(1), "alice", int64(5)).WillReturnRows(
+		pgxmock.NewRows([]string{"last_read_message_id"}).AddRow(int64(5)),
+	)
+	lastRead, err := s.MarkChannelRead(context.Background(), 1, "alice", 5)
+	if err != nil {
+		t.Fatalf("mark read: %v", err)
+	}
+	if lastRead != 5 {
+		t.Fatalf("expected 5, got %d", lastRead)
+	}
+
+	mock.ExpectQuery("UPDATE channel_members").WithArgs(int64(1), "mallory", int64(0)).WillReturnError(pgx.ErrNoRows)
+	if _, err := s.MarkChannelRead(context.Background(), 1, "mallory", 0); !isPgNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
 	}
 }
 
-func TestPostgresStoreEnsureSchemaError(t *testing.T) {
+func TestPostgresStoreAttachments(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	if err != nil {
 		t.Fatalf("mock: %v", err)
@@ -195,9 +201,251 @@ func TestPostgresStoreEnsureSchemaError(t *testing.T) {
 	defer mock.Close()
 
 	s := newPostgresStoreWithPool(mock)
-	mock.ExpectExec("CREATE TABLE").WillReturnError(errors.New("boom"))
-	if err := s.ensureSchema(context.Background()); err == nil {
-		t.Fatalf("expected error")
+	now := time.Now()
+	mock.ExpectQuery("INSERT INTO attachments").
+		WithArgs(int64(1), "alice", "a.png", "image/png", int64(42), "channels/1/k", "channels/1/k.thumb.png").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "created_at"}).AddRow(int64(7), now))
+	created, err := s.CreateAttachment(context.Background(), Attachment{
+		ChannelID:    1,
+		UserID:       "alice",
+		Filename:     "a.png",
+		ContentType:  "image/png",
+		Size:         42,
+		StorageKey:   "channels/1/k",
+		ThumbnailKey: "channels/1/k.thumb.png",
+	})
+	if err != nil || created.ID != 7 {
+		t.Fatalf("create attachment: %v (%+v)", err, created)
+	}
+
+	mock.ExpectQuery("SELECT id, channel_id, user_id, filename").WithArgs(int64(7)).WillReturnRows(
+		pgxmock.NewRows([]string{"id", "channel_id", "user_id", "filename", "content_type", "size_bytes", "storage_key", "thumbnail_key", "message_id", "created_at"}).
+			AddRow(int64(7), int64(1), "alice", "a.png", "image/png", int64(42), "channels/1/k", "", nil, now),
+	)
+	got, err := s.GetAttachment(context.Background(), 7)
+	if err != nil || got.StorageKey != "channels/1/k" || got.MessageID != nil {
+		t.Fatalf("get attachment: %v (%+v)", err, got)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE attachments SET message_id").WithArgs(int64(9), []int64{7, 8}, int64(1), "alice").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectRollback()
+	if err := s.AttachToMessage(context.Background(), 1, 9, "alice", []int64{7, 8}); !errors.Is(err, errAttachmentUnavailable) {
+		t.Fatalf("expected a partial link to be refused, got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(int64(1), "alice").WillReturnRows(
+		pgxmock.NewRows([]string{"exists"}).AddRow(true),
+	)
+	if ok, err := s.IsMember(context.Background(), 1, "alice"); err != nil || !ok {
+		t.Fatalf("is member: %v %v", ok, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
+func TestPostgresStoreRetention(t *testing.T) {
+	t.Setenv("MESSAGE_RETENTION", "24h")
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+
+	s := newPostgresStoreWithPool(mock)
+	week := int64(7 * 24 * 3600)
+	mock.ExpectExec("UPDATE channels SET retention_seconds").WithArgs(&week, int64(1)).WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	if err := s.SetChannelRetention(context.Background(), 1, &week); err != nil {
+		t.Fatalf("set retention: %v", err)
+	}
+	mock.ExpectExec("UPDATE channels SET retention_seconds").WithArgs((*int64)(nil), int64(2)).WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	if err := s.SetChannelRetention(context.Background(), 2, nil); !isPgNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT id, name, created_by, created_at, retention_seconds FROM channels").WithArgs(int64(1)).WillReturnRows(
+		pgxmock.NewRows([]string{"id", "name", "created_by", "created_at", "retention_seconds"}).AddRow(int64(1), "general", "alice", time.Now(), &week),
+	)
+	channel, err := s.GetChannel(context.Background(), 1)
+	if err != nil || channel.RetentionSeconds == nil || *channel.RetentionSeconds != week {
+		t.Fatalf("get channel: %v (%+v)", err, channel)
+	}
+
+	mock.ExpectExec("DELETE FROM messages WHERE id IN").WithArgs(int64(86400), 500).WillReturnResult(pgxmock.NewResult("DELETE", 500))
+	if n, err := s.PurgeExpiredMessages(context.Background(), 500, false); err != nil || n != 500 {
+		t.Fatalf("purge: %d %v", n, err)
+	}
+	mock.ExpectExec("INSERT INTO messages_archive").WithArgs(int64(86400), 500).WillReturnResult(pgxmock.NewResult("INSERT", 3))
+	if n, err := s.PurgeExpiredMessages(context.Background(), 500, true); err != nil || n != 3 {
+		t.Fatalf("archive: %d %v", n, err)
+	}
+	mock.ExpectQuery("SELECT count").WithArgs(int64(86400)).WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(42)))
+	if n, err := s.CountExpiredMessages(context.Background()); err != nil || n != 42 {
+		t.Fatalf("count: %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
+func TestPostgresStoreExportMessages(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+
+	s := newPostgresStoreWithPool(mock)
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rng := ExportRange{From: &from}
+	mock.ExpectQuery("LEFT JOIN users u").WithArgs(int64(1), rng.From, rng.To, int64(0)).WillReturnRows(
+		pgxmock.NewRows([]string{"id", "channel_id", "user_id", "display_name", "payload", "created_at"}).
+			AddRow(int64(1), int64(1), "alice", "Alice", []byte("a"), time.Now()).
+			AddRow(int64(2), int64(1), "bob", "Bob", []byte("b"), time.Now()),
+	)
+	var got []string
+	err = s.ExportMessages(context.Background(), 1, rng, func(msg ExportedMessage) error {
+		got = append(got, msg.DisplayName+":"+msg.Payload)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if len(got) != 2 || got[0] != "Alice:a" || got[1] != "Bob:b" {
+		t.Fatalf("unexpected rows %v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
+func TestPostgresStoreModerationConfig(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+
+	s := newPostgresStoreWithPool(mock)
+	cfg := []byte(`{"filters":[{"type":"links"}]}`)
+	mock.ExpectExec("UPDATE channels SET moderation").WithArgs(cfg, int64(1)).WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	if err := s.SetModerationConfig(context.Background(), 1, cfg); err != nil {
+		t.Fatalf("set moderation: %v", err)
+	}
+	mock.ExpectExec("UPDATE channels SET moderation").WithArgs(cfg, int64(2)).WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	if err := s.SetModerationConfig(context.Background(), 2, cfg); !isPgNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	mock.ExpectQuery("SELECT moderation FROM channels").WithArgs(int64(1)).WillReturnRows(pgxmock.NewRows([]string{"moderation"}).AddRow(cfg))
+	raw, err := s.GetModerationConfig(context.Background(), 1)
+	if err != nil || string(raw) != string(cfg) {
+		t.Fatalf("get moderation: %q %v", raw, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
+func TestPostgresStoreScheduledMessages(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+
+	s := newPostgresStoreWithPool(mock)
+	now := time.Now()
+	channelID := int64(3)
+	cols := []string{"id", "user_id", "channel_id", "payload", "deliver_at", "status", "created_at"}
+
+	mock.ExpectQuery("INSERT INTO scheduled_messages").WithArgs("alice", &channelID, []byte("hi"), now).
+		WillReturnRows(pgxmock.NewRows(cols).AddRow(int64(1), "alice", &channelID, []byte("hi"), now, "pending", now))
+	sm, err := s.CreateScheduledMessage(context.Background(), ScheduledMessage{UserID: "alice", ChannelID: &channelID, Payload: "hi", DeliverAt: now})
+	if err != nil || sm.ID != 1 || sm.Payload != "hi" || *sm.ChannelID != channelID {
+		t.Fatalf("create: %+v %v", sm, err)
+	}
+
+	mock.ExpectQuery("UPDATE scheduled_messages SET status = 'sending'").WithArgs(50, float64(30)).
+		WillReturnRows(pgxmock.NewRows(cols).AddRow(int64(1), "alice", (*int64)(nil), []byte("hi"), now, "sending", now))
+	due, err := s.ClaimDueScheduledMessages(context.Background(), 50, 30*time.Second)
+	if err != nil || len(due) != 1 || due[0].ChannelID != nil || due[0].Status != scheduledSending {
+		t.Fatalf("claim: %+v %v", due, err)
+	}
+	mock.ExpectExec("UPDATE scheduled_messages SET status = 'sent'").WithArgs(int64(1)).WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	if err := s.MarkScheduledMessageSent(context.Background(), 1); err != nil {
+		t.Fatalf("mark sent: %v", err)
+	}
+
+	mock.ExpectExec("UPDATE scheduled_messages SET status = 'cancelled'").WithArgs(int64(1), "alice").WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	if err := s.CancelScheduledMessage(context.Background(), 1, "alice"); !isPgNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	mock.ExpectExec("INSERT INTO leader_leases").WithArgs("scheduler", "a", float64(15)).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	if ok, err := s.AcquireLease(context.Background(), "scheduler", "a", 15*time.Second); err != nil || !ok {
+		t.Fatalf("acquire: %v %v", ok, err)
+	}
+	mock.ExpectExec("INSERT INTO leader_leases").WithArgs("scheduler", "b", float64(15)).WillReturnResult(pgxmock.NewResult("INSERT", 0))
+	if ok, err := s.AcquireLease(context.Background(), "scheduler", "b", 15*time.Second); err != nil || ok {
+		t.Fatalf("expected lease held elsewhere: %v %v", ok, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
+func TestPostgresStoreSubjectSchemas(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+
+	s := newPostgresStoreWithPool(mock)
+	schema := []byte(`{"type":"object"}`)
+	mock.ExpectExec("INSERT INTO subject_schemas").WithArgs("orders.*", schema).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	if err := s.PutSubjectSchema(context.Background(), "orders.*", schema); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	mock.ExpectQuery("SELECT subject, schema, updated_at FROM subject_schemas").WillReturnRows(
+		pgxmock.NewRows([]string{"subject", "schema", "updated_at"}).AddRow("orders.*", schema, time.Now()),
+	)
+	schemas, err := s.ListSubjectSchemas(context.Background())
+	if err != nil || len(schemas) != 1 || string(schemas[0].Schema) != string(schema) {
+		t.Fatalf("list: %+v %v", schemas, err)
+	}
+	mock.ExpectExec("DELETE FROM subject_schemas").WithArgs("orders.*").WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	if err := s.DeleteSubjectSchema(context.Background(), "orders.*"); !isPgNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
+func TestGetDefaultRetention(t *testing.T) {
+	t.Setenv("MESSAGE_RETENTION", "")
+	if got := getDefaultRetention(); got != 0 {
+		t.Fatalf("expected 0, got %s", got)
+	}
+	t.Setenv("MESSAGE_RETENTION", "-1h")
+	if got := getDefaultRetention(); got != 0 {
+		t.Fatalf("expected 0 for negative, got %s", got)
+	}
+	t.Setenv("MESSAGE_RETENTION", "720h")
+	if got := getDefaultRetention(); got != 720*time.Hour {
+		t.Fatalf("expected 720h, got %s", got)
+	}
+}
+
+func TestIsPgNotFound(t *testing.T) {
+	if !isPgNotFound(pgx.ErrNoRows) {
+		t.Fatalf("expected true")
+	}
+	if isPgNotFound(context.Canceled) {
+		t.Fatalf("expected false")
 	}
 }
 
@@ -271,12 +519,34 @@ func TestPostgresStoreListMessagesError(t *testing.T) {
 	defer mock.Close()
 
 	s := newPostgresStoreWithPool(mock)
-	mock.ExpectQuery("SELECT id, channel_id").WithArgs(int64(1), 10).WillReturnError(errors.New("boom"))
+	mock.ExpectQuery("SELECT id, channel_id").WithArgs(int64(1), 10, int64(0)).WillReturnError(errors.New("boom"))
 	if _, err := s.ListMessages(context.Background(), 1, 10); err == nil {
 		t.Fatalf("expected error")
 	}
 }
 
+func TestPostgresStoreListMessagesAfter(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+
+	s := newPostgresStoreWithPool(mock)
+	mock.ExpectQuery("AND id > \\$2").WithArgs(int64(1), int64(5), 11, int64(0)).WillReturnRows(
+		pgxmock.NewRows([]string{"id", "channel_id", "user_id", "subject", "payload", "created_at"}).
+			AddRow(int64(6), int64(1), "alice", "channels.1", []byte("a"), time.Now()).
+			AddRow(int64(7), int64(1), "bob", "channels.1", []byte("b"), time.Now()),
+	)
+	msgs, err := s.ListMessagesAfter(context.Background(), 1, 5, 11)
+	if err != nil || len(msgs) != 2 || msgs[0].ID != 6 || msgs[1].Payload != "b" {
+		t.Fatalf("unexpected messages %+v (%v)", msgs, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
 func TestPostgresStoreSaveMessageError(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	if err != nil {
@@ -347,6 +617,65 @@ func TestPostgresStoreSaveChannelMessageError(t *testing.T) {
 	}
 }
 
+func TestPostgresStoreSaveChannelMessagesBatch(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("mock: %v", err)
+	}
+	defer mock.Close()
+
+	s := newPostgresStoreWithPool(mock)
+	batch := []PendingMessage{
+		{ChannelID: 1, UserID: "alice", Payload: []byte("a")},
+		{ChannelID: 2, UserID: "bob", Payload: []byte("b")},
+	}
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages").
+		WithArgs([]int64{1, 2}, []string{"alice", "bob"}, []string{"channels.1", "channels.2"}, [][]byte{[]byte("a"), []byte("b")}).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "channel_id", "user_id", "subject", "payload", "created_at"}).
+			AddRow(int64(11), int64(2), "bob", "channels.2", []byte("b"), now).
+			AddRow(int64(10), int64(1), "alice", "channels.1", []byte("a"), now))
+	mock.ExpectCommit()
+	msgs, errs := s.SaveChannelMessages(context.Background(), batch)
+	if errs[0] != nil || errs[1] != nil || msgs[0].ID != 10 || msgs[1].Payload != "b" {
+		t.Fatalf("expected rows in input order, got %+v %v", msgs, errs)
+	}
+
+	// When the multi-row insert fails, each row is retried on its own.
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages").WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).WillReturnError(errors.New("fk violation"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("INSERT INTO messages").WithArgs(int64(1), "alice", "channels.1", []byte("a")).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "channel_id", "user_id", "subject", "payload", "created_at"}).AddRow(int64(12), int64(1), "alice", "channels.1", []byte("a"), now))
+	mock.ExpectQuery("INSERT INTO messages").WithArgs(int64(2), "bob", "channels.2", []byte("b")).WillReturnError(errors.New("fk violation"))
+	msgs, errs = s.SaveChannelMessages(context.Background(), batch)
+	if errs[0] != nil || msgs[0].ID != 12 || errs[1] == nil {
+		t.Fatalf("expected only the bad row to fail, got %+v %v", msgs, errs)
+	}
+
+	// A failure reading back the inserted rows rolls the batch back, so the
+	// per-row retry does not save it twice.
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages").WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "channel_id", "user_id", "subject", "payload", "created_at"}).
+			AddRow(int64(13), int64(1), "alice", "channels.1", []byte("a"), now).
+			AddRow(int64(14), int64(2), "bob", "channels.2", []byte("b"), now).
+			RowError(1, errors.New("connection reset")))
+	mock.ExpectRollback()
+	for i, p := range batch {
+		mock.ExpectQuery("INSERT INTO messages").WithArgs(p.ChannelID, p.UserID, channelSubject(p.ChannelID), p.Payload).
+			WillReturnRows(pgxmock.NewRows([]string{"id", "channel_id", "user_id", "subject", "payload", "created_at"}).AddRow(int64(15+i), p.ChannelID, p.UserID, channelSubject(p.ChannelID), p.Payload, now))
+	}
+	msgs, errs = s.SaveChannelMessages(context.Background(), batch)
+	if errs[0] != nil || errs[1] != nil || msgs[0].ID != 15 || msgs[1].ID != 16 {
+		t.Fatalf("expected the rolled back batch saved per row, got %+v %v", msgs, errs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations: %v", err)
+	}
+}
+
 func TestPostgresStoreCreateUserError(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	if err != nil {
@@ -403,6 +732,35 @@ func TestPostgresStoreVerifyUserPasswordQueryError(t *testing.T) {
 	}
 }
 
+func TestMentionsUser(t *testing.T) {
+	cases := map[string]bool{
+		"@bob":            true,
+		"hi @bob, lunch?": true,
+		"(@bob)":          true,
+		"@bob.":           true,
+		"@bobby":          false,
+		"x@bob.com":       false,
+		"@@bob":           false,
+		"@bob-smith":      false,
+		"@bobé":           false,
+		"@bobby and @bob": true,
+	}
+	for payload, want := range cases {
+		if got := mentionsUser([]byte(payload), "bob"); got != want {
+			t.Errorf("mentionsUser(%q) = %v, want %v", payload, got, want)
+		}
+	}
+}
+
+func TestMentionPattern(t *testing.T) {
+	if got, want := mentionPattern("user-1"), `(?<![A-Za-z0-9_@])@user\-1(?![A-Za-z0-9_-]|\\[23])`; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got, want := mentionPattern("é"), `(?<![A-Za-z0-9_@])@\\303\\251(?![A-Za-z0-9_-]|\\[23])`; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
 func TestPostgresStoreListChannelsError(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	if err != nil {
@@ -411,8 +769,8 @@ func TestPostgresStoreListChannelsError(t *testing.T) {
 	defer mock.Close()
 
 	s := newPostgresStoreWithPool(mock)
-	mock.ExpectQuery("SELECT id, name").WillReturnError(errors.New("boom"))
-	if _, err := s.ListChannels(context.Background()); err == nil {
+	mock.ExpectQuery("SELECT c.id, c.name").WillReturnError(errors.New("boom"))
+	if _, err := s.ListChannels(context.Background(), "alice"); err == nil {
 		t.Fatalf("expected error")
 	}
 }
@@ -468,9 +826,10 @@ func TestPostgresStoreListChannelsRowsError(t *testing.T) {
 	defer mock.Close()
 
 	s := newPostgresStoreWithPool(mock)
-	rows := pgxmock.NewRows([]string{"id", "name", "created_by", "created_at"}).AddRow(int64(1), "c", "u", time.Now()).RowError(0, errors.New("row error"))
-	mock.ExpectQuery("SELECT id, name").WillReturnRows(rows)
-	if _, err := s.ListChannels(context.Background()); err == nil {
+	rows := pgxmock.NewRows([]string{"id", "name", "created_by", "created_at", "retention_seconds", "last_read_message_id", "unread_count", "mention_count"}).
+		AddRow(int64(1), "c", "u", time.Now(), nil, int64(0), int64(0), int64(0)).RowError(0, errors.New("row error"))
+	mock.ExpectQuery("SELECT c.id, c.name").WillReturnRows(rows)
+	if _, err := s.ListChannels(context.Background(), "u"); err == nil {
 		t.Fatalf("expected error")
 	}
 }
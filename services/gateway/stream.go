@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Fallbacks for networks whose proxies block WebSocket upgrades. /events
+// streams Server-Sent Events and /poll answers long-polls; both run the same
+// session as a multiplexed socket, bound to one channel or subject like a
+// plain /ws socket, and deliver the same envelopes. Clients send through
+// POST /channels/{id}/messages or /publish.
+
+const (
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 55 * time.Second
+	streamPingInterval = 30 * time.Second
+)
+
+// sseCodec frames envelopes as Server-Sent Events. The envelope type is the
+// event name, and persisted messages carry their id, which the browser sends
+// back as Last-Event-ID when it reconnects.
+type sseCodec struct{}
+
+func (sseCodec) label() string    { return "sse" }
+func (sseCodec) messageType() int { return websocket.TextMessage }
+
+func (sseCodec) encode(env wsEnvelope) []byte {
+	data, _ := json.Marshal(env)
+	var b bytes.Buffer
+	if env.MessageID != 0 {
+		fmt.Fprintf(&b, "id: %d\n", env.MessageID)
+	}
+	fmt.Fprintf(&b, "event: %s\ndata: %s\n\n", env.Type, data)
+	return b.Bytes()
+}
+
+// decode is never called: SSE clients do not send frames.
+func (sseCodec) decode([]byte) (wsEnvelope, error) {
+	return wsEnvelope{}, errInvalidFrame
+}
+
+// lastEventID reads the resume point from the Last-Event-ID header, or the
+// last_event_id query parameter for clients that cannot set headers.
+func lastEventID(req *http.Request) (int64, error) {
+	raw := req.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = req.URL.Query().Get("last_event_id")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.New("invalid last event id")
+	}
+	return id, nil
+}
+
+// openStream validates a fallback request and builds its session, along
+// with the subscribe command to run once something drains the queue. It
+// writes the error response itself when the request is refused. Callers set
+// the session's overflow hook, then start it.
+func openStream(ctx context.Context, w http.ResponseWriter, req *http.Request, nc NatsClient, store Store, presence Presence, options routerOptions, codec envelopeCodec) (*muxSession, wsEnvelope, bool) {
+	if options.drainer.Draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return nil, wsEnvelope{}, false
+	}
+	subject, channelID, err := subjectOrChannel(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, wsEnvelope{}, false
+	}
+	after, err := lastEventID(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, wsEnvelope{}, false
+	}
+	cmd := wsEnvelope{Type: "subscribe", Subject: subject}
+	if channelID != 0 {
+		// Checked up front so a refusal is an HTTP status, not an event.
+		userID := userFromContext(req.Context())
+		if store == nil || userID == "" {
+			http.Error(w, "store not configured", http.StatusServiceUnavailable)
+			return nil, wsEnvelope{}, false
+		}
+		member, err := store.IsMember(req.Context(), channelID, userID)
+		if err != nil {
+			log.Printf("membership check failed: %v", err)
+			http.Error(w, "membership check failed: "+err.Error(), http.StatusInternalServerError)
+			return nil, wsEnvelope{}, false
+		}
+		if !member {
+			http.Error(w, "not a member of this channel", http.StatusForbidden)
+			return nil, wsEnvelope{}, false
+		}
+		cmd = wsEnvelope{Type: "subscribe", ChannelID: channelID, ResumeAfter: after}
+	}
+	s := newMuxSession(ctx, req, nc, store, presence, options, codec)
+	if channelID != 0 {
+		s.members[channelID] = true
+	}
+	return s, cmd, true
+}
+
+// sseHandler streams a channel or subject as Server-Sent Events. On
+// reconnect the browser's Last-Event-ID resumes the channel from the store.
+func sseHandler(nc NatsClient, store Store, presence Presence, options routerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		s, cmd, ok := openStream(ctx, w, req, nc, store, presence, options, sseCodec{})
+		if !ok {
+			return
+		}
+		s.overflow = cancel
+		s.start()
+		// Streams cannot take a token in-band: they end when it expires and
+		// the browser reconnects with its refreshed cookie.
+		watch := watchToken(req, options, store, s.reply, cancel)
+		defer watch.stop()
+		live, unregister := options.connections.Register(
+			ConnectionInfo{UserID: s.userID, Transport: "sse", RemoteAddr: req.RemoteAddr},
+			s.subjects, cancel)
+		defer unregister()
+
+		s.beat = startPresence(nc, presence, options.presenceCfg, s.userID, live.id(), s.channelIDs)
+		defer s.beat.stop()
+		// Subscribing may replay more than the queue holds, so it runs
+		// alongside the writer below.
+		subscribed := make(chan struct{})
+		go func() {
+			defer close(subscribed)
+			s.subscribe(cmd)
+		}()
+		defer func() {
+			cancel()
+			<-subscribed
+			s.close()
+		}()
+
+		// On shutdown the stream ends with a retry hint, the SSE analogue of
+		// closeForRestart.
+		restart := make(chan time.Duration, 1)
+		untrack := options.drainer.Track(func(reconnectAfter time.Duration) {
+			select {
+			case restart <- reconnectAfter:
+			default:
+			}
+		})
+		defer untrack()
+
+		rc := http.NewResponseController(w)
+		write := func(data []byte) bool {
+			// The server's WriteTimeout would otherwise cut the stream.
+			_ = rc.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := w.Write(data); err != nil {
+				return false
+			}
+			flusher.Flush()
+			live.sent(len(data))
+			return true
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if !write([]byte(": connected\n\n")) {
+			return
+		}
+
+		ping := time.NewTicker(streamPingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case reconnectAfter := <-restart:
+				_ = write([]byte(fmt.Sprintf("retry: %d\n\n", reconnectAfter.Milliseconds())))
+				return
+			case <-ping.C:
+				if !write([]byte(": ping\n\n")) {
+					return
+				}
+			case <-s.queue.ready:
+				for {
+					data, ok := s.queue.next()
+					if !ok {
+						break
+					}
+					if !write(data) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// pollResponse is one long-poll answer. Clients pass LastEventID back as
+// last_event_id on the next poll.
+type pollResponse struct {
+	Events      []wsEnvelope `json:"events"`
+	LastEventID int64        `json:"last_event_id"`
+}
+
+// pollHandler answers a long-poll with whatever is waiting for the caller:
+// messages after last_event_id from the store, or else the first live
+// traffic, or an empty list once the timeout passes.
+func pollHandler(nc NatsClient, store Store, presence Presence, options routerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		timeout := defaultPollTimeout
+		if raw := req.URL.Query().Get("timeout"); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed < 0 {
+				http.Error(w, "invalid timeout", http.StatusBadRequest)
+				return
+			}
+			timeout = min(parsed, maxPollTimeout)
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		s, cmd, ok := openStream(ctx, w, req, nc, store, presence, options, jsonCodec{})
+		if !ok {
+			return
+		}
+		s.overflow = cancel
+		s.start()
+		subscribed := make(chan struct{})
+		go func() {
+			defer close(subscribed)
+			s.subscribe(cmd)
+		}()
+		defer func() {
+			cancel()
+			<-subscribed
+			s.close()
+		}()
+		untrack := options.drainer.Track(func(time.Duration) { cancel() })
+		defer untrack()
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 5*time.Second))
+
+		resp := pollResponse{Events: []wsEnvelope{}, LastEventID: cmd.ResumeAfter}
+		ready := subscribed
+		for {
+			select {
+			case <-ctx.Done():
+				writeJSON(w, http.StatusOK, resp)
+				return
+			case <-ready:
+				ready = nil
+			case <-s.queue.ready:
+			}
+			for {
+				data, ok := s.queue.next()
+				if !ok {
+					break
+				}
+				env, err := s.codec.decode(data)
+				if err != nil || env.Type == "subscribed" || env.Type == "resumed" {
+					continue
+				}
+				resp.Events = append(resp.Events, env)
+				resp.LastEventID = max(resp.LastEventID, env.MessageID)
+			}
+			// Hold the answer until the replay is done so it comes whole.
+			if len(resp.Events) > 0 && ready == nil {
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+		}
+	}
+}
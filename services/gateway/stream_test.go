@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func streamRequest(t *testing.T, url string, lastEventID int64) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Cookie", "access_token="+testToken(t, "test"))
+	if lastEventID != 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(lastEventID, 10))
+	}
+	return req
+}
+
+// readEvent reads one SSE event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (id, event string, env wsEnvelope) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return id, event, env
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &env); err != nil {
+				t.Fatalf("event data: %v", err)
+			}
+		}
+	}
+}
+
+func TestSSEStreamResumesFromLastEventID(t *testing.T) {
+	store := newMemStore()
+	ctx := context.Background()
+	_ = store.EnsureUser(ctx, "user-1")
+	channel, _ := store.CreateChannel(ctx, "general", "user-1")
+	_ = store.EnsureMember(ctx, channel.ID, "user-1")
+	seen, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("seen"))
+	missed, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("missed"))
+
+	nc := newFakeNats()
+	server := httptest.NewServer(NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+	t.Cleanup(server.Close)
+
+	req := streamRequest(t, server.URL+"/events?channel_id="+strconv.FormatInt(channel.ID, 10), seen.ID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected stream, got %v (%v)", resp, err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	if _, event, _ := readEvent(t, r); event != "subscribed" {
+		t.Fatalf("expected subscribed, got %s", event)
+	}
+	id, event, env := readEvent(t, r)
+	if event != "message" || id != strconv.FormatInt(missed.ID, 10) || !env.Replayed || env.Payload != "missed" {
+		t.Fatalf("expected replayed message, got %s %s %+v", id, event, env)
+	}
+	if _, event, _ := readEvent(t, r); event != "resumed" {
+		t.Fatalf("expected resumed, got %s", event)
+	}
+
+	// Sends go through REST and arrive on the stream.
+	post, _ := http.NewRequest(http.MethodPost, server.URL+"/channels/"+strconv.FormatInt(channel.ID, 10)+"/messages", strings.NewReader(`{"payload":"live"}`))
+	post.Header.Set("Cookie", "access_token="+testToken(t, "test"))
+	post.Header.Set("Content-Type", "application/json")
+	if resp, err := http.DefaultClient.Do(post); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("post message: %v (%v)", resp, err)
+	}
+	if id, event, env := readEvent(t, r); event != "message" || env.Payload != "live" || id == "" {
+		t.Fatalf("expected live message with id, got %s %s %+v", id, event, env)
+	}
+}
+
+func TestSSERefusesNonMembers(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "bob")
+	channel, _ := store.CreateChannel(context.Background(), "private", "bob")
+	server := httptest.NewServer(NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+	t.Cleanup(server.Close)
+
+	for _, path := range []string{"/events", "/poll"} {
+		resp, err := http.DefaultClient.Do(streamRequest(t, server.URL+path+"?channel_id="+strconv.FormatInt(channel.ID, 10), 0))
+		if err != nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s: expected 403, got %v (%v)", path, resp, err)
+		}
+		_ = resp.Body.Close()
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	store := newMemStore()
+	ctx := context.Background()
+	_ = store.EnsureUser(ctx, "user-1")
+	channel, _ := store.CreateChannel(ctx, "general", "user-1")
+	_ = store.EnsureMember(ctx, channel.ID, "user-1")
+	first, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("a"))
+	second, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("b"))
+
+	nc := newFakeNats()
+	server := httptest.NewServer(NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+	t.Cleanup(server.Close)
+	url := server.URL + "/poll?channel_id=" + strconv.FormatInt(channel.ID, 10)
+
+	poll := func(query string) pollResponse {
+		t.Helper()
+		resp, err := http.DefaultClient.Do(streamRequest(t, url+query, 0))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("poll: %v (%v)", resp, err)
+		}
+		defer resp.Body.Close()
+		var out pollResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatalf("decode poll: %v", err)
+		}
+		return out
+	}
+
+	got := poll("&last_event_id=" + strconv.FormatInt(first.ID, 10))
+	if len(got.Events) != 1 || got.Events[0].Payload != "b" || got.LastEventID != second.ID {
+		t.Fatalf("expected the missed message, got %+v", got)
+	}
+
+	if got := poll("&last_event_id=" + strconv.FormatInt(second.ID, 10) + "&timeout=50ms"); len(got.Events) != 0 || got.LastEventID != second.ID {
+		t.Fatalf("expected an empty poll after the timeout, got %+v", got)
+	}
+
+	done := make(chan pollResponse, 1)
+	go func() { done <- poll("&timeout=5s") }()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		nc.mu.Lock()
+		_, subscribed := nc.subjectCh[channelSubject(channel.ID)]
+		nc.mu.Unlock()
+		if subscribed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	_ = nc.Publish(channelSubject(channel.ID), []byte("live"))
+	select {
+	case got := <-done:
+		if len(got.Events) != 1 || got.Events[0].Payload != "live" {
+			t.Fatalf("expected live message, got %+v", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("poll did not return on live traffic")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricEphemeralEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "storm_ephemeral_events_total",
+	Help: "Typing signals handled, by event type and outcome (published, throttled, expired)",
+}, []string{"type", "outcome"})
+
+const (
+	typingStarted = "typing"
+	typingStopped = "stopped_typing"
+
+	// ephemeralSubjectPrefix namespaces events that are fanned out but never
+	// persisted. Clients cannot address it directly.
+	ephemeralSubjectPrefix = "ephemeral."
+
+	defaultTypingThrottle = 3 * time.Second
+	defaultTypingTTL      = 8 * time.Second
+)
+
+// channelEventsSubject carries a channel's ephemeral events.
+func channelEventsSubject(channelID int64) string {
+	return ephemeralSubjectPrefix + "channels." + strconv.FormatInt(channelID, 10)
+}
+
+// TypingEvent is fanned out to a channel's sockets. ExpiresIn tells clients
+// how long to show a typing indicator without a refresh; the server sends
+// stopped_typing with reason "expired" itself if the typist goes quiet.
+type TypingEvent struct {
+	Type      string `json:"type"`
+	ChannelID int64  `json:"channel_id"`
+	UserID    string `json:"user_id"`
+	ExpiresIn int64  `json:"expires_in_ms,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// parseTypingEvent decodes a message from channelEventsSubject.
+func parseTypingEvent(data []byte) (TypingEvent, bool) {
+	var ev TypingEvent
+	if err := json.Unmarshal(data, &ev); err != nil || ev.UserID == "" {
+		return TypingEvent{}, false
+	}
+	return ev, ev.Type == typingStarted || ev.Type == typingStopped
+}
+
+// typingSignal recognises a typing frame on a legacy socket, where every
+// other frame is a chat message: a JSON object whose only key is "type",
+// set to "typing" or "stopped_typing".
+func typingSignal(frame []byte) (string, bool) {
+	frame = bytes.TrimSpace(frame)
+	if len(frame) == 0 || frame[0] != '{' {
+		return "", false
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(frame, &obj); err != nil || len(obj) != 1 {
+		return "", false
+	}
+	var kind string
+	if err := json.Unmarshal(obj["type"], &kind); err != nil {
+		return "", false
+	}
+	return kind, kind == typingStarted || kind == typingStopped
+}
+
+type typingKey struct {
+	channelID int64
+	userID    string
+}
+
+type typingState struct {
+	lastSent time.Time
+	timer    *time.Timer
+	// conns holds the user's connections that are typing in the channel; a
+	// stop from one of them is announced only once none is left.
+	conns map[string]bool
+	// gen invalidates expiry timers that fired while a newer signal arrived.
+	gen int
+}
+
+// TypingTracker throttles and expires typing signals from this replica's
+// sockets. A typist is re-announced at most once per throttle interval, and
+// is announced as stopped once ttl passes without a fresh signal.
+type TypingTracker struct {
+	nc       NatsClient
+	throttle time.Duration
+	ttl      time.Duration
+
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+}
+
+// NewTypingTracker keeps ttl above throttle so remote indicators are always
+// refreshed before they lapse.
+func NewTypingTracker(nc NatsClient, throttle, ttl time.Duration) *TypingTracker {
+	if throttle <= 0 {
+		throttle = defaultTypingThrottle
+	}
+	if ttl <= throttle {
+		ttl = 2 * throttle
+	}
+	return &TypingTracker{nc: nc, throttle: throttle, ttl: ttl, active: make(map[typingKey]*typingState)}
+}
+
+// WithTypingTracker replaces the default tracker, e.g. to tune its timings.
+func WithTypingTracker(t *TypingTracker) RouterOption {
+	return func(o *routerOptions) {
+		o.typing = t
+	}
+}
+
+func (t *TypingTracker) publish(ev TypingEvent, outcome string) {
+	data, _ := json.Marshal(ev)
+	if err := t.nc.Publish(channelEventsSubject(ev.ChannelID), data); err != nil {
+		log.Printf("typing publish failed: %v", err)
+		return
+	}
+	metricEphemeralEvents.WithLabelValues(ev.Type, outcome).Inc()
+}
+
+// Signal handles a typing or stopped_typing signal from userID's connection
+// connID.
+func (t *TypingTracker) Signal(channelID int64, userID, connID, kind string) {
+	if t == nil {
+		return
+	}
+	if kind == typingStopped {
+		t.Stop(channelID, userID, connID, "")
+		return
+	}
+	key := typingKey{channelID: channelID, userID: userID}
+	now := time.Now()
+	t.mu.Lock()
+	state, ok := t.active[key]
+	if !ok {
+		state = &typingState{conns: make(map[string]bool)}
+		t.active[key] = state
+	}
+	state.conns[connID] = true
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+	state.gen++
+	gen := state.gen
+	state.timer = time.AfterFunc(t.ttl, func() { t.expire(key, gen) })
+	throttled := ok && now.Sub(state.lastSent) < t.throttle
+	if !throttled {
+		state.lastSent = now
+	}
+	t.mu.Unlock()
+
+	if throttled {
+		metricEphemeralEvents.WithLabelValues(typingStarted, "throttled").Inc()
+		return
+	}
+	t.publish(TypingEvent{Type: typingStarted, ChannelID: channelID, UserID: userID, ExpiresIn: t.ttl.Milliseconds()}, "published")
+}
+
+// Stop records that connection connID stopped typing, and announces that
+// userID stopped if it was their last typing connection in the channel.
+// reason is empty for an explicit signal and says why otherwise (e.g.
+// "disconnected").
+func (t *TypingTracker) Stop(channelID int64, userID, connID, reason string) {
+	if t == nil {
+		return
+	}
+	key := typingKey{channelID: channelID, userID: userID}
+	t.mu.Lock()
+	state, ok := t.active[key]
+	last := ok && state.conns[connID] && len(state.conns) == 1
+	if ok {
+		delete(state.conns, connID)
+	}
+	if last {
+		state.timer.Stop()
+		delete(t.active, key)
+	}
+	t.mu.Unlock()
+	if last {
+		t.publish(TypingEvent{Type: typingStopped, ChannelID: channelID, UserID: userID, Reason: reason}, "published")
+	}
+}
+
+func (t *TypingTracker) expire(key typingKey, gen int) {
+	t.mu.Lock()
+	if state, ok := t.active[key]; !ok || state.gen != gen {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.active, key)
+	t.mu.Unlock()
+	t.publish(TypingEvent{Type: typingStopped, ChannelID: key.channelID, UserID: key.userID, Reason: "expired"}, "expired")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTypingSignal(t *testing.T) {
+	cases := []struct {
+		frame string
+		kind  string
+		ok    bool
+	}{
+		{`{"type":"typing"}`, typingStarted, true},
+		{` {"type":"stopped_typing"} `, typingStopped, true},
+		{`{"type":"typing","text":"hi"}`, "", false},
+		{`{"type":"dance"}`, "", false},
+		{`typing`, "", false},
+	}
+	for _, tc := range cases {
+		kind, ok := typingSignal([]byte(tc.frame))
+		if ok != tc.ok || (ok && kind != tc.kind) {
+			t.Fatalf("%s: got %q %v", tc.frame, kind, ok)
+		}
+	}
+}
+
+func typingEvents(nc *fakeNats) []TypingEvent {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	var out []TypingEvent
+	for _, p := range nc.published {
+		if ev, ok := parseTypingEvent(p.data); ok && strings.HasPrefix(p.subject, ephemeralSubjectPrefix) {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func TestTypingTrackerThrottleAndExpiry(t *testing.T) {
+	nc := newFakeNats()
+	tracker := NewTypingTracker(nc, 40*time.Millisecond, 80*time.Millisecond)
+
+	tracker.Signal(1, "alice", "c1", typingStarted)
+	tracker.Signal(1, "alice", "c1", typingStarted)
+	if evs := typingEvents(nc); len(evs) != 1 || evs[0].Type != typingStarted || evs[0].ExpiresIn != 80 {
+		t.Fatalf("expected one throttled announcement, got %+v", evs)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	evs := typingEvents(nc)
+	if len(evs) != 2 || evs[1].Type != typingStopped || evs[1].Reason != "expired" {
+		t.Fatalf("expected expiry, got %+v", evs)
+	}
+
+	tracker.Signal(1, "alice", "c1", typingStarted)
+	tracker.Signal(1, "alice", "c1", typingStopped)
+	tracker.Stop(1, "alice", "c1", "disconnected")
+	if evs := typingEvents(nc); len(evs) != 4 || evs[3].Type != typingStopped || evs[3].Reason != "" {
+		t.Fatalf("expected a single explicit stop, got %+v", evs)
+	}
+	time.Sleep(120 * time.Millisecond)
+	if evs := typingEvents(nc); len(evs) != 4 {
+		t.Fatalf("stopped typists must not expire again, got %+v", evs)
+	}
+}
+
+func TestTypingTrackerKeepsOtherConnectionsTyping(t *testing.T) {
+	nc := newFakeNats()
+	tracker := NewTypingTracker(nc, time.Hour, 2*time.Hour)
+
+	// Closing an idle tab says nothing about the tab that is typing.
+	tracker.Signal(1, "alice", "c1", typingStarted)
+	tracker.Stop(1, "alice", "c2", "disconnected")
+	if evs := typingEvents(nc); len(evs) != 1 {
+		t.Fatalf("an idle connection must not stop the typist, got %+v", evs)
+	}
+
+	tracker.Signal(1, "alice", "c2", typingStarted)
+	tracker.Stop(1, "alice", "c1", "disconnected")
+	if evs := typingEvents(nc); len(evs) != 1 {
+		t.Fatalf("alice still types in c2, got %+v", evs)
+	}
+	tracker.Stop(1, "alice", "c2", "")
+	if evs := typingEvents(nc); len(evs) != 2 || evs[1].Type != typingStopped || evs[1].Reason != "" {
+		t.Fatalf("expected a stop once the last connection stopped, got %+v", evs)
+	}
+}
+
+func TestWebSocketTypingIsEphemeral(t *testing.T) {
+	nc := newFakeNats()
+	server := httptest.NewServer(NewRouter(nc, newMemStore(), nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+	t.Cleanup(server.Close)
+
+	header := http.Header{}
+	header.Set("Cookie", "access_token="+testToken(t, "test"))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?channel_id=3", header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	defer conn.Close()
+
+	queued := len(asyncTaskQueue)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"typing"}`)); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	// Another member's signal is delivered; the socket's own is not.
+	other, _ := json.Marshal(TypingEvent{Type: typingStarted, ChannelID: 3, UserID: "bob", ExpiresIn: 8000})
+	deadline := time.Now().Add(2 * time.Second)
+	for len(typingEvents(nc)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	_ = nc.Publish(channelEventsSubject(3), other)
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, frame, err := conn.ReadMessage()
+	if err != nil || string(frame) != string(other) {
+		t.Fatalf("expected bob's signal, got %q (%v)", frame, err)
+	}
+	if evs := typingEvents(nc); len(evs) != 2 || evs[0].UserID != "user-1" {
+		t.Fatalf("unexpected typing publishes %+v", evs)
+	}
+	nc.mu.Lock()
+	for _, p := range nc.published {
+		if p.subject == channelSubject(3) {
+			t.Fatalf("typing must not be published as a chat message")
+		}
+	}
+	nc.mu.Unlock()
+	if len(asyncTaskQueue) != queued {
+		t.Fatalf("typing must not be queued for persistence")
+	}
+}
+
+func TestMultiplexedTyping(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	_ = store.EnsureMember(context.Background(), channel.ID, "user-1")
+	nc := newFakeNats()
+	conn := dialMultiplexed(t, NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+
+	if env := roundTrip(t, conn, wsEnvelope{Type: typingStarted, Subject: "storm.events"}); env.Code != "invalid_channel" {
+		t.Fatalf("expected invalid_channel, got %+v", env)
+	}
+	_ = roundTrip(t, conn, wsEnvelope{Type: "subscribe", ChannelID: channel.ID})
+	if err := conn.WriteJSON(wsEnvelope{Type: typingStarted, ChannelID: channel.ID}); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	// Commands run in order, so the pong means the signal was handled.
+	_ = roundTrip(t, conn, wsEnvelope{Type: "ping"})
+	other, _ := json.Marshal(TypingEvent{Type: typingStopped, ChannelID: channel.ID, UserID: "bob", Reason: "expired"})
+	_ = nc.Publish(channelEventsSubject(channel.ID), other)
+	env := readEnvelope(t, conn)
+	if env.Type != typingStopped || env.UserID != "bob" || env.ChannelID != channel.ID || env.Reason != "expired" {
+		t.Fatalf("expected bob's stop, got %+v", env)
+	}
+	if evs := typingEvents(nc); len(evs) != 2 || evs[0].UserID != "user-1" {
+		t.Fatalf("expected the session's signal to be published, got %+v", evs)
+	}
+	if msgs, _ := store.ListMessages(context.Background(), channel.ID, 10); len(msgs) != 0 {
+		t.Fatalf("typing must not be persisted, got %d messages", len(msgs))
+	}
+}
@@ -0,0 +1,778 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricWriteEnqueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storm_write_queue_enqueued_total",
+		Help: "The total number of messages accepted by the write queue",
+	})
+	metricWriteRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storm_write_queue_retries_total",
+		Help: "The total number of message writes scheduled for another attempt",
+	})
+	metricWriteDeadLetters = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storm_write_queue_dead_letters_total",
+		Help: "The total number of messages given up on and sent to the dead-letter file",
+	})
+	metricWritePending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "storm_write_queue_pending",
+		Help: "Spooled messages not yet saved or dead-lettered",
+	})
+	metricWriteSpoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "storm_write_queue_spool_bytes",
+		Help: "Bytes used by the write queue spool on disk",
+	})
+)
+
+const (
+	defaultWriteMaxAttempts  = 5
+	defaultWriteBackoff      = 200 * time.Millisecond
+	defaultWriteMaxBackoff   = 10 * time.Second
+	defaultSpoolSegmentBytes = 16 << 20
+	defaultSpoolMaxBytes     = 1 << 30
+	spoolSegmentExt          = ".seg"
+	deadLetterFile           = "dead-letter.jsonl"
+)
+
+var errWriteQueueClosed = errors.New("write queue closed")
+
+// WriteQueueConfig controls the write queue between socket ingress and the
+// worker pool.
+type WriteQueueConfig struct {
+	// Dir holds the spool. Empty keeps queued messages in memory only, as
+	// asyncTaskQueue always did; they are then lost on a crash.
+	Dir          string
+	SegmentBytes int64
+	// MaxBytes caps the spool on disk; enqueues fail once it is reached.
+	MaxBytes int64
+	// MaxAttempts is how many times a message is written before it is
+	// dead-lettered. Attempt n waits Backoff*2^(n-1), at most MaxBackoff.
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// WriteQueue hands channel messages to the worker pool. With a spool, an
+// enqueue returns once the message is fsynced, and anything not saved when
+// the process dies is replayed on the next start, so delivery is
+// at-least-once. A nil *WriteQueue queues in memory without retries.
+type WriteQueue struct {
+	cfg   WriteQueueConfig
+	spool *writeSpool
+	// draining stops retries during the shutdown flush: spooled messages are
+	// left for the next start instead.
+	draining atomic.Bool
+	// stop releases retries waiting for room in asyncTaskQueue once the
+	// queue drains or closes.
+	stop     chan struct{}
+	stopOnce sync.Once
+	deadMu   sync.Mutex
+}
+
+func NewWriteQueue(cfg WriteQueueConfig) (*WriteQueue, error) {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = defaultSpoolSegmentBytes
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultSpoolMaxBytes
+	}
+	q := &WriteQueue{cfg: cfg, stop: make(chan struct{})}
+	if cfg.Dir == "" {
+		return q, nil
+	}
+	spool, err := openWriteSpool(cfg.Dir, cfg.SegmentBytes, cfg.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	q.spool = spool
+	return q, nil
+}
+
+// WithWriteQueue routes socket messages through q instead of straight into
+// asyncTaskQueue.
+func WithWriteQueue(q *WriteQueue) RouterOption {
+	return func(o *routerOptions) {
+		o.writes = q
+	}
+}
+
+// Start feeds spooled messages, replayed ones first, to the worker pool.
+func (q *WriteQueue) Start() {
+	if q == nil || q.spool == nil {
+		return
+	}
+	q.spool.start(asyncTaskQueue)
+}
+
+// Enqueue accepts task for persistence. A nil error means the task will be
+// written, or dead-lettered if it keeps failing.
+func (q *WriteQueue) Enqueue(ctx context.Context, task asyncTask) error {
+	if q == nil || q.spool == nil {
+		select {
+		case asyncTaskQueue <- task:
+			metricSaveQueueLen.Set(float64(len(asyncTaskQueue)))
+			metricWriteEnqueued.Inc()
+			return nil
+		default:
+			return errTaskQueueFull
+		}
+	}
+	if err := q.spool.append(ctx, task); err != nil {
+		return err
+	}
+	metricWriteEnqueued.Inc()
+	return nil
+}
+
+// saved records that task reached the store.
+func (q *WriteQueue) saved(task asyncTask) {
+	if q != nil && q.spool != nil && task.seq != 0 {
+		q.spool.complete(task.seq)
+	}
+}
+
+// retry schedules another attempt at a failed task and reports whether it
+// did. Otherwise the task is dead-lettered, or left in the spool when
+// draining, and its sender should be told it failed.
+func (q *WriteQueue) retry(task asyncTask, cause error) bool {
+	if q == nil {
+		return false
+	}
+	task.attempts++
+	if q.draining.Load() && q.spool != nil && task.seq != 0 {
+		log.Printf("write queue: leaving message %d in the spool for the next start: %v", task.seq, cause)
+		return false
+	}
+	if task.attempts < q.cfg.MaxAttempts && !q.draining.Load() {
+		metricWriteRetries.Inc()
+		// The sender keeps waiting; done only sees the final outcome.
+		time.AfterFunc(q.backoff(task.attempts), func() { q.requeue(task, cause) })
+		return true
+	}
+	q.deadLetter(task, cause)
+	q.saved(task)
+	return false
+}
+
+// requeue hands a retried task back to the workers, unless the queue stops
+// first: spooled tasks then stay on disk for the next start, in-memory ones
+// are dead-lettered. Either way the sender is told it failed.
+func (q *WriteQueue) requeue(task asyncTask, cause error) {
+	select {
+	case <-q.stop:
+	default:
+		select {
+		case asyncTaskQueue <- task:
+			return
+		case <-q.stop:
+		}
+	}
+	if q.spool != nil && task.seq != 0 {
+		log.Printf("write queue: leaving message %d in the spool for the next start: %v", task.seq, cause)
+	} else {
+		q.deadLetter(task, cause)
+	}
+	if task.done != nil {
+		task.done(Message{}, cause)
+	}
+}
+
+func (q *WriteQueue) backoff(attempt int) time.Duration {
+	d := q.cfg.Backoff
+	for i := 1; i < attempt && d < q.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if q.cfg.MaxBackoff > 0 && d > q.cfg.MaxBackoff {
+		d = q.cfg.MaxBackoff
+	}
+	return d
+}
+
+type deadLetter struct {
+	Seq       uint64    `json:"seq,omitempty"`
+	ChannelID int64     `json:"channel_id"`
+	UserID    string    `json:"user_id"`
+	Payload   []byte    `json:"payload"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// deadLetter appends task to the spool's dead-letter file, one JSON object
+// per line. Without a spool there is nowhere durable to put it, so it is
+// logged.
+func (q *WriteQueue) deadLetter(task asyncTask, cause error) {
+	metricWriteDeadLetters.Inc()
+	if q.spool == nil {
+		log.Printf("write queue: dropping message from %s to channel %d after %d attempts: %v", task.userID, task.channelID, task.attempts, cause)
+		return
+	}
+	line, err := json.Marshal(deadLetter{
+		Seq:       task.seq,
+		ChannelID: task.channelID,
+		UserID:    task.userID,
+		Payload:   task.payload,
+		Attempts:  task.attempts,
+		Error:     cause.Error(),
+		FailedAt:  time.Now().UTC(),
+	})
+	if err == nil {
+		q.deadMu.Lock()
+		err = appendLine(filepath.Join(q.cfg.Dir, deadLetterFile), line)
+		q.deadMu.Unlock()
+	}
+	if err != nil {
+		log.Printf("write queue: dead-letter write failed for message %d: %v", task.seq, err)
+	}
+}
+
+func appendLine(path string, line []byte) error {
+	// #nosec G304 -- path is under the configured spool directory.
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// drain stops retries and the feeder; called before the shutdown flush,
+// which then only sees what is already in asyncTaskQueue.
+func (q *WriteQueue) drain() {
+	if q == nil {
+		return
+	}
+	q.draining.Store(true)
+	q.stopOnce.Do(func() { close(q.stop) })
+	if q.spool != nil {
+		q.spool.stopFeed()
+	}
+}
+
+// Close stops retries and the feeder and syncs the spool.
+func (q *WriteQueue) Close() error {
+	if q == nil {
+		return nil
+	}
+	q.stopOnce.Do(func() { close(q.stop) })
+	if q.spool == nil {
+		return nil
+	}
+	return q.spool.close()
+}
+
+// spoolRecord is one line of a segment: a message, or the mark that the
+// message with sequence Done is finished.
+type spoolRecord struct {
+	Seq       uint64 `json:"seq,omitempty"`
+	Done      uint64 `json:"done,omitempty"`
+	ChannelID int64  `json:"channel_id,omitempty"`
+	UserID    string `json:"user_id,omitempty"`
+	Payload   []byte `json:"payload,omitempty"`
+}
+
+// spoolSegment is one file of the spool, named after the first sequence
+// written to it.
+type spoolSegment struct {
+	first       uint64
+	path        string
+	size        int64
+	outstanding int
+}
+
+// writeSpool is an append-only log of queued messages split into segments.
+// Done marks for a message always land in its own segment or a later one,
+// and segments are deleted oldest first once all their messages are done,
+// so a replay never misses a done mark.
+type writeSpool struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+
+	mu       sync.Mutex
+	segments []*spoolSegment // oldest first; the last one is active
+	active   *os.File
+	buf      *bufio.Writer
+	retired  []*os.File // rolled segments awaiting their final sync
+	flushed  int64      // bytes of the active segment visible to the feeder
+	total    int64
+	nextSeq  uint64
+	waiters  []chan error
+	closed   bool
+	// replayed holds the done marks found at open, so the feeder skips
+	// messages that were saved before the restart.
+	replayed map[uint64]bool
+	// callbacks are the senders waiting on spooled messages, until the
+	// feeder hands them over with their task.
+	callbacks map[uint64]func(Message, error)
+
+	kick     chan struct{}
+	more     chan struct{}
+	stop     chan struct{}
+	feedStop chan struct{}
+	feedOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d%s", first, spoolSegmentExt)
+}
+
+func openWriteSpool(dir string, segmentBytes, maxBytes int64) (*writeSpool, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &writeSpool{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		maxBytes:     maxBytes,
+		nextSeq:      1,
+		replayed:     make(map[uint64]bool),
+		callbacks:    make(map[uint64]func(Message, error)),
+		kick:         make(chan struct{}, 1),
+		more:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		feedStop:     make(chan struct{}),
+	}
+
+	owner := make(map[uint64]*spoolSegment)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &spoolSegment{first: first, path: filepath.Join(dir, name)}
+		// Sequences are never reused, even when the segments that held the
+		// messages are gone and only their done marks or names are left:
+		// a reused one would be skipped as already saved.
+		s.nextSeq = max(s.nextSeq, first+1)
+		err = scanSegment(seg.path, func(rec spoolRecord) {
+			switch {
+			case rec.Seq != 0:
+				owner[rec.Seq] = seg
+				s.nextSeq = max(s.nextSeq, rec.Seq+1)
+			case rec.Done != 0:
+				s.replayed[rec.Done] = true
+				s.nextSeq = max(s.nextSeq, rec.Done+1)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		seg.size = info.Size()
+		s.total += seg.size
+		s.segments = append(s.segments, seg)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].first < s.segments[j].first })
+	pending := 0
+	for seq, seg := range owner {
+		if !s.replayed[seq] {
+			seg.outstanding++
+			pending++
+		}
+	}
+	if pending > 0 {
+		log.Printf("write queue: replaying %d spooled messages", pending)
+	}
+
+	// New writes always go to a fresh segment, since nextSeq is past every
+	// segment's first; the old ones, which may end in a torn line, are only
+	// read.
+	if err := s.openSegment(); err != nil {
+		return nil, err
+	}
+	s.trim()
+	s.updateGauges()
+	s.wg.Add(1)
+	go s.syncLoop()
+	return s, nil
+}
+
+// scanSegment calls fn for every record in path. A torn last line, left by
+// a crash mid-write, is skipped.
+func scanSegment(path string, fn func(spoolRecord)) error {
+	// #nosec G304 -- path is under the configured spool directory.
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = readRecords(f, -1, fn)
+	return err
+}
+
+// readRecords decodes whole lines from r, up to limit bytes when limit is
+// not negative, and returns how many bytes it consumed.
+func readRecords(r io.Reader, limit int64, fn func(spoolRecord)) (int64, error) {
+	br := bufio.NewReader(r)
+	var consumed int64
+	for limit < 0 || consumed < limit {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// No newline yet: a torn or unflushed line.
+			return consumed, nil
+		}
+		if err != nil {
+			return consumed, err
+		}
+		consumed += int64(len(line))
+		var rec spoolRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Printf("write queue: skipping corrupt spool record: %v", err)
+			continue
+		}
+		fn(rec)
+	}
+	return consumed, nil
+}
+
+// openSegment starts a new active segment. Callers hold mu, except at open.
+func (s *writeSpool) openSegment() error {
+	seg := &spoolSegment{first: s.nextSeq, path: filepath.Join(s.dir, segmentName(s.nextSeq))}
+	if n := len(s.segments); n > 0 && s.segments[n-1].first == seg.first {
+		// The last segment has no messages yet; keep appending to it.
+		seg = s.segments[n-1]
+		s.segments = s.segments[:n-1]
+	}
+	// #nosec G304 -- path is under the configured spool directory.
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if s.active != nil {
+		if err := s.buf.Flush(); err != nil {
+			_ = f.Close()
+			return err
+		}
+		s.retired = append(s.retired, s.active)
+	}
+	s.segments = append(s.segments, seg)
+	s.active, s.buf, s.flushed = f, bufio.NewWriter(f), seg.size
+	return nil
+}
+
+func (s *writeSpool) write(rec spoolRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	seg := s.segments[len(s.segments)-1]
+	if _, err := s.buf.Write(line); err != nil {
+		return err
+	}
+	seg.size += int64(len(line))
+	s.total += int64(len(line))
+	return nil
+}
+
+// append spools task and waits until it is on disk.
+func (s *writeSpool) append(ctx context.Context, task asyncTask) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errWriteQueueClosed
+	}
+	if s.total+int64(len(task.payload)) > s.maxBytes {
+		s.mu.Unlock()
+		return errTaskQueueFull
+	}
+	if s.segments[len(s.segments)-1].size >= s.segmentBytes {
+		if err := s.openSegment(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	seq := s.nextSeq
+	if err := s.write(spoolRecord{Seq: seq, ChannelID: task.channelID, UserID: task.userID, Payload: task.payload}); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.nextSeq++
+	s.segments[len(s.segments)-1].outstanding++
+	if task.done != nil {
+		s.callbacks[seq] = task.done
+	}
+	synced := make(chan error, 1)
+	s.waiters = append(s.waiters, synced)
+	s.updateGauges()
+	s.mu.Unlock()
+
+	notify(s.kick)
+	var err error
+	select {
+	case err = <-synced:
+	case <-ctx.Done():
+		// The record may still be written; the sender's retry can then
+		// save it twice.
+		err = ctx.Err()
+	}
+	if err != nil {
+		// The caller reports the failure, so the feeder must not.
+		s.mu.Lock()
+		delete(s.callbacks, seq)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// complete marks seq done and deletes the segments that no longer hold
+// anything pending.
+func (s *writeSpool) complete(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		if s.segments[i].first <= seq {
+			s.segments[i].outstanding--
+			break
+		}
+	}
+	if err := s.write(spoolRecord{Done: seq}); err != nil {
+		log.Printf("write queue: done mark for %d failed: %v", seq, err)
+	}
+	s.trim()
+	s.updateGauges()
+	notify(s.kick)
+}
+
+func (s *writeSpool) trim() {
+	for len(s.segments) > 1 && s.segments[0].outstanding <= 0 {
+		seg := s.segments[0]
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("write queue: remove %s: %v", seg.path, err)
+			return
+		}
+		s.total -= seg.size
+		s.segments = s.segments[1:]
+	}
+}
+
+func (s *writeSpool) updateGauges() {
+	pending := 0
+	for _, seg := range s.segments {
+		pending += seg.outstanding
+	}
+	metricWritePending.Set(float64(pending))
+	metricWriteSpoolBytes.Set(float64(s.total))
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *writeSpool) start(out chan<- asyncTask) {
+	s.wg.Add(1)
+	go s.feed(out)
+}
+
+func (s *writeSpool) stopFeed() {
+	s.feedOnce.Do(func() { close(s.feedStop) })
+}
+
+// syncLoop group-commits: every wake-up flushes and fsyncs whatever was
+// written since the last one and releases all the enqueues waiting on it.
+func (s *writeSpool) syncLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.kick:
+		case <-ticker.C:
+		}
+		s.sync()
+	}
+}
+
+func (s *writeSpool) sync() {
+	s.mu.Lock()
+	err := s.buf.Flush()
+	s.flushed = s.segments[len(s.segments)-1].size
+	waiters, retired, active := s.waiters, s.retired, s.active
+	s.waiters, s.retired = nil, nil
+	s.mu.Unlock()
+
+	for _, f := range retired {
+		if serr := f.Sync(); serr != nil && err == nil {
+			err = serr
+		}
+		_ = f.Close()
+	}
+	if err == nil {
+		err = active.Sync()
+	}
+	for _, w := range waiters {
+		w <- err
+	}
+	notify(s.more)
+}
+
+// feed reads the spool in order and hands each pending message to out,
+// following the active segment as it grows.
+func (s *writeSpool) feed(out chan<- asyncTask) {
+	defer s.wg.Done()
+	cursor, offset := uint64(0), int64(0)
+	for {
+		s.mu.Lock()
+		var seg *spoolSegment
+		for _, candidate := range s.segments {
+			if candidate.first >= cursor {
+				seg = candidate
+				break
+			}
+		}
+		isActive := seg == s.segments[len(s.segments)-1]
+		limit := seg.size
+		if isActive {
+			limit = s.flushed
+		}
+		s.mu.Unlock()
+		if seg.first != cursor {
+			cursor, offset = seg.first, 0
+		}
+
+		if offset < limit {
+			n, err := s.feedSegment(seg.path, offset, limit, out)
+			offset += n
+			switch {
+			case errors.Is(err, errWriteQueueClosed):
+				return
+			case os.IsNotExist(err):
+				// Trimmed: everything in it was done.
+				cursor++
+				continue
+			case err != nil:
+				log.Printf("write queue: read %s: %v", seg.path, err)
+			case n > 0:
+				continue
+			case !isActive:
+				// Only a torn line is left, from a crash mid-write.
+				cursor++
+				continue
+			}
+		} else if !isActive {
+			cursor++
+			continue
+		}
+
+		select {
+		case <-s.feedStop:
+			return
+		case <-s.more:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *writeSpool) feedSegment(path string, offset, limit int64, out chan<- asyncTask) (int64, error) {
+	// #nosec G304 -- path is under the configured spool directory.
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var sendErr error
+	n, err := readRecords(io.NewSectionReader(f, offset, limit-offset), limit-offset, func(rec spoolRecord) {
+		if sendErr != nil || rec.Seq == 0 {
+			return
+		}
+		s.mu.Lock()
+		saved, callback := s.replayed[rec.Seq], s.callbacks[rec.Seq]
+		delete(s.callbacks, rec.Seq)
+		s.mu.Unlock()
+		if saved {
+			return
+		}
+		select {
+		case out <- asyncTask{taskType: taskSaveMessage, seq: rec.Seq, channelID: rec.ChannelID, userID: rec.UserID, payload: rec.Payload, done: callback}:
+			metricSaveQueueLen.Set(float64(len(out)))
+		case <-s.feedStop:
+			// The record stays in the spool for the next start; its sender
+			// must not wait for it.
+			sendErr = errWriteQueueClosed
+			if callback != nil {
+				callback(Message{}, errWriteQueueClosed)
+			}
+		}
+	})
+	if sendErr != nil {
+		return n, sendErr
+	}
+	return n, err
+}
+
+func (s *writeSpool) close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.stopFeed()
+	close(s.stop)
+	s.wg.Wait()
+
+	s.sync()
+	s.mu.Lock()
+	callbacks := s.callbacks
+	s.callbacks = make(map[uint64]func(Message, error))
+	err := s.active.Close()
+	s.mu.Unlock()
+	// Senders of records the feeder never reached are told now; the records
+	// themselves wait in the spool for the next start.
+	for _, callback := range callbacks {
+		callback(Message{}, errWriteQueueClosed)
+	}
+	return err
+}
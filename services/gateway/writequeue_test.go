@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// drainTaskQueue empties asyncTaskQueue now and after the test, since other
+// tests leave tasks in it.
+func drainTaskQueue(t *testing.T) {
+	drain := func() {
+		for len(asyncTaskQueue) > 0 {
+			<-asyncTaskQueue
+		}
+	}
+	drain()
+	t.Cleanup(drain)
+}
+
+// runWorkers saves queued tasks to store until the test ends.
+func runWorkers(t *testing.T, store Store) {
+	t.Helper()
+	drainTaskQueue(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := StartWorkerPool(ctx, store, nil, 1, BatchConfig{Size: 1})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func nextTask(t *testing.T) asyncTask {
+	t.Helper()
+	select {
+	case task := <-asyncTaskQueue:
+		return task
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a task from the spool")
+		return asyncTask{}
+	}
+}
+
+func TestWriteQueueReplaysUnsavedMessages(t *testing.T) {
+	drainTaskQueue(t)
+	dir := t.TempDir()
+	q, err := NewWriteQueue(WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for _, p := range []string{"a", "b", "c"} {
+		if err := q.Enqueue(context.Background(), asyncTask{taskType: taskSaveMessage, channelID: 7, userID: "alice", payload: []byte(p)}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	// Nothing was fed to the workers before the "crash".
+	_ = q.Close()
+
+	q, err = NewWriteQueue(WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	q.Start()
+	first := nextTask(t)
+	second, third := nextTask(t), nextTask(t)
+	if string(first.payload) != "a" || string(third.payload) != "c" || first.channelID != 7 || first.userID != "alice" || first.seq == 0 {
+		t.Fatalf("expected the spool replayed in order, got %+v %+v", first, third)
+	}
+	q.saved(first)
+	_ = q.Close()
+
+	q, err = NewWriteQueue(WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer q.Close()
+	q.Start()
+	if got := nextTask(t); got.seq != second.seq {
+		t.Fatalf("expected the saved message skipped, got seq %d", got.seq)
+	}
+	if got := nextTask(t); got.seq != third.seq {
+		t.Fatalf("expected seq %d, got %d", third.seq, got.seq)
+	}
+}
+
+func TestWriteQueueKeepsSequencesAcrossRestarts(t *testing.T) {
+	drainTaskQueue(t)
+	dir := t.TempDir()
+	q, err := NewWriteQueue(WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for _, p := range []string{"a", "b", "c"} {
+		if err := q.Enqueue(context.Background(), asyncTask{taskType: taskSaveMessage, channelID: 7, userID: "alice", payload: []byte(p)}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	_ = q.Close()
+
+	// The replay saves everything, leaving a segment of done marks only.
+	q, err = NewWriteQueue(WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	q.Start()
+	for range 3 {
+		q.saved(nextTask(t))
+	}
+	_ = q.Close()
+
+	q, err = NewWriteQueue(WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer q.Close()
+	if err := q.Enqueue(context.Background(), asyncTask{taskType: taskSaveMessage, channelID: 7, userID: "alice", payload: []byte("d")}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	q.Start()
+	if got := nextTask(t); string(got.payload) != "d" || got.seq <= 3 {
+		t.Fatalf("expected the new message fed under a fresh sequence, got %+v", got)
+	}
+}
+
+func TestWriteQueueAppendsPastTornTail(t *testing.T) {
+	drainTaskQueue(t)
+	dir := t.TempDir()
+	torn := []byte(`{"seq":1,"channel_id":1,"us`)
+	if err := os.WriteFile(filepath.Join(dir, segmentName(1)), torn, 0o600); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+	q, err := NewWriteQueue(WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer q.Close()
+	if err := q.Enqueue(context.Background(), asyncTask{taskType: taskSaveMessage, channelID: 7, userID: "alice", payload: []byte("a")}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	q.Start()
+	if got := nextTask(t); string(got.payload) != "a" {
+		t.Fatalf("expected the message after the torn line fed, got %+v", got)
+	}
+}
+
+func TestWriteQueueDeadLettersAfterRetries(t *testing.T) {
+	drainTaskQueue(t)
+	dir := t.TempDir()
+	q, err := NewWriteQueue(WriteQueueConfig{Dir: dir, MaxAttempts: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	store := newMemStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	workersDone := StartWorkerPool(ctx, store, q, 1, BatchConfig{Size: 1})
+	q.Start()
+	defer func() {
+		cancel()
+		<-workersDone
+		_ = q.Close()
+	}()
+
+	retries := testutil.ToFloat64(metricWriteRetries)
+	dead := testutil.ToFloat64(metricWriteDeadLetters)
+	outcome := make(chan error, 1)
+	task := asyncTask{taskType: taskSaveMessage, channelID: 404, userID: "alice", payload: []byte("lost"), done: func(_ Message, err error) { outcome <- err }}
+	if err := q.Enqueue(context.Background(), task); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	select {
+	case err := <-outcome:
+		if err == nil {
+			t.Fatalf("expected the save error once retries ran out")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sender never heard back")
+	}
+	if got := testutil.ToFloat64(metricWriteRetries) - retries; got != 2 {
+		t.Fatalf("expected 2 retries, got %v", got)
+	}
+	if got := testutil.ToFloat64(metricWriteDeadLetters) - dead; got != 1 {
+		t.Fatalf("expected 1 dead letter, got %v", got)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, deadLetterFile))
+	if err != nil {
+		t.Fatalf("read dead letters: %v", err)
+	}
+	var letter deadLetter
+	if err := json.Unmarshal(bytes.TrimSpace(raw), &letter); err != nil || letter.Attempts != 3 || string(letter.Payload) != "lost" || letter.Error == "" {
+		t.Fatalf("unexpected dead letter %s: %v", raw, err)
+	}
+}
+
+func TestWriteQueueRetryReleasedOnDrain(t *testing.T) {
+	drainTaskQueue(t)
+	q, err := NewWriteQueue(WriteQueueConfig{MaxAttempts: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	for len(asyncTaskQueue) < cap(asyncTaskQueue) {
+		asyncTaskQueue <- asyncTask{}
+	}
+
+	dead := testutil.ToFloat64(metricWriteDeadLetters)
+	outcome := make(chan error, 1)
+	task := asyncTask{taskType: taskSaveMessage, channelID: 1, userID: "alice", payload: []byte("hi"), done: func(_ Message, err error) { outcome <- err }}
+	if !q.retry(task, errors.New("connection reset")) {
+		t.Fatalf("expected a retry to be scheduled")
+	}
+	// The retry is stuck behind the full queue until the flush begins.
+	time.Sleep(20 * time.Millisecond)
+	q.drain()
+	select {
+	case err := <-outcome:
+		if err == nil {
+			t.Fatalf("expected the sender told the message failed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("retry never released")
+	}
+	if got := testutil.ToFloat64(metricWriteDeadLetters) - dead; got != 1 {
+		t.Fatalf("expected 1 dead letter, got %v", got)
+	}
+}
+
+func TestWriteQueueFeedStopReleasesSender(t *testing.T) {
+	drainTaskQueue(t)
+	dir := t.TempDir()
+	q, err := NewWriteQueue(WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for len(asyncTaskQueue) < cap(asyncTaskQueue) {
+		asyncTaskQueue <- asyncTask{}
+	}
+	outcome := make(chan error, 1)
+	task := asyncTask{taskType: taskSaveMessage, channelID: 1, userID: "alice", payload: []byte("hi"), done: func(_ Message, err error) { outcome <- err }}
+	if err := q.Enqueue(context.Background(), task); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	q.Start()
+	// The feeder is stuck behind the full queue when it is stopped.
+	time.Sleep(20 * time.Millisecond)
+	q.drain()
+	_ = q.Close()
+	select {
+	case err := <-outcome:
+		if !errors.Is(err, errWriteQueueClosed) {
+			t.Fatalf("expected the sender told the queue closed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sender never released")
+	}
+
+	// The message itself is still spooled for the next start.
+	drainTaskQueue(t)
+	q, err = NewWriteQueue(WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer q.Close()
+	q.Start()
+	if got := nextTask(t); string(got.payload) != "hi" {
+		t.Fatalf("expected the message replayed, got %+v", got)
+	}
+}
+
+type flakySaveStore struct {
+	*memStore
+	mu    sync.Mutex
+	fails int
+}
+
+func (s *flakySaveStore) SaveChannelMessages(ctx context.Context, batch []PendingMessage) ([]Message, []error) {
+	s.mu.Lock()
+	fail := s.fails > 0
+	s.fails--
+	s.mu.Unlock()
+	if fail {
+		errs := make([]error, len(batch))
+		for i := range errs {
+			errs[i] = errors.New("connection reset")
+		}
+		return make([]Message, len(batch)), errs
+	}
+	return s.memStore.SaveChannelMessages(ctx, batch)
+}
+
+func TestWriteQueueRetriesInMemory(t *testing.T) {
+	drainTaskQueue(t)
+	q, err := NewWriteQueue(WriteQueueConfig{MaxAttempts: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	store := &flakySaveStore{memStore: newMemStore(), fails: 1}
+	_ = store.EnsureUser(context.Background(), "alice")
+	channel, _ := store.CreateChannel(context.Background(), "general", "alice")
+	ctx, cancel := context.WithCancel(context.Background())
+	workersDone := StartWorkerPool(ctx, store, q, 1, BatchConfig{Size: 1})
+	defer func() {
+		cancel()
+		<-workersDone
+	}()
+
+	saved := make(chan Message, 1)
+	task := asyncTask{taskType: taskSaveMessage, channelID: channel.ID, userID: "alice", payload: []byte("hi"), done: func(msg Message, err error) {
+		if err != nil {
+			t.Errorf("expected the retry to succeed, got %v", err)
+		}
+		saved <- msg
+	}}
+	if err := q.Enqueue(context.Background(), task); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	select {
+	case msg := <-saved:
+		if msg.ID == 0 {
+			t.Fatalf("expected the saved message, got %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("message never saved")
+	}
+}
+
+func TestWriteQueueTrimsSegmentsAndCapsSize(t *testing.T) {
+	drainTaskQueue(t)
+	dir := t.TempDir()
+	q, err := NewWriteQueue(WriteQueueConfig{Dir: dir, SegmentBytes: 256, MaxBytes: 4096})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer q.Close()
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "alice")
+	channel, _ := store.CreateChannel(context.Background(), "general", "alice")
+	ctx, cancel := context.WithCancel(context.Background())
+	workersDone := StartWorkerPool(ctx, store, q, 2, BatchConfig{Size: 4, MaxWait: time.Millisecond})
+	q.Start()
+	defer func() {
+		cancel()
+		<-workersDone
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		task := asyncTask{taskType: taskSaveMessage, channelID: channel.ID, userID: "alice", payload: []byte("hello"), done: func(Message, error) { wg.Done() }}
+		if err := q.Enqueue(context.Background(), task); err != nil {
+			t.Fatalf("enqueue %d: %v", i, err)
+		}
+	}
+	wg.Wait()
+	// The next enqueue's done marks land after the last one; let them sync.
+	time.Sleep(50 * time.Millisecond)
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if len(segments) > 2 {
+		t.Fatalf("expected saved segments deleted, %d left", len(segments))
+	}
+
+	big := asyncTask{taskType: taskSaveMessage, channelID: channel.ID, userID: "alice", payload: make([]byte, 8192)}
+	if err := q.Enqueue(context.Background(), big); !errors.Is(err, errTaskQueueFull) {
+		t.Fatalf("expected the spool cap to reject, got %v", err)
+	}
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+// wsEnvelope is the frame format of multiplexed sockets (/ws?mode=multiplex),
+// in both directions. Clients send subscribe, unsubscribe, send and ping;
+// the server answers with subscribed, unsubscribed, ack or nack, pong and
+// error, and delivers traffic as message frames tagged with their channel or
+// subject. ID is chosen by the client and echoed on the reply to that
+// command; sends must carry one.
+type wsEnvelope struct {
+	Type        string `json:"type"`
+	ID          string `json:"id,omitempty"`
+	ChannelID   int64  `json:"channel_id,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	Payload     string `json:"payload,omitempty"`
+	MessageID   int64  `json:"message_id,omitempty"`
+	ResumeAfter int64  `json:"resume_after,omitempty"`
+	Replayed    bool   `json:"replayed,omitempty"`
+	Count       int    `json:"count,omitempty"`
+	UserID      string `json:"user_id,omitempty"`
+	ExpiresIn   int64  `json:"expires_in_ms,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Code        string `json:"code,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Details     any    `json:"details,omitempty"`
+	CreatedAt   string `json:"created_at,omitempty"`
+	RetryAfter  int64  `json:"retry_after_ms,omitempty"`
+	Token       string `json:"token,omitempty"`
+	Status      string `json:"status,omitempty"`
+
+	// sender is the user behind a live frame published without an id; it
+	// lets resume match the frame against replayed rows. Never sent.
+	sender string
+}
+
+const defaultMaxSubscriptions = 100
+
+// muxSubscription is one subject on a session. While replaying, live frames
+// are held in pending so they are delivered after the replayed history.
+type muxSubscription struct {
+	channelID int64
+	sub       Subscription
+	// events carries the channel's typing signals.
+	events    Subscription
+	replaying bool
+	pending   []wsEnvelope
+	overflow  bool
+}
+
+// muxSession is one multiplexed socket. The read loop owns subscription
+// changes; the writer goroutine owns the connection's writes.
+type muxSession struct {
+	ctx      context.Context
+	nc       NatsClient
+	store    Store
+	presence Presence
+	options  routerOptions
+	userID   string
+	codec    envelopeCodec
+	maxSubs  int
+	replay   int
+
+	// in receives NATS traffic for every subscription; queue carries every
+	// frame for the writer, replies and deliveries alike.
+	in      chan *nats.Msg
+	queue   *sendQueue
+	userSub Subscription
+	// overflow closes the socket when the disconnect policy trips.
+	overflow func()
+	// limit rate-limits sends; flooded closes the socket once it has used
+	// up its warnings.
+	limit   *sendGuard
+	flooded func()
+	// watch enforces token expiry; reauth commands refresh it.
+	watch *tokenWatch
+	// beat keeps the user's presence in subscribed channels alive.
+	beat *presenceBeat
+	// connID identifies the socket in the connection registry.
+	connID string
+
+	// deliverMu orders live deliveries against the end of a replay.
+	deliverMu sync.Mutex
+
+	mu      sync.Mutex
+	subs    map[string]*muxSubscription
+	members map[int64]bool
+}
+
+func (s *muxSession) subscribed(subject string) (*muxSubscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[subject]
+	return sub, ok
+}
+
+// subjects lists the session's subscriptions for the connection registry.
+func (s *muxSession) subjects() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.subs))
+	for subject := range s.subs {
+		out = append(out, subject)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// channelIDs lists the session's channel subscriptions for presence.
+func (s *muxSession) channelIDs() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []int64
+	for _, m := range s.subs {
+		if m.channelID != 0 {
+			out = append(out, m.channelID)
+		}
+	}
+	return out
+}
+
+// reply queues a frame that must not be dropped, such as a command reply.
+func (s *muxSession) reply(env wsEnvelope) {
+	_ = s.queue.put(s.ctx, s.codec.encode(env))
+}
+
+// deliver queues live traffic under the send queue's overflow policy.
+func (s *muxSession) deliver(env wsEnvelope) {
+	if !s.queue.offer(s.codec.encode(env)) && s.overflow != nil {
+		s.overflow()
+	}
+}
+
+func (s *muxSession) fail(id, code, message string) {
+	s.reply(wsEnvelope{Type: "error", ID: id, Code: code, Message: message})
+}
+
+// refuse answers a command that cannot be carried out: sends get a nack,
+// other commands an error.
+func (s *muxSession) refuse(cmd wsEnvelope, code, message string) {
+	if cmd.Type == "send" {
+		s.reply(nackFrame(cmd.ID, cmd.ChannelID, code, message, nil))
+		return
+	}
+	s.fail(cmd.ID, code, message)
+}
+
+// target resolves a command's channel_id or subject. Channel targets require
+// membership, which is checked once per channel and then cached.
+func (s *muxSession) target(cmd wsEnvelope) (string, int64, bool) {
+	if cmd.ChannelID != 0 {
+		if cmd.ChannelID < 0 {
+			s.refuse(cmd, "invalid_channel", "invalid channel id")
+			return "", 0, false
+		}
+		s.mu.Lock()
+		member, known := s.members[cmd.ChannelID]
+		s.mu.Unlock()
+		if !known {
+			if s.store == nil || s.userID == "" {
+				s.refuse(cmd, "unavailable", "store not configured")
+				return "", 0, false
+			}
+			ok, err := s.store.IsMember(s.ctx, cmd.ChannelID, s.userID)
+			if err != nil {
+				log.Printf("ws membership check failed: %v", err)
+				s.refuse(cmd, "unavailable", "membership check failed")
+				return "", 0, false
+			}
+			member = ok
+			s.mu.Lock()
+			s.members[cmd.ChannelID] = member
+			s.mu.Unlock()
+		}
+		if !member {
+			s.refuse(cmd, "forbidden", "not a member of this channel")
+			return "", 0, false
+		}
+		return channelSubject(cmd.ChannelID), cmd.ChannelID, true
+	}
+	if cmd.Subject == "" || !subjectRe.MatchString(cmd.Subject) || isReservedSubject(cmd.Subject) {
+		s.refuse(cmd, "invalid_subject", "invalid subject")
+		return "", 0, false
+	}
+	// Channel traffic must go through channel_id so membership applies.
+	if channelFromSubject(cmd.Subject) != 0 {
+		s.refuse(cmd, "invalid_subject", "use channel_id for channel subjects")
+		return "", 0, false
+	}
+	return cmd.Subject, 0, true
+}
+
+func (s *muxSession) subscribe(cmd wsEnvelope) {
+	subject, channelID, ok := s.target(cmd)
+	if !ok {
+		return
+	}
+	if _, exists := s.subscribed(subject); exists {
+		s.reply(wsEnvelope{Type: "subscribed", ID: cmd.ID, ChannelID: channelID, Subject: subject})
+		return
+	}
+	s.mu.Lock()
+	full := len(s.subs) >= s.maxSubs
+	s.mu.Unlock()
+	if full {
+		s.fail(cmd.ID, "too_many_subscriptions", "subscription limit reached")
+		return
+	}
+	// Register before subscribing so anything published while the replay
+	// query runs lands in the pending buffer rather than slipping ahead.
+	m := &muxSubscription{channelID: channelID, replaying: channelID != 0 && cmd.ResumeAfter > 0}
+	s.mu.Lock()
+	s.subs[subject] = m
+	s.mu.Unlock()
+	sub, err := s.nc.ChanSubscribe(subject, s.in)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.subs, subject)
+		s.mu.Unlock()
+		s.fail(cmd.ID, "subscribe_failed", "subscribe failed")
+		return
+	}
+	var events Subscription
+	if channelID != 0 {
+		if events, err = s.nc.ChanSubscribe(channelEventsSubject(channelID), s.in); err != nil {
+			log.Printf("events subscribe failed: %v", err)
+		}
+	}
+	s.mu.Lock()
+	m.sub, m.events = sub, events
+	s.mu.Unlock()
+	if s.presence != nil && channelID != 0 {
+		if err := s.presence.Incr(s.ctx, presenceKey(channelID)); err != nil {
+			log.Printf("presence incr failed: %v", err)
+		}
+	}
+	if channelID != 0 {
+		s.beat.touch()
+	}
+	s.reply(wsEnvelope{Type: "subscribed", ID: cmd.ID, ChannelID: channelID, Subject: subject})
+	if m.replaying {
+		s.resume(m, cmd.ResumeAfter)
+	}
+}
+
+func (s *muxSession) unsubscribe(cmd wsEnvelope) {
+	subject := cmd.Subject
+	if cmd.ChannelID != 0 {
+		subject = channelSubject(cmd.ChannelID)
+	}
+	s.mu.Lock()
+	current, ok := s.subs[subject]
+	delete(s.subs, subject)
+	s.mu.Unlock()
+	if ok {
+		s.release(current)
+	}
+	s.reply(wsEnvelope{Type: "unsubscribed", ID: cmd.ID, ChannelID: cmd.ChannelID, Subject: subject})
+}
+
+func (s *muxSession) release(m *muxSubscription) {
+	if m.sub != nil {
+		_ = m.sub.Unsubscribe()
+	}
+	if m.events != nil {
+		_ = m.events.Unsubscribe()
+	}
+	if m.channelID != 0 && s.userID != "" {
+		s.options.typing.Stop(m.channelID, s.userID, s.connID, "disconnected")
+	}
+	if m.channelID != 0 {
+		s.beat.leave(m.channelID)
+	}
+	if s.presence != nil && m.channelID != 0 {
+		if err := s.presence.Decr(context.Background(), presenceKey(m.channelID)); err != nil {
+			log.Printf("presence decr failed: %v", err)
+		}
+	}
+}
+
+// send publishes a payload and answers with an ack once it is accepted, or
+// a nack saying why it was not.
+func (s *muxSession) send(cmd wsEnvelope) {
+	if cmd.ID == "" {
+		s.refuse(cmd, nackMissingID, "sends need an id to be acknowledged")
+		return
+	}
+	if cmd.Payload == "" {
+		s.refuse(cmd, "empty_payload", "empty payload")
+		return
+	}
+	subject, channelID, ok := s.target(cmd)
+	if !ok {
+		return
+	}
+	if refused, out := s.limit.check(s.ctx, channelID); refused != nil {
+		if out && s.flooded != nil {
+			s.flooded()
+			return
+		}
+		s.reply(rateLimitedFrame(cmd.ID, channelID, refused))
+		return
+	}
+	payload, rejection := wsCheck(s.ctx, s.options, subject, channelID, s.userID, []byte(cmd.Payload))
+	if rejection != nil {
+		s.reply(rejectionNack(cmd.ID, channelID, rejection))
+		return
+	}
+	if channelID == 0 {
+		if err := s.nc.Publish(subject, payload); err != nil {
+			log.Printf("ws publish failed: %v", err)
+			s.reply(sendResult(cmd.ID, 0, Message{}, errPublishFailed))
+			return
+		}
+		s.reply(ackFrame(cmd.ID, Message{CreatedAt: time.Now()}))
+		return
+	}
+	// Channel messages are saved before they are published so every live
+	// frame carries the id a reconnecting client resumes from. Saves finish
+	// on the worker pool, which must not wait on this socket, so the answer
+	// is pushed past the queue limit; it goes out before the publish, so the
+	// sender sees it before its own echo.
+	id := cmd.ID
+	done := func(msg Message, err error) {
+		s.queue.push(s.codec.encode(sendResult(id, channelID, msg, err)))
+		if err != nil {
+			return
+		}
+		if err := publishChannelMessage(s.nc, msg, payload); err != nil {
+			log.Printf("ws publish failed: %v", err)
+		}
+	}
+	task := asyncTask{taskType: taskSaveMessage, channelID: channelID, userID: s.userID, payload: payload, done: done}
+	if err := s.options.writes.Enqueue(s.ctx, task); err != nil {
+		s.reply(sendResult(cmd.ID, channelID, Message{}, err))
+	}
+}
+
+func (s *muxSession) handle(raw []byte) {
+	cmd, err := s.codec.decode(raw)
+	if err != nil {
+		s.fail("", "invalid_frame", "frames must be "+s.codec.label()+" commands")
+		return
+	}
+	switch cmd.Type {
+	case "subscribe":
+		s.subscribe(cmd)
+	case "unsubscribe":
+		s.unsubscribe(cmd)
+	case "send":
+		s.send(cmd)
+	case typingStarted, typingStopped:
+		s.typing(cmd)
+	case typeReauth:
+		s.reply(s.watch.reauth(s.ctx, cmd))
+	case "ping":
+		s.reply(wsEnvelope{Type: "pong", ID: cmd.ID})
+	default:
+		s.fail(cmd.ID, "unknown_command", "unknown command "+cmd.Type)
+	}
+}
+
+// delivery turns a NATS message into a client frame. Messages for subjects
+// unsubscribed since they were queued are dropped.
+func (s *muxSession) delivery(msg *nats.Msg) (wsEnvelope, bool) {
+	if msg.Subject == userSubject(s.userID) {
+		return wsEnvelope{Type: "message", Subject: msg.Subject, Payload: string(msg.Data)}, true
+	}
+	if raw, ok := strings.CutPrefix(msg.Subject, ephemeralSubjectPrefix); ok {
+		return s.event(channelFromSubject(raw), msg)
+	}
+	sub, ok := s.subscribed(msg.Subject)
+	if !ok {
+		return wsEnvelope{}, false
+	}
+	return wsEnvelope{Type: "message", ChannelID: sub.channelID, Subject: msg.Subject, Payload: string(msg.Data), MessageID: messageIDFromHeader(msg), sender: senderFromHeader(msg)}, true
+}
+
+// event turns a channel's typing signal or presence transition into a
+// frame, skipping the session's own user and channels it has since left.
+func (s *muxSession) event(channelID int64, msg *nats.Msg) (wsEnvelope, bool) {
+	if _, ok := s.subscribed(channelSubject(channelID)); !ok || channelID == 0 {
+		return wsEnvelope{}, false
+	}
+	if ev, ok := parsePresenceEvent(msg.Data); ok {
+		if ev.UserID == s.userID {
+			return wsEnvelope{}, false
+		}
+		return wsEnvelope{Type: ev.Type, ChannelID: channelID, UserID: ev.UserID, Status: ev.Status}, true
+	}
+	ev, ok := parseTypingEvent(msg.Data)
+	if !ok || ev.UserID == s.userID {
+		return wsEnvelope{}, false
+	}
+	return wsEnvelope{Type: ev.Type, ChannelID: channelID, UserID: ev.UserID, ExpiresIn: ev.ExpiresIn, Reason: ev.Reason}, true
+}
+
+// typing relays a typing or stopped_typing signal for a channel. Signals are
+// ephemeral and get no reply on success.
+func (s *muxSession) typing(cmd wsEnvelope) {
+	if cmd.ChannelID == 0 {
+		s.fail(cmd.ID, "invalid_channel", "typing signals need a channel_id")
+		return
+	}
+	if _, channelID, ok := s.target(cmd); ok {
+		s.options.typing.Signal(channelID, s.userID, s.connID, cmd.Type)
+	}
+}
+
+// pump moves NATS traffic to the writer, diverting frames for subscriptions
+// that are still replaying into their pending buffer.
+func (s *muxSession) pump() {
+	for msg := range s.in {
+		env, deliver := s.delivery(msg)
+		if !deliver {
+			continue
+		}
+		s.deliverMu.Lock()
+		if s.hold(msg.Subject, env) {
+			s.deliverMu.Unlock()
+			continue
+		}
+		s.deliver(env)
+		s.deliverMu.Unlock()
+	}
+}
+
+// newMuxSession builds a session for req's user. Callers set its hooks
+// (overflow, limit, flooded, watch), then call start, and must call close.
+func newMuxSession(ctx context.Context, req *http.Request, nc NatsClient, store Store, presence Presence, options routerOptions, codec envelopeCodec) *muxSession {
+	s := &muxSession{
+		ctx:      ctx,
+		nc:       nc,
+		store:    store,
+		presence: presence,
+		options:  options,
+		userID:   userFromContext(req.Context()),
+		codec:    codec,
+		maxSubs:  envInt("WS_MAX_SUBSCRIPTIONS", defaultMaxSubscriptions),
+		replay:   envInt("WS_REPLAY_LIMIT", defaultReplayLimit),
+		in:       make(chan *nats.Msg, 256),
+		queue:    newSendQueue(options.sendQueue),
+		subs:     make(map[string]*muxSubscription),
+		members:  make(map[int64]bool),
+	}
+	s.queue.notice = func(count int) []byte {
+		return codec.encode(wsEnvelope{Type: "missed", Count: count})
+	}
+	if store != nil && s.userID != "" {
+		if err := store.EnsureUser(ctx, s.userID); err != nil {
+			log.Printf("ensure user failed: %v", err)
+		}
+	}
+	return s
+}
+
+// start subscribes the session to its user subject and starts its pump.
+// The pump reads the hooks, so they must be set before.
+func (s *muxSession) start() {
+	if s.userID != "" {
+		var err error
+		if s.userSub, err = s.nc.ChanSubscribe(userSubject(s.userID), s.in); err != nil {
+			log.Printf("user subscribe failed: %v", err)
+		}
+	}
+	go s.pump()
+}
+
+// close releases every subscription. No command may run after it.
+func (s *muxSession) close() {
+	if s.userSub != nil {
+		_ = s.userSub.Unsubscribe()
+	}
+	s.mu.Lock()
+	subs := s.subs
+	s.subs = nil
+	s.mu.Unlock()
+	for _, m := range subs {
+		s.release(m)
+	}
+	close(s.in)
+}
+
+// serveMultiplexed runs a multiplexed session on an upgraded connection.
+func serveMultiplexed(conn *websocket.Conn, req *http.Request, nc NatsClient, store Store, presence Presence, options routerOptions, codec envelopeCodec) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	s := newMuxSession(ctx, req, nc, store, presence, options, codec)
+	defer s.close()
+	var overflowOnce sync.Once
+	s.overflow = func() {
+		overflowOnce.Do(func() {
+			disconnectSlowConsumer(conn)
+			cancel()
+		})
+	}
+
+	s.limit = options.limits.guard(req)
+	s.flooded = func() {
+		disconnectFlooder(conn)
+		cancel()
+	}
+	s.watch = watchToken(req, options, store, s.reply, func() {
+		closeExpired(conn)
+		cancel()
+	})
+	defer s.watch.stop()
+	s.start()
+
+	conn.SetReadLimit(maxBodyBytes)
+	if err := conn.SetReadDeadline(time.Now().Add(90 * time.Second)); err != nil {
+		log.Printf("ws read deadline failed: %v", err)
+		return
+	}
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+	})
+
+	live, unregister := options.connections.Register(
+		ConnectionInfo{UserID: s.userID, Transport: "ws", RemoteAddr: req.RemoteAddr},
+		s.subjects, func() { disconnectByAdmin(conn) })
+	defer unregister()
+	s.connID = live.id()
+	s.beat = startPresence(nc, presence, options.presenceCfg, s.userID, live.id(), s.channelIDs)
+	defer s.beat.stop()
+
+	writer := newFrameWriter(conn, options.compression, codec.label(), live)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pingTicker := time.NewTicker(30 * time.Second)
+		defer pingTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-pingTicker.C:
+				_ = conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(5*time.Second))
+			case <-s.queue.ready:
+				for {
+					data, ok := s.queue.next()
+					if !ok {
+						break
+					}
+					if err := conn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
+						cancel()
+						return
+					}
+					if err := writer.write(codec.messageType(), data); err != nil {
+						cancel()
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			cancel()
+			break
+		}
+		if len(message) == 0 {
+			continue
+		}
+		countInbound(codec.label(), message)
+		live.received(len(message))
+		s.beat.active()
+		s.handle(message)
+	}
+	<-done
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialMultiplexed(t *testing.T, handler http.Handler) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	header := http.Header{}
+	header.Set("Cookie", "access_token="+testToken(t, "test"))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?mode=multiplex", header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func roundTrip(t *testing.T, conn *websocket.Conn, cmd wsEnvelope) wsEnvelope {
+	t.Helper()
+	if err := conn.WriteJSON(cmd); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	return readEnvelope(t, conn)
+}
+
+func readEnvelope(t *testing.T, conn *websocket.Conn) wsEnvelope {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var env wsEnvelope
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatalf("ws read: %v", err)
+	}
+	return env
+}
+
+func TestMultiplexedSubscribeSendUnsubscribe(t *testing.T) {
+	store := newMemStore()
+	runWorkers(t, store)
+	_ = store.EnsureUser(context.Background(), "user-1")
+	_ = store.EnsureUser(context.Background(), "bob")
+	mine, _ := store.CreateChannel(context.Background(), "mine", "user-1")
+	_ = store.EnsureMember(context.Background(), mine.ID, "user-1")
+	theirs, _ := store.CreateChannel(context.Background(), "theirs", "bob")
+	_ = store.EnsureMember(context.Background(), theirs.ID, "bob")
+
+	nc := newFakeNats()
+	conn := dialMultiplexed(t, NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+
+	if env := roundTrip(t, conn, wsEnvelope{Type: "subscribe", ID: "1", ChannelID: mine.ID}); env.Type != "subscribed" || env.ID != "1" || env.Subject != channelSubject(mine.ID) {
+		t.Fatalf("unexpected subscribe reply %+v", env)
+	}
+	if env := roundTrip(t, conn, wsEnvelope{Type: "subscribe", ID: "2", ChannelID: theirs.ID}); env.Type != "error" || env.Code != "forbidden" {
+		t.Fatalf("expected forbidden, got %+v", env)
+	}
+	if env := roundTrip(t, conn, wsEnvelope{Type: "subscribe", ID: "3", Subject: "storm.events"}); env.Type != "subscribed" {
+		t.Fatalf("unexpected subject subscribe reply %+v", env)
+	}
+
+	ack := roundTrip(t, conn, wsEnvelope{Type: "send", ID: "4", ChannelID: mine.ID, Payload: "hello"})
+	if ack.Type != "ack" || ack.ID != "4" || ack.MessageID == 0 || ack.CreatedAt == "" {
+		t.Fatalf("expected ack with message id, got %+v", ack)
+	}
+	if env := readEnvelope(t, conn); env.Type != "message" || env.ChannelID != mine.ID || env.Payload != "hello" || env.MessageID != ack.MessageID {
+		t.Fatalf("expected tagged channel message, got %+v", env)
+	}
+	_ = nc.Publish("storm.events", []byte("broadcast"))
+	if env := readEnvelope(t, conn); env.Type != "message" || env.ChannelID != 0 || env.Subject != "storm.events" {
+		t.Fatalf("expected subject message, got %+v", env)
+	}
+	if env := roundTrip(t, conn, wsEnvelope{Type: "send", ID: "5", ChannelID: theirs.ID, Payload: "x"}); env.Type != "nack" || env.ID != "5" || env.Code != "forbidden" {
+		t.Fatalf("expected forbidden send, got %+v", env)
+	}
+
+	if env := roundTrip(t, conn, wsEnvelope{Type: "unsubscribe", ID: "6", ChannelID: mine.ID}); env.Type != "unsubscribed" {
+		t.Fatalf("unexpected unsubscribe reply %+v", env)
+	}
+	_ = nc.Publish(channelSubject(mine.ID), []byte("after unsubscribe"))
+	if env := roundTrip(t, conn, wsEnvelope{Type: "ping", ID: "7"}); env.Type != "pong" || env.ID != "7" {
+		t.Fatalf("expected only pong after unsubscribe, got %+v", env)
+	}
+}
+
+func TestMultiplexedInvalidCommands(t *testing.T) {
+	conn := dialMultiplexed(t, NewRouter(newFakeNats(), newMemStore(), nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+
+	cases := []struct {
+		cmd  wsEnvelope
+		code string
+	}{
+		{wsEnvelope{Type: "subscribe", Subject: "channels.5"}, "invalid_subject"},
+		{wsEnvelope{Type: "subscribe", Subject: userSubject("bob")}, "invalid_subject"},
+		{wsEnvelope{Type: "subscribe", Subject: "bad subject"}, "invalid_subject"},
+		{wsEnvelope{Type: "dance"}, "unknown_command"},
+	}
+	for _, tc := range cases {
+		if env := roundTrip(t, conn, tc.cmd); env.Type != "error" || env.Code != tc.code {
+			t.Fatalf("%+v: expected %s, got %+v", tc.cmd, tc.code, env)
+		}
+	}
+	sends := []struct {
+		cmd  wsEnvelope
+		code string
+	}{
+		{wsEnvelope{Type: "send", Subject: "storm.events", Payload: "x"}, "missing_id"},
+		{wsEnvelope{Type: "send", ID: "1", Subject: "storm.events"}, "empty_payload"},
+		{wsEnvelope{Type: "send", ID: "2", Subject: "channels.5", Payload: "x"}, "invalid_subject"},
+	}
+	for _, tc := range sends {
+		if env := roundTrip(t, conn, tc.cmd); env.Type != "nack" || env.ID != tc.cmd.ID || env.Code != tc.code {
+			t.Fatalf("%+v: expected nack %s, got %+v", tc.cmd, tc.code, env)
+		}
+	}
+	if env := roundTrip(t, conn, wsEnvelope{Type: "send", ID: "3", Subject: "storm.events", Payload: "x"}); env.Type != "ack" || env.ID != "3" || env.MessageID != 0 || env.CreatedAt == "" {
+		t.Fatalf("expected subject ack, got %+v", env)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	if env := readEnvelope(t, conn); env.Code != "invalid_frame" {
+		t.Fatalf("expected invalid_frame, got %+v", env)
+	}
+}
+
+func TestMultiplexedSendRejection(t *testing.T) {
+	store := newMemStore()
+	_ = store.EnsureUser(context.Background(), "user-1")
+	channel, _ := store.CreateChannel(context.Background(), "general", "user-1")
+	_ = store.EnsureMember(context.Background(), channel.ID, "user-1")
+	_ = store.SetModerationConfig(context.Background(), channel.ID, []byte(`{"filters":[{"type":"links"}]}`))
+
+	nc := newFakeNats()
+	conn := dialMultiplexed(t, NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+	env := roundTrip(t, conn, wsEnvelope{Type: "send", ID: "9", ChannelID: channel.ID, Payload: "https://spam.test"})
+	if env.Type != "nack" || env.ID != "9" || env.Code != "moderation_rejected" || env.Details == nil {
+		t.Fatalf("expected moderation rejection, got %+v", env)
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if len(nc.published) != 0 {
+		t.Fatalf("rejected send must not be published")
+	}
+}
+
+func TestMultiplexedReceivesUserEvents(t *testing.T) {
+	nc := newFakeNats()
+	conn := dialMultiplexed(t, NewRouter(nc, nil, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+	// The user subject is subscribed before the first command is processed.
+	if env := roundTrip(t, conn, wsEnvelope{Type: "ping"}); env.Type != "pong" {
+		t.Fatalf("expected pong, got %+v", env)
+	}
+	_ = nc.Publish(userSubject("user-1"), []byte(`{"type":"reminder"}`))
+	if env := readEnvelope(t, conn); env.Type != "message" || env.Subject != userSubject("user-1") || env.Payload != `{"type":"reminder"}` {
+		t.Fatalf("unexpected user event %+v", env)
+	}
+}
+
+func TestMultiplexedResumeReplaysGap(t *testing.T) {
+	store := newMemStore()
+	runWorkers(t, store)
+	ctx := context.Background()
+	_ = store.EnsureUser(ctx, "user-1")
+	channel, _ := store.CreateChannel(ctx, "general", "user-1")
+	_ = store.EnsureMember(ctx, channel.ID, "user-1")
+	seen, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("seen"))
+	missed, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("missed"))
+
+	nc := newFakeNats()
+	conn := dialMultiplexed(t, NewRouter(nc, store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+	if env := roundTrip(t, conn, wsEnvelope{Type: "subscribe", ID: "1", ChannelID: channel.ID, ResumeAfter: seen.ID}); env.Type != "subscribed" {
+		t.Fatalf("unexpected subscribe reply %+v", env)
+	}
+	if env := readEnvelope(t, conn); env.Type != "message" || !env.Replayed || env.MessageID != missed.ID || env.Payload != "missed" {
+		t.Fatalf("expected replayed message, got %+v", env)
+	}
+	if env := readEnvelope(t, conn); env.Type != "resumed" || env.MessageID != missed.ID {
+		t.Fatalf("expected resumed marker, got %+v", env)
+	}
+
+	if ack := roundTrip(t, conn, wsEnvelope{Type: "send", ID: "2", ChannelID: channel.ID, Payload: "live"}); ack.Type != "ack" {
+		t.Fatalf("expected ack, got %+v", ack)
+	}
+	env := readEnvelope(t, conn)
+	if env.Type != "message" || env.Replayed || env.Payload != "live" || env.MessageID <= missed.ID {
+		t.Fatalf("expected live message with id, got %+v", env)
+	}
+	if msgs, _ := store.ListMessages(ctx, channel.ID, 10); len(msgs) != 3 || msgs[0].ID != env.MessageID {
+		t.Fatalf("socket send should persist before publishing, got %+v", msgs)
+	}
+}
+
+func TestMultiplexedResumeGapTooLarge(t *testing.T) {
+	t.Setenv("WS_REPLAY_LIMIT", "2")
+	store := newMemStore()
+	ctx := context.Background()
+	_ = store.EnsureUser(ctx, "user-1")
+	channel, _ := store.CreateChannel(ctx, "general", "user-1")
+	_ = store.EnsureMember(ctx, channel.ID, "user-1")
+	first, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("a"))
+	for _, p := range []string{"b", "c", "d"} {
+		_, _ = store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte(p))
+	}
+
+	conn := dialMultiplexed(t, NewRouter(newFakeNats(), store, nil, AuthConfig{Secret: []byte("test"), Enabled: true}))
+	_ = roundTrip(t, conn, wsEnvelope{Type: "subscribe", ChannelID: channel.ID, ResumeAfter: first.ID})
+	if env := readEnvelope(t, conn); env.Type != "gap" || env.Code != "gap_too_large" {
+		t.Fatalf("expected gap frame, got %+v", env)
+	}
+	if env := readEnvelope(t, conn); env.Type != "resumed" || env.MessageID != first.ID {
+		t.Fatalf("expected resumed marker at the client's position, got %+v", env)
+	}
+}
+
+func TestMuxResumeDeduplicatesHeldFrames(t *testing.T) {
+	store := newMemStore()
+	ctx := context.Background()
+	_ = store.EnsureUser(ctx, "user-1")
+	channel, _ := store.CreateChannel(ctx, "general", "user-1")
+	a, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("a"))
+	b, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("b"))
+
+	subject := channelSubject(channel.ID)
+	m := &muxSubscription{channelID: channel.ID, replaying: true}
+	s := &muxSession{ctx: ctx, store: store, codec: jsonCodec{}, replay: 10, queue: newSendQueue(SendQueueConfig{}), subs: map[string]*muxSubscription{subject: m}}
+	// b was published while the replay query ran; c arrived after it.
+	s.hold(subject, wsEnvelope{Type: "message", Subject: subject, Payload: "b", MessageID: b.ID})
+	s.hold(subject, wsEnvelope{Type: "message", Subject: subject, Payload: "c", MessageID: b.ID + 1})
+	s.resume(m, a.ID)
+
+	var got []string
+	for data, ok := s.queue.next(); ok; data, ok = s.queue.next() {
+		var env wsEnvelope
+		_ = json.Unmarshal(data, &env)
+		got = append(got, env.Type+":"+env.Payload)
+	}
+	if strings.Join(got, ",") != "message:b,resumed:,message:c" {
+		t.Fatalf("unexpected frame order %v", got)
+	}
+	if s.hold(subject, wsEnvelope{}) {
+		t.Fatalf("frames must not be held once live")
+	}
+}
+
+func TestMuxResumeDeduplicatesUnsavedFrames(t *testing.T) {
+	store := newMemStore()
+	ctx := context.Background()
+	_ = store.EnsureUser(ctx, "user-1")
+	channel, _ := store.CreateChannel(ctx, "general", "user-1")
+	a, _ := store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("a"))
+	_, _ = store.SaveChannelMessage(ctx, channel.ID, "user-1", []byte("ok"))
+
+	subject := channelSubject(channel.ID)
+	m := &muxSubscription{channelID: channel.ID, replaying: true}
+	s := &muxSession{ctx: ctx, store: store, codec: jsonCodec{}, replay: 10, queue: newSendQueue(SendQueueConfig{}), subs: map[string]*muxSubscription{subject: m}}
+	// A legacy socket published "ok" before its save landed in the replay;
+	// its second "ok" and another user's were not saved yet.
+	s.hold(subject, wsEnvelope{Type: "message", Subject: subject, Payload: "ok", sender: "user-1"})
+	s.hold(subject, wsEnvelope{Type: "message", Subject: subject, Payload: "ok", sender: "user-2"})
+	s.hold(subject, wsEnvelope{Type: "message", Subject: subject, Payload: "ok", sender: "user-1"})
+	s.resume(m, a.ID)
+
+	var got []string
+	for data, ok := s.queue.next(); ok; data, ok = s.queue.next() {
+		var env wsEnvelope
+		_ = json.Unmarshal(data, &env)
+		got = append(got, env.Type+":"+env.Payload)
+	}
+	if strings.Join(got, ",") != "message:ok,resumed:,message:ok,message:ok" {
+		t.Fatalf("expected one held copy dropped, got %v", got)
+	}
+}
+
+func TestMuxSessionStartsAfterHooks(t *testing.T) {
+	nc := newFakeNats()
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ctxUserIDKey{}, "alice"))
+	s := newMuxSession(context.Background(), req, nc, nil, nil, routerOptions{sendQueue: SendQueueConfig{Size: 1, Policy: QueueDisconnect}}, jsonCodec{})
+	defer s.close()
+	nc.mu.Lock()
+	_, early := nc.subjectCh[userSubject("alice")]
+	nc.mu.Unlock()
+	if early {
+		t.Fatalf("the user subject must not be live before start")
+	}
+
+	overflowed := make(chan struct{})
+	var once sync.Once
+	s.overflow = func() { once.Do(func() { close(overflowed) }) }
+	s.start()
+	for _, data := range []string{"one", "two"} {
+		if err := nc.Publish(userSubject("alice"), []byte(data)); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	select {
+	case <-overflowed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the overflow hook to fire")
+	}
+}
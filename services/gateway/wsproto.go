@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var metricWSBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "storm_ws_bytes_total",
+	Help: "WebSocket frame bytes before compression, by protocol (raw, json, proto) and direction (in, out)",
+}, []string{"protocol", "direction"})
+
+// Subprotocols offered on multiplexed sockets through Sec-WebSocket-Protocol.
+// Plain sockets carry raw payloads and do not negotiate.
+const (
+	protocolJSON  = "storm.json.v1"
+	protocolProto = "storm.proto.v1"
+)
+
+// envelopeCodec encodes wsEnvelope frames for one subprotocol.
+type envelopeCodec interface {
+	// label names the protocol in metrics.
+	label() string
+	messageType() int
+	encode(env wsEnvelope) []byte
+	decode(data []byte) (wsEnvelope, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) label() string    { return "json" }
+func (jsonCodec) messageType() int { return websocket.TextMessage }
+
+func (jsonCodec) encode(env wsEnvelope) []byte {
+	data, _ := json.Marshal(env)
+	return data
+}
+
+func (jsonCodec) decode(data []byte) (wsEnvelope, error) {
+	var env wsEnvelope
+	err := json.Unmarshal(data, &env)
+	return env, err
+}
+
+// protoCodec encodes wsEnvelope as the protobuf message in
+// docs/api/envelope.proto. Field numbers there must match these.
+type protoCodec struct{}
+
+const (
+	fieldType protowire.Number = iota + 1
+	fieldID
+	fieldChannelID
+	fieldSubject
+	fieldPayload
+	fieldMessageID
+	fieldResumeAfter
+	fieldReplayed
+	fieldCount
+	fieldUserID
+	fieldExpiresIn
+	fieldReason
+	fieldCode
+	fieldMessage
+	fieldDetails
+	fieldCreatedAt
+	fieldRetryAfter
+	fieldToken
+	fieldStatus
+)
+
+func (protoCodec) label() string    { return "proto" }
+func (protoCodec) messageType() int { return websocket.BinaryMessage }
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendBytes writes a proto bytes field, for data that need not be UTF-8.
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func (protoCodec) encode(env wsEnvelope) []byte {
+	var b []byte
+	b = appendString(b, fieldType, env.Type)
+	b = appendString(b, fieldID, env.ID)
+	b = appendVarint(b, fieldChannelID, uint64(env.ChannelID))
+	b = appendString(b, fieldSubject, env.Subject)
+	// Payloads are whatever was published, not necessarily UTF-8.
+	b = appendBytes(b, fieldPayload, []byte(env.Payload))
+	b = appendVarint(b, fieldMessageID, uint64(env.MessageID))
+	b = appendVarint(b, fieldResumeAfter, uint64(env.ResumeAfter))
+	b = appendVarint(b, fieldReplayed, protowire.EncodeBool(env.Replayed))
+	b = appendVarint(b, fieldCount, uint64(env.Count))
+	b = appendString(b, fieldUserID, env.UserID)
+	b = appendVarint(b, fieldExpiresIn, uint64(env.ExpiresIn))
+	b = appendString(b, fieldReason, env.Reason)
+	b = appendString(b, fieldCode, env.Code)
+	b = appendString(b, fieldMessage, env.Message)
+	b = appendString(b, fieldCreatedAt, env.CreatedAt)
+	b = appendVarint(b, fieldRetryAfter, uint64(env.RetryAfter))
+	b = appendString(b, fieldToken, env.Token)
+	b = appendString(b, fieldStatus, env.Status)
+	if env.Details != nil {
+		// Details vary by error code, so they travel as embedded JSON.
+		details, _ := json.Marshal(env.Details)
+		b = appendString(b, fieldDetails, string(details))
+	}
+	return b
+}
+
+var errInvalidFrame = errors.New("invalid frame")
+
+func (protoCodec) decode(data []byte) (wsEnvelope, error) {
+	var env wsEnvelope
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return wsEnvelope{}, errInvalidFrame
+		}
+		data = data[n:]
+		var (
+			s string
+			v uint64
+		)
+		switch typ {
+		case protowire.BytesType:
+			s, n = protowire.ConsumeString(data)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return wsEnvelope{}, errInvalidFrame
+		}
+		data = data[n:]
+		switch num {
+		case fieldType:
+			env.Type = s
+		case fieldID:
+			env.ID = s
+		case fieldChannelID:
+			env.ChannelID = int64(v)
+		case fieldSubject:
+			env.Subject = s
+		case fieldPayload:
+			env.Payload = s
+		case fieldMessageID:
+			env.MessageID = int64(v)
+		case fieldResumeAfter:
+			env.ResumeAfter = int64(v)
+		case fieldReplayed:
+			env.Replayed = protowire.DecodeBool(v)
+		case fieldCount:
+			env.Count = int(v)
+		case fieldUserID:
+			env.UserID = s
+		case fieldExpiresIn:
+			env.ExpiresIn = int64(v)
+		case fieldReason:
+			env.Reason = s
+		case fieldCode:
+			env.Code = s
+		case fieldMessage:
+			env.Message = s
+		case fieldDetails:
+			env.Details = json.RawMessage(s)
+		case fieldCreatedAt:
+			env.CreatedAt = s
+		case fieldRetryAfter:
+			env.RetryAfter = int64(v)
+		case fieldToken:
+			env.Token = s
+		case fieldStatus:
+			env.Status = s
+		}
+	}
+	return env, nil
+}
+
+// negotiateProtocol picks the first subprotocol the client offered that the
+// gateway speaks. Clients that offer none get JSON without a protocol header.
+func negotiateProtocol(req *http.Request) (string, envelopeCodec) {
+	for _, offered := range websocket.Subprotocols(req) {
+		switch strings.TrimSpace(offered) {
+		case protocolJSON:
+			return protocolJSON, jsonCodec{}
+		case protocolProto:
+			return protocolProto, protoCodec{}
+		}
+	}
+	return "", jsonCodec{}
+}
+
+// CompressionConfig tunes permessage-deflate. Frames shorter than MinBytes
+// are sent uncompressed, where deflate costs more than it saves.
+type CompressionConfig struct {
+	Enabled  bool
+	Level    int
+	MinBytes int
+}
+
+const (
+	defaultCompressionLevel    = 1
+	defaultCompressionMinBytes = 256
+)
+
+// WithCompression enables permessage-deflate on /ws.
+func WithCompression(cfg CompressionConfig) RouterOption {
+	return func(o *routerOptions) {
+		o.compression = cfg
+	}
+}
+
+// frameWriter writes one socket's frames, applying the compression threshold
+// and counting bytes under the socket's protocol label.
+type frameWriter struct {
+	conn        *websocket.Conn
+	compression CompressionConfig
+	protocol    string
+	live        *liveConn
+}
+
+func newFrameWriter(conn *websocket.Conn, cfg CompressionConfig, protocol string, live *liveConn) *frameWriter {
+	if cfg.Enabled {
+		if err := conn.SetCompressionLevel(cfg.Level); err != nil {
+			_ = conn.SetCompressionLevel(defaultCompressionLevel)
+		}
+	}
+	return &frameWriter{conn: conn, compression: cfg, protocol: protocol, live: live}
+}
+
+func (f *frameWriter) write(messageType int, data []byte) error {
+	if f.compression.Enabled {
+		f.conn.EnableWriteCompression(len(data) >= f.compression.MinBytes)
+	}
+	if err := f.conn.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	metricWSBytes.WithLabelValues(f.protocol, "out").Add(float64(len(data)))
+	f.live.sent(len(data))
+	return nil
+}
+
+func countInbound(protocol string, data []byte) {
+	metricWSBytes.WithLabelValues(protocol, "in").Add(float64(len(data)))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestProtoCodecRoundTrip(t *testing.T) {
+	codec := protoCodec{}
+	env := wsEnvelope{
+		Type: "message", ID: "7", ChannelID: 42, Subject: "channels.42", Payload: "héllo",
+		MessageID: 9, ResumeAfter: 3, Replayed: true, Count: 2, UserID: "alice",
+		ExpiresIn: 8000, Reason: "expired", Code: "c", Message: "m", CreatedAt: "2026-01-02T03:04:05Z",
+	}
+	got, err := codec.decode(codec.encode(env))
+	if err != nil || !reflect.DeepEqual(got, env) {
+		t.Fatalf("round trip mismatch: %+v (%v)", got, err)
+	}
+
+	withDetails, _ := codec.decode(codec.encode(wsEnvelope{Type: "error", Details: map[string]string{"filter": "links"}}))
+	if string(withDetails.Details.(json.RawMessage)) != `{"filter":"links"}` {
+		t.Fatalf("unexpected details %v", withDetails.Details)
+	}
+
+	// Fields from newer schema versions are skipped.
+	data := protowire.AppendTag(codec.encode(wsEnvelope{Type: "ping"}), 99, protowire.Fixed32Type)
+	data = protowire.AppendFixed32(data, 1)
+	if env, err := codec.decode(data); err != nil || env.Type != "ping" {
+		t.Fatalf("unknown field not skipped: %+v (%v)", env, err)
+	}
+	// Payloads are bytes on the wire and need not be valid UTF-8.
+	binary := string([]byte{0xff, 0x00, 0xfe})
+	if env, err := codec.decode(codec.encode(wsEnvelope{Type: "message", Payload: binary})); err != nil || env.Payload != binary {
+		t.Fatalf("binary payload mangled: %q (%v)", env.Payload, err)
+	}
+	if _, err := codec.decode([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Fatalf("expected truncated frame error")
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	if name, codec := negotiateProtocol(req); name != "" || codec.label() != "json" {
+		t.Fatalf("expected JSON default, got %q", name)
+	}
+	req.Header.Set("Sec-WebSocket-Protocol", "mqtt, storm.proto.v1, storm.json.v1")
+	if name, codec := negotiateProtocol(req); name != protocolProto || codec.label() != "proto" {
+		t.Fatalf("expected client's first supported choice, got %q", name)
+	}
+}
+
+func TestMultiplexedProtobufWithCompression(t *testing.T) {
+	router := NewRouter(newFakeNats(), nil, nil, AuthConfig{Secret: []byte("test"), Enabled: true},
+		WithCompression(CompressionConfig{Enabled: true, Level: 1, MinBytes: 0}))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{Subprotocols: []string{protocolProto}, EnableCompression: true}
+	header := http.Header{}
+	header.Set("Cookie", "access_token="+testToken(t, "test"))
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?mode=multiplex", header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != protocolProto {
+		t.Fatalf("expected %s, got %q", protocolProto, conn.Subprotocol())
+	}
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Fatalf("expected permessage-deflate, got %q", resp.Header.Get("Sec-WebSocket-Extensions"))
+	}
+
+	before := testutil.ToFloat64(metricWSBytes.WithLabelValues("proto", "out"))
+	if err := conn.WriteMessage(websocket.BinaryMessage, protoCodec{}.encode(wsEnvelope{Type: "ping", ID: "1"})); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	kind, data, err := conn.ReadMessage()
+	if err != nil || kind != websocket.BinaryMessage {
+		t.Fatalf("expected binary frame, got %d (%v)", kind, err)
+	}
+	if env, err := (protoCodec{}).decode(data); err != nil || env.Type != "pong" || env.ID != "1" {
+		t.Fatalf("unexpected reply %+v (%v)", env, err)
+	}
+	if after := testutil.ToFloat64(metricWSBytes.WithLabelValues("proto", "out")); after != before+float64(len(data)) {
+		t.Fatalf("expected %d proto bytes counted, got %v", len(data), after-before)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ping"}`)); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	_, data, _ = conn.ReadMessage()
+	if env, _ := (protoCodec{}).decode(data); env.Code != "invalid_frame" {
+		t.Fatalf("JSON on a proto socket should be rejected, got %+v", env)
+	}
+}